@@ -1,24 +1,53 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/alexedwards/scs/v2"
 	"github.com/ismail118/bookings-app/helpers"
 	"github.com/ismail118/bookings-app/internal/config"
 	"github.com/ismail118/bookings-app/internal/driver"
+	"github.com/ismail118/bookings-app/internal/feedsync"
 	"github.com/ismail118/bookings-app/internal/handlers"
+	"github.com/ismail118/bookings-app/internal/mailer"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"github.com/ismail118/bookings-app/internal/render"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/repository/dbrepo"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const portNumber = ":8080"
 
+// shutdownTimeout is how long in-flight requests get to finish after a stop signal
+const shutdownTimeout = 30 * time.Second
+
+// mailFlushTimeout is how long the mail workers get to finish the messages they are sending
+const mailFlushTimeout = 10 * time.Second
+
+// feedStopTimeout is how long a cancelled sync of external calendars gets to stop
+const feedStopTimeout = 5 * time.Second
+
+// exit codes reported to the process supervisor
+const (
+	exitOK            = 0
+	exitServerError   = 1
+	exitShutdownError = 2
+)
+
 var app config.AppConfig
 var session *scs.SessionManager
 var infoLog *log.Logger
@@ -30,12 +59,16 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.SQL.Close()
 
-	defer close(app.MailChan)
+	smtpMailer, err := mailer.NewSMTPMailer(app.SMTP)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	fmt.Println("start mail listener")
-	listenForMail()
+	fmt.Println("start mail workers")
+	stopWorkers := make(chan struct{})
+	mailDone := startMailWorkers(dbrepo.NewPostgresRepo(db.SQL, &app), smtpMailer, stopWorkers)
+	feedsDone := startFeedSync(feedsync.New(dbrepo.NewPostgresRepo(db.SQL, &app), nil), app.FeedSyncInterval, stopWorkers)
 
 	fmt.Println(fmt.Sprintf("Staring application on port %s", portNumber))
 
@@ -44,10 +77,86 @@ func main() {
 		Handler: routes(&app),
 	}
 
-	err = srv.ListenAndServe()
+	serverErr := make(chan error, 1)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := exitOK
+	select {
+	case sig := <-quit:
+		infoLog.Printf("shutdown: received signal %s", sig)
+	case err := <-serverErr:
+		errorLog.Printf("shutdown: http server failed: %v", err)
+		exitCode = exitServerError
+	}
+
+	if code := shutdown(srv, db, stopWorkers, mailDone, feedsDone, smtpMailer); code != exitOK && exitCode == exitOK {
+		exitCode = code
+	}
+
+	infoLog.Printf("shutdown: complete, exit code %d", exitCode)
+	os.Exit(exitCode)
+}
+
+// shutdown stops the application in order: it drains http connections, stops the mail workers from
+// claiming new mail and cancels the sync of external calendars, waits for messages being sent, closes
+// the SMTP connections and finally closes the database pool.
+// Mail still waiting in the queue is kept in the database for the next start.
+// It returns the exit code for the process.
+func shutdown(srv *http.Server, db *driver.DB, stopWorkers chan<- struct{}, mailDone, feedsDone <-chan struct{},
+	smtp io.Closer) int {
+	exitCode := exitOK
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
 	if err != nil {
-		log.Fatal(err)
+		errorLog.Printf("shutdown: http server did not drain in %s: %v", shutdownTimeout, err)
+		exitCode = exitShutdownError
+	} else {
+		infoLog.Println("shutdown: http server drained")
+	}
+
+	close(stopWorkers)
+
+	select {
+	case <-mailDone:
+		infoLog.Println("shutdown: mail workers stopped")
+	case <-time.After(mailFlushTimeout):
+		errorLog.Printf("shutdown: mail workers did not stop in %s, messages being sent will be retried", mailFlushTimeout)
+		exitCode = exitShutdownError
 	}
+
+	select {
+	case <-feedsDone:
+		infoLog.Println("shutdown: calendar sync stopped")
+	case <-time.After(feedStopTimeout):
+		errorLog.Printf("shutdown: calendar sync did not stop in %s", feedStopTimeout)
+		exitCode = exitShutdownError
+	}
+
+	err = smtp.Close()
+	if err != nil {
+		errorLog.Printf("shutdown: can't close smtp connections: %v", err)
+	}
+
+	err = db.SQL.Close()
+	if err != nil {
+		errorLog.Printf("shutdown: can't close database pool: %v", err)
+		exitCode = exitShutdownError
+	} else {
+		infoLog.Println("shutdown: database pool closed")
+	}
+
+	return exitCode
 }
 
 func run() (*driver.DB, error) {
@@ -57,7 +166,6 @@ func run() (*driver.DB, error) {
 	gob.Register(models.Room{})
 	gob.Register(models.Restriction{})
 	gob.Register(models.RoomRestriction{})
-	gob.Register(map[string]int{})
 
 	// read flags
 	inProduction := flag.Bool("production", true, "Application is in production")
@@ -68,6 +176,25 @@ func run() (*driver.DB, error) {
 	dbPassword := flag.String("dbpass", "", "Database password")
 	dbPort := flag.String("dbport", "5432", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, required)")
+	dbTimeout := flag.Duration("dbtimeout", 3*time.Second, "Timeout for a single database query")
+	smtpHost := flag.String("smtphost", envOr("SMTP_HOST", "localhost"), "SMTP server host")
+	smtpPort := flag.Int("smtpport", envIntOr("SMTP_PORT", 1025), "SMTP server port")
+	smtpUser := flag.String("smtpuser", envOr("SMTP_USERNAME", ""), "SMTP username")
+	smtpPassword := flag.String("smtppass", envOr("SMTP_PASSWORD", ""), "SMTP password")
+	smtpEncryption := flag.String("smtpencryption", envOr("SMTP_ENCRYPTION", "none"), "SMTP encryption (none, starttls, ssl)")
+	smtpKeepAlive := flag.Bool("smtpkeepalive", envBoolOr("SMTP_KEEPALIVE", true), "Reuse SMTP connections between messages")
+	mailFrom := flag.String("mailfrom", envOr("MAIL_FROM", "me@here.com"), "Sender address for outgoing mail")
+	baseURL := flag.String("baseurl", envOr("BASE_URL", "http://localhost:8080"), "Public url of the application, used for links in emails")
+	secret := flag.String("secret", envOr("APP_SECRET", ""), "Secret key used to sign tokens sent to users")
+	persistLockouts := flag.Bool("persistlockouts", true, "Store failed login counts in the database")
+	uploadDir := flag.String("uploads", envOr("UPLOAD_DIR", "./uploads"), "Directory where uploaded room photos are stored")
+	currency := flag.String("currency", envOr("CURRENCY", pricing.DefaultCurrency), "Currency of the room prices")
+	taxRate := flag.Int("taxrate", envIntOr("TAX_RATE", 0), "Tax on stays in basis points, 1000 is 10%")
+	cleaningFee := flag.Int("cleaningfee", envIntOr("CLEANING_FEE", 0), "Cleaning fee added to every stay, in cents")
+	stayDiscounts := flag.String("staydiscounts", envOr("STAY_DISCOUNTS", ""), "Discounts for long stays as nights:percent, like 7:10,28:20")
+	cancelBefore := flag.Int("cancelbefore", envIntOr("CANCEL_BEFORE_DAYS", 2), "Guests can change or cancel their reservation until this many days before arrival")
+	feedSync := flag.Duration("feedsync", envDurationOr("FEED_SYNC_INTERVAL", 15*time.Minute), "How often external booking calendars are imported, 0 turns it off")
+	require2FA := flag.Int("require2fa", envIntOr("REQUIRE_2FA_LEVEL", 0), "Require two-factor authentication from this access level up (0 off, 2 managers and owners, 3 owners)")
 
 	flag.Parse()
 
@@ -76,12 +203,41 @@ func run() (*driver.DB, error) {
 		os.Exit(1)
 	}
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-
 	// change this to true when in production
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.DBQueryTimeout = *dbTimeout
+	app.BaseURL = strings.TrimSuffix(*baseURL, "/")
+	app.Secret = []byte(*secret)
+	app.PersistLoginLockouts = *persistLockouts
+	app.TwoFactorAccessLevel = *require2FA
+	app.UploadDir = *uploadDir
+	app.CancelBeforeDays = *cancelBefore
+	app.FeedSyncInterval = *feedSync
+
+	discounts, err := parseStayDiscounts(*stayDiscounts)
+	if err != nil {
+		return nil, err
+	}
+	app.Pricing = pricing.Rules{
+		Currency:      strings.ToUpper(*currency),
+		TaxRate:       *taxRate,
+		StayDiscounts: discounts,
+	}
+	if *cleaningFee > 0 {
+		app.Pricing.Fees = append(app.Pricing.Fees, pricing.Fee{Name: "Cleaning fee", Amount: *cleaningFee})
+	}
+
+	app.SMTP = config.SMTPConfig{
+		Host:       *smtpHost,
+		Port:       *smtpPort,
+		Username:   *smtpUser,
+		Password:   *smtpPassword,
+		Encryption: *smtpEncryption,
+		From:       *mailFrom,
+		KeepAlive:  *smtpKeepAlive,
+		PoolSize:   mailWorkers,
+	}
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -89,6 +245,21 @@ func run() (*driver.DB, error) {
 	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
 
+	randomSecret := len(app.Secret) == 0
+	if randomSecret {
+		if app.InProduction {
+			return nil, errors.New("missing secret, set -secret or APP_SECRET")
+		}
+
+		// tokens sent before a restart stop working, which is fine in development
+		app.Secret = make([]byte, 32)
+		_, err := rand.Read(app.Secret)
+		if err != nil {
+			return nil, err
+		}
+		infoLog.Println("no secret set, using a random one")
+	}
+
 	// set up the session
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -113,10 +284,110 @@ func run() (*driver.DB, error) {
 
 	app.TemplateCache = tc
 
+	mtc, err := render.CreateMailTemplateCache()
+	if err != nil {
+		return nil, err
+	}
+
+	app.MailTemplateCache = mtc
+
 	repo := handlers.NewRepo(&app, db)
+	err = repo.LoadLoginLockouts(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if randomSecret {
+		err = requireSecretForTwoFactor(context.Background(), repo.DB)
+		if err != nil {
+			return nil, err
+		}
+	}
 	handlers.NewHandlers(repo)
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
 
 	return db, nil
 }
+
+// requireSecretForTwoFactor fails when a user has two-factor authentication enabled, their secret is sealed
+// with the app secret and a random one can't open it
+func requireSecretForTwoFactor(ctx context.Context, db repository.DatabaseRepo) error {
+	users, err := db.AllUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.TOTPEnabled {
+			return errors.New("users have two-factor authentication enabled, set -secret or APP_SECRET to the secret it was enabled with")
+		}
+	}
+
+	return nil
+}
+
+// envOr returns the environment variable key, or fallback when it is not set
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
+
+// envIntOr returns the environment variable key as int, or fallback when it is not set or not a number
+func envIntOr(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return v
+}
+
+// envBoolOr returns the environment variable key as bool, or fallback when it is not set or not a bool
+func envBoolOr(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return v
+}
+
+// envDurationOr returns the environment variable key as duration, or fallback when it is not set or not a
+// duration
+func envDurationOr(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return v
+}
+
+// parseStayDiscounts parses a list of nights:percent pairs separated by commas
+func parseStayDiscounts(s string) ([]pricing.StayDiscount, error) {
+	var discounts []pricing.StayDiscount
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		nights, percent, found := strings.Cut(pair, ":")
+		minNights, err := strconv.Atoi(nights)
+		if !found || err != nil || minNights < 1 {
+			return nil, fmt.Errorf("invalid stay discount %q", pair)
+		}
+		pct, err := strconv.Atoi(percent)
+		if err != nil || pct < 1 || pct > 100 {
+			return nil, fmt.Errorf("invalid stay discount %q", pair)
+		}
+
+		discounts = append(discounts, pricing.StayDiscount{MinNights: minNights, Percent: pct})
+	}
+
+	return discounts, nil
+}
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"github.com/ismail118/bookings-app/internal/driver"
+	"github.com/ismail118/bookings-app/internal/feedsync"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/repository/dbrepo"
+	"io"
+	"log"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestRun(t *testing.T) {
@@ -12,3 +23,137 @@ func TestRun(t *testing.T) {
 		t.Error("failed run()")
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	infoLog = log.New(io.Discard, "", 0)
+	errorLog = log.New(io.Discard, "", 0)
+	app.InfoLog = infoLog
+	app.ErrorLog = errorLog
+
+	stopWorkers := make(chan struct{})
+	mailDone := startMailWorkers(dbrepo.NewTestingRepo(&app), &captureMailer{}, stopWorkers)
+	feedsDone := startFeedSync(feedsync.New(dbrepo.NewTestingRepo(&app), nil), time.Hour, stopWorkers)
+
+	// sql.Open does not connect, so the pool can be closed without a database
+	pool, err := sql.Open("pgx", "postgres://localhost/bookings_app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := shutdown(&http.Server{}, &driver.DB{SQL: pool}, stopWorkers, mailDone, feedsDone, &captureMailer{})
+	if code != exitOK {
+		t.Errorf("shutdown returned exit code %d, wanted %d", code, exitOK)
+	}
+
+	select {
+	case <-mailDone:
+	default:
+		t.Error("mail workers should have stopped after shutdown")
+	}
+
+	select {
+	case <-feedsDone:
+	default:
+		t.Error("calendar sync should have stopped after shutdown")
+	}
+
+	if err := pool.Ping(); err == nil {
+		t.Error("database pool should be closed after shutdown")
+	}
+}
+
+func TestMailBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, mailRetryBase},
+		{2, 2 * mailRetryBase},
+		{3, 4 * mailRetryBase},
+		{20, mailRetryMax},
+	}
+
+	for _, e := range tests {
+		if got := mailBackoff(e.attempts); got != e.expected {
+			t.Errorf("backoff after %d attempts: got %s, wanted %s", e.attempts, got, e.expected)
+		}
+	}
+}
+
+func TestDeliverMail(t *testing.T) {
+	app.InfoLog = log.New(io.Discard, "", 0)
+	app.ErrorLog = log.New(io.Discard, "", 0)
+
+	repo := dbrepo.NewTestingRepo(&app)
+	queued := models.QueuedMail{
+		ID:       1,
+		Mail:     models.MailData{To: "guest@here.com", Subject: "Reservation Confirmation"},
+		Attempts: 1,
+	}
+
+	ml := &captureMailer{}
+	deliverMail(repo, ml, queued)
+
+	if len(ml.sent) != 1 {
+		t.Fatalf("expected 1 message to be sent, got %d", len(ml.sent))
+	}
+	if ml.sent[0].To != "guest@here.com" {
+		t.Errorf("sent message to %s, wanted guest@here.com", ml.sent[0].To)
+	}
+
+	// a failing transport must not panic for both the retry and the dead-letter path
+	ml = &captureMailer{fail: true}
+	deliverMail(repo, ml, queued)
+
+	queued.Attempts = mailMaxAttempts
+	deliverMail(repo, ml, queued)
+
+	if len(ml.sent) != 0 {
+		t.Errorf("failing mailer should not record messages, got %d", len(ml.sent))
+	}
+}
+
+func TestParseStayDiscounts(t *testing.T) {
+	discounts, err := parseStayDiscounts(" 7:10, 28:20,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discounts) != 2 || discounts[0].MinNights != 7 || discounts[0].Percent != 10 || discounts[1].MinNights != 28 || discounts[1].Percent != 20 {
+		t.Errorf("wrong discounts %+v", discounts)
+	}
+
+	discounts, err = parseStayDiscounts("")
+	if err != nil || len(discounts) != 0 {
+		t.Errorf("expected no discounts, got %+v %v", discounts, err)
+	}
+
+	for _, s := range []string{"7", "x:10", "7:0", "7:101", "0:10"} {
+		if _, err := parseStayDiscounts(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+// usersRepo returns users as the only users of the site
+type usersRepo struct {
+	repository.DatabaseRepo
+	users []models.User
+}
+
+func (r usersRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	return r.users, nil
+}
+
+func TestRequireSecretForTwoFactor(t *testing.T) {
+	repo := dbrepo.NewTestingRepo(&app)
+
+	err := requireSecretForTwoFactor(context.Background(), usersRepo{repo, []models.User{{ID: 1}}})
+	if err != nil {
+		t.Errorf("no user has two-factor authentication, got %v", err)
+	}
+
+	err = requireSecretForTwoFactor(context.Background(), usersRepo{repo, []models.User{{ID: 1}, {ID: 2, TOTPEnabled: true}}})
+	if err == nil {
+		t.Error("expected an error when a user has two-factor authentication")
+	}
+}
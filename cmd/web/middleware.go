@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"github.com/ismail118/bookings-app/helpers"
+	"github.com/ismail118/bookings-app/internal/audit"
+	"github.com/ismail118/bookings-app/internal/handlers"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/tokens"
 	"github.com/justinas/nosurf"
 	"net/http"
+	"strings"
 )
 
 // NoSurf is the csrf protection middleware
@@ -16,14 +24,110 @@ func NoSurf(next http.Handler) http.Handler {
 		Secure:   app.InProduction,
 		SameSite: http.SameSiteLaxMode,
 	})
+
+	// a browser never sends an Authorization header on its own, so api requests carrying a token can't be
+	// forged by another site. APIToken rejects the request when the token is invalid.
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		_, ok := bearerToken(r)
+		return ok && strings.HasPrefix(r.URL.Path, "/api/")
+	})
+
+	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			handlers.WriteAPIError(w, http.StatusUnauthorized, "unauthorized", "Use an api token in the Authorization header")
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}))
 	return csrfHandler
 }
 
+// bearerToken returns the token of a Bearer authorization header, ok is false when there is none
+func bearerToken(r *http.Request) (token string, ok bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// apiTokenKey is the context key of the api token a request was authenticated with
+type apiTokenKey struct{}
+
+// apiTokenFrom returns the api token the request was authenticated with, ok is false for requests
+// without a token
+func apiTokenFrom(ctx context.Context) (t models.APIToken, ok bool) {
+	t, ok = ctx.Value(apiTokenKey{}).(models.APIToken)
+	return t, ok
+}
+
+// APIToken authenticates api requests that carry an api token as a Bearer authorization header. The
+// changes made with the token are recorded in the audit log for the user who created it.
+func APIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t, err := handlers.Repo.AuthenticateAPIToken(r.Context(), raw)
+		if errors.Is(err, tokens.ErrInvalid) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			handlers.WriteAPIError(w, http.StatusUnauthorized, "unauthorized", "The api token is invalid or was revoked")
+			return
+		} else if err != nil {
+			app.ErrorLog.Printf("api: can't get api token: %v", err)
+			handlers.WriteAPIError(w, http.StatusInternalServerError, "internal_error", "can't get api token")
+			return
+		}
+
+		ip := helpers.ClientIP(r)
+		err = handlers.Repo.DB.TouchAPIToken(r.Context(), t.ID, ip)
+		if err != nil {
+			app.ErrorLog.Printf("api: can't record use of api token %d: %v", t.ID, err)
+		}
+
+		ctx := context.WithValue(r.Context(), apiTokenKey{}, t)
+		ctx = audit.WithActor(ctx, audit.Actor{UserID: t.UserID, IPAddress: ip})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// APIRequireScope rejects requests authenticated with an api token that wasn't granted scope. Requests
+// without a token are public and only protected by the session and csrf checks.
+func APIRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := apiTokenFrom(r.Context())
+			if ok && !t.HasScope(scope) {
+				handlers.WriteAPIError(w, http.StatusForbidden, "forbidden", "The api token doesn't have the "+scope+" scope")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // SessionLoad loads and saves session data for current request
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// AuditActor puts the logged in user and the client ip in the request context, so the changes
+// made while handling the request are recorded in the audit log with them
+func AuditActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := audit.WithActor(r.Context(), audit.Actor{
+			UserID:    session.GetInt(r.Context(), "user_id"),
+			IPAddress: helpers.ClientIP(r),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Auth redirects to the login page when there is no logged in user
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
@@ -35,3 +139,90 @@ func Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireRole loads the logged in user and only lets the request through when
+// the user's access level is at least level. The level is stored in the session
+// so templates can hide actions the user is not allowed to perform. Users whose
+// role requires two-factor authentication are sent to set it up first.
+func RequireRole(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := handlers.Repo.DB.GetUserByID(r.Context(), session.GetInt(r.Context(), "user_id"))
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.Active) {
+				// the user was removed or deactivated while still logged in
+				_ = session.Destroy(r.Context())
+				session.Put(r.Context(), "error", "Unauthenticated")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			} else if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+
+			session.Put(r.Context(), "access_level", user.AccessLevel)
+
+			if app.TwoFactorAccessLevel > 0 && user.AccessLevel >= app.TwoFactorAccessLevel && !user.TOTPEnabled {
+				session.Put(r.Context(), "warning", "Your role requires two-factor authentication, please set it up")
+				http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+				return
+			}
+
+			if user.AccessLevel < level {
+				session.Put(r.Context(), "error", "You don't have permission to do that")
+				http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIRequireRole is RequireRole for the api, it answers with a json error instead of redirecting.
+// Requests authenticated with an api token need the admin scope and act with the role of the user who
+// created the token.
+func APIRequireRole(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, withToken := apiTokenFrom(r.Context())
+
+			userID := session.GetInt(r.Context(), "user_id")
+			if withToken {
+				if !t.HasScope(models.ScopeAdmin) {
+					handlers.WriteAPIError(w, http.StatusForbidden, "forbidden", "The api token doesn't have the admin scope")
+					return
+				}
+				userID = t.UserID
+			} else if !helpers.IsAuthenticated(r) {
+				handlers.WriteAPIError(w, http.StatusUnauthorized, "unauthorized", "Please log in")
+				return
+			}
+
+			user, err := handlers.Repo.DB.GetUserByID(r.Context(), userID)
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.Active) {
+				if !withToken {
+					_ = session.Destroy(r.Context())
+				}
+				handlers.WriteAPIError(w, http.StatusUnauthorized, "unauthorized", "Please log in")
+				return
+			} else if err != nil {
+				app.ErrorLog.Printf("api: can't get user: %v", err)
+				handlers.WriteAPIError(w, http.StatusInternalServerError, "internal_error", "can't get user")
+				return
+			}
+
+			// tokens are created on the admin pages, which already make the user set up two-factor authentication
+			if !withToken && app.TwoFactorAccessLevel > 0 && user.AccessLevel >= app.TwoFactorAccessLevel && !user.TOTPEnabled {
+				handlers.WriteAPIError(w, http.StatusForbidden, "forbidden", "Your role requires two-factor authentication, please set it up")
+				return
+			}
+
+			if user.AccessLevel < level {
+				handlers.WriteAPIError(w, http.StatusForbidden, "forbidden", "You don't have permission to do that")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
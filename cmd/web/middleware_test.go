@@ -1,7 +1,10 @@
 package main
 
 import (
+	"github.com/ismail118/bookings-app/internal/audit"
+	"github.com/ismail118/bookings-app/internal/models"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -30,3 +33,254 @@ func TestSessionLoad(t *testing.T) {
 		t.Errorf("%T type is not http.Handler", v)
 	}
 }
+
+// loginAs puts the user id in the session before calling next, zero means logged out
+func loginAs(userID int, next http.Handler) http.Handler {
+	return session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID > 0 {
+			session.Put(r.Context(), "user_id", userID)
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+func TestAuth(t *testing.T) {
+	var myH myHandler
+
+	rr := httptest.NewRecorder()
+	loginAs(0, Auth(&myH)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("logged out user should be redirected to login, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = httptest.NewRecorder()
+	loginAs(models.AccessLevelStaff, Auth(&myH)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("logged in user should pass, got %d", rr.Code)
+	}
+}
+
+func TestAuditActor(t *testing.T) {
+	var actor audit.Actor
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = audit.ActorFrom(r.Context())
+	})
+
+	req := httptest.NewRequest("POST", "/admin/rooms/1", nil)
+	req.RemoteAddr = "10.0.0.7:52100"
+	loginAs(models.AccessLevelManager, AuditActor(next)).ServeHTTP(httptest.NewRecorder(), req)
+
+	if actor.UserID != models.AccessLevelManager || actor.IPAddress != "10.0.0.7" {
+		t.Errorf("wrong actor in context %+v", actor)
+	}
+}
+
+var requireRoleTests = []struct {
+	name             string
+	userID           int
+	level            int
+	expectedCode     int
+	expectedLocation string
+}{
+	{"staff-on-staff-route", models.AccessLevelStaff, models.AccessLevelStaff, http.StatusOK, ""},
+	{"staff-on-manager-route", models.AccessLevelStaff, models.AccessLevelManager, http.StatusSeeOther, "/admin/dashboard"},
+	{"manager-on-manager-route", models.AccessLevelManager, models.AccessLevelManager, http.StatusOK, ""},
+	{"manager-on-owner-route", models.AccessLevelManager, models.AccessLevelOwner, http.StatusSeeOther, "/admin/dashboard"},
+	{"owner-on-staff-route", models.AccessLevelOwner, models.AccessLevelStaff, http.StatusOK, ""},
+	{"owner-on-owner-route", models.AccessLevelOwner, models.AccessLevelOwner, http.StatusOK, ""},
+	{"removed-user", 99, models.AccessLevelStaff, http.StatusSeeOther, "/user/login"},
+}
+
+func TestRequireRole(t *testing.T) {
+	for _, e := range requireRoleTests {
+		var accessLevel int
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accessLevel = session.GetInt(r.Context(), "access_level")
+		})
+
+		rr := httptest.NewRecorder()
+		loginAs(e.userID, RequireRole(e.level)(next)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("for %s expected location %q but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+
+		if e.expectedCode == http.StatusOK && accessLevel != e.userID {
+			t.Errorf("for %s expected access level %d in session but got %d", e.name, e.userID, accessLevel)
+		}
+	}
+}
+
+func TestRequireRole_TwoFactorPolicy(t *testing.T) {
+	app.TwoFactorAccessLevel = models.AccessLevelManager
+	defer func() { app.TwoFactorAccessLevel = 0 }()
+
+	var myH myHandler
+
+	rr := httptest.NewRecorder()
+	loginAs(models.AccessLevelManager, RequireRole(models.AccessLevelStaff)(&myH)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/two-factor" {
+		t.Errorf("manager without two-factor should be sent to set it up, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = httptest.NewRecorder()
+	loginAs(models.AccessLevelStaff, RequireRole(models.AccessLevelStaff)(&myH)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("staff is not covered by the policy, got %d", rr.Code)
+	}
+
+	// user 4 is a staff member with two-factor authentication
+	app.TwoFactorAccessLevel = models.AccessLevelStaff
+	rr = httptest.NewRecorder()
+	loginAs(4, RequireRole(models.AccessLevelStaff)(&myH)).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("user with two-factor should pass, got %d", rr.Code)
+	}
+}
+
+func TestNoSurf_ExemptsAPIWithToken(t *testing.T) {
+	var myH myHandler
+	h := NoSurf(&myH)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/reservations", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken("frontdesk"))
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("api requests with a token should not need a csrf token, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/reservations", nil))
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("api requests without a token should get a json 401, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/make-reservation", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken("frontdesk"))
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("form posts should need a csrf token, got %d", rr.Code)
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		expectedCode  int
+		expectedToken int
+		expectedActor int
+	}{
+		{"no-token", "", http.StatusOK, 0, 0},
+		{"basic-auth", "Basic dXNlcjpwYXNz", http.StatusOK, 0, 0},
+		{"valid", "Bearer " + testAPIToken("frontdesk"), http.StatusOK, 1, models.AccessLevelManager},
+		{"lower-case-scheme", "bearer " + testAPIToken("admintool"), http.StatusOK, 3, models.AccessLevelOwner},
+		{"unknown", "Bearer " + testAPIToken("unknown"), http.StatusUnauthorized, 0, 0},
+		{"forged", "Bearer frontdesk.abc", http.StatusUnauthorized, 0, 0},
+		{"empty", "Bearer ", http.StatusUnauthorized, 0, 0},
+	}
+
+	for _, e := range tests {
+		var tokenID, actorID int
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiToken, _ := apiTokenFrom(r.Context())
+			tokenID = apiToken.ID
+			actorID = audit.ActorFrom(r.Context()).UserID
+		})
+
+		req := httptest.NewRequest("GET", "/api/v1/rooms", nil)
+		if e.authorization != "" {
+			req.Header.Set("Authorization", e.authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		APIToken(next).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if tokenID != e.expectedToken {
+			t.Errorf("for %s expected token %d but got %d", e.name, e.expectedToken, tokenID)
+		}
+		if actorID != e.expectedActor {
+			t.Errorf("for %s expected audit actor %d but got %d", e.name, e.expectedActor, actorID)
+		}
+		if e.expectedCode == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("for %s expected a WWW-Authenticate header", e.name)
+		}
+	}
+}
+
+func TestAPIRequireScope(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		scope        string
+		expectedCode int
+	}{
+		{"no-token", "", models.ScopeReservationsWrite, http.StatusOK},
+		{"granted", "frontdesk", models.ScopeReservationsWrite, http.StatusOK},
+		{"not-granted", "reader", models.ScopeReservationsWrite, http.StatusForbidden},
+		{"admin-includes-all", "admintool", models.ScopeAvailabilityRead, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		var myH myHandler
+
+		req := httptest.NewRequest("POST", "/api/v1/reservations", nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testAPIToken(e.token))
+		}
+
+		rr := httptest.NewRecorder()
+		APIToken(APIRequireScope(e.scope)(&myH)).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestAPIRequireRole(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       int
+		token        string
+		level        int
+		expectedCode int
+	}{
+		{"logged-out", 0, "", models.AccessLevelStaff, http.StatusUnauthorized},
+		{"staff-on-staff-route", models.AccessLevelStaff, "", models.AccessLevelStaff, http.StatusOK},
+		{"staff-on-owner-route", models.AccessLevelStaff, "", models.AccessLevelOwner, http.StatusForbidden},
+		{"removed-user", 99, "", models.AccessLevelStaff, http.StatusUnauthorized},
+		{"admin-token", 0, "admintool", models.AccessLevelOwner, http.StatusOK},
+		{"token-without-admin-scope", 0, "frontdesk", models.AccessLevelStaff, http.StatusForbidden},
+		{"token-overrides-session", models.AccessLevelOwner, "reader", models.AccessLevelStaff, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		var myH myHandler
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/reservations", nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testAPIToken(e.token))
+		}
+
+		rr := httptest.NewRecorder()
+		loginAs(e.userID, APIToken(APIRequireRole(e.level)(&myH))).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.expectedCode != http.StatusOK && rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("for %s expected a json error, got %q", e.name, rr.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/ismail118/bookings-app/internal/config"
 	"github.com/ismail118/bookings-app/internal/handlers"
+	"github.com/ismail118/bookings-app/internal/models"
 	"net/http"
+	"os"
 )
 
 func routes(app *config.AppConfig) http.Handler {
@@ -14,11 +16,14 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(NoSurf)
 	mux.Use(SessionLoad)
+	mux.Use(AuditActor)
 
 	mux.Get("/", handlers.Repo.Home)
 	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/room-one", handlers.Repo.RoomOne)
-	mux.Get("/room-two", handlers.Repo.RoomTwo)
+	mux.Get("/rooms", handlers.Repo.Rooms)
+	mux.Get("/rooms/{slug}", handlers.Repo.Room)
+	mux.Get("/room-one", http.RedirectHandler("/rooms/room-one", http.StatusMovedPermanently).ServeHTTP)
+	mux.Get("/room-two", http.RedirectHandler("/rooms/room-two", http.StatusMovedPermanently).ServeHTTP)
 
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
@@ -31,25 +36,167 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
 
+	mux.Get("/manage-booking", handlers.Repo.ManageBooking)
+	mux.Post("/manage-booking", handlers.Repo.PostManageBooking)
+	mux.Get("/manage-booking/link", handlers.Repo.ManageBookingLink)
+	mux.Get("/manage-booking/reservation", handlers.Repo.ManageBookingReservation)
+	mux.Post("/manage-booking/reservation/dates", handlers.Repo.PostManageBookingDates)
+	mux.Post("/manage-booking/reservation/cancel", handlers.Repo.PostManageBookingCancel)
+
+	mux.Get("/calendar/rooms.ics", handlers.Repo.CalendarFeed)
+	mux.Get("/calendar/rooms/{id}.ics", handlers.Repo.RoomCalendarFeed)
+
+	mux.Get("/api/openapi.json", handlers.Repo.APIOpenAPI)
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(APIToken)
+		mux.NotFound(handlers.Repo.APINotFound)
+		mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(APIRequireScope(models.ScopeAvailabilityRead))
+			mux.Get("/rooms", handlers.Repo.APIRooms)
+			mux.Get("/rooms/{id}", handlers.Repo.APIRoom)
+			mux.Get("/availability", handlers.Repo.APIAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(APIRequireScope(models.ScopeReservationsWrite))
+			mux.Post("/reservations", handlers.Repo.APIPostReservation)
+			mux.Get("/reservations/{code}", handlers.Repo.APIReservation)
+			mux.Post("/reservations/{code}/cancel", handlers.Repo.APICancelReservation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(APIRequireRole(models.AccessLevelStaff))
+			mux.Get("/admin/reservations", handlers.Repo.APIAdminReservations)
+		})
+	})
+
 	fileServer := http.FileServer(http.Dir("static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
+	uploadServer := http.FileServer(filesOnly{http.Dir(app.UploadDir)})
+	mux.Handle("/uploads/*", http.StripPrefix("/uploads", uploadServer))
+
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
+	mux.Get("/user/login/two-factor", handlers.Repo.ShowTwoFactorLogin)
+	mux.Post("/user/login/two-factor", handlers.Repo.PostTwoFactorLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
+	mux.Get("/user/forgot-password", handlers.Repo.ShowForgotPassword)
+	mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", handlers.Repo.ShowResetPassword)
+	mux.Post("/user/reset-password", handlers.Repo.PostResetPassword)
 
 	mux.Route("/admin", func(mux chi.Router) {
-		//mux.Use(Auth)
-		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
-		mux.Get("/reservations-new", handlers.Repo.NewAdminReservations)
-		mux.Get("/reservations-all", handlers.Repo.NewAdminAllReservations)
-		mux.Get("/reservations-calendar", handlers.Repo.NewAdminReservationsCalendars)
-		mux.Post("/reservations-calendar", handlers.Repo.NewAdminPostReservationsCalendars)
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
-
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		mux.Use(Auth)
+
+		// every user can manage their own two-factor authentication
+		mux.Get("/two-factor", handlers.Repo.AdminTwoFactor)
+		mux.Post("/two-factor/enable", handlers.Repo.AdminEnableTwoFactor)
+		mux.Post("/two-factor/disable", handlers.Repo.AdminDisableTwoFactor)
+
+		// staff can look after reservations
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireRole(models.AccessLevelStaff))
+			mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+			mux.Get("/reservations-new", handlers.Repo.NewAdminReservations)
+			mux.Get("/reservations-all", handlers.Repo.NewAdminAllReservations)
+			mux.Get("/reservations-calendar", handlers.Repo.NewAdminReservationsCalendars)
+			mux.Post("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
+			mux.Post("/check-in-reservation/{src}/{id}/do", handlers.Repo.AdminCheckInReservation)
+			mux.Post("/check-out-reservation/{src}/{id}/do", handlers.Repo.AdminCheckOutReservation)
+			mux.Post("/no-show-reservation/{src}/{id}/do", handlers.Repo.AdminNoShowReservation)
+
+			mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+			mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		})
+
+		// managers can also cancel reservations, block rooms, manage the room catalog and external calendars
+		// and handle failed mail
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireRole(models.AccessLevelManager))
+			mux.Post("/reservations-calendar", handlers.Repo.NewAdminPostReservationsCalendars)
+			mux.Post("/blocks", handlers.Repo.AdminPostBlock)
+			mux.Get("/blocks/{id}/show", handlers.Repo.AdminShowBlock)
+			mux.Post("/blocks/{id}", handlers.Repo.AdminPostShowBlock)
+			mux.Post("/blocks/{id}/split", handlers.Repo.AdminSplitBlock)
+			mux.Post("/blocks/{id}/unblock", handlers.Repo.AdminUnblockDays)
+			mux.Post("/delete-block/{id}/do", handlers.Repo.AdminDeleteBlock)
+			mux.Post("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+
+			mux.Get("/rooms", handlers.Repo.AdminRooms)
+			mux.Get("/rooms/{id}/show", handlers.Repo.AdminShowRoom)
+			mux.Post("/rooms/{id}", handlers.Repo.AdminPostShowRoom)
+			mux.Post("/delete-room/{id}/do", handlers.Repo.AdminDeleteRoom)
+			mux.Post("/rooms/{id}/photos", handlers.Repo.AdminUploadRoomPhotos)
+			mux.Post("/rooms/{id}/seasonal-rates", handlers.Repo.AdminPostSeasonalRate)
+			mux.Post("/delete-seasonal-rate/{room_id}/{id}/do", handlers.Repo.AdminDeleteSeasonalRate)
+			mux.Post("/rooms/{id}/stay-rules", handlers.Repo.AdminPostStayRule)
+			mux.Post("/delete-stay-rule/{room_id}/{id}/do", handlers.Repo.AdminDeleteStayRule)
+			mux.Post("/delete-room-photo/{id}/do", handlers.Repo.AdminDeleteRoomPhoto)
+			mux.Post("/cover-room-photo/{id}/do", handlers.Repo.AdminCoverRoomPhoto)
+			mux.Post("/move-up-room-photo/{id}/do", handlers.Repo.AdminMoveUpRoomPhoto)
+			mux.Post("/move-down-room-photo/{id}/do", handlers.Repo.AdminMoveDownRoomPhoto)
+
+			mux.Get("/mail-queue", handlers.Repo.AdminMailQueue)
+			mux.Post("/mail-queue/{id}/retry", handlers.Repo.AdminRetryMail)
+
+			mux.Get("/external-feeds", handlers.Repo.AdminExternalFeeds)
+			mux.Post("/external-feeds", handlers.Repo.AdminPostExternalFeed)
+			mux.Post("/sync-external-feed/{id}/do", handlers.Repo.AdminSyncExternalFeed)
+			mux.Post("/delete-external-feed/{id}/do", handlers.Repo.AdminDeleteExternalFeed)
+		})
+
+		// owners can also manage users, api tokens and calendar feeds
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireRole(models.AccessLevelOwner))
+			mux.Get("/users", handlers.Repo.AdminUsers)
+			mux.Get("/users/{id}/show", handlers.Repo.AdminShowUser)
+			mux.Post("/users/{id}", handlers.Repo.AdminPostShowUser)
+			mux.Post("/activate-user/{id}/do", handlers.Repo.AdminActivateUser)
+			mux.Post("/deactivate-user/{id}/do", handlers.Repo.AdminDeactivateUser)
+			mux.Post("/delete-user/{id}/do", handlers.Repo.AdminDeleteUser)
+			mux.Post("/reset-two-factor/{id}/do", handlers.Repo.AdminResetTwoFactor)
+
+			mux.Get("/login-lockouts", handlers.Repo.AdminLoginLockouts)
+			mux.Post("/login-lockouts/unlock", handlers.Repo.AdminUnlockLogin)
+
+			mux.Get("/audit-log", handlers.Repo.AdminAuditLog)
+
+			mux.Get("/api-tokens", handlers.Repo.AdminAPITokens)
+			mux.Post("/api-tokens", handlers.Repo.AdminPostAPIToken)
+			mux.Post("/revoke-api-token/{id}/do", handlers.Repo.AdminRevokeAPIToken)
+
+			mux.Get("/calendar-feeds", handlers.Repo.AdminCalendarFeeds)
+			mux.Post("/calendar-feeds/{id}/token", handlers.Repo.AdminPostCalendarFeedToken)
+			mux.Post("/calendar-feeds/{id}/revoke", handlers.Repo.AdminRevokeCalendarFeedToken)
+		})
 	})
 	return mux
 }
+
+// filesOnly is a http.FileSystem that answers directories as not found, so the names of uploaded files
+// can't be listed
+type filesOnly struct {
+	fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return file, nil
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/go-chi/chi"
 	"github.com/ismail118/bookings-app/internal/config"
+	"github.com/ismail118/bookings-app/internal/openapi"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -18,3 +27,169 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("%T not type *chi.Mux", v)
 	}
 }
+
+func TestRoutes_Uploads(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "rooms", "1"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "rooms", "1", "photo-thumb.jpg"), []byte("jpeg"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadApp := app
+	uploadApp.UploadDir = dir
+	mux := routes(&uploadApp)
+
+	tests := []struct {
+		url          string
+		expectedCode int
+	}{
+		{"/uploads/rooms/1/photo-thumb.jpg", http.StatusOK},
+		{"/uploads/rooms/1/", http.StatusNotFound},
+		{"/uploads/rooms/", http.StatusNotFound},
+		{"/uploads/", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", e.url, nil))
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected %d, got %d", e.url, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRoutes_AdminRequiresLogin(t *testing.T) {
+	mux := routes(&app)
+
+	for _, url := range []string{
+		"/admin/dashboard",
+		"/admin/reservations-all",
+		"/admin/reservations/all/1/show",
+		"/admin/mail-queue",
+		"/admin/external-feeds",
+		"/admin/calendar-feeds",
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+			t.Errorf("%s should redirect to login, got %d %s", url, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRoutes_APIAdminRequiresLogin(t *testing.T) {
+	mux := routes(&app)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/admin/reservations", nil))
+
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("api admin routes should answer 401 json, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestRoutes_APITokens(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		token        string
+		expectedCode int
+	}{
+		{"write-without-token", "POST", "/api/v1/reservations", "", http.StatusUnauthorized},
+		{"write-without-scope", "POST", "/api/v1/reservations", "reader", http.StatusForbidden},
+		{"write-with-scope", "POST", "/api/v1/reservations", "frontdesk", http.StatusBadRequest},
+		{"read-without-token", "GET", "/api/v1/rooms", "", http.StatusOK},
+		{"read-with-scope", "GET", "/api/v1/rooms", "reader", http.StatusOK},
+		{"admin-without-scope", "GET", "/api/v1/admin/reservations", "frontdesk", http.StatusForbidden},
+		{"admin-with-scope", "GET", "/api/v1/admin/reservations", "admintool", http.StatusOK},
+		{"revoked", "GET", "/api/v1/rooms", "revoked", http.StatusUnauthorized},
+	}
+
+	mux := routes(&app)
+
+	for _, e := range tests {
+		// the reservation is invalid json, so a request that gets through is rejected by the handler
+		req := httptest.NewRequest(e.method, e.url, strings.NewReader("{"))
+		req.Header.Set("Content-Type", "application/json")
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testAPIToken(e.token))
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("for %s expected code %d but got %d: %s", e.name, e.expectedCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRoutes_CalendarFeeds(t *testing.T) {
+	mux := routes(&app)
+
+	for _, e := range []struct {
+		url     string
+		payload string
+	}{
+		{"/calendar/rooms.ics", "all-rooms-feed"},
+		{"/calendar/rooms/1.ics", "room-one-feed"},
+	} {
+		token := url.QueryEscape(tokens.Sign(app.Secret, "calendar-feed", e.payload))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", e.url+"?token="+token, nil))
+
+		if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/calendar") {
+			t.Errorf("%s should serve the feed without a login, got %d %s", e.url, rr.Code, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// isJSONRoute reports whether a route answers with json and so belongs in the OpenAPI document
+func isJSONRoute(route string) bool {
+	return strings.HasPrefix(route, "/api/") || strings.HasSuffix(route, "-json")
+}
+
+func TestRoutes_APIRoutesInSpec(t *testing.T) {
+	mux := routes(&app)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	var doc openapi.Document
+	err := json.Unmarshal(rr.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("can't read the spec: %v", err)
+	}
+
+	registered := make(map[string]bool)
+	err = chi.Walk(mux.(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !isJSONRoute(route) {
+			return nil
+		}
+
+		registered[method+" "+route] = true
+		if doc.Paths[route][strings.ToLower(method)] == nil {
+			t.Errorf("%s %s is missing from the OpenAPI document", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, item := range doc.Paths {
+		for method := range item {
+			if !registered[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is in the OpenAPI document but not in the routes", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
@@ -1,57 +1,118 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"github.com/ismail118/bookings-app/internal/mailer"
 	"github.com/ismail118/bookings-app/internal/models"
-	mail "github.com/xhit/go-simple-mail/v2"
-	"io/ioutil"
-	"log"
-	"strings"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"sync"
 	"time"
 )
 
-func listenForMail() {
+// mailWorkers is the number of goroutines sending queued mail
+const mailWorkers = 2
+
+// mailPollInterval is how long an idle worker waits before looking for due mail again
+const mailPollInterval = 5 * time.Second
+
+// mailMaxAttempts is the number of sends tried before a message goes to the dead-letter state
+const mailMaxAttempts = 5
+
+// mailRetryBase is the delay before the first retry, it doubles on every further attempt
+const mailRetryBase = 30 * time.Second
+
+// mailRetryMax caps the delay between two attempts
+const mailRetryMax = 6 * time.Hour
+
+// mailStaleAfter is how long a message can stay claimed before another worker picks it up again
+const mailStaleAfter = 10 * time.Minute
+
+// startMailWorkers starts the workers sending mail from the queue. Workers stop claiming new mail
+// once stop is closed; the returned channel is closed when every worker finished its current message.
+func startMailWorkers(repo repository.DatabaseRepo, ml mailer.Mailer, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < mailWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailWorker(repo, ml, stop)
+		}()
+	}
+
 	go func() {
-		for {
-			msg := <-app.MailChan
-			sendMsg(msg)
-		}
+		wg.Wait()
+		close(done)
 	}()
+
+	return done
 }
 
-func sendMsg(m models.MailData) {
-	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
+func mailWorker(repo repository.DatabaseRepo, ml mailer.Mailer, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		mails, err := repo.ClaimMail(context.Background(), 1, mailStaleAfter)
+		if err != nil {
+			app.ErrorLog.Println("mail: can't claim queued mail:", err)
+		}
 
-	client, err := server.Connect()
-	if err != nil {
-		log.Println(err)
+		if len(mails) == 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(mailPollInterval):
+			}
+			continue
+		}
+
+		for _, m := range mails {
+			deliverMail(repo, ml, m)
+		}
 	}
+}
 
-	email := mail.NewMSG()
-	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
-	if m.Template == "" {
-		email.SetBody(mail.TextHTML, m.Content)
-	} else {
-		data, err := ioutil.ReadFile(fmt.Sprintf("./email-templates/%s", m.Template))
+// deliverMail sends one queued message and records the outcome in the queue
+func deliverMail(repo repository.DatabaseRepo, ml mailer.Mailer, m models.QueuedMail) {
+	ctx := context.Background()
+
+	err := ml.Send(m.Mail)
+	if err == nil {
+		app.InfoLog.Printf("mail: sent message %d to %s", m.ID, m.Mail.To)
+		err = repo.MarkMailSent(ctx, m.ID)
 		if err != nil {
-			app.ErrorLog.Println(err)
+			app.ErrorLog.Printf("mail: sent message %d but can't mark it as sent: %v", m.ID, err)
 		}
-
-		mailTemplate := string(data)
-		msgToSend := strings.Replace(mailTemplate, "[%body%]", m.Content, 1)
-		email.SetBody(mail.TextHTML, msgToSend)
+		return
 	}
 
-	err = email.Send(client)
+	if m.Attempts >= mailMaxAttempts {
+		app.ErrorLog.Printf("mail: giving up on message %d to %s after %d attempts: %v", m.ID, m.Mail.To, m.Attempts, err)
+		err = repo.MarkMailDead(ctx, m.ID, err.Error())
+	} else {
+		next := time.Now().Add(mailBackoff(m.Attempts))
+		app.InfoLog.Printf("mail: message %d to %s failed (attempt %d), retrying at %s: %v", m.ID, m.Mail.To, m.Attempts, next.Format(time.RFC3339), err)
+		err = repo.MarkMailFailed(ctx, m.ID, err.Error(), next)
+	}
 	if err != nil {
-		log.Println(err)
-		return
+		app.ErrorLog.Printf("mail: can't update message %d: %v", m.ID, err)
+	}
+}
+
+// mailBackoff returns the delay before the next attempt after the given number of failed attempts
+func mailBackoff(attempts int) time.Duration {
+	delay := mailRetryBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= mailRetryMax {
+			return mailRetryMax
+		}
 	}
 
-	log.Println("Email Send")
+	return delay
 }
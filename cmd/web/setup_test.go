@@ -1,17 +1,60 @@
 package main
 
 import (
+	"errors"
+	"github.com/alexedwards/scs/v2"
+	"github.com/ismail118/bookings-app/helpers"
+	"github.com/ismail118/bookings-app/internal/handlers"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"log"
 	"net/http"
 	"os"
+	"sync"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
+	session = scs.New()
+	app.Session = session
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+	helpers.NewHelpers(&app)
+
 	os.Exit(m.Run())
 }
 
+// testAPIToken returns the token of an api token of the testing repo by its payload
+func testAPIToken(payload string) string {
+	return tokens.Sign(app.Secret, "api-token", payload)
+}
+
 type myHandler struct {
 }
 
 func (h *myHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
+
+// captureMailer records sent messages instead of talking to an SMTP server
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []models.MailData
+	fail bool
+}
+
+func (c *captureMailer) Send(m models.MailData) error {
+	if c.fail {
+		return errors.New("smtp unavailable")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, m)
+	return nil
+}
+
+func (c *captureMailer) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"github.com/ismail118/bookings-app/internal/feedsync"
+	"time"
+)
+
+// startFeedSync imports the external booking calendars right away and then every interval, an interval
+// of 0 turns the sync off. A sync in progress is cancelled once stop is closed; the returned channel is
+// closed when the sync stopped.
+func startFeedSync(syncer *feedsync.Syncer, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	if interval <= 0 {
+		close(done)
+		return done
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			syncFeeds(ctx, syncer)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return done
+}
+
+// syncFeeds syncs every feed once, the failures are recorded on the feeds and shown in the admin dashboard
+func syncFeeds(ctx context.Context, syncer *feedsync.Syncer) {
+	failed, err := syncer.SyncAll(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println("feeds: can't sync external calendars:", err)
+		return
+	}
+	if failed > 0 {
+		app.ErrorLog.Printf("feeds: %d external calendars failed to sync", failed)
+	}
+}
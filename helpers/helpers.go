@@ -3,6 +3,7 @@ package helpers
 import (
 	"fmt"
 	"github.com/ismail118/bookings-app/internal/config"
+	"net"
 	"net/http"
 	"runtime/debug"
 )
@@ -29,3 +30,12 @@ func IsAuthenticated(r *http.Request) bool {
 	exists := app.Session.Exists(r.Context(), "user_id")
 	return exists
 }
+
+// ClientIP returns the ip address of the client without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
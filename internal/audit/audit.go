@@ -0,0 +1,94 @@
+// Package audit records who changed what. The handlers put the actor of a request in its context and
+// the repository stores an entry with the changed fields in the transaction of the change.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/models"
+	"reflect"
+	"sort"
+)
+
+// Actor is the user making a change, UserID is 0 for guests and background jobs
+type Actor struct {
+	UserID    int
+	IPAddress string
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom returns the actor in ctx, or the zero Actor when there is none
+func ActorFrom(ctx context.Context) Actor {
+	a, _ := ctx.Value(actorKey{}).(Actor)
+	return a
+}
+
+// Fields are the audited fields of an entity, the values must encode to json
+type Fields map[string]interface{}
+
+type change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff returns the json encoded changes from before to after, with the fields whose value differs.
+// before is nil for a new entity and after is nil for a deleted one.
+func Diff(before, after Fields) (string, error) {
+	changes := make(map[string]change)
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			changes[k] = change{Before: v, After: after[k]}
+		}
+	}
+	for k, v := range after {
+		if _, ok := before[k]; !ok {
+			changes[k] = change{After: v}
+		}
+	}
+
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Parse reads changes encoded by Diff, ordered by field
+func Parse(s string) ([]models.AuditChange, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var changes map[string]change
+	err := json.Unmarshal([]byte(s), &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := make([]models.AuditChange, 0, len(changes))
+	for field, c := range changes {
+		parsed = append(parsed, models.AuditChange{
+			Field:  field,
+			Before: format(c.Before),
+			After:  format(c.After),
+		})
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Field < parsed[j].Field })
+
+	return parsed, nil
+}
+
+func format(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
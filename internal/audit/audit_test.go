@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"context"
+	"testing"
+)
+
+func TestActor(t *testing.T) {
+	ctx := context.Background()
+	if a := ActorFrom(ctx); a != (Actor{}) {
+		t.Errorf("expected no actor, got %+v", a)
+	}
+
+	ctx = WithActor(ctx, Actor{UserID: 2, IPAddress: "192.0.2.1"})
+	if a := ActorFrom(ctx); a.UserID != 2 || a.IPAddress != "192.0.2.1" {
+		t.Errorf("wrong actor %+v", a)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  Fields
+		after   Fields
+		changes map[string][2]string
+	}{
+		{"created", nil, Fields{"name": "Room", "price": 12000}, map[string][2]string{"name": {"", "Room"}, "price": {"", "12000"}}},
+		{"deleted", Fields{"name": "Room"}, nil, map[string][2]string{"name": {"Room", ""}}},
+		{"updated", Fields{"name": "Room", "price": 12000}, Fields{"name": "Room", "price": 15000}, map[string][2]string{"price": {"12000", "15000"}}},
+		{"unchanged", Fields{"name": "Room"}, Fields{"name": "Room"}, map[string][2]string{}},
+	}
+
+	for _, e := range tests {
+		s, err := Diff(e.before, e.after)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		changes, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		if len(changes) != len(e.changes) {
+			t.Errorf("%s: expected %d changes, got %+v", e.name, len(e.changes), changes)
+			continue
+		}
+		for _, c := range changes {
+			want, ok := e.changes[c.Field]
+			if !ok || c.Before != want[0] || c.After != want[1] {
+				t.Errorf("%s: wrong change %+v", e.name, c)
+			}
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	s, _ := Diff(nil, Fields{"b": 1, "a": 2, "c": 3})
+	changes, _ := Parse(s)
+
+	if len(changes) != 3 || changes[0].Field != "a" || changes[2].Field != "c" {
+		t.Errorf("changes should be ordered by field, got %+v", changes)
+	}
+}
@@ -2,18 +2,41 @@ package config
 
 import (
 	"github.com/alexedwards/scs/v2"
-	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"html/template"
 	"log"
+	"time"
 )
 
 // AppConfig holds the application config
 type AppConfig struct {
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
-	MailChan      chan models.MailData
+	UseCache             bool
+	TemplateCache        map[string]*template.Template
+	MailTemplateCache    map[string]*template.Template
+	InfoLog              *log.Logger
+	ErrorLog             *log.Logger
+	InProduction         bool
+	Session              *scs.SessionManager
+	DBQueryTimeout       time.Duration
+	SMTP                 SMTPConfig
+	BaseURL              string
+	Secret               []byte
+	PersistLoginLockouts bool
+	TwoFactorAccessLevel int
+	UploadDir            string
+	Pricing              pricing.Rules // property wide currency, stay discounts, fees and taxes
+	CancelBeforeDays     int           // guests can change or cancel until this many days before arrival
+	FeedSyncInterval     time.Duration // how often external booking calendars are imported, 0 turns it off
+}
+
+// SMTPConfig holds the settings for the outgoing mail server
+type SMTPConfig struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+	From       string
+	KeepAlive  bool
+	PoolSize   int
 }
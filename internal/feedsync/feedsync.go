@@ -0,0 +1,167 @@
+package feedsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/ical"
+	"github.com/ismail118/bookings-app/internal/models"
+	"io"
+	"net/http"
+	"time"
+)
+
+// fetchTimeout is how long downloading a feed may take
+const fetchTimeout = 30 * time.Second
+
+// maxFeedBytes is the size above which a feed is rejected
+const maxFeedBytes = 5 << 20
+
+// maxUIDLength is the longest uid stored as is, longer ones are stored as their hash
+const maxUIDLength = 255
+
+// Store keeps the feeds and their external bookings
+type Store interface {
+	AllExternalFeeds(ctx context.Context) ([]models.ExternalFeed, error)
+	SyncExternalFeed(ctx context.Context, id int, bookings []models.ExternalBooking) error
+	MarkExternalFeedFailed(ctx context.Context, id int, lastError string) error
+}
+
+// Syncer imports the iCalendar feeds of other booking sites as external bookings
+type Syncer struct {
+	store  Store
+	client *http.Client
+	now    func() time.Time
+}
+
+// New returns a syncer that downloads feeds with client, a nil client uses a client with a timeout
+func New(store Store, client *http.Client) *Syncer {
+	if client == nil {
+		client = &http.Client{Timeout: fetchTimeout}
+	}
+
+	return &Syncer{
+		store:  store,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// SyncAll syncs every feed, a feed that fails doesn't stop the others. It returns the number of feeds
+// that failed.
+func (s *Syncer) SyncAll(ctx context.Context) (int, error) {
+	feeds, err := s.store.AllExternalFeeds(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, f := range feeds {
+		if ctx.Err() != nil {
+			return failed, ctx.Err()
+		}
+
+		err = s.Sync(ctx, f)
+		if err != nil {
+			failed++
+		}
+	}
+
+	return failed, nil
+}
+
+// Sync downloads the feed and replaces its external bookings. When it fails the error is recorded on
+// the feed and the bookings of the last sync are kept.
+func (s *Syncer) Sync(ctx context.Context, f models.ExternalFeed) error {
+	bookings, err := s.Fetch(ctx, f.URL)
+	if err == nil {
+		err = s.store.SyncExternalFeed(ctx, f.ID, bookings)
+	}
+	if err == nil || ctx.Err() != nil {
+		// a sync stopped by a shutdown is not a problem of the feed
+		return err
+	}
+
+	markErr := s.store.MarkExternalFeedFailed(ctx, f.ID, err.Error())
+	if markErr != nil {
+		return fmt.Errorf("%v, and can't record the failure: %w", err, markErr)
+	}
+
+	return err
+}
+
+// Fetch downloads the feed at url and returns its bookings
+func (s *Syncer) Fetch(ctx context.Context, url string) ([]models.ExternalBooking, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxFeedBytes {
+		return nil, fmt.Errorf("the feed is larger than %d bytes", maxFeedBytes)
+	}
+
+	c, err := ical.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("can't read the feed: %w", err)
+	}
+
+	return Bookings(c, s.now()), nil
+}
+
+// Bookings returns the events of c that still block the room after today. Cancelled events and events
+// without a uid or a start are left out, and of events sharing a uid the last one wins.
+func Bookings(c *ical.Calendar, today time.Time) []models.ExternalBooking {
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	var bookings []models.ExternalBooking
+	index := make(map[string]int)
+	for _, ev := range c.Events {
+		if ev.UID == "" || ev.Start.IsZero() || ev.Status == ical.StatusCancelled {
+			continue
+		}
+
+		b := models.ExternalBooking{
+			UID:       ev.UID,
+			StartDate: ev.Start,
+			EndDate:   ev.End,
+			Summary:   ev.Summary,
+		}
+		if len(b.UID) > maxUIDLength {
+			sum := sha256.Sum256([]byte(b.UID))
+			b.UID = hex.EncodeToString(sum[:])
+		}
+		if !b.EndDate.After(b.StartDate) {
+			b.EndDate = b.StartDate.AddDate(0, 0, 1)
+		}
+		if !b.EndDate.After(today) {
+			continue
+		}
+
+		if i, ok := index[b.UID]; ok {
+			bookings[i] = b
+			continue
+		}
+		index[b.UID] = len(bookings)
+		bookings = append(bookings, b)
+	}
+
+	return bookings
+}
@@ -0,0 +1,232 @@
+package feedsync
+
+import (
+	"context"
+	"errors"
+	"github.com/ismail118/bookings-app/internal/ical"
+	"github.com/ismail118/bookings-app/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFeed has a stay, a cancelled stay, a stay that is over and a stay with a date-time start
+const testFeed = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Other Site//Listing 42//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:stay-1@other.example\r\n" +
+	"DTSTART;VALUE=DATE:20500110\r\n" +
+	"DTEND;VALUE=DATE:20500113\r\n" +
+	"SUMMARY:Reserved\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:stay-2@other.example\r\n" +
+	"DTSTART;VALUE=DATE:20500120\r\n" +
+	"DTEND;VALUE=DATE:20500122\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:stay-3@other.example\r\n" +
+	"DTSTART;VALUE=DATE:20491201\r\n" +
+	"DTEND;VALUE=DATE:20491205\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:stay-4@other.example\r\n" +
+	"DTSTART:20500201T150000Z\r\n" +
+	"DTEND:20500203T110000Z\r\n" +
+	"SUMMARY:Not available\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+// memoryStore records the syncs and failures of feeds
+type memoryStore struct {
+	feeds    []models.ExternalFeed
+	bookings map[int][]models.ExternalBooking
+	failures map[int]string
+}
+
+func newMemoryStore(feeds ...models.ExternalFeed) *memoryStore {
+	return &memoryStore{
+		feeds:    feeds,
+		bookings: make(map[int][]models.ExternalBooking),
+		failures: make(map[int]string),
+	}
+}
+
+func (s *memoryStore) AllExternalFeeds(ctx context.Context) ([]models.ExternalFeed, error) {
+	return s.feeds, nil
+}
+
+func (s *memoryStore) SyncExternalFeed(ctx context.Context, id int, bookings []models.ExternalBooking) error {
+	s.bookings[id] = bookings
+	delete(s.failures, id)
+	return nil
+}
+
+func (s *memoryStore) MarkExternalFeedFailed(ctx context.Context, id int, lastError string) error {
+	s.failures[id] = lastError
+	return nil
+}
+
+// newTestSyncer returns a syncer whose today is 2050-01-05
+func newTestSyncer(store Store, client *http.Client) *Syncer {
+	s := New(store, client)
+	s.now = func() time.Time { return time.Date(2050, 1, 5, 12, 0, 0, 0, time.UTC) }
+	return s
+}
+
+func newFeedServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/listing.ics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ical.ContentType)
+		_, _ = w.Write([]byte(testFeed))
+	})
+	mux.HandleFunc("/broken.ics", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>maintenance</html>"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func testDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	srv := newFeedServer()
+	defer srv.Close()
+
+	store := newMemoryStore()
+	s := newTestSyncer(store, srv.Client())
+
+	err := s.Sync(context.Background(), models.ExternalFeed{ID: 1, URL: srv.URL + "/listing.ics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []models.ExternalBooking{
+		{UID: "stay-1@other.example", StartDate: testDate(2050, 1, 10), EndDate: testDate(2050, 1, 13), Summary: "Reserved"},
+		{UID: "stay-4@other.example", StartDate: testDate(2050, 2, 1), EndDate: testDate(2050, 2, 3), Summary: "Not available"},
+	}
+	got := store.bookings[1]
+	if len(got) != len(want) {
+		t.Fatalf("expected %d bookings, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("booking %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSyncer_SyncFailures(t *testing.T) {
+	srv := newFeedServer()
+	defer srv.Close()
+
+	var tests = []struct {
+		name    string
+		url     string
+		wantErr string
+	}{
+		{"not found", srv.URL + "/missing.ics", "unexpected status 404 Not Found"},
+		{"not a calendar", srv.URL + "/broken.ics", "can't read the feed: not an icalendar stream"},
+		{"invalid url", "://nowhere", "missing protocol scheme"},
+	}
+
+	for _, e := range tests {
+		store := newMemoryStore()
+		store.bookings[1] = []models.ExternalBooking{{UID: "kept"}}
+		s := newTestSyncer(store, srv.Client())
+
+		err := s.Sync(context.Background(), models.ExternalFeed{ID: 1, URL: e.url})
+		if err == nil || !strings.Contains(err.Error(), e.wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", e.name, e.wantErr, err)
+		}
+		if !strings.Contains(store.failures[1], e.wantErr) {
+			t.Errorf("%s: expected failure %q to be recorded, got %q", e.name, e.wantErr, store.failures[1])
+		}
+		if len(store.bookings[1]) != 1 {
+			t.Errorf("%s: bookings of the last sync should be kept, got %+v", e.name, store.bookings[1])
+		}
+	}
+}
+
+func TestSyncer_SyncAll(t *testing.T) {
+	srv := newFeedServer()
+	defer srv.Close()
+
+	store := newMemoryStore(
+		models.ExternalFeed{ID: 1, URL: srv.URL + "/missing.ics"},
+		models.ExternalFeed{ID: 2, URL: srv.URL + "/listing.ics"},
+	)
+	s := newTestSyncer(store, srv.Client())
+
+	failed, err := s.SyncAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 {
+		t.Errorf("expected 1 failed feed, got %d", failed)
+	}
+	if store.failures[1] == "" {
+		t.Error("expected the failure of feed 1 to be recorded")
+	}
+	if len(store.bookings[2]) != 2 {
+		t.Errorf("a failing feed should not stop the others, got %+v", store.bookings[2])
+	}
+}
+
+func TestSyncer_SyncCancelled(t *testing.T) {
+	srv := newFeedServer()
+	defer srv.Close()
+
+	store := newMemoryStore(models.ExternalFeed{ID: 1, URL: srv.URL + "/listing.ics"})
+	s := newTestSyncer(store, srv.Client())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.SyncAll(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(store.failures) > 0 {
+		t.Errorf("a cancelled sync should not be recorded as a failure, got %v", store.failures)
+	}
+}
+
+func TestBookings(t *testing.T) {
+	longUID := strings.Repeat("x", 300)
+	c := &ical.Calendar{
+		Events: []ical.Event{
+			{UID: "a", Start: testDate(2050, 1, 10), End: testDate(2050, 1, 12), Summary: "first"},
+			{UID: "", Start: testDate(2050, 1, 10), End: testDate(2050, 1, 12)},
+			{UID: "b", Start: testDate(2050, 1, 15), End: testDate(2050, 1, 15)},
+			{UID: "a", Start: testDate(2050, 1, 11), End: testDate(2050, 1, 14), Summary: "moved"},
+			{UID: "c", Start: testDate(2050, 1, 1), End: testDate(2050, 1, 5)},
+			{UID: "d", Start: testDate(2050, 1, 1), End: testDate(2050, 1, 6)},
+			{UID: longUID, Start: testDate(2050, 1, 20), End: testDate(2050, 1, 21)},
+		},
+	}
+
+	got := Bookings(c, time.Date(2050, 1, 5, 23, 0, 0, 0, time.UTC))
+
+	want := []models.ExternalBooking{
+		{UID: "a", StartDate: testDate(2050, 1, 11), EndDate: testDate(2050, 1, 14), Summary: "moved"},
+		{UID: "b", StartDate: testDate(2050, 1, 15), EndDate: testDate(2050, 1, 16)},
+		{UID: "d", StartDate: testDate(2050, 1, 1), EndDate: testDate(2050, 1, 6)},
+	}
+	if len(got) != len(want)+1 {
+		t.Fatalf("expected %d bookings, got %+v", len(want)+1, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("booking %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	if uid := got[len(want)].UID; len(uid) > maxUIDLength || uid == longUID {
+		t.Errorf("expected a long uid to be hashed, got %q", uid)
+	}
+}
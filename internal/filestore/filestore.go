@@ -0,0 +1,172 @@
+// Package filestore stores uploaded files behind an interface, so the local disk
+// can be swapped for another storage backend
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidName is returned for names that are empty or point outside the store
+var ErrInvalidName = errors.New("invalid file name")
+
+// FileStore saves and removes files by name and tells where they are served from
+type FileStore interface {
+	Save(ctx context.Context, name string, r io.Reader) error
+	Delete(ctx context.Context, name string) error
+	URL(name string) string
+}
+
+// cleanName checks that name is a relative slash separated path inside the store
+func cleanName(name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != name || strings.Contains(name, "\\") {
+		return "", ErrInvalidName
+	}
+
+	return clean, nil
+}
+
+// Local stores files in a directory on disk
+type Local struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocal creates a store for dir whose files are served under baseURL
+func NewLocal(dir, baseURL string) *Local {
+	return &Local{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Save writes r to name, creating the parent directories when needed
+func (l *Local) Save(ctx context.Context, name string, r io.Reader) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p := filepath.Join(l.dir, filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a failed upload never leaves half a file behind
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// Delete removes name, a file that is already gone is not an error
+func (l *Local) Delete(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(l.dir, filepath.FromSlash(name)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// URL returns the public url of name
+func (l *Local) URL(name string) string {
+	return l.baseURL + "/" + name
+}
+
+// Memory keeps files in memory, it is used in tests
+type Memory struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemory creates an empty in memory store
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string][]byte)}
+}
+
+// Save stores the content of r under name
+func (m *Memory) Save(ctx context.Context, name string, r io.Reader) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = b
+
+	return nil
+}
+
+// Delete removes name
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+
+	return nil
+}
+
+// URL returns the url of name under /uploads
+func (m *Memory) URL(name string) string {
+	return "/uploads/" + name
+}
+
+// Names returns the names of all stored files
+func (m *Memory) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,80 @@
+package filestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal_SaveAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocal(dir, "/uploads/")
+	ctx := context.Background()
+
+	err := store.Save(ctx, "rooms/1/photo.jpg", strings.NewReader("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "rooms", "1", "photo.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "image" {
+		t.Errorf("wrong content, got %q", b)
+	}
+
+	if url := store.URL("rooms/1/photo.jpg"); url != "/uploads/rooms/1/photo.jpg" {
+		t.Errorf("wrong url, got %s", url)
+	}
+
+	err = store.Delete(ctx, "rooms/1/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rooms", "1", "photo.jpg")); !os.IsNotExist(err) {
+		t.Error("file should be removed")
+	}
+
+	err = store.Delete(ctx, "rooms/1/photo.jpg")
+	if err != nil {
+		t.Errorf("deleting a missing file should not fail, got %v", err)
+	}
+}
+
+func TestLocal_InvalidName(t *testing.T) {
+	store := NewLocal(t.TempDir(), "/uploads")
+	ctx := context.Background()
+
+	for _, name := range []string{"", "../secret", "rooms/../../secret", "/etc/passwd", "rooms\\1.jpg", "rooms/"} {
+		if err := store.Save(ctx, name, strings.NewReader("x")); err != ErrInvalidName {
+			t.Errorf("save %q: expected ErrInvalidName, got %v", name, err)
+		}
+		if err := store.Delete(ctx, name); err != ErrInvalidName {
+			t.Errorf("delete %q: expected ErrInvalidName, got %v", name, err)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store := NewMemory()
+	ctx := context.Background()
+
+	err := store.Save(ctx, "a.jpg", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := store.Names(); len(names) != 1 || names[0] != "a.jpg" {
+		t.Errorf("wrong names %v", names)
+	}
+
+	err = store.Delete(ctx, "a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := store.Names(); len(names) != 0 {
+		t.Errorf("expected no files, got %v", names)
+	}
+}
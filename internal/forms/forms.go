@@ -1,12 +1,19 @@
 package forms
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/asaskevich/govalidator"
+	"io"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
 type Form struct {
 	Data   url.Values
 	Errors errors
@@ -29,6 +36,36 @@ func New(data url.Values) *Form {
 	}
 }
 
+// FromJSON reads a flat json object into a form. Numbers and booleans become their text, so the
+// same validators work for json request bodies and posted forms.
+func FromJSON(r io.Reader) (*Form, error) {
+	var body map[string]interface{}
+
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	err := d.Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	data := url.Values{}
+	for field, v := range body {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			data.Set(field, v)
+		case json.Number:
+			data.Set(field, v.String())
+		case bool:
+			data.Set(field, strconv.FormatBool(v))
+		default:
+			return nil, fmt.Errorf("field %s must be a string, a number or a boolean", field)
+		}
+	}
+
+	return New(data), nil
+}
+
 // Required validate given multiple fields
 func (f *Form) Required(fields ...string) {
 	for _, field := range fields {
@@ -69,3 +106,49 @@ func (f *Form) IsEmail(field string) bool {
 
 	return true
 }
+
+// IsSlug checks that the field only has lowercase letters and digits separated by single dashes
+func (f *Form) IsSlug(field string) bool {
+	if !slugPattern.MatchString(f.Data.Get(field)) {
+		f.Errors.Add(field, "Use lowercase letters, digits and dashes only")
+		return false
+	}
+
+	return true
+}
+
+// IsDate checks that the field is a date in layout, blank fields are left to Required
+func (f *Form) IsDate(field, layout string) bool {
+	x := f.Data.Get(field)
+	if x == "" {
+		return true
+	}
+
+	_, err := time.Parse(layout, x)
+	if err != nil {
+		f.Errors.Add(field, fmt.Sprintf("Invalid date, use the format %s", layout))
+		return false
+	}
+
+	return true
+}
+
+// IsInt checks that the field is a whole number of at least min, blank fields are left to Required
+func (f *Form) IsInt(field string, min int) bool {
+	x := f.Data.Get(field)
+	if x == "" {
+		return true
+	}
+
+	n, err := strconv.Atoi(x)
+	if err != nil {
+		f.Errors.Add(field, "This field must be a whole number")
+		return false
+	}
+	if n < min {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at least %d", min))
+		return false
+	}
+
+	return true
+}
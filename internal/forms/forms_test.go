@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -111,3 +112,79 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("got valid when should invalid")
 	}
 }
+
+func TestForm_IsSlug(t *testing.T) {
+	tests := []struct {
+		slug  string
+		valid bool
+	}{
+		{"room-one", true},
+		{"suite2", true},
+		{"Room-One", false},
+		{"room--one", false},
+		{"-room", false},
+		{"room one", false},
+		{"", false},
+	}
+
+	for _, e := range tests {
+		formData := url.Values{}
+		formData.Add("a", e.slug)
+
+		f := New(formData)
+		f.IsSlug("a")
+
+		if f.Valid() != e.valid {
+			t.Errorf("slug %q: expected valid %v but got %v", e.slug, e.valid, f.Valid())
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	f, err := FromJSON(strings.NewReader(`{"name": "Room", "capacity": 4, "active": true, "note": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Data.Get("name") != "Room" || f.Data.Get("capacity") != "4" || f.Data.Get("active") != "true" {
+		t.Errorf("wrong form data %v", f.Data)
+	}
+	if f.Data.Has("note") {
+		t.Error("null fields should be left out")
+	}
+
+	for _, body := range []string{`{"name": `, `{"tags": ["a"]}`, `[1, 2]`} {
+		_, err = FromJSON(strings.NewReader(body))
+		if err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestForm_IsDate(t *testing.T) {
+	f := New(url.Values{"a": {"2050-01-02"}, "b": {"02/01/2050"}})
+
+	if !f.IsDate("a", "2006-01-02") {
+		t.Error("got invalid when should valid")
+	}
+	if !f.IsDate("c", "2006-01-02") {
+		t.Error("blank field should be left to Required")
+	}
+	if f.IsDate("b", "2006-01-02") || f.Errors.Get("b") == "" {
+		t.Error("got valid when should invalid")
+	}
+}
+
+func TestForm_IsInt(t *testing.T) {
+	f := New(url.Values{"a": {"3"}, "b": {"three"}, "c": {"0"}})
+
+	if !f.IsInt("a", 1) {
+		t.Error("got invalid when should valid")
+	}
+	if f.IsInt("b", 1) {
+		t.Error("got valid for text")
+	}
+	if f.IsInt("c", 1) || f.Errors.Get("c") != "This field must be at least 1" {
+		t.Errorf("got valid below the minimum, error %q", f.Errors.Get("c"))
+	}
+}
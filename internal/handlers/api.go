@@ -0,0 +1,598 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/ismail118/bookings-app/internal/forms"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/stayrules"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiDateLayout is the format of the dates in api requests and responses
+const apiDateLayout = "2006-01-02"
+
+// api pagination defaults, per_page can't go above apiMaxPerPage
+const (
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+)
+
+// api error codes, clients can rely on them while the messages may change
+const (
+	apiErrInvalidJSON       = "invalid_json"
+	apiErrValidation        = "validation_failed"
+	apiErrNotFound          = "not_found"
+	apiErrRoomNotAvailable  = "room_not_available"
+	apiErrStayRule          = "stay_rule_violation"
+	apiErrCannotCancel      = "cannot_cancel"
+	apiErrInternal          = "internal_error"
+	apiErrMethodNotAllowed  = "method_not_allowed"
+	apiErrUnsupportedFormat = "unsupported_media_type"
+)
+
+// apiTokenPurpose binds api tokens to the api, so they can't be used as other signed tokens
+const apiTokenPurpose = "api-token"
+
+// apiEnvelope wraps every successful api response, Meta is set for paginated lists
+type apiEnvelope struct {
+	Data interface{} `json:"data"`
+	Meta *apiMeta    `json:"meta,omitempty"`
+}
+
+// apiMeta describes the page of a paginated list
+type apiMeta struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// apiErrorEnvelope wraps every failed api response
+type apiErrorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+// apiError tells what went wrong, Fields has the validation errors by field
+type apiError struct {
+	Status  int                 `json:"status"`
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+}
+
+type apiRoom struct {
+	ID           int            `json:"id"`
+	Name         string         `json:"name"`
+	Slug         string         `json:"slug"`
+	Description  string         `json:"description"`
+	Capacity     int            `json:"capacity"`
+	Amenities    []string       `json:"amenities"`
+	BasePrice    int            `json:"base_price"`
+	WeekendPrice int            `json:"weekend_price"`
+	Photos       []apiRoomPhoto `json:"photos"`
+}
+
+type apiRoomPhoto struct {
+	URL       string `json:"url"`
+	MediumURL string `json:"medium_url"`
+	ThumbURL  string `json:"thumb_url"`
+	IsCover   bool   `json:"is_cover"`
+}
+
+type apiQuote struct {
+	Currency string         `json:"currency"`
+	Nights   int            `json:"nights"`
+	Total    int            `json:"total"`
+	Lines    []pricing.Line `json:"lines"`
+}
+
+type apiAvailableRoom struct {
+	Room  apiRoom  `json:"room"`
+	Quote apiQuote `json:"quote"`
+}
+
+type apiAvailability struct {
+	StartDate string             `json:"start_date"`
+	EndDate   string             `json:"end_date"`
+	Rooms     []apiAvailableRoom `json:"rooms"`
+	Reasons   []string           `json:"reasons"`
+}
+
+type apiReservation struct {
+	ID               int            `json:"id"`
+	ConfirmationCode string         `json:"confirmation_code"`
+	Status           string         `json:"status"`
+	FirstName        string         `json:"first_name"`
+	LastName         string         `json:"last_name"`
+	Email            string         `json:"email"`
+	Phone            string         `json:"phone"`
+	RoomID           int            `json:"room_id"`
+	RoomName         string         `json:"room_name"`
+	StartDate        string         `json:"start_date"`
+	EndDate          string         `json:"end_date"`
+	Total            int            `json:"total"`
+	Currency         string         `json:"currency"`
+	PriceLines       []pricing.Line `json:"price_lines"`
+	CanCancel        bool           `json:"can_cancel"`
+}
+
+func newAPIRoom(room models.Room) apiRoom {
+	out := apiRoom{
+		ID:           room.ID,
+		Name:         room.RoomName,
+		Slug:         room.Slug,
+		Description:  room.Description,
+		Capacity:     room.Capacity,
+		Amenities:    room.Amenities,
+		BasePrice:    room.BasePrice,
+		WeekendPrice: room.WeekendPrice,
+		Photos:       []apiRoomPhoto{},
+	}
+	if out.Amenities == nil {
+		out.Amenities = []string{}
+	}
+
+	for _, p := range room.Photos {
+		out.Photos = append(out.Photos, apiRoomPhoto{
+			URL:       p.URL,
+			MediumURL: p.MediumURL,
+			ThumbURL:  p.ThumbURL,
+			IsCover:   p.IsCover,
+		})
+	}
+
+	return out
+}
+
+func newAPIQuote(q pricing.Quote) apiQuote {
+	out := apiQuote{Currency: q.Currency, Nights: q.Nights, Total: q.Total, Lines: q.Lines}
+	if out.Lines == nil {
+		out.Lines = []pricing.Line{}
+	}
+	return out
+}
+
+func (m *Repository) newAPIReservation(res models.Reservation) apiReservation {
+	out := apiReservation{
+		ID:               res.ID,
+		ConfirmationCode: res.ConfirmationCode,
+		Status:           res.Status,
+		FirstName:        res.FirstName,
+		LastName:         res.LastName,
+		Email:            res.Email,
+		Phone:            res.PhoneNumber,
+		RoomID:           res.RoomID,
+		RoomName:         res.Room.RoomName,
+		StartDate:        res.StartDate.Format(apiDateLayout),
+		EndDate:          res.EndDate.Format(apiDateLayout),
+		Total:            res.Total,
+		Currency:         res.Currency,
+		PriceLines:       res.PriceLines,
+		CanCancel:        m.canChangeReservation(res),
+	}
+	if out.PriceLines == nil {
+		out.PriceLines = []pricing.Line{}
+	}
+	return out
+}
+
+// writeJSON sends v as the json body of a response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// WriteAPIError sends an api error response, the middleware uses it for requests that don't reach a handler
+func WriteAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorEnvelope{Error: apiError{Status: status, Code: code, Message: message}})
+}
+
+// AuthenticateAPIToken returns the api token for token, the value of a Bearer authorization header.
+// It returns tokens.ErrInvalid when the token wasn't created by us or was revoked.
+func (m *Repository) AuthenticateAPIToken(ctx context.Context, token string) (models.APIToken, error) {
+	if tokens.Verify(m.App.Secret, apiTokenPurpose, token) != nil {
+		return models.APIToken{}, tokens.ErrInvalid
+	}
+
+	t, err := m.DB.GetAPITokenByHash(ctx, tokens.Hash(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, tokens.ErrInvalid
+	} else if err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// writeAPIValidationError sends the errors of an invalid form
+func writeAPIValidationError(w http.ResponseWriter, form *forms.Form) {
+	writeJSON(w, http.StatusUnprocessableEntity, apiErrorEnvelope{Error: apiError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    apiErrValidation,
+		Message: "The request has invalid fields",
+		Fields:  form.Errors,
+	}})
+}
+
+// writeAPIServerError logs err and sends a generic error, the details stay in the log
+func (m *Repository) writeAPIServerError(w http.ResponseWriter, message string, err error) {
+	m.App.ErrorLog.Printf("api: %s: %v", message, err)
+	WriteAPIError(w, http.StatusInternalServerError, apiErrInternal, message)
+}
+
+// readAPIForm reads the json body of r into a form, it sends the error response and returns false
+// when the body can't be read
+func readAPIForm(w http.ResponseWriter, r *http.Request) (*forms.Form, bool) {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		WriteAPIError(w, http.StatusUnsupportedMediaType, apiErrUnsupportedFormat, "The request body must be json")
+		return nil, false
+	}
+
+	form, err := forms.FromJSON(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		WriteAPIError(w, http.StatusBadRequest, apiErrInvalidJSON, "The request body is not a valid json object: "+err.Error())
+		return nil, false
+	}
+
+	return form, true
+}
+
+// apiPage reads the page and per_page query parameters, it sends the error response and returns false
+// when they are invalid
+func apiPage(w http.ResponseWriter, r *http.Request) (page, perPage int, ok bool) {
+	form := forms.New(r.URL.Query())
+	form.IsInt("page", 1)
+	form.IsInt("per_page", 1)
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return 0, 0, false
+	}
+
+	page, perPage = 1, apiDefaultPerPage
+	if form.Data.Get("page") != "" {
+		page, _ = strconv.Atoi(form.Data.Get("page"))
+	}
+	if form.Data.Get("per_page") != "" {
+		perPage, _ = strconv.Atoi(form.Data.Get("per_page"))
+	}
+	if perPage > apiMaxPerPage {
+		perPage = apiMaxPerPage
+	}
+
+	return page, perPage, true
+}
+
+// paginate returns the bounds of a page in a list of total items, pages after the last one are empty
+func paginate(total, page, perPage int) (from, to int) {
+	// checked before multiplying, so a huge page can't overflow
+	if page-1 >= (total+perPage-1)/perPage {
+		return total, total
+	}
+
+	from = (page - 1) * perPage
+	if from > total {
+		from = total
+	}
+	to = from + perPage
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+// apiPathID returns the path segment after prefix, like the id in /api/v1/rooms/{id}
+func apiPathID(r *http.Request, prefix string) string {
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	return strings.Split(rest, "/")[0]
+}
+
+// APINotFound answers unknown api routes
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	WriteAPIError(w, http.StatusNotFound, apiErrNotFound, "There is no such api endpoint")
+}
+
+// APIMethodNotAllowed answers api routes called with the wrong method
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteAPIError(w, http.StatusMethodNotAllowed, apiErrMethodNotAllowed, "The endpoint doesn't support "+r.Method)
+}
+
+// APIRooms lists the rooms by name
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := apiPage(w, r)
+	if !ok {
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.writeAPIServerError(w, "can't get rooms", err)
+		return
+	}
+
+	from, to := paginate(len(rooms), page, perPage)
+	out := make([]apiRoom, 0, to-from)
+	for _, room := range rooms[from:to] {
+		out = append(out, newAPIRoom(room))
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{
+		Data: out,
+		Meta: &apiMeta{Page: page, PerPage: perPage, Total: len(rooms)},
+	})
+}
+
+// APIRoom shows a room by id
+func (m *Repository) APIRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(apiPathID(r, "/api/v1/rooms/"))
+	if err != nil || roomID < 1 {
+		WriteAPIError(w, http.StatusNotFound, apiErrNotFound, "Room not found")
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteAPIError(w, http.StatusNotFound, apiErrNotFound, "Room not found")
+		return
+	}
+	if err != nil {
+		m.writeAPIServerError(w, "can't get room", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{Data: newAPIRoom(room)})
+}
+
+// APIAvailability lists the rooms free from start_date up to end_date with their price, room_id limits
+// the search to one room. Reasons explains an empty list when stay rules are in the way.
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+	form.Required("start_date", "end_date")
+	form.IsDate("start_date", apiDateLayout)
+	form.IsDate("end_date", apiDateLayout)
+	form.IsInt("room_id", 1)
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	startDate, _ := time.Parse(apiDateLayout, form.Data.Get("start_date"))
+	endDate, _ := time.Parse(apiDateLayout, form.Data.Get("end_date"))
+	roomID, _ := strconv.Atoi(form.Data.Get("room_id"))
+
+	err := stayrules.ValidateDates(startDate, endDate, stayrules.Today())
+	if err != nil {
+		WriteAPIError(w, http.StatusUnprocessableEntity, apiErrValidation, err.Error())
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
+	if err != nil {
+		m.writeAPIServerError(w, "can't search availability", err)
+		return
+	}
+
+	out := apiAvailability{
+		StartDate: startDate.Format(apiDateLayout),
+		EndDate:   endDate.Format(apiDateLayout),
+		Rooms:     []apiAvailableRoom{},
+		Reasons:   []string{},
+	}
+
+	for _, room := range rooms {
+		if roomID != 0 && room.ID != roomID {
+			continue
+		}
+
+		q, err := m.quote(r.Context(), room, startDate, endDate)
+		if err != nil {
+			m.writeAPIServerError(w, "can't calculate price", err)
+			return
+		}
+		out.Rooms = append(out.Rooms, apiAvailableRoom{Room: newAPIRoom(room), Quote: newAPIQuote(q)})
+	}
+
+	if len(out.Rooms) == 0 {
+		reasons, err := m.stayRuleReasons(r.Context(), roomID, startDate, endDate)
+		if err == nil {
+			out.Reasons = append(out.Reasons, reasons...)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{Data: out})
+}
+
+// APIPostReservation books a room for a guest like the make reservation form and sends the same mails
+func (m *Repository) APIPostReservation(w http.ResponseWriter, r *http.Request) {
+	form, ok := readAPIForm(w, r)
+	if !ok {
+		return
+	}
+
+	form.Required("room_id", "start_date", "end_date", "first_name", "last_name", "email", "phone")
+	form.IsInt("room_id", 1)
+	form.IsDate("start_date", apiDateLayout)
+	form.IsDate("end_date", apiDateLayout)
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(form.Data.Get("room_id"))
+	startDate, _ := time.Parse(apiDateLayout, form.Data.Get("start_date"))
+	endDate, _ := time.Parse(apiDateLayout, form.Data.Get("end_date"))
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("room_id", "There is no such room")
+		writeAPIValidationError(w, form)
+		return
+	}
+	if err != nil {
+		m.writeAPIServerError(w, "can't get room", err)
+		return
+	}
+
+	reasons, err := m.stayRuleReasons(r.Context(), roomID, startDate, endDate)
+	if err != nil {
+		m.writeAPIServerError(w, "can't check stay rules", err)
+		return
+	}
+	if len(reasons) > 0 {
+		WriteAPIError(w, http.StatusUnprocessableEntity, apiErrStayRule, reasons[0])
+		return
+	}
+
+	q, err := m.quote(r.Context(), room, startDate, endDate)
+	if err != nil {
+		m.writeAPIServerError(w, "can't calculate price", err)
+		return
+	}
+
+	reservation := models.Reservation{
+		FirstName:   form.Data.Get("first_name"),
+		LastName:    form.Data.Get("last_name"),
+		Email:       form.Data.Get("email"),
+		PhoneNumber: form.Data.Get("phone"),
+		StartDate:   startDate,
+		EndDate:     endDate,
+		RoomID:      roomID,
+		Room:        room,
+		Total:       q.Total,
+		Currency:    q.Currency,
+		PriceLines:  q.Lines,
+	}
+
+	err = m.book(r.Context(), &reservation)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		WriteAPIError(w, http.StatusConflict, apiErrRoomNotAvailable, "The room is not available for these dates")
+		return
+	}
+	if err != nil {
+		m.writeAPIServerError(w, "can't book reservation", err)
+		return
+	}
+
+	m.queueBookingMails(r, reservation)
+
+	w.Header().Set("Location", "/api/v1/reservations/"+reservation.ConfirmationCode)
+	writeJSON(w, http.StatusCreated, apiEnvelope{Data: m.newAPIReservation(reservation)})
+}
+
+// guestReservation returns the reservation with the code in the path when email is the guest's. It sends
+// the same not found error for an unknown code and a wrong email, like the manage booking form.
+func (m *Repository) guestReservation(w http.ResponseWriter, r *http.Request, email string) (models.Reservation, bool) {
+	code := strings.ToUpper(apiPathID(r, "/api/v1/reservations/"))
+
+	res, err := m.DB.GetReservationByCode(r.Context(), code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.writeAPIServerError(w, "can't get reservation", err)
+		return res, false
+	}
+	if err != nil || !strings.EqualFold(res.Email, strings.TrimSpace(email)) {
+		WriteAPIError(w, http.StatusNotFound, apiErrNotFound, "We couldn't find a booking with this code and email")
+		return res, false
+	}
+
+	return res, true
+}
+
+// APIReservation shows a reservation to its guest, the email query parameter must match the booking
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+	form.Required("email")
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	res, ok := m.guestReservation(w, r, form.Data.Get("email"))
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{Data: m.newAPIReservation(res)})
+}
+
+// APICancelReservation cancels a reservation for its guest while the cancellation policy allows it,
+// the email in the body must match the booking
+func (m *Repository) APICancelReservation(w http.ResponseWriter, r *http.Request) {
+	form, ok := readAPIForm(w, r)
+	if !ok {
+		return
+	}
+
+	form.Required("email")
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	res, ok := m.guestReservation(w, r, form.Data.Get("email"))
+	if !ok {
+		return
+	}
+
+	if !m.canChangeReservation(res) {
+		WriteAPIError(w, http.StatusConflict, apiErrCannotCancel, "This reservation can no longer be cancelled")
+		return
+	}
+
+	err := m.DB.UpdateReservationStatus(r.Context(), res.ID, models.ReservationCancelled)
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		WriteAPIError(w, http.StatusConflict, apiErrCannotCancel, "This reservation can no longer be cancelled")
+		return
+	}
+	if err != nil {
+		m.writeAPIServerError(w, "can't cancel reservation", err)
+		return
+	}
+
+	m.queueCancellationMails(r, res)
+
+	res.Status = models.ReservationCancelled
+	writeJSON(w, http.StatusOK, apiEnvelope{Data: m.newAPIReservation(res)})
+}
+
+// APIAdminReservations lists the reservations by arrival for the staff, status filters them
+func (m *Repository) APIAdminReservations(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := apiPage(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !models.IsReservationStatus(status) {
+		form := forms.New(r.URL.Query())
+		form.Errors.Add("status", "Unknown reservation status")
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	reservations, err := m.DB.AllReservations(r.Context(), status)
+	if err != nil {
+		m.writeAPIServerError(w, "can't get reservations", err)
+		return
+	}
+
+	from, to := paginate(len(reservations), page, perPage)
+	out := make([]apiReservation, 0, to-from)
+	for _, res := range reservations[from:to] {
+		out = append(out, m.newAPIReservation(res))
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{
+		Data: out,
+		Meta: &apiMeta{Page: page, PerPage: perPage, Total: len(reservations)},
+	})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testAPI = []struct {
+	name           string
+	method         string
+	url            string
+	contentType    string
+	body           string
+	expectedStatus int
+	expectedCode   string
+	expectedData   string
+}{
+	{"rooms", "GET", "/api/v1/rooms", "", "", http.StatusOK, "", `"name":"room test"`},
+	{"rooms-empty-page", "GET", "/api/v1/rooms?page=2", "", "", http.StatusOK, "", `"data":[],"meta":{"page":2,"per_page":20,"total":1}`},
+	{"rooms-huge-page", "GET", "/api/v1/rooms?page=9223372036854775807&per_page=100", "", "", http.StatusOK, "", `"data":[],"meta":{"page":9223372036854775807,"per_page":100,"total":1}`},
+	{"rooms-invalid-page", "GET", "/api/v1/rooms?per_page=many", "", "", http.StatusUnprocessableEntity, "validation_failed", `"per_page":["This field must be a whole number"]`},
+	{"room", "GET", "/api/v1/rooms/2", "", "", http.StatusOK, "", `"id":2`},
+	{"room-not-found", "GET", "/api/v1/rooms/3", "", "", http.StatusNotFound, "not_found", ""},
+	{"room-invalid-id", "GET", "/api/v1/rooms/abc", "", "", http.StatusNotFound, "not_found", ""},
+
+	{"availability", "GET", "/api/v1/availability?start_date=2050-01-01&end_date=2050-01-02", "", "", http.StatusOK, "", `"rooms":[{"room":{"id":0`},
+	{"availability-other-room", "GET", "/api/v1/availability?start_date=2050-01-01&end_date=2050-01-02&room_id=1", "", "", http.StatusOK, "", `"rooms":[],"reasons":[]`},
+	{"availability-stay-rules", "GET", "/api/v1/availability?start_date=2050-03-01&end_date=2050-03-02", "", "", http.StatusOK, "", `"reasons":["A minimum stay of 3 nights applies to arrivals on 2050-03-01","Arrivals are not possible on 2050-03-01"]`},
+	{"availability-missing-dates", "GET", "/api/v1/availability?start_date=2050-01-01", "", "", http.StatusUnprocessableEntity, "validation_failed", `"end_date":["This field cannot be blank"]`},
+	{"availability-invalid-date", "GET", "/api/v1/availability?start_date=01/01/2050&end_date=2050-01-02", "", "", http.StatusUnprocessableEntity, "validation_failed", `"start_date":["Invalid date, use the format 2006-01-02"]`},
+	{"availability-past", "GET", "/api/v1/availability?start_date=2000-01-01&end_date=2000-01-02", "", "", http.StatusUnprocessableEntity, "validation_failed", `"message":"The arrival date can't be in the past"`},
+	{"availability-db-error", "GET", "/api/v1/availability?start_date=2050-01-02&end_date=2050-01-03", "", "", http.StatusInternalServerError, "internal_error", ""},
+
+	{"create", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": 1, "start_date": "2050-01-01", "end_date": "2050-01-03", "first_name": "John", "last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`,
+		http.StatusCreated, "", `"status":"pending"`},
+	{"create-unknown-room", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": 3, "start_date": "2050-01-01", "end_date": "2050-01-03", "first_name": "John", "last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`,
+		http.StatusUnprocessableEntity, "validation_failed", `"room_id":["There is no such room"]`},
+	{"create-taken", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": 1, "start_date": "2050-01-15", "end_date": "2050-01-17", "first_name": "John", "last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`,
+		http.StatusConflict, "room_not_available", ""},
+	{"create-stay-rule", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": 1, "start_date": "2050-03-01", "end_date": "2050-03-02", "first_name": "John", "last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`,
+		http.StatusUnprocessableEntity, "stay_rule_violation", `"message":"A minimum stay of 3 nights applies to arrivals on 2050-03-01"`},
+	{"create-db-error", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": 2, "start_date": "2050-01-01", "end_date": "2050-01-03", "first_name": "John", "last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`,
+		http.StatusInternalServerError, "internal_error", ""},
+	{"create-invalid-fields", "POST", "/api/v1/reservations", "application/json",
+		`{"room_id": "one", "start_date": "2050-01-01", "first_name": "Jo", "email": "john"}`,
+		http.StatusUnprocessableEntity, "validation_failed", `"room_id":["This field must be a whole number"]`},
+	{"create-invalid-json", "POST", "/api/v1/reservations", "application/json", `{"room_id": `, http.StatusBadRequest, "invalid_json", ""},
+	{"create-form-body", "POST", "/api/v1/reservations", "application/x-www-form-urlencoded", `room_id=1`, http.StatusUnsupportedMediaType, "unsupported_media_type", ""},
+
+	{"reservation", "GET", "/api/v1/reservations/abcd2345?email=Guest@here.com", "", "", http.StatusOK, "", `"confirmation_code":"ABCD2345"`},
+	{"reservation-wrong-email", "GET", "/api/v1/reservations/ABCD2345?email=other@here.com", "", "", http.StatusNotFound, "not_found", ""},
+	{"reservation-unknown-code", "GET", "/api/v1/reservations/ZZZZ9999?email=guest@here.com", "", "", http.StatusNotFound, "not_found", ""},
+	{"reservation-missing-email", "GET", "/api/v1/reservations/ABCD2345", "", "", http.StatusUnprocessableEntity, "validation_failed", ""},
+
+	{"cancel", "POST", "/api/v1/reservations/ABCD2345/cancel", "application/json", `{"email": "guest@here.com"}`, http.StatusOK, "", `"status":"cancelled"`},
+	{"cancel-too-late", "POST", "/api/v1/reservations/SOON2345/cancel", "application/json", `{"email": "guest@here.com"}`, http.StatusConflict, "cannot_cancel", ""},
+	{"cancel-cancelled", "POST", "/api/v1/reservations/GONE2345/cancel", "application/json", `{"email": "guest@here.com"}`, http.StatusConflict, "cannot_cancel", ""},
+	{"cancel-wrong-email", "POST", "/api/v1/reservations/ABCD2345/cancel", "application/json", `{"email": "other@here.com"}`, http.StatusNotFound, "not_found", ""},
+
+	{"admin-reservations", "GET", "/api/v1/admin/reservations?status=pending", "", "", http.StatusOK, "", `"data":[],"meta":{"page":1,"per_page":20,"total":0}`},
+	{"admin-reservations-unknown-status", "GET", "/api/v1/admin/reservations?status=paid", "", "", http.StatusUnprocessableEntity, "validation_failed", `"status":["Unknown reservation status"]`},
+
+	{"unknown-endpoint", "GET", "/api/v1/invoices", "", "", http.StatusNotFound, "not_found", ""},
+	{"wrong-method", "DELETE", "/api/v1/rooms", "", "", http.StatusMethodNotAllowed, "method_not_allowed", ""},
+}
+
+func TestAPI(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range testAPI {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s : wrong response code, got %d want %d: %s", e.name, rr.Code, e.expectedStatus, rr.Body.String())
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("failed %s : wrong content type %q", e.name, ct)
+		}
+
+		var resp apiErrorEnvelope
+		err := json.Unmarshal(rr.Body.Bytes(), &resp)
+		if err != nil {
+			t.Errorf("failed %s : invalid json %s", e.name, rr.Body.String())
+			continue
+		}
+
+		if resp.Error.Code != e.expectedCode {
+			t.Errorf("failed %s : wrong error code, got %q want %q", e.name, resp.Error.Code, e.expectedCode)
+		}
+		if e.expectedCode != "" && resp.Error.Status != e.expectedStatus {
+			t.Errorf("failed %s : wrong status in error, got %d", e.name, resp.Error.Status)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedData) {
+			t.Errorf("failed %s : expected %s in %s", e.name, e.expectedData, rr.Body.String())
+		}
+	}
+}
+
+func TestAPI_CreateReservationLocation(t *testing.T) {
+	body := `{"room_id": 1, "start_date": "2050-01-01", "end_date": "2050-01-03", "first_name": "John",
+		"last_name": "Smith", "email": "john@smith.com", "phone": "555-555-5555"}`
+	req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+
+	var resp struct {
+		Data apiReservation `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Data.ConfirmationCode) != confirmationCodeLength || resp.Data.Currency == "" || !resp.Data.CanCancel {
+		t.Errorf("unexpected reservation %+v", resp.Data)
+	}
+	if rr.Header().Get("Location") != "/api/v1/reservations/"+resp.Data.ConfirmationCode {
+		t.Errorf("wrong location %q", rr.Header().Get("Location"))
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		total, page, perPage int
+		from, to             int
+	}{
+		{45, 1, 20, 0, 20},
+		{45, 3, 20, 40, 45},
+		{45, 4, 20, 45, 45},
+		{0, 1, 20, 0, 0},
+		{45, math.MaxInt, 100, 45, 45},
+	}
+
+	for _, e := range tests {
+		from, to := paginate(e.total, e.page, e.perPage)
+		if from != e.from || to != e.to {
+			t.Errorf("paginate(%d, %d, %d) = %d, %d, want %d, %d", e.total, e.page, e.perPage, from, to, e.from, e.to)
+		}
+	}
+}
+
+func TestAuthenticateAPIToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		expectedErr error
+		expectedID  int
+	}{
+		{"valid", tokens.Sign(app.Secret, apiTokenPurpose, "frontdesk"), nil, 1},
+		{"unknown", tokens.Sign(app.Secret, apiTokenPurpose, "unknown"), tokens.ErrInvalid, 0},
+		{"other-purpose", tokens.Sign(app.Secret, manageBookingPurpose, "frontdesk"), tokens.ErrInvalid, 0},
+		{"garbage", "frontdesk", tokens.ErrInvalid, 0},
+	}
+
+	for _, e := range tests {
+		apiToken, err := Repo.AuthenticateAPIToken(context.Background(), e.token)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("failed %s : wrong error, got %v want %v", e.name, err, e.expectedErr)
+		}
+		if apiToken.ID != e.expectedID {
+			t.Errorf("failed %s : wrong token, got %d want %d", e.name, apiToken.ID, e.expectedID)
+		}
+	}
+}
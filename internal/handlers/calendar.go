@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/ismail118/bookings-app/helpers"
+	"github.com/ismail118/bookings-app/internal/ical"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/render"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarFeedPurpose signs the tokens of the calendar feed urls. Only their hashes are stored, a leaked
+// feed url is revoked by revoking or replacing the token of its feed.
+const calendarFeedPurpose = "calendar-feed"
+
+// calendarFeedHistoryDays is how long past stays stay in the feeds
+const calendarFeedHistoryDays = 90
+
+// calendarProdID identifies the app in the calendars it exports
+const calendarProdID = "-//Bookings//Room Calendar//EN"
+
+// CalendarFeed serves the reservations and owner blocks of all rooms as an iCalendar feed
+func (m *Repository) CalendarFeed(w http.ResponseWriter, r *http.Request) {
+	valid, err := m.validCalendarToken(r, 0)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.writeCalendarFeed(w, r, 0, "All rooms", "rooms.ics")
+}
+
+// RoomCalendarFeed serves the reservations and owner blocks of the room in /calendar/rooms/{id}.ics as an
+// iCalendar feed
+func (m *Repository) RoomCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	roomID, err := strconv.Atoi(strings.TrimSuffix(exploded[3], ".ics"))
+	if err != nil || roomID < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	valid, err := m.validCalendarToken(r, roomID)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.NotFound(w, r)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	m.writeCalendarFeed(w, r, roomID, roomCalendarName(roomID, room), fmt.Sprintf("room-%d.ics", roomID))
+}
+
+// roomCalendarName returns the name of the calendar of a room
+func roomCalendarName(roomID int, room models.Room) string {
+	if room.RoomName == "" {
+		return fmt.Sprintf("Room %d", roomID)
+	}
+	return room.RoomName
+}
+
+// writeCalendarFeed writes the feed of the room, or of all rooms when roomID is 0
+func (m *Repository) writeCalendarFeed(w http.ResponseWriter, r *http.Request, roomID int, name, filename string) {
+	since := time.Now().AddDate(0, 0, -calendarFeedHistoryDays)
+	restrictions, err := m.DB.GetCalendarRestrictions(r.Context(), roomID, since)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	c := &ical.Calendar{
+		ProdID: calendarProdID,
+		Name:   name,
+		Method: "PUBLISH",
+	}
+	now := time.Now()
+	for _, rr := range restrictions {
+		c.Events = append(c.Events, m.restrictionEvent(rr, now))
+	}
+
+	var buf bytes.Buffer
+	err = c.Encode(&buf)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// restrictionEvent converts a reservation, an owner block or an external booking to an event. The uids
+// only depend on the ids, so calendar apps update the events when dates or statuses change.
+func (m *Repository) restrictionEvent(rr models.RoomRestriction, stamp time.Time) ical.Event {
+	if rr.RestrictionID == models.RestrictionReservation && rr.ReservationID > 0 {
+		res := rr.Reservation
+		description := fmt.Sprintf("Confirmation code %s, %s\n%s/admin/reservations/all/%d/show",
+			res.ConfirmationCode, res.Status, m.App.BaseURL, rr.ReservationID)
+
+		ev := ical.Event{
+			UID:          m.calendarUID("reservation", rr.ReservationID),
+			Start:        rr.StartDate,
+			End:          rr.EndDate,
+			Summary:      fmt.Sprintf("%s: %s %s", rr.Room.RoomName, res.FirstName, res.LastName),
+			Description:  description,
+			Status:       ical.StatusConfirmed,
+			Stamp:        stamp,
+			LastModified: rr.UpdatedAt,
+		}
+		if res.Status == models.ReservationPending {
+			ev.Status = ical.StatusTentative
+		}
+		if res.UpdatedAt.After(ev.LastModified) {
+			ev.LastModified = res.UpdatedAt
+		}
+		return ev
+	}
+
+	if rr.RestrictionID == models.RestrictionExternalBooking {
+		return ical.Event{
+			UID:          m.calendarUID("external", rr.ID),
+			Start:        rr.StartDate,
+			End:          rr.EndDate,
+			Summary:      fmt.Sprintf("%s: %s booking", rr.Room.RoomName, rr.Reason),
+			Description:  rr.Note,
+			Status:       ical.StatusConfirmed,
+			Stamp:        stamp,
+			LastModified: rr.UpdatedAt,
+		}
+	}
+
+	summary := rr.Room.RoomName + ": Blocked"
+	if rr.Reason != "" {
+		summary += " (" + rr.Reason + ")"
+	}
+	return ical.Event{
+		UID:          m.calendarUID("block", rr.ID),
+		Start:        rr.StartDate,
+		End:          rr.EndDate,
+		Summary:      summary,
+		Description:  rr.Note,
+		Status:       ical.StatusConfirmed,
+		Stamp:        stamp,
+		LastModified: rr.UpdatedAt,
+	}
+}
+
+// reservationCalendar returns the calendar attached to the confirmation mail of res
+func (m *Repository) reservationCalendar(res models.Reservation) ([]byte, error) {
+	description := fmt.Sprintf("Confirmation code %s\nManage your booking: %s",
+		res.ConfirmationCode, m.manageBookingLink(res.ConfirmationCode))
+
+	c := &ical.Calendar{
+		ProdID: calendarProdID,
+		Method: "PUBLISH",
+		Events: []ical.Event{
+			{
+				UID:         m.calendarUID("reservation", res.ID),
+				Start:       res.StartDate,
+				End:         res.EndDate,
+				Summary:     "Fort Smythe Bed and Breakfast, " + res.Room.RoomName,
+				Description: description,
+				Location:    res.Room.RoomName,
+				Status:      ical.StatusConfirmed,
+				Stamp:       time.Now(),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := c.Encode(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// calendarUID returns the stable uid of an event for the entity kind with id, scoped to the host of the app
+func (m *Repository) calendarUID(kind string, id int) string {
+	host := "bookings"
+	u, err := url.Parse(m.App.BaseURL)
+	if err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	return fmt.Sprintf("%s-%d@%s", kind, id, host)
+}
+
+// validCalendarToken reports whether the token of r opens the feed of the room, or of all rooms when
+// roomID is 0
+func (m *Repository) validCalendarToken(r *http.Request, roomID int) (bool, error) {
+	token := r.URL.Query().Get("token")
+	if tokens.Verify(m.App.Secret, calendarFeedPurpose, token) != nil {
+		return false, nil
+	}
+
+	t, err := m.DB.GetCalendarFeedTokenByHash(r.Context(), tokens.Hash(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return t.RoomID == roomID, nil
+}
+
+// calendarFeedPath returns the path of the feed of a room, or of all rooms when roomID is 0
+func calendarFeedPath(roomID int) string {
+	if roomID == 0 {
+		return "/calendar/rooms.ics"
+	}
+	return fmt.Sprintf("/calendar/rooms/%d.ics", roomID)
+}
+
+// calendarFeedLink returns the secret url of the feed of a room opened by token
+func (m *Repository) calendarFeedLink(roomID int, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", m.App.BaseURL, calendarFeedPath(roomID), url.QueryEscape(token))
+}
+
+// calendarFeed is a row of the calendar feeds page, Token is empty when the feed has no url
+type calendarFeed struct {
+	RoomID int
+	Name   string
+	Token  models.CalendarFeedToken
+}
+
+// AdminCalendarFeeds lists the calendar feeds, to subscribe to them in Google or Outlook. The urls are only
+// shown when they are created, so the page offers to create a new url or revoke the current one.
+func (m *Repository) AdminCalendarFeeds(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get rooms")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	feedTokens, err := m.DB.AllCalendarFeedTokens(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get calendar feeds")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	byRoom := make(map[int]models.CalendarFeedToken)
+	for _, t := range feedTokens {
+		byRoom[t.RoomID] = t
+	}
+
+	feeds := []calendarFeed{{Name: "All rooms", Token: byRoom[0]}}
+	for _, room := range rooms {
+		feeds = append(feeds, calendarFeed{RoomID: room.ID, Name: room.RoomName, Token: byRoom[room.ID]})
+	}
+
+	data := make(map[string]interface{})
+	data["feeds"] = feeds
+	render.Template(w, r, "admin-calendar-feeds.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminPostCalendarFeedToken creates a new url for the feed of the room in
+// /admin/calendar-feeds/{id}/token, id 0 being the feed of all rooms, and shows it once. The previous url
+// of the feed stops working.
+func (m *Repository) AdminPostCalendarFeedToken(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+		return
+	}
+
+	name := "All rooms"
+	if roomID != 0 {
+		room, err := m.DB.GetRoomByID(r.Context(), roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room")
+			http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+			return
+		}
+		name = roomCalendarName(roomID, room)
+	}
+
+	token, err := tokens.New(m.App.Secret, calendarFeedPurpose)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.ReplaceCalendarFeedToken(r.Context(), roomID, tokens.Hash(token))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save calendar feed url")
+		http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar feed url created")
+
+	data := make(map[string]interface{})
+	data["name"] = name
+	data["url"] = m.calendarFeedLink(roomID, token)
+	render.Template(w, r, "admin-calendar-feed-created.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRevokeCalendarFeedToken stops the url of the feed of the room in /admin/calendar-feeds/{id}/revoke
+// from working, id 0 being the feed of all rooms
+func (m *Repository) AdminRevokeCalendarFeedToken(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteCalendarFeedToken(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "The calendar feed has no url to revoke")
+		http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't revoke calendar feed url")
+		http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar feed url revoked")
+	http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+}
+
+// maxFeedNameLength is the longest name of an external calendar, it is stored as the reason of its bookings
+const maxFeedNameLength = 100
+
+// AdminExternalFeeds lists the calendars of other booking sites imported as external bookings, and the
+// form to add one
+func (m *Repository) AdminExternalFeeds(w http.ResponseWriter, r *http.Request) {
+	feeds, err := m.DB.AllExternalFeeds(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get external calendars")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get rooms")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["external_feeds"] = feeds
+	data["rooms"] = rooms
+	render.Template(w, r, "admin-external-feeds.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminPostExternalFeed adds the calendar of a room on another booking site and imports it right away
+func (m *Repository) AdminPostExternalFeed(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	f := models.ExternalFeed{
+		Name: strings.TrimSpace(r.Form.Get("name")),
+		URL:  strings.TrimSpace(r.Form.Get("url")),
+	}
+
+	if f.Name == "" || len(f.Name) > maxFeedNameLength {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Please name the calendar after the booking site, in at most %d characters", maxFeedNameLength))
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	u, err := url.Parse(f.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		m.App.Session.Put(r.Context(), "error", "Please enter the http or https address of the calendar")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	f.RoomID, err = strconv.Atoi(r.Form.Get("room_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.GetRoomByID(r.Context(), f.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "The room doesn't exist")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get room")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	f.ID, err = m.DB.InsertExternalFeed(r.Context(), f)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save external calendar")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	err = m.Feeds.Sync(r.Context(), f)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("External calendar added, but it can't be imported yet: %v", err))
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "External calendar added and imported")
+	http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+}
+
+// AdminSyncExternalFeed imports an external calendar now, without waiting for the background sync
+func (m *Repository) AdminSyncExternalFeed(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	f, err := m.DB.GetExternalFeedByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "The external calendar doesn't exist")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get external calendar")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	err = m.Feeds.Sync(r.Context(), f)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("can't import %s: %v", f.Name, err))
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s imported", f.Name))
+	http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+}
+
+// AdminDeleteExternalFeed stops importing an external calendar and removes its bookings
+func (m *Repository) AdminDeleteExternalFeed(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteExternalFeed(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "The external calendar doesn't exist")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete external calendar")
+		http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "External calendar deleted")
+	http.Redirect(w, r, "/admin/external-feeds", http.StatusSeeOther)
+}
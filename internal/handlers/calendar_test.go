@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"github.com/ismail118/bookings-app/internal/ical"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCalendarFeeds = []struct {
+	name           string
+	url            string
+	payload        string // the feed token is signed for payload, when set, see testCalendarFeedTokens
+	expectedStatus int
+	expected       []string
+	unexpected     []string
+}{
+	{"all-rooms", "/calendar/rooms.ics", "all-rooms-feed", http.StatusOK,
+		[]string{"X-WR-CALNAME:All rooms", "UID:reservation-1@localhost", "UID:block-2@localhost",
+			"SUMMARY:Room One: John Smith", "STATUS:TENTATIVE", "SUMMARY:Room Two: Blocked (Maintenance)",
+			"DTSTART;VALUE=DATE:20500101", "DTEND;VALUE=DATE:20500103"},
+		nil},
+	{"room", "/calendar/rooms/1.ics", "room-one-feed", http.StatusOK,
+		[]string{"X-WR-CALNAME:Room 1", "UID:reservation-1@localhost", "UID:external-3@localhost",
+			"SUMMARY:Room One: Holiday Lets booking", "DTSTART;VALUE=DATE:20500110"},
+		[]string{"UID:block-2@localhost"}},
+	{"other-room-token", "/calendar/rooms/2.ics", "room-one-feed", http.StatusNotFound, nil, nil},
+	{"all-rooms-token-for-room", "/calendar/rooms/1.ics", "all-rooms-feed", http.StatusNotFound, nil, nil},
+	{"room-token-for-all-rooms", "/calendar/rooms.ics", "room-one-feed", http.StatusNotFound, nil, nil},
+	{"revoked-token", "/calendar/rooms/2.ics", "room-two-feed", http.StatusNotFound, nil, nil},
+	{"missing-token", "/calendar/rooms.ics", "", http.StatusNotFound, nil, nil},
+	{"forged-token", "/calendar/rooms.ics?token=all-rooms-feed.abc", "", http.StatusNotFound, nil, nil},
+	{"unknown-room", "/calendar/rooms/3.ics", "room-one-feed", http.StatusNotFound, nil, nil},
+	{"invalid-room-id", "/calendar/rooms/abc.ics", "room-one-feed", http.StatusNotFound, nil, nil},
+}
+
+func TestCalendarFeed(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range testCalendarFeeds {
+		target := e.url
+		if e.payload != "" {
+			target += "?token=" + url.QueryEscape(tokens.Sign(app.Secret, calendarFeedPurpose, e.payload))
+		}
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectedStatus)
+			continue
+		}
+		if e.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != ical.ContentType {
+			t.Errorf("failed %s : wrong content type %q", e.name, ct)
+		}
+
+		body := rr.Body.String()
+		for _, s := range e.expected {
+			if !strings.Contains(body, s+"\r\n") {
+				t.Errorf("failed %s : expected %q in\n%s", e.name, s, body)
+			}
+		}
+		for _, s := range e.unexpected {
+			if strings.Contains(body, s) {
+				t.Errorf("failed %s : did not expect %q in\n%s", e.name, s, body)
+			}
+		}
+	}
+}
+
+func TestAdminCalendarFeeds(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/calendar-feeds", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminCalendarFeeds).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	// the urls are only shown when they are created
+	for _, s := range []string{`action="/admin/calendar-feeds/0/revoke"`, `action="/admin/calendar-feeds/1/revoke"`,
+		`action="/admin/calendar-feeds/1/token"`, "Active"} {
+		if !strings.Contains(rr.Body.String(), s) {
+			t.Errorf("expected %q on the page", s)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "token=") {
+		t.Error("the page should not show feed urls")
+	}
+}
+
+var testCalendarFeedTokenActions = []struct {
+	name          string
+	url           string
+	handler       func(*Repository, http.ResponseWriter, *http.Request)
+	expectedCode  int
+	expectedFlash string
+	expectedError string
+	expectedHTML  string
+}{
+	{"new-all-rooms", "/admin/calendar-feeds/0/token", (*Repository).AdminPostCalendarFeedToken, http.StatusOK,
+		"Calendar feed url created", "", "http://localhost:8080/calendar/rooms.ics?token="},
+	{"new-room", "/admin/calendar-feeds/2/token", (*Repository).AdminPostCalendarFeedToken, http.StatusOK,
+		"Calendar feed url created", "", "http://localhost:8080/calendar/rooms/2.ics?token="},
+	{"new-unknown-room", "/admin/calendar-feeds/3/token", (*Repository).AdminPostCalendarFeedToken, http.StatusSeeOther,
+		"", "can't get room", ""},
+	{"new-invalid-id", "/admin/calendar-feeds/abc/token", (*Repository).AdminPostCalendarFeedToken, http.StatusSeeOther,
+		"", "can't parse to int", ""},
+	{"revoke", "/admin/calendar-feeds/1/revoke", (*Repository).AdminRevokeCalendarFeedToken, http.StatusSeeOther,
+		"Calendar feed url revoked", "", ""},
+	{"revoke-without-url", "/admin/calendar-feeds/2/revoke", (*Repository).AdminRevokeCalendarFeedToken, http.StatusSeeOther,
+		"", "The calendar feed has no url to revoke", ""},
+}
+
+func TestCalendarFeedTokenActions(t *testing.T) {
+	for _, e := range testCalendarFeedTokenActions {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.handler(Repo, w, r)
+		}).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectedCode)
+		}
+
+		if e.expectedCode == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/calendar-feeds" {
+			t.Errorf("failed %s : expected a redirect to the calendar feeds, got %s", e.name, rr.Header().Get("Location"))
+		}
+
+		// the flash of a rendered page is already shown
+		if e.expectedCode == http.StatusSeeOther {
+			if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+				t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectedFlash)
+			}
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectedError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectedError)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s : expected %q in the page", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func TestReservationCalendar(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	res := models.Reservation{
+		ID:               1,
+		ConfirmationCode: "ABCD2345",
+		StartDate:        start,
+		EndDate:          start.AddDate(0, 0, 2),
+		Room:             models.Room{ID: 1, RoomName: "Room One"},
+	}
+
+	ics, err := Repo.reservationCalendar(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest's event has the uid of the reservation in the feeds
+	for _, s := range []string{"UID:reservation-1@localhost", "DTSTART;VALUE=DATE:20500101",
+		"DTEND;VALUE=DATE:20500103", "LOCATION:Room One"} {
+		if !strings.Contains(string(ics), s+"\r\n") {
+			t.Errorf("expected %q in\n%s", s, ics)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(string(ics), "\r\n ", "")
+	if !strings.Contains(unfolded, Repo.manageBookingLink(res.ConfirmationCode)) {
+		t.Errorf("expected the manage booking link in\n%s", ics)
+	}
+}
+
+// testFeedTransport serves the calendar of the first external feed of the testing repo, other feeds
+// are not found
+type testFeedTransport struct{}
+
+func (testFeedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rr := httptest.NewRecorder()
+	if r.URL.Host != "holidaylets.test" {
+		rr.WriteHeader(http.StatusNotFound)
+		return rr.Result(), nil
+	}
+
+	rr.Header().Set("Content-Type", ical.ContentType)
+	_, _ = rr.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:stay-1@holidaylets.test\r\n" +
+		"DTSTART;VALUE=DATE:20500110\r\nDTEND;VALUE=DATE:20500113\r\nSUMMARY:Reserved\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	return rr.Result(), nil
+}
+
+func TestAdminDashboard(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/dashboard", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminDashboard).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	for _, s := range []string{"Holiday Lets", "1 failing", "unexpected status 404 Not Found"} {
+		if !strings.Contains(rr.Body.String(), s) {
+			t.Errorf("expected %q on the dashboard", s)
+		}
+	}
+
+	// the dashboard can't send its errors elsewhere
+	req, _ = http.NewRequest("GET", "/admin/dashboard", nil)
+	ctx, cancel := context.WithCancel(getCtx(req))
+	req = req.WithContext(ctx)
+	cancel()
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminDashboard).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "get external calendars") {
+		t.Errorf("expected the dashboard with an error, got %d", rr.Code)
+	}
+}
+
+var testExternalFeedActions = []struct {
+	name            string
+	method          string
+	url             string
+	postData        string
+	handler         func(*Repository, http.ResponseWriter, *http.Request)
+	expectedFlash   string
+	expectedWarning string
+	expectedError   string
+}{
+	{"add", "POST", "/admin/external-feeds", "room_id=1&name=Holiday+Lets&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "External calendar added and imported", "", ""},
+	{"add-not-importable", "POST", "/admin/external-feeds", "room_id=2&name=Stay+Finder&url=https://stayfinder.test/calendar/2.ics",
+		(*Repository).AdminPostExternalFeed, "", "External calendar added, but it can't be imported yet: unexpected status 404 Not Found", ""},
+	{"add-missing-name", "POST", "/admin/external-feeds", "room_id=1&name=+&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "Please name the calendar after the booking site, in at most 100 characters"},
+	{"add-long-name", "POST", "/admin/external-feeds", "room_id=1&name=" + strings.Repeat("a", 101) + "&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "Please name the calendar after the booking site, in at most 100 characters"},
+	{"add-invalid-url", "POST", "/admin/external-feeds", "room_id=1&name=Holiday+Lets&url=webcal://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "Please enter the http or https address of the calendar"},
+	{"add-invalid-room", "POST", "/admin/external-feeds", "room_id=abc&name=Holiday+Lets&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "can't parse to int"},
+	{"add-unknown-room", "POST", "/admin/external-feeds", "room_id=3&name=Holiday+Lets&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "The room doesn't exist"},
+	{"add-db-error", "POST", "/admin/external-feeds", "room_id=1&name=fail&url=https://holidaylets.test/listing/1.ics",
+		(*Repository).AdminPostExternalFeed, "", "", "can't save external calendar"},
+	{"sync", "POST", "/admin/sync-external-feed/1/do", "", (*Repository).AdminSyncExternalFeed, "Holiday Lets imported", "", ""},
+	{"sync-failing", "POST", "/admin/sync-external-feed/2/do", "", (*Repository).AdminSyncExternalFeed,
+		"", "", "can't import Stay Finder: unexpected status 404 Not Found"},
+	{"sync-unknown", "POST", "/admin/sync-external-feed/3/do", "", (*Repository).AdminSyncExternalFeed,
+		"", "", "The external calendar doesn't exist"},
+	{"sync-invalid-id", "POST", "/admin/sync-external-feed/abc/do", "", (*Repository).AdminSyncExternalFeed,
+		"", "", "can't parse to int"},
+	{"delete", "POST", "/admin/delete-external-feed/1/do", "", (*Repository).AdminDeleteExternalFeed,
+		"External calendar deleted", "", ""},
+	{"delete-unknown", "POST", "/admin/delete-external-feed/3/do", "", (*Repository).AdminDeleteExternalFeed,
+		"", "", "The external calendar doesn't exist"},
+}
+
+func TestExternalFeedActions(t *testing.T) {
+	for _, e := range testExternalFeedActions {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postData))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.handler(Repo, w, r)
+		}).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/external-feeds" {
+			t.Errorf("failed %s : expected a redirect to the external calendars, got %d %s", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectedFlash)
+		}
+
+		if warning := session.GetString(ctx, "warning"); warning != e.expectedWarning {
+			t.Errorf("failed %s : wrong warning, got %q want %q", e.name, warning, e.expectedWarning)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectedError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectedError)
+		}
+	}
+}
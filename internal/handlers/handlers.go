@@ -1,17 +1,35 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ismail118/bookings-app/helpers"
 	"github.com/ismail118/bookings-app/internal/config"
 	"github.com/ismail118/bookings-app/internal/driver"
+	"github.com/ismail118/bookings-app/internal/feedsync"
+	"github.com/ismail118/bookings-app/internal/filestore"
 	"github.com/ismail118/bookings-app/internal/forms"
+	"github.com/ismail118/bookings-app/internal/ical"
+	"github.com/ismail118/bookings-app/internal/images"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"github.com/ismail118/bookings-app/internal/render"
 	"github.com/ismail118/bookings-app/internal/repository"
 	"github.com/ismail118/bookings-app/internal/repository/dbrepo"
-	"log"
+	"github.com/ismail118/bookings-app/internal/stayrules"
+	"github.com/ismail118/bookings-app/internal/throttle"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"github.com/ismail118/bookings-app/internal/totp"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,25 +40,73 @@ var Repo *Repository
 
 // Repository is the repository type
 type Repository struct {
-	App *config.AppConfig
-	DB  repository.DatabaseRepo
+	App          *config.AppConfig
+	DB           repository.DatabaseRepo
+	Files        filestore.FileStore
+	Feeds        *feedsync.Syncer
+	LoginByEmail *throttle.Limiter
+	LoginByIP    *throttle.Limiter
 }
 
+// emailLoginLimits slows down and then locks logins for an email that keeps failing
+var emailLoginLimits = throttle.Config{
+	MaxFailures: 5,
+	Lockout:     15 * time.Minute,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// ipLoginLimits locks an ip address that fails for many emails, without delays since
+// several staff members may log in from the same address
+var ipLoginLimits = throttle.Config{
+	MaxFailures: 20,
+	Lockout:     15 * time.Minute,
+}
+
+// uploadsURL is where the files of the local file store are served
+const uploadsURL = "/uploads"
+
 // NewRepo creates a new repository
 func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	repo := dbrepo.NewPostgresRepo(db.SQL, a)
+
+	var store throttle.Store
+	if a.PersistLoginLockouts {
+		store = repo
+	}
+
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
+		App:          a,
+		DB:           repo,
+		Files:        filestore.NewLocal(a.UploadDir, uploadsURL),
+		Feeds:        feedsync.New(repo, nil),
+		LoginByEmail: throttle.New("email", emailLoginLimits, store),
+		LoginByIP:    throttle.New("ip", ipLoginLimits, store),
 	}
 }
 
 func NewTestRepo(a *config.AppConfig) *Repository {
+	repo := dbrepo.NewTestingRepo(a)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		App:          a,
+		DB:           repo,
+		Files:        filestore.NewMemory(),
+		Feeds:        feedsync.New(repo, nil),
+		LoginByEmail: throttle.New("email", emailLoginLimits, repo),
+		LoginByIP:    throttle.New("ip", ipLoginLimits, repo),
 	}
 }
 
+// LoadLoginLockouts reads the stored login lockouts, so they survive a restart
+func (m *Repository) LoadLoginLockouts(ctx context.Context) error {
+	err := m.LoginByEmail.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.LoginByIP.Load(ctx)
+}
+
 // NewHandlers sets the repository for the handlers
 func NewHandlers(r *Repository) {
 	Repo = r
@@ -57,14 +123,37 @@ func (m *Repository) About(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "about.page.gohtml", &models.TemplateData{})
 }
 
-// RoomOne renders the room one page
-func (m *Repository) RoomOne(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "room-one.page.gohtml", &models.TemplateData{})
+// Rooms renders the room catalog
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get rooms")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	render.Template(w, r, "rooms.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
 }
 
-// RoomTwo renders the room two page
-func (m *Repository) RoomTwo(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "room-two.page.gohtml", &models.TemplateData{})
+// Room renders the page of the room with the slug in /rooms/{slug}
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	room, err := m.DB.GetRoomBySlug(r.Context(), exploded[2])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't find room")
+		http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	render.Template(w, r, "room.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
 }
 
 // Availability renders the search availability page
@@ -99,7 +188,14 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	err = stayrules.ValidateDates(startDate, endDate, stayrules.Today())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't search availability")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -107,13 +203,29 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(rooms) == 0 {
-		m.App.Session.Put(r.Context(), "error", "No Availability")
+		msg := "No Availability"
+		reasons, err := m.stayRuleReasons(r.Context(), 0, startDate, endDate)
+		if err == nil && len(reasons) > 0 {
+			msg = "No Availability: " + strings.Join(reasons, "; ")
+		}
+		m.App.Session.Put(r.Context(), "error", msg)
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
 
+	quotes := make(map[int]pricing.Quote, len(rooms))
+	for _, room := range rooms {
+		quotes[room.ID], err = m.quote(r.Context(), room, startDate, endDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't calculate price")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+	}
+
 	data := make(map[string]interface{})
 	data["rooms"] = rooms
+	data["quotes"] = quotes
 
 	res := models.Reservation{
 		StartDate: startDate,
@@ -152,15 +264,50 @@ func (m *Repository) PostAvailabilityJSON(w http.ResponseWriter, r *http.Request
 
 	sd := r.Form.Get("start")
 	ed := r.Form.Get("end")
+	rd := r.Form.Get("room_id")
+
 	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
+	startDate, errStart := time.Parse(layout, sd)
+	endDate, errEnd := time.Parse(layout, ed)
+	if errStart != nil || errEnd != nil {
+		resp := jsonResponse{
+			Ok:      false,
+			Message: "Invalid arrival or departure date",
+		}
+
+		out, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+
+	roomID, err := strconv.Atoi(rd)
+	if err != nil {
+		resp := jsonResponse{
+			Ok:      false,
+			Message: "Invalid room",
+		}
 
-	endDate, _ := time.Parse(layout, ed)
+		out, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
 
-	rd := r.Form.Get("room_id")
-	roomID, _ := strconv.Atoi(rd)
+	err = stayrules.ValidateDates(startDate, endDate, stayrules.Today())
+	if err != nil {
+		resp := jsonResponse{
+			Ok:      false,
+			Message: err.Error(),
+		}
+
+		out, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
 
-	available, err := m.DB.SearchAvailabilityByRoomID(roomID, startDate, endDate)
+	available, err := m.DB.SearchAvailabilityByRoomID(r.Context(), roomID, startDate, endDate)
 	if err != nil {
 		resp := jsonResponse{
 			Ok:      false,
@@ -173,16 +320,24 @@ func (m *Repository) PostAvailabilityJSON(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	message := ""
+	if !available {
+		reasons, err := m.stayRuleReasons(r.Context(), roomID, startDate, endDate)
+		if err == nil && len(reasons) > 0 {
+			message = strings.Join(reasons, "; ")
+		}
+	}
+
 	res := jsonResponse{
 		Ok:        available,
-		Message:   "",
+		Message:   message,
 		RoomID:    rd,
 		StartDate: sd,
 		EndDate:   ed,
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(res)
 }
 
@@ -200,7 +355,7 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(res.RoomID)
+	room, err := m.DB.GetRoomByID(r.Context(), res.RoomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't find room")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -262,7 +417,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't find room")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -305,63 +460,129 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	// the dates come from the form, so the stay rules are checked again before booking
+	reasons, err := m.stayRuleReasons(r.Context(), roomID, startDate, endDate)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
+		m.App.Session.Put(r.Context(), "error", "can't check stay rules")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	if len(reasons) > 0 {
+		m.App.Session.Put(r.Context(), "error", reasons[0])
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 
-	restriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	// the price is calculated again, the rates may have changed since the guest chose the room
+	q, err := m.quote(r.Context(), room, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't calculate price")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
+	reservation.Total, reservation.Currency, reservation.PriceLines = q.Total, q.Currency, q.Lines
 
-	err = m.DB.InsertRoomRestriction(restriction)
+	err = m.book(r.Context(), &reservation)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room is no longer available for the selected dates")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction!")
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	htmlMessage := fmt.Sprintf(`
-	<strong>Reservation Confirmation</strong><br>
-	Dear %s <br>
-	This is confirm your reservation from %s to %s.
+	m.queueBookingMails(r, reservation)
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// book stores reservation with a new confirmation code and sets its id and code, a new code is tried
+// when the random one is already taken
+func (m *Repository) book(ctx context.Context, reservation *models.Reservation) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		reservation.ConfirmationCode, err = newConfirmationCode()
+		if err != nil {
+			return err
+		}
+
+		reservation.ID, err = m.DB.BookReservation(ctx, *reservation)
+		if !errors.Is(err, repository.ErrDuplicateConfirmationCode) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	reservation.Status = models.ReservationPending
+	return nil
+}
 
-`, reservation.FirstName, sd, ed)
+// queueBookingMails notifies the guest and the owner of a new reservation
+func (m *Repository) queueBookingMails(r *http.Request, reservation models.Reservation) {
+	td := &models.MailTemplateData{
+		Reservation: reservation,
+		Room:        reservation.Room,
+		StartDate:   reservation.StartDate,
+		EndDate:     reservation.EndDate,
+		Links: map[string]string{
+			"reservation": fmt.Sprintf("%s/admin/reservations/new/%d/show", m.App.BaseURL, reservation.ID),
+			"manage":      m.manageBookingLink(reservation.ConfirmationCode),
+		},
+	}
 
-	// send email notification
-	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "me@here.com",
-		Subject:  "Reservation Confirmation",
-		Content:  htmlMessage,
-		Template: "basic.html",
+	var attachments []models.MailAttachment
+	ics, err := m.reservationCalendar(reservation)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't create calendar of reservation %d: %v", reservation.ID, err)
+	} else {
+		attachments = append(attachments, models.MailAttachment{Name: "reservation.ics", ContentType: ical.ContentType, Data: ics})
 	}
 
-	m.App.MailChan <- msg
+	m.queueMail(r, "reservation-confirmation.mail.gohtml", reservation.Email, td, attachments...)
+	m.queueMail(r, "owner-reservation-alert.mail.gohtml", "owner@gmail.com", td)
+}
 
-	htmlMessage = fmt.Sprintf(`
-	Dear Owner <br>
-	You got new reservation from %s to %s.<br>
-`, sd, ed)
-	msg = models.MailData{
-		To:       "owner@gmail.com",
-		From:     "me@here.com",
-		Subject:  "Reservation Coming Alert",
-		Content:  htmlMessage,
-		Template: "basic.html",
+// queueCancellationMails notifies the guest and the owner of a reservation the guest cancelled
+func (m *Repository) queueCancellationMails(r *http.Request, res models.Reservation) {
+	td := &models.MailTemplateData{
+		Reservation: res,
+		Room:        res.Room,
+		StartDate:   res.StartDate,
+		EndDate:     res.EndDate,
+		Links: map[string]string{
+			"reservation": fmt.Sprintf("%s/admin/reservations/all/%d/show", m.App.BaseURL, res.ID),
+		},
 	}
+	m.queueMail(r, "reservation-cancellation.mail.gohtml", res.Email, td)
+	m.queueMail(r, "owner-reservation-cancelled.mail.gohtml", "owner@gmail.com", td)
+}
 
-	m.App.MailChan <- msg
+// queueMail renders the email template tmpl and puts the message with attachments in the mail queue.
+// Failing to queue a notification is logged but does not fail the request that triggered it.
+func (m *Repository) queueMail(r *http.Request, tmpl, to string, td *models.MailTemplateData, attachments ...models.MailAttachment) {
+	if td.Links == nil {
+		td.Links = make(map[string]string)
+	}
+	td.Links["home"] = m.App.BaseURL + "/"
 
-	m.App.Session.Put(r.Context(), "reservation", reservation)
+	msg, err := render.MailMessage(tmpl, to, td)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't render mail %s: %v", tmpl, err)
+		return
+	}
+	msg.Attachments = attachments
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	err = m.DB.EnqueueMail(r.Context(), msg)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't queue mail %s: %v", tmpl, err)
+	}
 }
 
 // ReservationSummary renders the reservation summary page
@@ -390,455 +611,2921 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
-	roomID, err := strconv.Atoi(exploded[2])
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "invalid room id")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-
-	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
-	if !ok {
-		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
+// manageBookingPurpose signs the manage booking links sent to guests
+const manageBookingPurpose = "manage-booking"
 
-	res.RoomID = roomID
+// confirmationCodeAlphabet leaves out letters and digits that are easily mistaken for each other
+const confirmationCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
 
-	m.App.Session.Put(r.Context(), "reservation", res)
-	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
-}
+// confirmationCodeLength is the number of characters of a confirmation code
+const confirmationCodeLength = 8
 
-func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
-	roomID, err := strconv.Atoi(r.URL.Query().Get("id"))
+// newConfirmationCode returns a random confirmation code for a reservation
+func newConfirmationCode() (string, error) {
+	b := make([]byte, confirmationCodeLength)
+	_, err := rand.Read(b)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "invalid room id")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+		return "", err
 	}
 
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
-
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, sd)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "invalid start date")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-	endDate, err := time.Parse(layout, ed)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "invalid end date")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	for i := range b {
+		b[i] = confirmationCodeAlphabet[int(b[i])%len(confirmationCodeAlphabet)]
 	}
 
-	room, err := m.DB.GetRoomByID(roomID)
-	if err != nil {
-		if err != nil {
-			m.App.Session.Put(r.Context(), "error", "can't get room")
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-	}
+	return string(b), nil
+}
 
-	var res models.Reservation
-	res.RoomID = roomID
-	res.StartDate = startDate
-	res.EndDate = endDate
-	res.Room.RoomName = room.RoomName
+// manageBookingLink returns the link that opens the reservation with the given confirmation code
+// without asking for the code and email
+func (m *Repository) manageBookingLink(code string) string {
+	token := tokens.Sign(m.App.Secret, manageBookingPurpose, code)
+	return fmt.Sprintf("%s/manage-booking/link?token=%s", m.App.BaseURL, url.QueryEscape(token))
+}
 
-	m.App.Session.Put(r.Context(), "reservation", res)
+// canChangeReservation reports whether the guest can still change or cancel res. Changes are
+// possible until App.CancelBeforeDays days before arrival.
+func (m *Repository) canChangeReservation(res models.Reservation) bool {
+	if !res.Open() {
+		return false
+	}
 
-	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+	deadline := res.StartDate.AddDate(0, 0, -m.App.CancelBeforeDays)
+	return !stayrules.Today().After(deadline)
 }
 
-func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "login.page.gohtml", &models.TemplateData{
+// ManageBooking shows the form to look up a reservation with its confirmation code and email
+func (m *Repository) ManageBooking(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "manage-booking.page.gohtml", &models.TemplateData{
 		Form: forms.New(nil),
 	})
 }
 
-func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.RenewToken(r.Context())
-
+// PostManageBooking looks up the reservation of the guest. The same message is shown for an unknown
+// code and for a wrong email, so codes can't be checked without knowing the email.
+func (m *Repository) PostManageBooking(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't parse form")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
 		return
 	}
 
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
-
 	form := forms.New(r.PostForm)
+	form.Required("confirmation_code", "email")
 	form.IsEmail("email")
-	form.Required("email", "password")
 	if !form.Valid() {
-		render.Template(w, r, "login.page.gohtml", &models.TemplateData{
+		render.Template(w, r, "manage-booking.page.gohtml", &models.TemplateData{
 			Form: form,
 		})
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
-		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	code := strings.ToUpper(strings.TrimSpace(r.Form.Get("confirmation_code")))
+	res, err := m.DB.GetReservationByCode(r.Context(), code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation")
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
+		return
+	}
+	if err != nil || !strings.EqualFold(res.Email, strings.TrimSpace(r.Form.Get("email"))) {
+		m.App.Session.Put(r.Context(), "error", "We couldn't find a booking with this code and email")
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "user_id", id)
-	m.App.Session.Put(r.Context(), "flash", "Success Login")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	m.App.Session.Put(r.Context(), "manage_booking_code", res.ConfirmationCode)
+	http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
 }
 
-func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.Destroy(r.Context())
-	_ = m.App.Session.RenewToken(r.Context())
-	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
-}
+// ManageBookingLink opens the reservation of a signed link from the confirmation mail
+func (m *Repository) ManageBookingLink(w http.ResponseWriter, r *http.Request) {
+	code, err := tokens.Open(m.App.Secret, manageBookingPurpose, r.URL.Query().Get("token"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid, please enter your confirmation code")
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
+		return
+	}
 
-func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.gohtml", &models.TemplateData{})
+	m.App.Session.Put(r.Context(), "manage_booking_code", code)
+	http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
 }
 
-func (m *Repository) NewAdminReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.NewReservations()
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get all reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
-		return
+// managedReservation returns the reservation the guest has opened in this session. When there is none
+// it sends the guest back to the lookup form and returns false.
+func (m *Repository) managedReservation(w http.ResponseWriter, r *http.Request) (models.Reservation, bool) {
+	code := m.App.Session.GetString(r.Context(), "manage_booking_code")
+	if code == "" {
+		m.App.Session.Put(r.Context(), "error", "Please enter your confirmation code and email")
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
+		return models.Reservation{}, false
 	}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	res, err := m.DB.GetReservationByCode(r.Context(), code)
+	if err != nil {
+		m.App.Session.Remove(r.Context(), "manage_booking_code")
+		m.App.Session.Put(r.Context(), "error", "can't get reservation")
+		http.Redirect(w, r, "/manage-booking", http.StatusSeeOther)
+		return models.Reservation{}, false
+	}
 
-	render.Template(w, r, "admin-new-reservations.page.gohtml", &models.TemplateData{
-		Data: data,
-	})
+	return res, true
 }
 
-func (m *Repository) NewAdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get all reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+// ManageBookingReservation shows the reservation the guest has opened, with the forms to change
+// its dates or cancel it while the cancellation policy allows it
+func (m *Repository) ManageBookingReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.managedReservation(w, r)
+	if !ok {
 		return
 	}
 
+	layout := "2006-01-02"
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format(layout)
+	stringMap["end_date"] = res.EndDate.Format(layout)
+	stringMap["deadline"] = res.StartDate.AddDate(0, 0, -m.App.CancelBeforeDays).Format(layout)
+
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["reservation"] = res
+	data["can_change"] = m.canChangeReservation(res)
 
-	render.Template(w, r, "admin-all-reservations.page.gohtml", &models.TemplateData{
-		Data: data,
+	render.Template(w, r, "manage-booking-reservation.page.gohtml", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
 	})
 }
 
-func (m *Repository) NewAdminReservationsCalendars(w http.ResponseWriter, r *http.Request) {
-	now := time.Now()
-	yr := r.URL.Query().Get("y")
-	mo := r.URL.Query().Get("m")
+// PostManageBookingDates moves the reservation of the guest to new dates when the room is available
+// and the stay rules allow them, at the price of the new dates
+func (m *Repository) PostManageBookingDates(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.managedReservation(w, r)
+	if !ok {
+		return
+	}
 
-	if yr != "" && mo != "" {
-		year, _ := strconv.Atoi(yr)
-		month, _ := strconv.Atoi(mo)
-		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
 	}
 
-	data := make(map[string]interface{})
-	data["now"] = now
+	if !m.canChangeReservation(res) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be changed")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
 
-	next := now.AddDate(0, 1, 0)
-	last := now.AddDate(0, -1, 0)
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse start date")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
 
-	nextMonth := next.Format("01")
-	nextMonthYear := next.Format("2006")
+	endDate, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse end date")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	reasons, err := m.stayRuleReasons(r.Context(), res.RoomID, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't check stay rules")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+	if len(reasons) > 0 {
+		m.App.Session.Put(r.Context(), "error", reasons[0])
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), res.RoomID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't find room")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	q, err := m.quote(r.Context(), room, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't calculate price")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	previous := res
+	res.StartDate, res.EndDate = startDate, endDate
+	res.Total, res.Currency, res.PriceLines = q.Total, q.Currency, q.Lines
+
+	err = m.DB.ChangeReservationDates(r.Context(), res)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, the room is not available for the new dates")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be changed")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't change reservation")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	td := &models.MailTemplateData{
+		Reservation: res,
+		Room:        res.Room,
+		StartDate:   res.StartDate,
+		EndDate:     res.EndDate,
+		Previous:    previous,
+		Links: map[string]string{
+			"manage":      m.manageBookingLink(res.ConfirmationCode),
+			"reservation": fmt.Sprintf("%s/admin/reservations/all/%d/show", m.App.BaseURL, res.ID),
+		},
+	}
+	m.queueMail(r, "reservation-changed.mail.gohtml", res.Email, td)
+	m.queueMail(r, "owner-reservation-changed.mail.gohtml", "owner@gmail.com", td)
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation has been changed")
+	http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+}
+
+// PostManageBookingCancel cancels the reservation of the guest and frees the room
+func (m *Repository) PostManageBookingCancel(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.managedReservation(w, r)
+	if !ok {
+		return
+	}
+
+	if !m.canChangeReservation(res) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.UpdateReservationStatus(r.Context(), res.ID, models.ReservationCancelled)
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't cancel reservation")
+		http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+		return
+	}
+
+	m.queueCancellationMails(r, res)
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation has been cancelled")
+	http.Redirect(w, r, "/manage-booking/reservation", http.StatusSeeOther)
+}
+
+func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[2])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid room id")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get room")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	q, err := m.quote(r.Context(), room, res.StartDate, res.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't calculate price")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = roomID
+	res.Total, res.Currency, res.PriceLines = q.Total, q.Currency, q.Lines
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// stayRuleReasons explains why the stay rules reject a stay in the room roomID, or in any room when
+// roomID is 0. Every distinct reason is returned once, no reasons means the rules allow the stay.
+func (m *Repository) stayRuleReasons(ctx context.Context, roomID int, start, end time.Time) ([]string, error) {
+	today := stayrules.Today()
+	err := stayrules.ValidateDates(start, end, today)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	rules, err := m.DB.StayRulesForStay(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	byRoom := stayrules.ByRoom(rules)
+	roomIDs := make([]int, 0, len(byRoom))
+	for id := range byRoom {
+		if roomID == 0 || id == roomID {
+			roomIDs = append(roomIDs, id)
+		}
+	}
+	sort.Ints(roomIDs)
+
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, id := range roomIDs {
+		err := stayrules.Check(byRoom[id], start, end, today)
+		if err != nil && !seen[err.Error()] {
+			seen[err.Error()] = true
+			reasons = append(reasons, err.Error())
+		}
+	}
+
+	return reasons, nil
+}
+
+// quote prices a stay in room with the room rates, its seasonal rates and the property wide pricing rules
+func (m *Repository) quote(ctx context.Context, room models.Room, start, end time.Time) (pricing.Quote, error) {
+	seasons, err := m.DB.SeasonalRatesForRoom(ctx, room.ID)
+	if err != nil {
+		return pricing.Quote{}, err
+	}
+
+	rules := m.App.Pricing
+	rules.NightlyPrice = room.BasePrice
+	rules.WeekendPrice = room.WeekendPrice
+	rules.Seasons = nil
+	for _, sr := range seasons {
+		rules.Seasons = append(rules.Seasons, pricing.Season{
+			Name:         sr.Name,
+			Start:        sr.StartDate,
+			End:          sr.EndDate,
+			NightlyPrice: sr.NightlyPrice,
+		})
+	}
+
+	return pricing.Calculate(rules, start, end)
+}
+
+func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid room id")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	sd := r.URL.Query().Get("s")
+	ed := r.URL.Query().Get("e")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, sd)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid start date")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	endDate, err := time.Parse(layout, ed)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid end date")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+	}
+
+	q, err := m.quote(r.Context(), room, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't calculate price")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	var res models.Reservation
+	res.RoomID = roomID
+	res.StartDate = startDate
+	res.EndDate = endDate
+	res.Room.RoomName = room.RoomName
+	res.Total, res.Currency, res.PriceLines = q.Total, q.Currency, q.Lines
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "login.page.gohtml", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.IsEmail("email")
+	form.Required("email", "password")
+	if !form.Valid() {
+		render.Template(w, r, "login.page.gohtml", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	ip := helpers.ClientIP(r)
+	if wait := m.loginWait(email, ip); wait > 0 {
+		m.App.Session.Put(r.Context(), "error",
+			fmt.Sprintf("Too many failed logins, please try again in %s", wait.Round(time.Second)))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		m.loginFailed(r, email, ip)
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get user")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	if user.TOTPEnabled {
+		// the password is right, the user is logged in after entering a code in the second step
+		m.App.Session.Put(r.Context(), "two_factor_user_id", user.ID)
+		m.App.Session.Put(r.Context(), "two_factor_started_at", time.Now().Unix())
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.logIn(w, r, user)
+}
+
+// logIn puts the user in the session once all login steps have passed
+func (m *Repository) logIn(w http.ResponseWriter, r *http.Request, user models.User) {
+	email := strings.ToLower(user.Email)
+	err := m.LoginByEmail.Reset(r.Context(), email)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't reset failed logins of %s: %v", email, err)
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Remove(r.Context(), "two_factor_user_id")
+	m.App.Session.Remove(r.Context(), "two_factor_started_at")
+	m.App.Session.Put(r.Context(), "user_id", user.ID)
+	m.App.Session.Put(r.Context(), "flash", "Success Login")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// loginWait returns how long the email and ip address have to wait before the next login attempt
+func (m *Repository) loginWait(email, ip string) time.Duration {
+	wait := m.LoginByEmail.Wait(email)
+	if ipWait := m.LoginByIP.Wait(ip); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// twoFactorTimeout is how long a user has to enter the code after entering the password
+const twoFactorTimeout = 5 * time.Minute
+
+// totpIssuer is the name authenticator apps show next to the codes
+const totpIssuer = "Bookings"
+
+// recoveryCodeCount is the number of recovery codes given when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+// pendingTwoFactorUser returns the user that entered the right password but not the code yet
+func (m *Repository) pendingTwoFactorUser(r *http.Request) (models.User, bool) {
+	id := m.App.Session.GetInt(r.Context(), "two_factor_user_id")
+	startedAt := time.Unix(m.App.Session.GetInt64(r.Context(), "two_factor_started_at"), 0)
+	if id == 0 || time.Since(startedAt) > twoFactorTimeout {
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil || !user.Active || !user.TOTPEnabled {
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+// ShowTwoFactorLogin shows the form for the code of the second login step
+func (m *Repository) ShowTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := m.pendingTwoFactorUser(r); !ok {
+		m.App.Session.Put(r.Context(), "error", "Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "login-two-factor.page.gohtml", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostTwoFactorLogin checks the code from the authenticator app or a recovery code and logs the user in
+func (m *Repository) PostTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, ok := m.pendingTwoFactorUser(r)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	email := strings.ToLower(user.Email)
+	ip := helpers.ClientIP(r)
+	if wait := m.loginWait(email, ip); wait > 0 {
+		m.App.Session.Put(r.Context(), "error",
+			fmt.Sprintf("Too many failed logins, please try again in %s", wait.Round(time.Second)))
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	ok, err = m.checkSecondFactor(r, user, r.Form.Get("code"))
+	if errors.Is(err, totp.ErrDecrypt) {
+		// recovery codes don't depend on the app secret, so they still work
+		m.App.ErrorLog.Printf("can't open the two-factor secret of user %d, the app secret changed since it was enabled", user.ID)
+		m.App.Session.Put(r.Context(), "error", "Codes from your authenticator app can't be checked right now, please use a recovery code")
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if !ok {
+		m.loginFailed(r, email, ip)
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.logIn(w, r, user)
+}
+
+// checkSecondFactor accepts a code from the authenticator app or an unused recovery code,
+// each code can only be used once
+func (m *Repository) checkSecondFactor(r *http.Request, user models.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	if _, err := strconv.Atoi(code); err == nil {
+		secret, err := totp.Open(m.App.Secret, user.TOTPSecret)
+		if err != nil {
+			return false, err
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+
+		return m.DB.UseTOTPStep(r.Context(), user.ID, step)
+	}
+
+	return m.DB.UseRecoveryCode(r.Context(), user.ID, tokens.Hash(totp.NormalizeRecoveryCode(code)))
+}
+
+// requiresTwoFactor reports whether the policy makes two-factor authentication mandatory for user
+func (m *Repository) requiresTwoFactor(user models.User) bool {
+	return m.App.TwoFactorAccessLevel > 0 && user.AccessLevel >= m.App.TwoFactorAccessLevel
+}
+
+// AdminTwoFactor shows the two-factor settings of the logged in user. When it is off,
+// a secret is prepared and shown as a QR code to scan with an authenticator app.
+func (m *Repository) AdminTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get user")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	intMap := make(map[string]int)
+
+	if user.TOTPEnabled {
+		intMap["enabled"] = 1
+		intMap["recovery_codes"], err = m.DB.CountRecoveryCodes(r.Context(), user.ID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get recovery codes")
+			http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+			return
+		}
+	} else {
+		// keep the prepared secret until it is confirmed, so a reload doesn't invalidate a scanned QR code
+		var secret string
+		if user.TOTPSecret != "" {
+			secret, err = totp.Open(m.App.Secret, user.TOTPSecret)
+		}
+
+		if user.TOTPSecret == "" || err != nil {
+			secret, err = m.newTOTPSecret(r, user.ID)
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+		}
+
+		stringMap["secret"] = secret
+		stringMap["uri"] = totp.ProvisioningURI(totpIssuer, user.Email, secret)
+	}
+
+	if m.requiresTwoFactor(user) {
+		intMap["required"] = 1
+	}
+
+	render.Template(w, r, "admin-two-factor.page.gohtml", &models.TemplateData{
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Form:      forms.New(nil),
+	})
+}
+
+// newTOTPSecret prepares a new secret for the user and returns it
+func (m *Repository) newTOTPSecret(r *http.Request, userID int) (string, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := totp.Seal(m.App.Secret, secret)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.DB.SetUserTOTPSecret(r.Context(), userID, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// AdminEnableTwoFactor turns on two-factor authentication once the user entered a valid code
+// for the prepared secret, and shows the recovery codes once
+func (m *Repository) AdminEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get user")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := totp.Open(m.App.Secret, user.TOTPSecret)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Please scan the QR code again")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	step, ok := totp.Validate(secret, r.Form.Get("code"), time.Now())
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := totp.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = tokens.Hash(totp.NormalizeRecoveryCode(c))
+	}
+
+	err = m.DB.EnableUserTOTP(r.Context(), user.ID, step, hashes)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't enable two-factor authentication")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication enabled")
+
+	data := make(map[string]interface{})
+	data["recovery_codes"] = codes
+	render.Template(w, r, "admin-two-factor-recovery.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminDisableTwoFactor turns off two-factor authentication after checking a code,
+// unless the policy requires it for the user's role
+func (m *Repository) AdminDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get user")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if m.requiresTwoFactor(user) {
+		m.App.Session.Put(r.Context(), "error", "Two-factor authentication is required for your role")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := m.checkSecondFactor(r, user, r.Form.Get("code"))
+	if err != nil || !ok {
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DisableUserTOTP(r.Context(), user.ID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't disable two-factor authentication")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication disabled")
+	http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+}
+
+// passwordResetPurpose binds reset tokens to password resets, so they can't be used elsewhere
+const passwordResetPurpose = "password-reset"
+
+// passwordResetTTL is how long a password reset link can be used
+const passwordResetTTL = time.Hour
+
+// ShowForgotPassword shows the form to ask for a password reset link
+func (m *Repository) ShowForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "forgot-password.page.gohtml", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link when the email belongs to an active user.
+// The response is the same either way, so it can't be used to find out who has an account.
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "forgot-password.page.gohtml", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	user, err := m.DB.GetUserByEmail(r.Context(), email)
+	if err == nil && user.Active {
+		m.sendPasswordReset(r, user)
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.App.ErrorLog.Printf("can't get user for password reset: %v", err)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "If the email belongs to an account, a reset link has been sent to it")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// sendPasswordReset stores a new reset token for user and queues the mail with the link
+func (m *Repository) sendPasswordReset(r *http.Request, user models.User) {
+	token, err := tokens.New(m.App.Secret, passwordResetPurpose)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't create password reset token: %v", err)
+		return
+	}
+
+	err = m.DB.InsertPasswordReset(r.Context(), user.ID, tokens.Hash(token), time.Now().Add(passwordResetTTL))
+	if err != nil {
+		m.App.ErrorLog.Printf("can't store password reset token: %v", err)
+		return
+	}
+
+	td := &models.MailTemplateData{
+		User: user,
+		Links: map[string]string{
+			"reset": fmt.Sprintf("%s/user/reset-password?token=%s", m.App.BaseURL, url.QueryEscape(token)),
+		},
+	}
+	m.queueMail(r, "password-reset.mail.gohtml", user.Email, td)
+}
+
+// ShowResetPassword shows the form to choose a new password when the token in the link is valid
+func (m *Repository) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if !m.validResetToken(r, token) {
+		m.App.Session.Put(r.Context(), "error", "This reset link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+	render.Template(w, r, "reset-password.page.gohtml", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      forms.New(nil),
+	})
+}
+
+// PostResetPassword sets the new password and uses up the token
+func (m *Repository) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	token := r.Form.Get("token")
+	if tokens.Verify(m.App.Secret, passwordResetPurpose, token) != nil {
+		m.App.Session.Put(r.Context(), "error", "This reset link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password", "password_confirm")
+	form.MinLength("password", minPasswordLength)
+	if r.Form.Get("password") != r.Form.Get("password_confirm") {
+		form.Errors.Add("password_confirm", "Passwords don't match")
+	}
+
+	if !form.Valid() {
+		stringMap := make(map[string]string)
+		stringMap["token"] = token
+		render.Template(w, r, "reset-password.page.gohtml", &models.TemplateData{
+			StringMap: stringMap,
+			Form:      form,
+		})
+		return
+	}
+
+	err = m.DB.ResetPassword(r.Context(), tokens.Hash(token), r.Form.Get("password"))
+	if errors.Is(err, repository.ErrInvalidResetToken) {
+		m.App.Session.Put(r.Context(), "error", "This reset link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't reset password")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Your password has been changed, please log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// validResetToken checks the signature of the token before looking it up
+func (m *Repository) validResetToken(r *http.Request, token string) bool {
+	if tokens.Verify(m.App.Secret, passwordResetPurpose, token) != nil {
+		return false
+	}
+
+	err := m.DB.CheckPasswordReset(r.Context(), tokens.Hash(token))
+	if err != nil {
+		if !errors.Is(err, repository.ErrInvalidResetToken) {
+			m.App.ErrorLog.Printf("can't check password reset token: %v", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// loginFailed counts a failed login for the email and the ip address and stores an audit record
+func (m *Repository) loginFailed(r *http.Request, email, ip string) {
+	err := m.LoginByEmail.Fail(r.Context(), email)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't store failed login of %s: %v", email, err)
+	}
+
+	err = m.LoginByIP.Fail(r.Context(), ip)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't store failed login from %s: %v", ip, err)
+	}
+
+	err = m.DB.InsertFailedLogin(r.Context(), email, ip)
+	if err != nil {
+		m.App.ErrorLog.Printf("can't store audit of failed login: %v", err)
+	}
+}
+
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	// the dashboard is where the other admin pages send errors to, so it shows its own errors in place
+	feeds, err := m.DB.AllExternalFeeds(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get external calendars")
+	}
+
+	failing := 0
+	for _, f := range feeds {
+		if f.Failing() {
+			failing++
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["external_feeds"] = feeds
+	data["failing_feeds"] = failing
+	render.Template(w, r, "admin-dashboard.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// NewAdminReservations lists the reservations that need attention, the pending ones unless another
+// status is asked for
+func (m *Repository) NewAdminReservations(w http.ResponseWriter, r *http.Request) {
+	m.reservationList(w, r, "admin-new-reservations.page.gohtml", models.ReservationPending)
+}
+
+// NewAdminAllReservations lists all reservations, or the ones with the status asked for
+func (m *Repository) NewAdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	m.reservationList(w, r, "admin-all-reservations.page.gohtml", "")
+}
+
+// reservationList renders a reservation list page filtered by the status query parameter, or by
+// status when there is none. An empty status lists every reservation.
+func (m *Repository) reservationList(w http.ResponseWriter, r *http.Request, page, status string) {
+	if r.URL.Query().Has("status") {
+		status = r.URL.Query().Get("status")
+	}
+	if status != "" && !models.IsReservationStatus(status) {
+		m.App.Session.Put(r.Context(), "error", "unknown reservation status")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	reservations, err := m.DB.AllReservations(r.Context(), status)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get all reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+	data["statuses"] = models.ReservationStatuses
+
+	stringMap := make(map[string]string)
+	stringMap["status"] = status
+
+	render.Template(w, r, page, &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+func (m *Repository) NewAdminReservationsCalendars(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	yr := r.URL.Query().Get("y")
+	mo := r.URL.Query().Get("m")
+
+	if yr != "" && mo != "" {
+		year, _ := strconv.Atoi(yr)
+		month, _ := strconv.Atoi(mo)
+		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	data := make(map[string]interface{})
+	data["now"] = now
+
+	next := now.AddDate(0, 1, 0)
+	last := now.AddDate(0, -1, 0)
+
+	nextMonth := next.Format("01")
+	nextMonthYear := next.Format("2006")
 
 	lastMonth := last.Format("01")
 	lastMonthYear := last.Format("2006")
 
 	stringMap := make(map[string]string)
-	stringMap["next_month"] = nextMonth
-	stringMap["next_month_year"] = nextMonthYear
-	stringMap["last_month"] = lastMonth
-	stringMap["last_month_year"] = lastMonthYear
+	stringMap["next_month"] = nextMonth
+	stringMap["next_month_year"] = nextMonthYear
+	stringMap["last_month"] = lastMonth
+	stringMap["last_month_year"] = lastMonthYear
+
+	stringMap["this_month"] = now.Format("01")
+	stringMap["this_month_year"] = now.Format("2006")
+
+	// get the first and last days of the month
+	currentYear, currentMonth, _ := now.Date()
+	currentLocation := now.Location()
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	intMap := make(map[string]int)
+	intMap["days_in_month"] = lastOfMonth.Day()
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get all rooms")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data["rooms"] = rooms
+
+	for _, x := range rooms {
+		reservationMap := make(map[string]int)
+		blockMap := make(map[string]int)
+		blockVersions := make(map[string]int)
+		blockTitles := make(map[string]string)
+		externalTitles := make(map[string]string)
+		var blocks []models.RoomRestriction
+
+		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
+			reservationMap[d.Format("2006-01-2")] = 0
+			blockMap[d.Format("2006-01-2")] = 0
+		}
+
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), x.ID, firstOfMonth, firstOfMonth.AddDate(0, 1, 0))
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get restrictions")
+			http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+			return
+		}
+
+		for _, y := range restrictions {
+			if y.ReservationID > 0 {
+				// it's a reservations, the room is free again on the departure day
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					reservationMap[d.Format("2006-01-2")] = y.ReservationID
+				}
+			} else if y.RestrictionID == models.RestrictionExternalBooking {
+				// it's booked on another site, only a new sync of its calendar changes it
+				title := externalBookingTitle(y)
+				for d := y.StartDate; !d.After(y.LastDay()); d = d.AddDate(0, 0, 1) {
+					externalTitles[d.Format("2006-01-2")] = title
+				}
+			} else {
+				// it's a block, covering every day up to its end date
+				title := blockTitle(y)
+				for d := y.StartDate; !d.After(y.LastDay()); d = d.AddDate(0, 0, 1) {
+					if _, ok := blockMap[d.Format("2006-01-2")]; ok {
+						blockMap[d.Format("2006-01-2")] = y.ID
+						blockVersions[d.Format("2006-01-2")] = y.Version
+						blockTitles[d.Format("2006-01-2")] = title
+					}
+				}
+				blocks = append(blocks, y)
+			}
+		}
+
+		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
+		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+		data[fmt.Sprintf("block_versions_%d", x.ID)] = blockVersions
+		data[fmt.Sprintf("block_titles_%d", x.ID)] = blockTitles
+		data[fmt.Sprintf("external_titles_%d", x.ID)] = externalTitles
+		data[fmt.Sprintf("blocks_%d", x.ID)] = blocks
+	}
+
+	data["block_reasons"] = models.BlockReasons
+
+	render.Template(w, r, "admin-reservations-calendars.page.gohtml", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// blockTitle describes an owner block for the calendar
+func blockTitle(b models.RoomRestriction) string {
+	reason := b.Reason
+	if reason == "" {
+		reason = "Owner block"
+	}
+
+	title := fmt.Sprintf("%s, %s to %s", reason, b.StartDate.Format("2006-01-02"), b.LastDay().Format("2006-01-02"))
+	if b.Note != "" {
+		title += ": " + b.Note
+	}
+	return title
+}
+
+// externalBookingTitle describes a booking made on another site for the calendar
+func externalBookingTitle(b models.RoomRestriction) string {
+	title := fmt.Sprintf("Booked on %s, %s to %s", b.Reason, b.StartDate.Format("2006-01-02"), b.LastDay().Format("2006-01-02"))
+	if b.Note != "" {
+		title += ": " + b.Note
+	}
+	return title
+}
+
+// NewAdminPostReservationsCalendars applies the blocks added and removed in the calendar. Every change is posted
+// explicitly: add_block is "room_id:day" and remove_block is "room_id:day:block_id:version", the version being the
+// one the block had when the calendar was shown. Either all changes are saved or none, and changes that conflict
+// with what others saved in the meantime are reported back.
+func (m *Repository) NewAdminPostReservationsCalendars(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	month, _ := strconv.Atoi(r.Form.Get("m"))
+	year, _ := strconv.Atoi(r.Form.Get("y"))
+	calendar := fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%02d", year, month)
+
+	changes, err := parseBlockChanges(r.PostForm)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid calendar changes")
+		http.Redirect(w, r, calendar, http.StatusSeeOther)
+		return
+	}
+
+	if len(changes) == 0 {
+		m.App.Session.Put(r.Context(), "flash", "No changes")
+		http.Redirect(w, r, calendar, http.StatusSeeOther)
+		return
+	}
+
+	conflicts, err := m.DB.ApplyBlockChanges(r.Context(), changes)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save changes")
+		http.Redirect(w, r, calendar, http.StatusSeeOther)
+		return
+	}
+
+	if len(conflicts) > 0 {
+		roomNames := make(map[int]string)
+		rooms, err := m.DB.AllRooms(r.Context())
+		if err == nil {
+			for _, room := range rooms {
+				roomNames[room.ID] = room.RoomName
+			}
+		}
+
+		msgs := make([]string, 0, len(conflicts))
+		for _, c := range conflicts {
+			name, ok := roomNames[c.Change.RoomID]
+			if !ok {
+				name = fmt.Sprintf("Room %d", c.Change.RoomID)
+			}
+			msgs = append(msgs, fmt.Sprintf("%s on %s: %s", name, c.Change.Day.Format("2006-01-02"), c.Reason))
+		}
+
+		m.App.Session.Put(r.Context(), "error", "Nothing was saved, the calendar changed in the meantime. "+
+			strings.Join(msgs, "; "))
+		http.Redirect(w, r, calendar, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, calendar, http.StatusSeeOther)
+}
+
+// parseBlockChanges reads the add_block and remove_block values posted by the calendar
+func parseBlockChanges(form url.Values) ([]models.BlockChange, error) {
+	var changes []models.BlockChange
+
+	for _, v := range form["add_block"] {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid block to add %q", v)
+		}
+
+		c, err := parseBlockChange(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	for _, v := range form["remove_block"] {
+		parts := strings.Split(v, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid block to remove %q", v)
+		}
+
+		c, err := parseBlockChange(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		c.Remove = true
+
+		c.BlockID, err = strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		c.Version, err = strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func parseBlockChange(roomID, day string) (models.BlockChange, error) {
+	var c models.BlockChange
+	var err error
+
+	c.RoomID, err = strconv.Atoi(roomID)
+	if err != nil {
+		return c, err
+	}
+	c.Day, err = time.Parse("2006-01-2", day)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// calendarURL is the admin calendar showing the month of t
+func calendarURL(t time.Time) string {
+	return fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", t.Format("2006"), t.Format("01"))
+}
+
+// parseBlockForm reads the days, reason and note of an owner block. The form has the first and the last
+// blocked day, the returned block ends the day after the last one.
+func parseBlockForm(r *http.Request) (models.RoomRestriction, string) {
+	layout := "2006-01-02"
+	var b models.RoomRestriction
+	var err error
+
+	b.StartDate, err = time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		return b, "Invalid start date"
+	}
+	lastDay, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil || lastDay.Before(b.StartDate) {
+		return b, "The last day must be on or after the first day"
+	}
+	b.EndDate = lastDay.AddDate(0, 0, 1)
+
+	b.Reason = r.Form.Get("reason")
+	valid := false
+	for _, reason := range models.BlockReasons {
+		if reason == b.Reason {
+			valid = true
+		}
+	}
+	if !valid {
+		return b, "Invalid reason"
+	}
+
+	b.Note = strings.TrimSpace(r.Form.Get("note"))
+	return b, ""
+}
+
+// blockErrorMessage turns an error saving a block into a message for the user
+func blockErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, repository.ErrRoomNotAvailable):
+		return "The room is already booked or blocked on some of these days"
+	case errors.Is(err, repository.ErrInvalidBlockRange):
+		return "The dates don't fit the block"
+	default:
+		return "can't save block"
+	}
+}
+
+// AdminPostBlock blocks a room for a range of days
+func (m *Repository) AdminPostBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	b, msg := parseBlockForm(r)
+	if msg != "" {
+		m.App.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	b.RoomID, err = strconv.Atoi(r.Form.Get("room_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "invalid room id")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.InsertBlock(r.Context(), b)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", blockErrorMessage(err))
+		http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room blocked")
+	http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+}
+
+// blockFromURI loads the owner block whose id is the fourth segment of the request uri
+func (m *Repository) blockFromURI(r *http.Request) (models.RoomRestriction, error) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		return models.RoomRestriction{}, err
+	}
+
+	return m.DB.GetBlockByID(r.Context(), id)
+}
+
+// AdminShowBlock shows an owner block to edit, split or unblock some of its days
+func (m *Repository) AdminShowBlock(w http.ResponseWriter, r *http.Request) {
+	b, err := m.blockFromURI(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get block")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["block"] = b
+	data["block_reasons"] = models.BlockReasons
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = b.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = b.LastDay().Format("2006-01-02")
+	stringMap["calendar_url"] = calendarURL(b.StartDate)
+
+	render.Template(w, r, "admin-block-show.page.gohtml", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminPostShowBlock changes the days, reason and note of an owner block
+func (m *Repository) AdminPostShowBlock(w http.ResponseWriter, r *http.Request) {
+	old, err := m.blockFromURI(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get block")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+	blockURL := fmt.Sprintf("/admin/blocks/%d/show", old.ID)
+
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	b, msg := parseBlockForm(r)
+	if msg != "" {
+		m.App.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+	b.ID = old.ID
+	b.RoomID = old.RoomID
+
+	err = m.DB.UpdateBlock(r.Context(), b)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", blockErrorMessage(err))
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Block saved")
+	http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+}
+
+// AdminSplitBlock splits an owner block in two, the second block starts on the posted split date
+func (m *Repository) AdminSplitBlock(w http.ResponseWriter, r *http.Request) {
+	b, err := m.blockFromURI(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get block")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+	blockURL := fmt.Sprintf("/admin/blocks/%d/show", b.ID)
+
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	at, err := time.Parse("2006-01-02", r.Form.Get("split_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid split date")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.SplitBlock(r.Context(), b.ID, at)
+	if errors.Is(err, repository.ErrInvalidBlockRange) {
+		m.App.Session.Put(r.Context(), "error", "The second block must start after the first day and on or before the last day")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't split block")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Block split")
+	http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+}
+
+// AdminUnblockDays unblocks the posted days of an owner block, the days around them stay blocked
+func (m *Repository) AdminUnblockDays(w http.ResponseWriter, r *http.Request) {
+	b, err := m.blockFromURI(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get block")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+	blockURL := fmt.Sprintf("/admin/blocks/%d/show", b.ID)
+
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	layout := "2006-01-02"
+	start, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid start date")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+	lastDay, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil || lastDay.Before(start) {
+		m.App.Session.Put(r.Context(), "error", "The last day must be on or after the first day")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+	if start.Before(b.StartDate) || lastDay.After(b.LastDay()) {
+		m.App.Session.Put(r.Context(), "error", "The days to unblock must be days of this block")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteBlockRange(r.Context(), b.RoomID, start, lastDay.AddDate(0, 0, 1))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't unblock days")
+		http.Redirect(w, r, blockURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Days unblocked")
+	http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+}
+
+// AdminDeleteBlock removes a whole owner block
+func (m *Repository) AdminDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	b, err := m.blockFromURI(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get block")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteBlockByID(r.Context(), b.ID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete block")
+		http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Block deleted")
+	http.Redirect(w, r, calendarURL(b.StartDate), http.StatusSeeOther)
+}
+
+// AdminProcessReservation confirms a pending reservation
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	m.setReservationStatus(w, r, models.ReservationConfirmed, "Reservation confirmed")
+}
+
+// AdminCheckInReservation records the arrival of the guest of a confirmed reservation
+func (m *Repository) AdminCheckInReservation(w http.ResponseWriter, r *http.Request) {
+	m.setReservationStatus(w, r, models.ReservationCheckedIn, "Guest checked in")
+}
+
+// AdminCheckOutReservation records the departure of a checked in guest
+func (m *Repository) AdminCheckOutReservation(w http.ResponseWriter, r *http.Request) {
+	m.setReservationStatus(w, r, models.ReservationCheckedOut, "Guest checked out")
+}
+
+// AdminNoShowReservation records that the guest of a confirmed reservation didn't arrive and frees the room
+func (m *Repository) AdminNoShowReservation(w http.ResponseWriter, r *http.Request) {
+	m.setReservationStatus(w, r, models.ReservationNoShow, "Reservation marked as no-show")
+}
+
+// setReservationStatus moves the reservation in the url to status and goes back to the page the
+// reservation was opened from
+func (m *Repository) setReservationStatus(w http.ResponseWriter, r *http.Request, status, flash string) {
+	exploded := strings.Split(r.RequestURI, "/")
+	reservationId, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	src := exploded[3]
+
+	err = m.DB.UpdateReservationStatus(r.Context(), reservationId, status)
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("The reservation can't be changed to %s", strings.ToLower(models.StatusName(status))))
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, reservationId), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't update reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", flash)
+
+	if year != "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+}
+
+func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	reservationId, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	src := exploded[3]
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	stringMap["year"] = year
+	stringMap["month"] = month
+
+	reservation, err := m.DB.GetReservationByID(r.Context(), reservationId)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	history, err := m.DB.AuditLog(r.Context(), models.AuditFilter{
+		EntityType: models.AuditReservation,
+		EntityID:   reservationId,
+	})
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation history")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = reservation
+	data["history"] = history
+	render.Template(w, r, "admin-reservation-show.page.gohtml", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      forms.New(nil),
+	})
+}
+
+func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	reservationId, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	src := exploded[3]
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	reservation, err := m.DB.GetReservationByID(r.Context(), reservationId)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	reservation.FirstName = r.Form.Get("first_name")
+	reservation.LastName = r.Form.Get("last_name")
+	reservation.Email = r.Form.Get("email")
+	reservation.PhoneNumber = r.Form.Get("phone_number")
+
+	err = m.DB.UpdateReservation(r.Context(), reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	year := r.Form.Get("year")
+	month := r.Form.Get("month")
+
+	m.App.Session.Put(r.Context(), "flash", "Changes Save")
+
+	if year != "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+}
+
+// AdminDeleteReservation cancels a reservation and frees the room, the reservation is kept for the records
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	m.setReservationStatus(w, r, models.ReservationCancelled, "Reservation cancelled")
+}
+
+// AdminMailQueue shows the queued mail with the given status, dead-letter mail by default
+func (m *Repository) AdminMailQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case models.MailStatusPending, models.MailStatusSending, models.MailStatusSent, models.MailStatusDead:
+	default:
+		status = models.MailStatusDead
+	}
+
+	mails, err := m.DB.MailByStatus(r.Context(), status)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get mail queue")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["status"] = status
+
+	data := make(map[string]interface{})
+	data["mails"] = mails
+
+	render.Template(w, r, "admin-mail-queue.page.gohtml", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminRetryMail puts a dead-letter message back in the mail queue
+func (m *Repository) AdminRetryMail(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	mailID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/mail-queue", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.RetryMail(r.Context(), mailID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't retry mail")
+		http.Redirect(w, r, "/admin/mail-queue", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Mail queued for retry")
+	http.Redirect(w, r, "/admin/mail-queue", http.StatusSeeOther)
+}
+
+// minPasswordLength is the shortest password accepted for users
+const minPasswordLength = 8
+
+// AdminUsers lists all users
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := m.DB.AllUsers(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get users")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+	render.Template(w, r, "admin-users.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowUser shows the form to edit a user, id 0 shows an empty form for a new user
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	userID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user := models.User{AccessLevel: models.AccessLevelStaff, Active: true}
+	if userID > 0 {
+		user, err = m.DB.GetUserByID(r.Context(), userID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get user")
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	render.Template(w, r, "admin-user-show.page.gohtml", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostShowUser creates or updates a user and sets a new password when one is given
+func (m *Repository) AdminPostShowUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	userID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user := models.User{Active: true}
+	if userID > 0 {
+		user, err = m.DB.GetUserByID(r.Context(), userID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get user")
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+	}
+
+	user.FirstName = r.Form.Get("first_name")
+	user.LastName = r.Form.Get("last_name")
+	user.Email = strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if userID == 0 {
+		form.Required("password")
+	}
+	if password != "" {
+		form.MinLength("password", minPasswordLength)
+	}
+
+	accessLevel, err := strconv.Atoi(r.Form.Get("access_level"))
+	if err != nil || accessLevel < models.AccessLevelStaff || accessLevel > models.AccessLevelOwner {
+		form.Errors.Add("access_level", "Invalid access level")
+	} else if userID == m.App.Session.GetInt(r.Context(), "user_id") && accessLevel < user.AccessLevel {
+		form.Errors.Add("access_level", "You can't lower your own access level")
+	} else {
+		user.AccessLevel = accessLevel
+	}
+
+	if form.Valid() {
+		if userID == 0 {
+			user.ID, err = m.DB.InsertUser(r.Context(), user, password)
+		} else {
+			err = m.DB.UpdateUser(r.Context(), user)
+		}
+
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			form.Errors.Add("email", "This email is already used by another user")
+		} else if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't save user")
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["user"] = user
+		render.Template(w, r, "admin-user-show.page.gohtml", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	if userID > 0 && password != "" {
+		err = m.DB.UpdateUserPassword(r.Context(), userID, password)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't reset password")
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminActivateUser lets a deactivated user log in again
+func (m *Repository) AdminActivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, true)
+}
+
+// AdminDeactivateUser stops a user from logging in without removing the account
+func (m *Repository) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, false)
+}
+
+func (m *Repository) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	exploded := strings.Split(r.RequestURI, "/")
+	userID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if userID == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't deactivate yourself")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.SetUserActive(r.Context(), userID, active)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't update user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if active {
+		m.App.Session.Put(r.Context(), "flash", "User activated")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "User deactivated")
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDeleteUser removes a user
+func (m *Repository) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	userID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if userID == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't delete yourself")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DeleteUser(r.Context(), userID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User deleted")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminLoginLockouts shows the emails and ip addresses with failed logins and the latest failed logins
+func (m *Repository) AdminLoginLockouts(w http.ResponseWriter, r *http.Request) {
+	failedLogins, err := m.DB.RecentFailedLogins(r.Context(), 50)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get failed logins")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["lockouts"] = append(m.LoginByEmail.Lockouts(), m.LoginByIP.Lockouts()...)
+	data["failed_logins"] = failedLogins
+	data["now"] = time.Now()
+	render.Template(w, r, "admin-login-lockouts.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// auditLogPageSize is the number of entries on a page of the audit log
+const auditLogPageSize = 50
+
+// AdminAuditLog shows the audit log newest first, filtered by entity, user and action
+func (m *Repository) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter := models.AuditFilter{
+		Action:     q.Get("action"),
+		EntityType: q.Get("entity_type"),
+		Limit:      auditLogPageSize + 1,
+	}
+
+	if filter.Action != "" && !contains(models.AuditActions, filter.Action) {
+		m.App.Session.Put(r.Context(), "error", "unknown audit action")
+		http.Redirect(w, r, "/admin/audit-log", http.StatusSeeOther)
+		return
+	}
+	if filter.EntityType != "" && !contains(models.AuditEntityTypes, filter.EntityType) {
+		m.App.Session.Put(r.Context(), "error", "unknown audit entity type")
+		http.Redirect(w, r, "/admin/audit-log", http.StatusSeeOther)
+		return
+	}
+
+	entityID, errEntity := queryInt(q, "entity_id", 0)
+	userID, errUser := queryInt(q, "user_id", 0)
+	page, errPage := queryInt(q, "page", 1)
+	if errEntity != nil || errUser != nil || errPage != nil || page < 1 {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/audit-log", http.StatusSeeOther)
+		return
+	}
+	filter.EntityID = entityID
+	filter.UserID = userID
+	filter.Offset = (page - 1) * auditLogPageSize
+
+	entries, err := m.DB.AuditLog(r.Context(), filter)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get audit log")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	users, err := m.DB.AllUsers(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get users")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	if len(entries) > auditLogPageSize {
+		entries = entries[:auditLogPageSize]
+		q.Set("page", strconv.Itoa(page+1))
+		stringMap["next_page"] = "/admin/audit-log?" + q.Encode()
+	}
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page-1))
+		stringMap["previous_page"] = "/admin/audit-log?" + q.Encode()
+	}
+	stringMap["action"] = filter.Action
+	stringMap["entity_type"] = filter.EntityType
+
+	intMap := make(map[string]int)
+	intMap["entity_id"] = filter.EntityID
+	intMap["user_id"] = filter.UserID
+	intMap["page"] = page
+
+	data := make(map[string]interface{})
+	data["entries"] = entries
+	data["users"] = users
+	data["actions"] = models.AuditActions
+	data["entity_types"] = models.AuditEntityTypes
+	render.Template(w, r, "admin-audit-log.page.gohtml", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
+
+// queryInt parses the query parameter key as an int, def when it is missing
+func queryInt(q url.Values, key string, def int) (int, error) {
+	if q.Get(key) == "" {
+		return def, nil
+	}
+	return strconv.Atoi(q.Get(key))
+}
+
+// contains reports whether list has s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminUnlockLogin forgets the failed logins of an email or ip address
+func (m *Repository) AdminUnlockLogin(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/login-lockouts", http.StatusSeeOther)
+		return
+	}
+
+	key := r.Form.Get("key")
+
+	switch r.Form.Get("kind") {
+	case "email":
+		err = m.LoginByEmail.Reset(r.Context(), key)
+	case "ip":
+		err = m.LoginByIP.Reset(r.Context(), key)
+	default:
+		m.App.Session.Put(r.Context(), "error", "unknown lockout")
+		http.Redirect(w, r, "/admin/login-lockouts", http.StatusSeeOther)
+		return
+	}
+
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't unlock login")
+		http.Redirect(w, r, "/admin/login-lockouts", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Unlocked %s", key))
+	http.Redirect(w, r, "/admin/login-lockouts", http.StatusSeeOther)
+}
+
+// AdminResetTwoFactor turns off two-factor authentication for a user who lost the device and the recovery codes
+func (m *Repository) AdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	userID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DisableUserTOTP(r.Context(), userID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't reset two-factor authentication")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminAPITokens lists the api tokens and the form to create one
+func (m *Repository) AdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	apiTokens, err := m.DB.AllAPITokens(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get api tokens")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["api_tokens"] = apiTokens
+	data["scopes"] = models.APITokenScopes
+	render.Template(w, r, "admin-api-tokens.page.gohtml", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostAPIToken creates an api token for the logged in user and shows it once, only its hash is stored
+func (m *Repository) AdminPostAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	t := models.APIToken{
+		UserID: m.App.Session.GetInt(r.Context(), "user_id"),
+		Name:   strings.TrimSpace(r.Form.Get("name")),
+		Scopes: r.Form["scopes"],
+	}
+
+	if t.Name == "" {
+		m.App.Session.Put(r.Context(), "error", "Please name the token after the script or tool that uses it")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	if len(t.Scopes) == 0 {
+		m.App.Session.Put(r.Context(), "error", "Please choose at least one scope")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	for _, scope := range t.Scopes {
+		if !contains(models.APITokenScopes, scope) {
+			m.App.Session.Put(r.Context(), "error", "Unknown scope")
+			http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+			return
+		}
+	}
+
+	token, err := tokens.New(m.App.Secret, apiTokenPurpose)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertAPIToken(r.Context(), t, tokens.Hash(token))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save api token")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API token created")
+
+	data := make(map[string]interface{})
+	data["api_token"] = t
+	data["token"] = token
+	render.Template(w, r, "admin-api-token-created.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRevokeAPIToken stops an api token from being accepted
+func (m *Repository) AdminRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.RevokeAPIToken(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "The api token doesn't exist or was already revoked")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't revoke api token")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API token revoked")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+}
+
+// AdminRooms lists the room catalog
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get rooms")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	render.Template(w, r, "admin-rooms.page.gohtml", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowRoom shows the form to edit a room, id 0 shows an empty form for a new room
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	room := models.Room{Capacity: 2}
+	var rates []models.SeasonalRate
+	var stayRules []models.StayRule
+	if roomID > 0 {
+		room, err = m.DB.GetRoomByID(r.Context(), roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+
+		rates, err = m.DB.SeasonalRatesForRoom(r.Context(), roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get seasonal rates")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+
+		stayRules, err = m.DB.StayRulesForRoom(r.Context(), roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get stay rules")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["seasonal_rates"] = rates
+	data["stay_rules"] = stayRules
+	data["base_price"] = formatCents(room.BasePrice)
+	data["weekend_price"] = ""
+	if room.WeekendPrice > 0 {
+		data["weekend_price"] = formatCents(room.WeekendPrice)
+	}
+	render.Template(w, r, "admin-room-show.page.gohtml", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostShowRoom creates or updates a room of the catalog
+func (m *Repository) AdminPostShowRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	var room models.Room
+	if roomID > 0 {
+		room, err = m.DB.GetRoomByID(r.Context(), roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+	}
+
+	room.RoomName = r.Form.Get("room_name")
+	room.Slug = strings.ToLower(strings.TrimSpace(r.Form.Get("slug")))
+	room.Description = r.Form.Get("description")
+	room.Amenities = nil
+	for _, a := range strings.Split(r.Form.Get("amenities"), "\n") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			room.Amenities = append(room.Amenities, a)
+		}
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "slug", "capacity", "base_price")
+	form.Data.Set("slug", room.Slug)
+	form.IsSlug("slug")
+
+	capacity, err := strconv.Atoi(r.Form.Get("capacity"))
+	if err != nil || capacity < 1 {
+		form.Errors.Add("capacity", "Capacity must be at least 1")
+	} else {
+		room.Capacity = capacity
+	}
+
+	basePrice, err := parseCents(r.Form.Get("base_price"))
+	if err != nil {
+		form.Errors.Add("base_price", "Invalid price")
+	} else {
+		room.BasePrice = basePrice
+	}
+
+	room.WeekendPrice = 0
+	if wp := r.Form.Get("weekend_price"); strings.TrimSpace(wp) != "" {
+		room.WeekendPrice, err = parseCents(wp)
+		if err != nil {
+			form.Errors.Add("weekend_price", "Invalid price")
+		}
+	}
+
+	if form.Valid() {
+		if roomID == 0 {
+			room.ID, err = m.DB.InsertRoom(r.Context(), room)
+		} else {
+			err = m.DB.UpdateRoom(r.Context(), room)
+		}
+
+		if errors.Is(err, repository.ErrDuplicateSlug) {
+			form.Errors.Add("slug", "This slug is already used by another room")
+		} else if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't save room")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["room"] = room
+		render.Template(w, r, "admin-room-show.page.gohtml", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminDeleteRoom removes a room that has no reservations
+func (m *Repository) AdminDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
 
-	stringMap["this_month"] = now.Format("01")
-	stringMap["this_month_year"] = now.Format("2006")
+	err = m.DB.DeleteRoom(r.Context(), roomID)
+	if errors.Is(err, repository.ErrRoomHasReservations) {
+		m.App.Session.Put(r.Context(), "error", "This room has reservations and can't be deleted")
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", roomID), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
 
-	// get the first and last days of the month
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+	for _, p := range room.Photos {
+		m.removeFiles(r.Context(), p.Files)
+	}
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
+	m.App.Session.Put(r.Context(), "flash", "Room deleted")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
 
-	rooms, err := m.DB.AllRooms()
+// maxPhotosPerUpload limits how many photos can be uploaded at once
+const maxPhotosPerUpload = 10
+
+// AdminUploadRoomPhotos stores the uploaded photos of a room resized to every images.Sizes variant
+func (m *Repository) AdminUploadRoomPhotos(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get all rooms")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 		return
 	}
+	roomURL := fmt.Sprintf("/admin/rooms/%d/show", roomID)
 
-	data["rooms"] = rooms
+	// leave some room for the multipart headers and the other form fields
+	maxRequestSize := int64(maxPhotosPerUpload*images.MaxUploadSize + 1<<20)
+	if r.ContentLength > maxRequestSize {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Upload at most %d photos of %d MB at once", maxPhotosPerUpload, images.MaxUploadSize>>20))
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 
-	for _, x := range rooms {
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
+	err = r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
 
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
+	files := r.MultipartForm.File["photos"]
+	if len(files) == 0 {
+		m.App.Session.Put(r.Context(), "error", "Choose at least one photo")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	if len(files) > maxPhotosPerUpload {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Upload at most %d photos at once", maxPhotosPerUpload))
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
 
-		restrictions, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
+	var failed []string
+	uploaded := 0
+	for _, fh := range files {
+		err = m.saveRoomPhoto(r.Context(), roomID, fh)
 		if err != nil {
-			m.App.Session.Put(r.Context(), "error", "can't get restrictions")
-			http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
-			return
+			failed = append(failed, fmt.Sprintf("%s: %s", fh.Filename, photoErrorMessage(err)))
+			continue
 		}
+		uploaded++
+	}
 
-		for _, y := range restrictions {
-			if y.ReservationID > 0 {
-				// it's a reservations
-				for d := y.StartDate; d.After(y.EndDate) == false; d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = y.ReservationID
-				}
-			} else {
-				// it's a block
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
-			}
-		}
+	if len(failed) > 0 {
+		m.App.Session.Put(r.Context(), "error", strings.Join(failed, "; "))
+	}
+	if uploaded > 0 {
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d photo(s) uploaded", uploaded))
+	}
+	http.Redirect(w, r, roomURL, http.StatusSeeOther)
+}
 
-		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+// saveRoomPhoto resizes one uploaded photo, stores the variants and adds the photo to the room
+func (m *Repository) saveRoomPhoto(ctx context.Context, roomID int, fh *multipart.FileHeader) error {
+	if fh.Size > images.MaxUploadSize {
+		return images.ErrTooLarge
+	}
 
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	f, err := fh.Open()
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	render.Template(w, r, "admin-reservations-calendars.page.gohtml", &models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		IntMap:    intMap,
-	})
-}
+	variants, err := images.Process(f)
+	if err != nil {
+		return err
+	}
 
-func (m *Repository) NewAdminPostReservationsCalendars(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	base, err := randomName()
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't parse form")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
-		return
+		return err
 	}
 
-	month, _ := strconv.Atoi(r.Form.Get("m"))
-	year, _ := strconv.Atoi(r.Form.Get("y"))
+	photo := models.RoomPhoto{RoomID: roomID}
+	for _, v := range variants {
+		name := fmt.Sprintf("rooms/%d/%s-%s%s", roomID, base, v.Name, v.Ext)
+		err = m.Files.Save(ctx, name, bytes.NewReader(v.Data))
+		if err != nil {
+			m.removeFiles(ctx, photo.Files)
+			return err
+		}
+		photo.Files = append(photo.Files, name)
+
+		switch v.Name {
+		case "thumb":
+			photo.ThumbURL = m.Files.URL(name)
+		case "medium":
+			photo.MediumURL = m.Files.URL(name)
+		case "large":
+			photo.URL = m.Files.URL(name)
+		}
+	}
 
-	// process blocks
-	rooms, err := m.DB.AllRooms()
+	_, err = m.DB.InsertRoomPhoto(ctx, photo)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get all rooms")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
-		return
+		m.removeFiles(ctx, photo.Files)
+		return err
 	}
 
-	form := forms.New(r.PostForm)
+	return nil
+}
 
-	for _, x := range rooms {
-		// get the block map from the session. loop through entire map, if we have an entry in the map
-		// that does not exist in our posted data, and if the restriction id > 0, then it is a block we need to remove
-		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
-		for name, value := range curMap {
-			// ok will be false if the value is not in the map
-			if val, ok := curMap[name]; ok {
-				// only pay attention to values > 0, and that are not in the form post
-				// the rest are just placeholders for days without blocks
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
-						// delete the restriction by id
-						err := m.DB.DeleteBlockByID(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
-		}
+// photoErrorMessage explains why a photo was rejected without leaking internal errors
+func photoErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, images.ErrTooLarge), errors.Is(err, images.ErrUnsupportedType), errors.Is(err, images.ErrTooManyPixels):
+		return err.Error()
+	default:
+		return "can't save photo"
 	}
+}
 
-	// now handle new blocks
-	for name, _ := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			t, _ := time.Parse("2006-01-2", exploded[3])
-			// insert new block
-			err := m.DB.InsertBlockForRoom(roomID, t)
-			if err != nil {
-				log.Println(err)
-			}
-		}
+// randomName returns a random file name, so uploaded files can't be guessed or overwritten
+func randomName() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	return hex.EncodeToString(b), nil
 }
 
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
-	reservationId, err := strconv.Atoi(exploded[4])
+// removeFiles deletes files from the file store, failures are only logged since the photo is already gone
+func (m *Repository) removeFiles(ctx context.Context, files []string) {
+	for _, name := range files {
+		err := m.Files.Delete(ctx, name)
+		if err != nil {
+			m.App.ErrorLog.Printf("can't delete file %s: %v", name, err)
+		}
+	}
+}
+
+// AdminDeleteRoomPhoto removes a photo and its files
+func (m *Repository) AdminDeleteRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	photo, ok := m.roomPhotoFromURI(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DeleteRoomPhoto(r.Context(), photo.ID)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't parse to int")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't delete photo")
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", photo.RoomID), http.StatusSeeOther)
 		return
 	}
 
-	src := exploded[3]
+	m.removeFiles(r.Context(), photo.Files)
+
+	m.App.Session.Put(r.Context(), "flash", "Photo deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", photo.RoomID), http.StatusSeeOther)
+}
+
+// AdminCoverRoomPhoto makes a photo the cover of its room
+func (m *Repository) AdminCoverRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	photo, ok := m.roomPhotoFromURI(w, r)
+	if !ok {
+		return
+	}
 
-	err = m.DB.UpdateProcessedForReservation(reservationId, 1)
+	err := m.DB.SetRoomCoverPhoto(r.Context(), photo.ID)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't update reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't update photo")
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", photo.RoomID), http.StatusSeeOther)
 		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	m.App.Session.Put(r.Context(), "flash", "Cover photo changed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", photo.RoomID), http.StatusSeeOther)
+}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
+// AdminMoveUpRoomPhoto shows a photo one place earlier
+func (m *Repository) AdminMoveUpRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	m.moveRoomPhoto(w, r, true)
+}
 
-	if year != "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+// AdminMoveDownRoomPhoto shows a photo one place later
+func (m *Repository) AdminMoveDownRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	m.moveRoomPhoto(w, r, false)
+}
+
+func (m *Repository) moveRoomPhoto(w http.ResponseWriter, r *http.Request, up bool) {
+	photo, ok := m.roomPhotoFromURI(w, r)
+	if !ok {
 		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	err := m.DB.MoveRoomPhoto(r.Context(), photo.ID, up)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't update photo")
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/show", photo.RoomID), http.StatusSeeOther)
 }
 
-func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+// roomPhotoFromURI loads the photo of /admin/<action>/{id}/do, it redirects and returns false when that fails
+func (m *Repository) roomPhotoFromURI(w http.ResponseWriter, r *http.Request) (models.RoomPhoto, bool) {
 	exploded := strings.Split(r.RequestURI, "/")
-	reservationId, err := strconv.Atoi(exploded[4])
+	photoID, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't parse to int")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
-		return
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return models.RoomPhoto{}, false
 	}
 
-	src := exploded[3]
+	photo, err := m.DB.GetRoomPhotoByID(r.Context(), photoID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get photo")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return models.RoomPhoto{}, false
+	}
 
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	return photo, true
+}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+// AdminPostSeasonalRate adds a seasonal rate to a room
+func (m *Repository) AdminPostSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+	roomURL := fmt.Sprintf("/admin/rooms/%d/show", roomID)
 
-	stringMap["year"] = year
-	stringMap["month"] = month
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+
+	layout := "2006-01-02"
+	rate := models.SeasonalRate{
+		RoomID: roomID,
+		Name:   strings.TrimSpace(r.Form.Get("name")),
+	}
 
-	reservation, err := m.DB.GetReservationByID(reservationId)
+	rate.StartDate, err = time.Parse(layout, r.Form.Get("start_date"))
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "Invalid start date")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	rate.EndDate, err = time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil || rate.EndDate.Before(rate.StartDate) {
+		m.App.Session.Put(r.Context(), "error", "The last night must be on or after the first night")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	rate.NightlyPrice, err = parseCents(r.Form.Get("nightly_price"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid nightly price")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
 		return
 	}
+	if rate.Name == "" {
+		rate.Name = "Seasonal rate"
+	}
 
-	data := make(map[string]interface{})
-	data["reservation"] = reservation
-	render.Template(w, r, "admin-reservation-show.page.gohtml", &models.TemplateData{
-		Data:      data,
-		StringMap: stringMap,
-		Form:      forms.New(nil),
-	})
+	_, err = m.DB.InsertSeasonalRate(r.Context(), rate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save seasonal rate")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Seasonal rate added")
+	http.Redirect(w, r, roomURL, http.StatusSeeOther)
 }
 
-func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// AdminDeleteSeasonalRate removes a seasonal rate of a room
+func (m *Repository) AdminDeleteSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't parse form")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 		return
 	}
+	roomURL := fmt.Sprintf("/admin/rooms/%d/show", roomID)
 
-	exploded := strings.Split(r.RequestURI, "/")
-	reservationId, err := strconv.Atoi(exploded[4])
+	id, err := strconv.Atoi(exploded[4])
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't parse to int")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
 		return
 	}
 
-	src := exploded[3]
+	err = m.DB.DeleteSeasonalRate(r.Context(), roomID, id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't delete seasonal rate")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
 
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	m.App.Session.Put(r.Context(), "flash", "Seasonal rate deleted")
+	http.Redirect(w, r, roomURL, http.StatusSeeOther)
+}
 
-	reservation, err := m.DB.GetReservationByID(reservationId)
+// AdminPostStayRule adds a stay rule to a room
+func (m *Repository) AdminPostStayRule(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[3])
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 		return
 	}
+	roomURL := fmt.Sprintf("/admin/rooms/%d/show", roomID)
 
-	reservation.FirstName = r.Form.Get("first_name")
-	reservation.LastName = r.Form.Get("last_name")
-	reservation.Email = r.Form.Get("email")
-	reservation.PhoneNumber = r.Form.Get("phone_number")
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+
+	layout := "2006-01-02"
+	rule := models.StayRule{
+		RoomID:            roomID,
+		ClosedToArrival:   r.Form.Get("closed_to_arrival") != "",
+		ClosedToDeparture: r.Form.Get("closed_to_departure") != "",
+	}
 
-	err = m.DB.UpdateReservation(reservation)
+	rule.StartDate, err = time.Parse(layout, r.Form.Get("start_date"))
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "Invalid start date")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+	rule.EndDate, err = time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil || rule.EndDate.Before(rule.StartDate) {
+		m.App.Session.Put(r.Context(), "error", "The last day must be on or after the first day")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
 		return
 	}
 
-	year := r.Form.Get("year")
-	month := r.Form.Get("month")
+	for _, wd := range r.Form["weekdays"] {
+		d, err := strconv.Atoi(wd)
+		if err != nil || d < int(time.Sunday) || d > int(time.Saturday) {
+			m.App.Session.Put(r.Context(), "error", "Invalid weekday")
+			http.Redirect(w, r, roomURL, http.StatusSeeOther)
+			return
+		}
+		rule.Weekdays = append(rule.Weekdays, time.Weekday(d))
+	}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes Save")
+	limits := []struct {
+		field string
+		dst   *int
+	}{
+		{"min_nights", &rule.MinNights},
+		{"max_nights", &rule.MaxNights},
+		{"min_lead_days", &rule.MinLeadDays},
+		{"max_lead_days", &rule.MaxLeadDays},
+	}
+	for _, l := range limits {
+		v := strings.TrimSpace(r.Form.Get(l.field))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			m.App.Session.Put(r.Context(), "error", "Nights and days must be positive whole numbers")
+			http.Redirect(w, r, roomURL, http.StatusSeeOther)
+			return
+		}
+		*l.dst = n
+	}
 
-	if year != "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	if (rule.MaxNights > 0 && rule.MaxNights < rule.MinNights) || (rule.MaxLeadDays > 0 && rule.MaxLeadDays < rule.MinLeadDays) {
+		m.App.Session.Put(r.Context(), "error", "A maximum can't be less than its minimum")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
 		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	if rule.MinNights == 0 && rule.MaxNights == 0 && rule.MinLeadDays == 0 && rule.MaxLeadDays == 0 &&
+		!rule.ClosedToArrival && !rule.ClosedToDeparture {
+		m.App.Session.Put(r.Context(), "error", "The stay rule doesn't restrict anything")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.InsertStayRule(r.Context(), rule)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't save stay rule")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Stay rule added")
+	http.Redirect(w, r, roomURL, http.StatusSeeOther)
 }
 
-func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+// AdminDeleteStayRule removes a stay rule of a room
+func (m *Repository) AdminDeleteStayRule(w http.ResponseWriter, r *http.Request) {
 	exploded := strings.Split(r.RequestURI, "/")
-	reservationId, err := strconv.Atoi(exploded[4])
+	roomID, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't parse to int")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 		return
 	}
+	roomURL := fmt.Sprintf("/admin/rooms/%d/show", roomID)
 
-	src := exploded[3]
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse to int")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
+		return
+	}
 
-	err = m.DB.DeleteReservation(reservationId)
+	err = m.DB.DeleteStayRule(r.Context(), roomID, id)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't update reservation")
-		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "can't delete stay rule")
+		http.Redirect(w, r, roomURL, http.StatusSeeOther)
 		return
 	}
 
-	month := r.URL.Query().Get("m")
-	year := r.URL.Query().Get("y")
+	m.App.Session.Put(r.Context(), "flash", "Stay rule deleted")
+	http.Redirect(w, r, roomURL, http.StatusSeeOther)
+}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation deleted")
+// formatCents formats cents for a price input, like 120.50
+func formatCents(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
 
-	if year != "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
-		return
+// parseCents parses a price like "120" or "120.50" into cents
+func parseCents(s string) (int, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if whole == "" || len(frac) > 2 || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("invalid price %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	units, err := strconv.Atoi(whole)
+	if err != nil {
+		return 0, err
+	}
+	cents, _ := strconv.Atoi(frac)
+
+	return units*100 + cents, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
 }
@@ -1,10 +1,19 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/ismail118/bookings-app/internal/filestore"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"github.com/ismail118/bookings-app/internal/totp"
+	"image"
+	"image/png"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -28,16 +37,38 @@ var Tests = []struct {
 	{"about", "/about", "GET", http.StatusOK},
 	{"room-one", "/room-one", "GET", http.StatusOK},
 	{"room-two", "/room-two", "GET", http.StatusOK},
+	{"rooms", "/rooms", "GET", http.StatusOK},
+	{"room", "/rooms/room-one", "GET", http.StatusOK},
+	{"room-not-found", "/rooms/no-such-room", "GET", http.StatusOK},
 	{"search-availability", "/search-availability", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
+	{"manage booking", "/manage-booking", "GET", http.StatusOK},
 	{"non-exist-routes", "/this/not/exist", "GET", http.StatusNotFound},
 	// new routes
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/logout", "GET", http.StatusOK},
+	{"forgot password", "/user/forgot-password", "GET", http.StatusOK},
 	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
 	{"new res", "/admin/reservations-new", "GET", http.StatusOK},
 	{"all res", "/admin/reservations-all", "GET", http.StatusOK},
+	{"cancelled res", "/admin/reservations-all?status=cancelled", "GET", http.StatusOK},
+	{"confirmed new res", "/admin/reservations-new?status=confirmed", "GET", http.StatusOK},
 	{"all res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
+	{"mail queue", "/admin/mail-queue", "GET", http.StatusOK},
+	{"mail queue pending", "/admin/mail-queue?status=pending", "GET", http.StatusOK},
+	{"external feeds", "/admin/external-feeds", "GET", http.StatusOK},
+	{"users", "/admin/users", "GET", http.StatusOK},
+	{"new user", "/admin/users/0/show", "GET", http.StatusOK},
+	{"show user", "/admin/users/2/show", "GET", http.StatusOK},
+	{"login lockouts", "/admin/login-lockouts", "GET", http.StatusOK},
+	{"audit log", "/admin/audit-log", "GET", http.StatusOK},
+	{"audit log filtered", "/admin/audit-log?entity_type=reservation&entity_id=1&action=update&page=2", "GET", http.StatusOK},
+	{"api tokens", "/admin/api-tokens", "GET", http.StatusOK},
+	{"calendar feeds", "/admin/calendar-feeds", "GET", http.StatusOK},
+	{"admin rooms", "/admin/rooms", "GET", http.StatusOK},
+	{"new room", "/admin/rooms/0/show", "GET", http.StatusOK},
+	{"show room", "/admin/rooms/1/show", "GET", http.StatusOK},
+	{"show room with photos", "/admin/rooms/2/show", "GET", http.StatusOK},
 }
 
 func TestHandlers(t *testing.T) {
@@ -405,6 +436,64 @@ func TestRepository_PostReservation(t *testing.T) {
 	if rr.Code != http.StatusSeeOther {
 		t.Errorf("PostReservation handler returend wrong response code for fail insert restriction: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
+
+	// test for room booked by someone else in the meantime
+	reqBody = url.Values{}
+	reqBody.Add("start_date", "2050-01-15")
+	reqBody.Add("end_date", "2050-01-16")
+	reqBody.Add("first_name", "ismail")
+	reqBody.Add("last_name", "alfiyasin")
+	reqBody.Add("email", "alfiyasin@gmail.com")
+	reqBody.Add("phone_number", "555-555-555")
+	reqBody.Add("room_id", "1")
+
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody.Encode()))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostReservation handler returend wrong response code for room no longer available: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/search-availability" {
+		t.Errorf("PostReservation handler returend wrong location for room no longer available: got %s, wanted %s", actualLoc.String(), "/search-availability")
+	}
+
+	if msg := session.GetString(ctx, "error"); !strings.Contains(msg, "no longer available") {
+		t.Errorf("PostReservation handler should tell the guest the room is no longer available, got %q", msg)
+	}
+
+	// test stay rules are checked again before booking
+	reqBody.Set("start_date", "2050-03-01")
+	reqBody.Set("end_date", "2050-03-02")
+
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody.Encode()))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(rr, req)
+
+	actualLoc, _ = rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/search-availability" {
+		t.Errorf("PostReservation handler should reject a stay breaking the stay rules: got %d %s", rr.Code, actualLoc)
+	}
+
+	if msg := session.GetString(ctx, "error"); msg != "A minimum stay of 3 nights applies to arrivals on 2050-03-01" {
+		t.Errorf("PostReservation handler should explain the stay rule, got %q", msg)
+	}
 }
 
 func TestRepository_PostAvailability(t *testing.T) {
@@ -471,7 +560,7 @@ func TestRepository_PostAvailability(t *testing.T) {
 	}
 
 	// test fail search available room
-	postData = fmt.Sprintf("&%s&%s", "start=2050-01-02", "end=2050-01-02")
+	postData = fmt.Sprintf("&%s&%s", "start=2050-01-02", "end=2050-01-03")
 	req, _ = http.NewRequest(http.MethodPost, "/search-availability", strings.NewReader(postData))
 	ctx = getCtx(req)
 	req = req.WithContext(ctx)
@@ -487,7 +576,7 @@ func TestRepository_PostAvailability(t *testing.T) {
 	}
 
 	// test no available room
-	postData = fmt.Sprintf("&%s&%s", "start=2022-01-02", "end=2022-01-02")
+	postData = fmt.Sprintf("&%s&%s", "start=2050-02-01", "end=2050-02-02")
 	req, _ = http.NewRequest(http.MethodPost, "/search-availability", strings.NewReader(postData))
 	ctx = getCtx(req)
 	req = req.WithContext(ctx)
@@ -503,6 +592,72 @@ func TestRepository_PostAvailability(t *testing.T) {
 	}
 }
 
+var testAvailabilityStayRules = []struct {
+	name             string
+	start            string
+	end              string
+	expectationError string
+}{
+	{"no-rules", "2050-02-01", "2050-02-02", "No Availability"},
+	{"end-before-start", "2050-02-03", "2050-02-01", "The departure date must be after the arrival date"},
+	{"same-day", "2050-02-03", "2050-02-03", "The departure date must be after the arrival date"},
+	{"past-arrival", "2022-01-02", "2022-01-03", "The arrival date can't be in the past"},
+	{"rules", "2050-03-01", "2050-03-02", "No Availability: A minimum stay of 3 nights applies to arrivals on 2050-03-01; Arrivals are not possible on 2050-03-01"},
+}
+
+func TestRepository_PostAvailabilityStayRules(t *testing.T) {
+	for _, e := range testAvailabilityStayRules {
+		postData := url.Values{}
+		postData.Add("start", e.start)
+		postData.Add("end", e.end)
+
+		req, _ := http.NewRequest(http.MethodPost, "/search-availability", strings.NewReader(postData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostAvailability).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != "/search-availability" {
+			t.Errorf("failed %s : wrong location, got %s", e.name, rrLoc.String())
+		}
+
+		if msg := session.GetString(ctx, "error"); msg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, msg, e.expectationError)
+		}
+	}
+}
+
+func TestRepository_CancelledRequest(t *testing.T) {
+	postData := fmt.Sprintf("&%s&%s", "start=2050-01-01", "end=2050-01-02")
+	req, _ := http.NewRequest(http.MethodPost, "/search-availability", strings.NewReader(postData))
+	ctx, cancel := context.WithCancel(getCtx(req))
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// the client went away before the handler reached the database
+	cancel()
+
+	handler := http.HandlerFunc(Repo.PostAvailability)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostAvailability handler returend wrong response code for cancelled request: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	if msg := session.GetString(ctx, "error"); msg != "can't search availability" {
+		t.Errorf("PostAvailability handler should abort the search for cancelled request, got error %q", msg)
+	}
+}
+
 func TestRepository_PostAvailabilityJSON(t *testing.T) {
 	postData := fmt.Sprintf("&%s&%s&%s", "start=2050-01-01", "end=2050-01-02", "room_id=1")
 	req, _ := http.NewRequest(http.MethodPost, "/search-availability-json", strings.NewReader(postData))
@@ -534,6 +689,44 @@ func TestRepository_PostAvailabilityJSON(t *testing.T) {
 		t.Errorf("PostReservation handler returend wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
 	}
 
+	// test invalid dates are rejected instead of searching with zero dates
+	postData = fmt.Sprintf("&%s&%s&%s", "start=soon", "end=2050-01-02", "room_id=1")
+	req, _ = http.NewRequest(http.MethodPost, "/search-availability-json", strings.NewReader(postData))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostAvailabilityJSON).ServeHTTP(rr, req)
+
+	var resp jsonResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal("failed to parse json", err)
+	}
+	if resp.Ok || resp.Message != "Invalid arrival or departure date" {
+		t.Errorf("PostAvailabilityJSON handler should reject invalid dates, got %+v", resp)
+	}
+
+	// test stay rules explain why the room is not available
+	postData = fmt.Sprintf("&%s&%s&%s", "start=2050-03-01", "end=2050-03-02", "room_id=1")
+	req, _ = http.NewRequest(http.MethodPost, "/search-availability-json", strings.NewReader(postData))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostAvailabilityJSON).ServeHTTP(rr, req)
+
+	resp = jsonResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal("failed to parse json", err)
+	}
+	if resp.Ok || resp.Message != "A minimum stay of 3 nights applies to arrivals on 2050-03-01" {
+		t.Errorf("PostAvailabilityJSON handler should explain the stay rule, got %+v", resp)
+	}
+
 	// test fail search availability
 	postData = fmt.Sprintf("&%s&%s&%s", "start=2050-01-01", "end=2050-01-02", "room_id=3")
 	req, _ = http.NewRequest(http.MethodPost, "/search-availability-json", strings.NewReader(postData))
@@ -765,6 +958,20 @@ var loginTest = []struct {
 		`action="/user/login"`,
 		"",
 	},
+	{
+		"two-factor-user",
+		"totp@here.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login/two-factor",
+	},
+	{
+		"email-in-other-case",
+		"TOTP@Here.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login/two-factor",
+	},
 }
 
 func TestLogin(t *testing.T) {
@@ -814,6 +1021,157 @@ func TestLogin(t *testing.T) {
 
 }
 
+func TestLogin_Throttle(t *testing.T) {
+	repo := NewTestRepo(&app)
+
+	login := func(email string) (int, string) {
+		postedData := url.Values{}
+		postedData.Add("email", email)
+		postedData.Add("password", "password")
+
+		req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+		req.RemoteAddr = "192.0.2.1:5000"
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(repo.PostShowLogin).ServeHTTP(rr, req)
+
+		return rr.Code, session.GetString(ctx, "error")
+	}
+
+	_, errMsg := login("ismail@here.com")
+	if errMsg != "Invalid login credentials" {
+		t.Errorf("first failure should be an invalid login, got %q", errMsg)
+	}
+
+	_, errMsg = login("ISMAIL@here.com")
+	if !strings.HasPrefix(errMsg, "Too many failed logins") {
+		t.Errorf("retry right after a failure should be delayed, got %q", errMsg)
+	}
+
+	if wait := repo.LoginByIP.Wait("192.0.2.1"); wait != 0 {
+		t.Errorf("a single failure should not delay the ip address, got %s", wait)
+	}
+
+	code, errMsg := login("me@here.com")
+	if code != http.StatusSeeOther || errMsg != "" {
+		t.Errorf("other emails should still log in, got %d %q", code, errMsg)
+	}
+
+	lockouts := repo.LoginByEmail.Lockouts()
+	if len(lockouts) != 1 || lockouts[0].Key != "ismail@here.com" || lockouts[0].Failures != 1 {
+		t.Errorf("expected one failure for ismail@here.com, got %+v", lockouts)
+	}
+}
+
+func TestRepository_AdminUnlockLogin(t *testing.T) {
+	_ = Repo.LoginByEmail.Fail(context.Background(), "locked@here.com")
+
+	var tests = []struct {
+		name             string
+		body             string
+		expectationFlash string
+		expectationError string
+	}{
+		{"unlock-email", "kind=email&key=locked@here.com", "Unlocked locked@here.com", ""},
+		{"unlock-ip", "kind=ip&key=127.0.0.1", "Unlocked 127.0.0.1", ""},
+		{"unknown-kind", "kind=user&key=1", "", "unknown lockout"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/login-lockouts/unlock", strings.NewReader(e.body))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminUnlockLogin).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+
+	if wait := Repo.LoginByEmail.Wait("locked@here.com"); wait != 0 {
+		t.Errorf("unlocked email should not wait, got %s", wait)
+	}
+}
+
+func TestRepository_AdminAuditLog(t *testing.T) {
+	var tests = []struct {
+		name                string
+		query               string
+		expectedCode        int
+		expectedLocation    string
+		expectedError       string
+		expectedHTML        string
+		expectedMissingHTML string
+	}{
+		{"all", "", http.StatusOK, "", "", "status:</strong> pending &rarr; confirmed", ""},
+		{"by-entity", "entity_type=block", http.StatusOK, "", "", "reason:</strong>  &rarr; Maintenance", "pending &rarr; confirmed"},
+		{"unknown-entity", "entity_type=invoice", http.StatusSeeOther, "/admin/audit-log", "unknown audit entity type", "", ""},
+		{"unknown-action", "action=purge", http.StatusSeeOther, "/admin/audit-log", "unknown audit action", "", ""},
+		{"invalid-page", "page=abc", http.StatusSeeOther, "/admin/audit-log", "can't parse to int", "", ""},
+		{"db-error", "user_id=101", http.StatusSeeOther, "/admin/dashboard", "can't get audit log", "", ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/audit-log?"+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminAuditLog).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectedCode)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("failed %s : wrong location, got %q want %q", e.name, rr.Header().Get("Location"), e.expectedLocation)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectedError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectedError)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s : expected %q in the page", e.name, e.expectedHTML)
+		}
+
+		if e.expectedMissingHTML != "" && strings.Contains(rr.Body.String(), e.expectedMissingHTML) {
+			t.Errorf("failed %s : didn't expect %q in the page", e.name, e.expectedMissingHTML)
+		}
+	}
+}
+
+func TestRepository_AdminShowReservationHistory(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations/all/1/show", nil)
+	req.RequestURI = "/admin/reservations/all/1/show"
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminShowReservation).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong response code, got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(rr.Body.String(), "status:</strong> pending &rarr; confirmed") {
+		t.Error("expected the status change in the reservation history")
+	}
+}
+
 var testResCalendars = []struct {
 	name                string
 	queryParams         []string
@@ -835,6 +1193,27 @@ var testResCalendars = []struct {
 		fmt.Sprintf(`<h3>%s %d</h3>`, "May", 2050),
 		"",
 	},
+	{
+		"test-block-span",
+		[]string{"05", "2050"},
+		http.StatusOK,
+		`title="Maintenance, 2050-05-01 to 2050-05-03: new boiler"`,
+		"",
+	},
+	{
+		"test-block-remove-change",
+		[]string{"05", "2050"},
+		http.StatusOK,
+		`data-remove="1:2050-05-2:1:1"`,
+		"",
+	},
+	{
+		"test-external-booking",
+		[]string{"05", "2050"},
+		http.StatusOK,
+		`<span class="text-info" title="Booked on Holiday Lets, 2050-05-10 to 2050-05-12: Reserved">E</span>`,
+		"",
+	},
 }
 
 func TestRepository_NewAdminReservationsCalendars(t *testing.T) {
@@ -875,22 +1254,52 @@ func TestRepository_NewAdminReservationsCalendars(t *testing.T) {
 }
 
 var testPostResCalendars = []struct {
-	name            string
-	bodyReq         string
-	stringMap       map[string]int
-	expectationCode int
+	name             string
+	bodyReq          string
+	expectationFlash string
+	expectationError string
 }{
 	{
-		"test-delete-reservation",
+		"test-no-changes",
 		`m=05&y=2023`,
-		map[string]int{"2023-05-1": 2},
-		http.StatusSeeOther,
+		"No changes",
+		"",
 	},
 	{
 		"test-add-block",
-		`m=05&y=2023&add_block_1_2023-05-01=1`,
-		map[string]int{},
-		http.StatusSeeOther,
+		`m=05&y=2023&add_block=1:2023-05-1`,
+		"Changes saved",
+		"",
+	},
+	{
+		"test-remove-block",
+		`m=05&y=2050&remove_block=1:2050-05-2:1:1&remove_block=1:2050-05-3:1:1`,
+		"Changes saved",
+		"",
+	},
+	{
+		"test-remove-changed-block",
+		`m=05&y=2050&remove_block=1:2050-05-2:1:0&add_block=2:2050-05-2`,
+		"",
+		"Nothing was saved, the calendar changed in the meantime. room test on 2050-05-02: the block was changed by someone else",
+	},
+	{
+		"test-add-booked-day",
+		`m=01&y=2050&add_block=1:2050-01-15`,
+		"",
+		"Nothing was saved, the calendar changed in the meantime. room test on 2050-01-15: the room has been booked",
+	},
+	{
+		"test-invalid-change",
+		`m=05&y=2050&remove_block=1:2050-05-2`,
+		"",
+		"invalid calendar changes",
+	},
+	{
+		"test-db-error",
+		`m=05&y=2050&add_block=3:2050-05-2`,
+		"",
+		"can't save changes",
 	},
 }
 
@@ -902,15 +1311,109 @@ func TestRepository_NewAdminPostReservationsCalendars(t *testing.T) {
 
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-		session.Put(req.Context(), "block_map_1", e.stringMap)
-
 		rr := httptest.NewRecorder()
 
 		handler := http.HandlerFunc(Repo.NewAdminPostReservationsCalendars)
 		handler.ServeHTTP(rr, req)
 
-		if rr.Code != e.expectationCode {
-			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if !strings.HasPrefix(rrLoc.String(), "/admin/reservations-calendar?y=") {
+			t.Errorf("failed %s : wrong location, got %s", e.name, rrLoc.String())
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+var testBlocks = []struct {
+	name                string
+	method              string
+	url                 string
+	body                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"add", "POST", "/admin/blocks", "room_id=1&start_date=2050-06-01&end_date=2050-06-07&reason=Maintenance&note=paint", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=06", "Room blocked", ""},
+	{"add-one-day", "POST", "/admin/blocks", "room_id=1&start_date=2050-06-01&end_date=2050-06-01&reason=Cleaning", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=06", "Room blocked", ""},
+	{"add-end-before-start", "POST", "/admin/blocks", "room_id=1&start_date=2050-06-07&end_date=2050-06-01&reason=Maintenance", (*Repository).AdminPostBlock, "/admin/reservations-calendar", "", "The last day must be on or after the first day"},
+	{"add-invalid-reason", "POST", "/admin/blocks", "room_id=1&start_date=2050-06-01&end_date=2050-06-07&reason=Party", (*Repository).AdminPostBlock, "/admin/reservations-calendar", "", "Invalid reason"},
+	{"add-invalid-room", "POST", "/admin/blocks", "room_id=x&start_date=2050-06-01&end_date=2050-06-07&reason=Other", (*Repository).AdminPostBlock, "/admin/reservations-calendar", "", "invalid room id"},
+	{"add-overlap", "POST", "/admin/blocks", "room_id=1&start_date=2050-01-15&end_date=2050-01-17&reason=Other", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=01", "", "The room is already booked or blocked on some of these days"},
+	{"add-overlap-arrival-day", "POST", "/admin/blocks", "room_id=1&start_date=2050-01-12&end_date=2050-01-15&reason=Other", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=01", "", "The room is already booked or blocked on some of these days"},
+	{"add-before-arrival-day", "POST", "/admin/blocks", "room_id=1&start_date=2050-01-12&end_date=2050-01-14&reason=Other", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=01", "Room blocked", ""},
+	{"add-on-departure-day", "POST", "/admin/blocks", "room_id=1&start_date=2050-01-18&end_date=2050-01-18&reason=Cleaning", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=01", "Room blocked", ""},
+	{"add-db-error", "POST", "/admin/blocks", "room_id=3&start_date=2050-06-01&end_date=2050-06-07&reason=Other", (*Repository).AdminPostBlock, "/admin/reservations-calendar?y=2050&m=06", "", "can't save block"},
+	{"update", "POST", "/admin/blocks/1", "start_date=2050-05-02&end_date=2050-05-09&reason=Owner+stay", (*Repository).AdminPostShowBlock, "/admin/reservations-calendar?y=2050&m=05", "Block saved", ""},
+	{"update-overlap", "POST", "/admin/blocks/1", "start_date=2050-01-15&end_date=2050-01-17&reason=Other", (*Repository).AdminPostShowBlock, "/admin/blocks/1/show", "", "The room is already booked or blocked on some of these days"},
+	{"update-unknown", "POST", "/admin/blocks/2", "start_date=2050-05-02&end_date=2050-05-09&reason=Other", (*Repository).AdminPostShowBlock, "/admin/reservations-calendar", "", "can't get block"},
+	{"split", "POST", "/admin/blocks/1/split", "split_date=2050-05-03", (*Repository).AdminSplitBlock, "/admin/reservations-calendar?y=2050&m=05", "Block split", ""},
+	{"split-outside", "POST", "/admin/blocks/1/split", "split_date=2050-05-01", (*Repository).AdminSplitBlock, "/admin/blocks/1/show", "", "The second block must start after the first day and on or before the last day"},
+	{"split-invalid-date", "POST", "/admin/blocks/1/split", "split_date=x", (*Repository).AdminSplitBlock, "/admin/blocks/1/show", "", "Invalid split date"},
+	{"unblock", "POST", "/admin/blocks/1/unblock", "start_date=2050-05-02&end_date=2050-05-02", (*Repository).AdminUnblockDays, "/admin/reservations-calendar?y=2050&m=05", "Days unblocked", ""},
+	{"unblock-outside", "POST", "/admin/blocks/1/unblock", "start_date=2050-05-02&end_date=2050-05-04", (*Repository).AdminUnblockDays, "/admin/blocks/1/show", "", "The days to unblock must be days of this block"},
+	{"delete", "POST", "/admin/delete-block/1/do", "", (*Repository).AdminDeleteBlock, "/admin/reservations-calendar?y=2050&m=05", "Block deleted", ""},
+	{"delete-unknown", "POST", "/admin/delete-block/2/do", "", (*Repository).AdminDeleteBlock, "/admin/reservations-calendar", "", "can't get block"},
+}
+
+func TestRepository_Blocks(t *testing.T) {
+	for _, e := range testBlocks {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+func TestRepository_AdminShowBlock(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/blocks/1/show", nil)
+	req.RequestURI = "/admin/blocks/1/show"
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminShowBlock).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("AdminShowBlock returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	for _, want := range []string{`value="2050-05-03"`, `<option value="Maintenance" selected>`, "new boiler"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("AdminShowBlock page should contain %s", want)
 		}
 	}
 }
@@ -1079,10 +1582,1252 @@ func TestRepository_AdminDeleteReservation(t *testing.T) {
 		}
 	}
 }
-func getCtx(req *http.Request) context.Context {
-	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
-	if err != nil {
+
+var testReservationStatus = []struct {
+	name                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	url                 string
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"confirm", (*Repository).AdminProcessReservation, "/admin/process-reservation/new/1/do",
+		"/admin/reservations-new", "Reservation confirmed", ""},
+	{"check-in-pending", (*Repository).AdminCheckInReservation, "/admin/check-in-reservation/all/1/do",
+		"/admin/reservations/all/1/show", "", "The reservation can't be changed to checked in"},
+	{"check-out", (*Repository).AdminCheckOutReservation, "/admin/check-out-reservation/cal/4/do?y=2050&m=01",
+		"/admin/reservations-calendar?y=2050&m=01", "Guest checked out", ""},
+	{"no-show-checked-in", (*Repository).AdminNoShowReservation, "/admin/no-show-reservation/all/4/do",
+		"/admin/reservations/all/4/show", "", "The reservation can't be changed to no-show"},
+	{"cancel", (*Repository).AdminDeleteReservation, "/admin/delete-reservation/all/1/do",
+		"/admin/reservations-all", "Reservation cancelled", ""},
+	{"cancel-cancelled", (*Repository).AdminDeleteReservation, "/admin/delete-reservation/all/3/do",
+		"/admin/reservations/all/3/show", "", "The reservation can't be changed to cancelled"},
+	{"update-fails", (*Repository).AdminProcessReservation, "/admin/process-reservation/all/101/do",
+		"/admin/dashboard", "", "can't update reservation"},
+}
+
+func TestRepository_AdminReservationStatus(t *testing.T) {
+	for _, e := range testReservationStatus {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+func getCtx(req *http.Request) context.Context {
+	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+	if err != nil {
 		log.Println(err)
 	}
 	return ctx
 }
+
+var testRetryMail = []struct {
+	name                string
+	id                  string
+	expectationCode     int
+	expectationLocation string
+	expectationFlash    string
+}{
+	{
+		"retry-dead-mail",
+		"1",
+		http.StatusSeeOther,
+		"/admin/mail-queue",
+		"Mail queued for retry",
+	},
+	{
+		"retry-invalid-id",
+		"invalid",
+		http.StatusSeeOther,
+		"/admin/mail-queue",
+		"",
+	},
+	{
+		"retry-fails",
+		"2",
+		http.StatusSeeOther,
+		"/admin/mail-queue",
+		"",
+	},
+}
+
+func TestRepository_AdminRetryMail(t *testing.T) {
+	for _, e := range testRetryMail {
+		uri := fmt.Sprintf("/admin/mail-queue/%s/retry", e.id)
+		req, _ := http.NewRequest("POST", uri, nil)
+		req.RequestURI = uri
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminRetryMail)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+	}
+}
+
+var testPostShowUser = []struct {
+	name                string
+	id                  string
+	formData            string
+	expectationCode     int
+	expectationLocation string
+	expectationError    string
+}{
+	{
+		"new-user",
+		"0",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=1&password=secret123",
+		http.StatusSeeOther,
+		"/admin/users",
+		"",
+	},
+	{
+		"new-user-without-password",
+		"0",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=1&password=",
+		http.StatusOK,
+		"",
+		"password",
+	},
+	{
+		"new-user-duplicate-email",
+		"0",
+		"first_name=john&last_name=smith&email=taken@here.com&access_level=1&password=secret123",
+		http.StatusOK,
+		"",
+		"email",
+	},
+	{
+		"new-user-duplicate-email-other-case",
+		"0",
+		"first_name=john&last_name=smith&email=Taken@Here.com&access_level=1&password=secret123",
+		http.StatusOK,
+		"",
+		"email",
+	},
+	{
+		"update-user",
+		"2",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=2&password=",
+		http.StatusSeeOther,
+		"/admin/users",
+		"",
+	},
+	{
+		"update-user-duplicate-email",
+		"2",
+		"first_name=john&last_name=smith&email=taken@here.com&access_level=2&password=",
+		http.StatusOK,
+		"",
+		"email",
+	},
+	{
+		"reset-password-too-short",
+		"2",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=2&password=short",
+		http.StatusOK,
+		"",
+		"password",
+	},
+	{
+		"invalid-access-level",
+		"2",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=9&password=",
+		http.StatusOK,
+		"",
+		"access_level",
+	},
+	{
+		"lower-own-access-level",
+		"3",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=1&password=",
+		http.StatusOK,
+		"",
+		"access_level",
+	},
+	{
+		"user-not-found",
+		"99",
+		"first_name=john&last_name=smith&email=john@here.com&access_level=1&password=",
+		http.StatusSeeOther,
+		"/admin/users",
+		"",
+	},
+}
+
+func TestRepository_AdminPostShowUser(t *testing.T) {
+	for _, e := range testPostShowUser {
+		uri := fmt.Sprintf("/admin/users/%s", e.id)
+		req, _ := http.NewRequest("POST", uri, strings.NewReader(e.formData))
+		req.RequestURI = uri
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", models.AccessLevelOwner)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowUser)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+
+		if e.expectationError != "" && !strings.Contains(rr.Body.String(), fmt.Sprintf(`name="%s" id="%s"`, e.expectationError, e.expectationError)) {
+			t.Errorf("failed %s : form should be shown again", e.name)
+		}
+	}
+}
+
+var testUserActions = []struct {
+	name             string
+	url              string
+	handler          func(*Repository, http.ResponseWriter, *http.Request)
+	expectationFlash string
+	expectationError string
+}{
+	{"deactivate", "/admin/deactivate-user/2/do", (*Repository).AdminDeactivateUser, "User deactivated", ""},
+	{"activate", "/admin/activate-user/2/do", (*Repository).AdminActivateUser, "User activated", ""},
+	{"deactivate-self", "/admin/deactivate-user/3/do", (*Repository).AdminDeactivateUser, "", "You can't deactivate yourself"},
+	{"deactivate-not-found", "/admin/deactivate-user/99/do", (*Repository).AdminDeactivateUser, "", "can't update user"},
+	{"delete", "/admin/delete-user/2/do", (*Repository).AdminDeleteUser, "User deleted", ""},
+	{"delete-self", "/admin/delete-user/3/do", (*Repository).AdminDeleteUser, "", "You can't delete yourself"},
+	{"delete-not-found", "/admin/delete-user/99/do", (*Repository).AdminDeleteUser, "", "can't delete user"},
+	{"delete-invalid-id", "/admin/delete-user/x/do", (*Repository).AdminDeleteUser, "", "can't parse to int"},
+}
+
+func TestRepository_AdminUserActions(t *testing.T) {
+	for _, e := range testUserActions {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", models.AccessLevelOwner)
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != "/admin/users" {
+			t.Errorf("failed %s : wrong location, got %s want /admin/users", e.name, rrLoc.String())
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+var testPostShowRoom = []struct {
+	name                string
+	id                  string
+	formData            string
+	expectationCode     int
+	expectationLocation string
+	expectationError    string
+}{
+	{
+		"new-room",
+		"0",
+		"room_name=Suite&slug=suite&description=nice&capacity=2&amenities=Wifi%0ABalcony&base_price=150",
+		http.StatusSeeOther,
+		"/admin/rooms",
+		"",
+	},
+	{
+		"new-room-duplicate-slug",
+		"0",
+		"room_name=Suite&slug=taken&capacity=2&base_price=150",
+		http.StatusOK,
+		"",
+		"slug",
+	},
+	{
+		"update-room",
+		"1",
+		"room_name=Room+One&slug=Room-One&capacity=3&base_price=120.50",
+		http.StatusSeeOther,
+		"/admin/rooms",
+		"",
+	},
+	{
+		"invalid-slug",
+		"1",
+		"room_name=Room+One&slug=room+one&capacity=3&base_price=120",
+		http.StatusOK,
+		"",
+		"slug",
+	},
+	{
+		"invalid-capacity",
+		"1",
+		"room_name=Room+One&slug=room-one&capacity=0&base_price=120",
+		http.StatusOK,
+		"",
+		"capacity",
+	},
+	{
+		"invalid-price",
+		"1",
+		"room_name=Room+One&slug=room-one&capacity=2&base_price=12.345",
+		http.StatusOK,
+		"",
+		"base_price",
+	},
+	{
+		"room-not-found",
+		"99",
+		"room_name=Room+One&slug=room-one&capacity=2&base_price=120",
+		http.StatusSeeOther,
+		"/admin/rooms",
+		"",
+	},
+}
+
+func TestRepository_AdminPostShowRoom(t *testing.T) {
+	for _, e := range testPostShowRoom {
+		uri := fmt.Sprintf("/admin/rooms/%s", e.id)
+		req, _ := http.NewRequest("POST", uri, strings.NewReader(e.formData))
+		req.RequestURI = uri
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowRoom)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+
+		if e.expectationError != "" && !strings.Contains(rr.Body.String(), fmt.Sprintf(`name="%s" id="%s"`, e.expectationError, e.expectationError)) {
+			t.Errorf("failed %s : form should be shown again", e.name)
+		}
+	}
+}
+
+var testDeleteRoom = []struct {
+	name                string
+	url                 string
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"delete", "/admin/delete-room/2/do", "/admin/rooms", "Room deleted", ""},
+	{"has-reservations", "/admin/delete-room/1/do", "/admin/rooms/1/show", "", "This room has reservations and can't be deleted"},
+	{"not-found", "/admin/delete-room/99/do", "/admin/rooms", "", "can't delete room"},
+	{"invalid-id", "/admin/delete-room/x/do", "/admin/rooms", "", "can't parse to int"},
+}
+
+func TestRepository_AdminDeleteRoom(t *testing.T) {
+	for _, e := range testDeleteRoom {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminDeleteRoom)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+// multipartPhotos builds an upload request body with the given file names and contents
+func multipartPhotos(files map[string][]byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for name, data := range files {
+		fw, _ := mw.CreateFormFile("photos", name)
+		fw.Write(data)
+	}
+	mw.Close()
+
+	return body, mw.FormDataContentType()
+}
+
+func testPNG() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	return buf.Bytes()
+}
+
+var testUploadRoomPhotos = []struct {
+	name             string
+	roomID           string
+	files            map[string][]byte
+	expectationFlash string
+	expectationError string
+	expectationFiles int
+}{
+	{"valid", "1", map[string][]byte{"photo.png": testPNG()}, "1 photo(s) uploaded", "", 3},
+	{"unsupported", "1", map[string][]byte{"notes.txt": []byte("hello")}, "", "notes.txt: photo must be a jpeg, png, gif or webp image", 0},
+	{"no-files", "1", map[string][]byte{}, "", "Choose at least one photo", 0},
+	{"room-not-found", "99", map[string][]byte{"photo.png": testPNG()}, "", "photo.png: can't save photo", 0},
+}
+
+func TestRepository_AdminUploadRoomPhotos(t *testing.T) {
+	for _, e := range testUploadRoomPhotos {
+		repo := NewTestRepo(&app)
+		store := repo.Files.(*filestore.Memory)
+
+		body, contentType := multipartPhotos(e.files)
+		uri := fmt.Sprintf("/admin/rooms/%s/photos", e.roomID)
+		req, _ := http.NewRequest("POST", uri, body)
+		req.RequestURI = uri
+		req.Header.Set("Content-Type", contentType)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		repo.AdminUploadRoomPhotos(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if want := fmt.Sprintf("/admin/rooms/%s/show", e.roomID); rrLoc.String() != want {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), want)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+
+		if names := store.Names(); len(names) != e.expectationFiles {
+			t.Errorf("failed %s : expected %d stored files, got %v", e.name, e.expectationFiles, names)
+		}
+	}
+}
+
+var testRoomPhotoActions = []struct {
+	name                string
+	url                 string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"delete", "/admin/delete-room-photo/1/do", (*Repository).AdminDeleteRoomPhoto, "/admin/rooms/1/show", "Photo deleted", ""},
+	{"delete-not-found", "/admin/delete-room-photo/99/do", (*Repository).AdminDeleteRoomPhoto, "/admin/rooms", "", "can't get photo"},
+	{"cover", "/admin/cover-room-photo/2/do", (*Repository).AdminCoverRoomPhoto, "/admin/rooms/1/show", "Cover photo changed", ""},
+	{"move-up", "/admin/move-up-room-photo/2/do", (*Repository).AdminMoveUpRoomPhoto, "/admin/rooms/1/show", "", ""},
+	{"move-down", "/admin/move-down-room-photo/1/do", (*Repository).AdminMoveDownRoomPhoto, "/admin/rooms/1/show", "", ""},
+	{"invalid-id", "/admin/move-down-room-photo/x/do", (*Repository).AdminMoveDownRoomPhoto, "/admin/rooms", "", "can't parse to int"},
+}
+
+func TestRepository_RoomPhotoActions(t *testing.T) {
+	for _, e := range testRoomPhotoActions {
+		repo := NewTestRepo(&app)
+		store := repo.Files.(*filestore.Memory)
+		for _, name := range []string{"rooms/1/photo1-thumb.jpg", "rooms/1/photo1-medium.jpg", "rooms/1/photo1-large.jpg"} {
+			store.Save(context.Background(), name, strings.NewReader("x"))
+		}
+
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		e.handler(repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+
+		deleted := len(store.Names()) == 0
+		if deleted != (e.name == "delete") {
+			t.Errorf("failed %s : photo files deleted %v", e.name, deleted)
+		}
+	}
+}
+
+var testSeasonalRates = []struct {
+	name                string
+	method              string
+	url                 string
+	body                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"add", "POST", "/admin/rooms/1/seasonal-rates", "name=Summer&start_date=2050-07-01&end_date=2050-08-31&nightly_price=150", (*Repository).AdminPostSeasonalRate, "/admin/rooms/1/show", "Seasonal rate added", ""},
+	{"add-invalid-start", "POST", "/admin/rooms/1/seasonal-rates", "name=Summer&start_date=invalid&end_date=2050-08-31&nightly_price=150", (*Repository).AdminPostSeasonalRate, "/admin/rooms/1/show", "", "Invalid start date"},
+	{"add-end-before-start", "POST", "/admin/rooms/1/seasonal-rates", "name=Summer&start_date=2050-08-31&end_date=2050-07-01&nightly_price=150", (*Repository).AdminPostSeasonalRate, "/admin/rooms/1/show", "", "The last night must be on or after the first night"},
+	{"add-invalid-price", "POST", "/admin/rooms/1/seasonal-rates", "name=Summer&start_date=2050-07-01&end_date=2050-08-31&nightly_price=abc", (*Repository).AdminPostSeasonalRate, "/admin/rooms/1/show", "", "Invalid nightly price"},
+	{"add-db-error", "POST", "/admin/rooms/3/seasonal-rates", "name=Summer&start_date=2050-07-01&end_date=2050-08-31&nightly_price=150", (*Repository).AdminPostSeasonalRate, "/admin/rooms/3/show", "", "can't save seasonal rate"},
+	{"delete", "POST", "/admin/delete-seasonal-rate/1/1/do", "", (*Repository).AdminDeleteSeasonalRate, "/admin/rooms/1/show", "Seasonal rate deleted", ""},
+	{"delete-unknown", "POST", "/admin/delete-seasonal-rate/1/2/do", "", (*Repository).AdminDeleteSeasonalRate, "/admin/rooms/1/show", "", "can't delete seasonal rate"},
+	{"delete-invalid-id", "POST", "/admin/delete-seasonal-rate/1/x/do", "", (*Repository).AdminDeleteSeasonalRate, "/admin/rooms/1/show", "", "can't parse to int"},
+}
+
+func TestRepository_SeasonalRates(t *testing.T) {
+	for _, e := range testSeasonalRates {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+var testStayRules = []struct {
+	name                string
+	method              string
+	url                 string
+	body                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"add", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&min_nights=3&weekdays=5&weekdays=6", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "Stay rule added", ""},
+	{"add-closed", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&closed_to_arrival=1", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "Stay rule added", ""},
+	{"add-invalid-start", "POST", "/admin/rooms/1/stay-rules", "start_date=invalid&end_date=2050-08-31&min_nights=3", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "Invalid start date"},
+	{"add-end-before-start", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-08-31&end_date=2050-07-01&min_nights=3", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "The last day must be on or after the first day"},
+	{"add-invalid-weekday", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&min_nights=3&weekdays=7", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "Invalid weekday"},
+	{"add-negative-nights", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&min_nights=-1", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "Nights and days must be positive whole numbers"},
+	{"add-max-below-min", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&min_nights=5&max_nights=2", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "A maximum can't be less than its minimum"},
+	{"add-nothing", "POST", "/admin/rooms/1/stay-rules", "start_date=2050-07-01&end_date=2050-08-31", (*Repository).AdminPostStayRule, "/admin/rooms/1/show", "", "The stay rule doesn't restrict anything"},
+	{"add-db-error", "POST", "/admin/rooms/3/stay-rules", "start_date=2050-07-01&end_date=2050-08-31&min_nights=3", (*Repository).AdminPostStayRule, "/admin/rooms/3/show", "", "can't save stay rule"},
+	{"delete", "POST", "/admin/delete-stay-rule/1/1/do", "", (*Repository).AdminDeleteStayRule, "/admin/rooms/1/show", "Stay rule deleted", ""},
+	{"delete-unknown", "POST", "/admin/delete-stay-rule/1/2/do", "", (*Repository).AdminDeleteStayRule, "/admin/rooms/1/show", "", "can't delete stay rule"},
+}
+
+func TestRepository_StayRules(t *testing.T) {
+	for _, e := range testStayRules {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+var testPostManageBooking = []struct {
+	name                string
+	body                string
+	expectationCode     int
+	expectationLocation string
+	expectationError    string
+	expectationSession  string
+}{
+	{"found", "confirmation_code=+abcd2345+&email=Guest@Here.com", http.StatusSeeOther, "/manage-booking/reservation", "", "ABCD2345"},
+	{"wrong-email", "confirmation_code=ABCD2345&email=other@here.com", http.StatusSeeOther, "/manage-booking", "We couldn't find a booking with this code and email", ""},
+	{"unknown-code", "confirmation_code=XXXX2345&email=guest@here.com", http.StatusSeeOther, "/manage-booking", "We couldn't find a booking with this code and email", ""},
+	{"missing-email", "confirmation_code=ABCD2345", http.StatusOK, "", "", ""},
+}
+
+func TestRepository_PostManageBooking(t *testing.T) {
+	for _, e := range testPostManageBooking {
+		req, _ := http.NewRequest("POST", "/manage-booking", strings.NewReader(e.body))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostManageBooking).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+
+		if code := session.GetString(ctx, "manage_booking_code"); code != e.expectationSession {
+			t.Errorf("failed %s : wrong code in session, got %q want %q", e.name, code, e.expectationSession)
+		}
+	}
+}
+
+func TestRepository_ManageBookingLink(t *testing.T) {
+	var tests = []struct {
+		name                string
+		token               string
+		expectationLocation string
+		expectationCode     string
+	}{
+		{"valid-link", tokens.Sign(app.Secret, manageBookingPurpose, "ABCD2345"), "/manage-booking/reservation", "ABCD2345"},
+		{"forged-link", tokens.Sign([]byte("other-secret"), manageBookingPurpose, "ABCD2345"), "/manage-booking", ""},
+		{"other-purpose", tokens.Sign(app.Secret, passwordResetPurpose, "ABCD2345"), "/manage-booking", ""},
+		{"no-token", "", "/manage-booking", ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/manage-booking/link?token="+url.QueryEscape(e.token), nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ManageBookingLink).ServeHTTP(rr, req)
+
+		rrLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : expected redirect to %s, got %d %s", e.name, e.expectationLocation, rr.Code, rrLoc)
+		}
+
+		if code := session.GetString(ctx, "manage_booking_code"); code != e.expectationCode {
+			t.Errorf("failed %s : wrong code in session, got %q want %q", e.name, code, e.expectationCode)
+		}
+	}
+}
+
+func TestRepository_ManageBookingReservation(t *testing.T) {
+	var tests = []struct {
+		name            string
+		code            string
+		expectationCode int
+	}{
+		{"open", "ABCD2345", http.StatusOK},
+		{"too-late", "SOON2345", http.StatusOK},
+		{"cancelled", "GONE2345", http.StatusOK},
+		{"unknown", "XXXX2345", http.StatusSeeOther},
+		{"not-opened", "", http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/manage-booking/reservation", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		if e.code != "" {
+			session.Put(ctx, "manage_booking_code", e.code)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ManageBookingReservation).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+	}
+}
+
+var testManageBookingActions = []struct {
+	name                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	code                string
+	body                string
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"change-dates", (*Repository).PostManageBookingDates, "ABCD2345", "start_date=2050-06-15&end_date=2050-06-17",
+		"/manage-booking/reservation", "Your reservation has been changed", ""},
+	{"change-dates-not-available", (*Repository).PostManageBookingDates, "ABCD2345", "start_date=2050-01-15&end_date=2050-01-17",
+		"/manage-booking/reservation", "", "Sorry, the room is not available for the new dates"},
+	{"change-dates-stay-rules", (*Repository).PostManageBookingDates, "ABCD2345", "start_date=2050-03-10&end_date=2050-03-11",
+		"/manage-booking/reservation", "", "A minimum stay of 3 nights applies to arrivals on 2050-03-10"},
+	{"change-dates-invalid", (*Repository).PostManageBookingDates, "ABCD2345", "start_date=2050-06-15&end_date=2050-06-15",
+		"/manage-booking/reservation", "", "The departure date must be after the arrival date"},
+	{"change-dates-bad-date", (*Repository).PostManageBookingDates, "ABCD2345", "start_date=invalid&end_date=2050-06-15",
+		"/manage-booking/reservation", "", "can't parse start date"},
+	{"change-dates-too-late", (*Repository).PostManageBookingDates, "SOON2345", "start_date=2050-06-15&end_date=2050-06-17",
+		"/manage-booking/reservation", "", "This reservation can no longer be changed"},
+	{"change-dates-cancelled", (*Repository).PostManageBookingDates, "GONE2345", "start_date=2050-06-15&end_date=2050-06-17",
+		"/manage-booking/reservation", "", "This reservation can no longer be changed"},
+	{"change-dates-not-opened", (*Repository).PostManageBookingDates, "", "start_date=2050-06-15&end_date=2050-06-17",
+		"/manage-booking", "", "Please enter your confirmation code and email"},
+	{"cancel", (*Repository).PostManageBookingCancel, "ABCD2345", "",
+		"/manage-booking/reservation", "Your reservation has been cancelled", ""},
+	{"cancel-too-late", (*Repository).PostManageBookingCancel, "SOON2345", "",
+		"/manage-booking/reservation", "", "This reservation can no longer be cancelled"},
+	{"cancel-cancelled", (*Repository).PostManageBookingCancel, "GONE2345", "",
+		"/manage-booking/reservation", "", "This reservation can no longer be cancelled"},
+	{"cancel-not-opened", (*Repository).PostManageBookingCancel, "", "",
+		"/manage-booking", "", "Please enter your confirmation code and email"},
+}
+
+func TestRepository_ManageBookingActions(t *testing.T) {
+	for _, e := range testManageBookingActions {
+		req, _ := http.NewRequest("POST", "/manage-booking/reservation", strings.NewReader(e.body))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if e.code != "" {
+			session.Put(ctx, "manage_booking_code", e.code)
+		}
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+// mailRecorder keeps the mails queued through it
+type mailRecorder struct {
+	repository.DatabaseRepo
+	mails []models.MailData
+}
+
+func (m *mailRecorder) EnqueueMail(ctx context.Context, mail models.MailData) error {
+	m.mails = append(m.mails, mail)
+	return m.DatabaseRepo.EnqueueMail(ctx, mail)
+}
+
+var testForgotPassword = []struct {
+	name                string
+	email               string
+	expectationCode     int
+	expectationLocation string
+	expectationMailTo   string
+}{
+	{"known-email", "staff@here.com", http.StatusSeeOther, "/user/login", "staff@here.com"},
+	{"email-in-other-case", "Staff@Here.com", http.StatusSeeOther, "/user/login", "staff@here.com"},
+	{"stored-in-mixed-case", "mixed.case@here.com", http.StatusSeeOther, "/user/login", "Mixed.Case@Here.com"},
+	{"unknown-email", "nobody@here.com", http.StatusSeeOther, "/user/login", ""},
+	{"invalid-email", "nobody", http.StatusOK, "", ""},
+}
+
+func TestRepository_PostForgotPassword(t *testing.T) {
+	for _, e := range testForgotPassword {
+		req, _ := http.NewRequest("POST", "/user/forgot-password", strings.NewReader("email="+e.email))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		repo := NewTestRepo(&app)
+		recorder := &mailRecorder{DatabaseRepo: repo.DB}
+		repo.DB = recorder
+		handler := http.HandlerFunc(repo.PostForgotPassword)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+
+		var mailTo string
+		if len(recorder.mails) > 0 {
+			mailTo = recorder.mails[0].To
+		}
+		if mailTo != e.expectationMailTo {
+			t.Errorf("failed %s : reset mail sent to %q, want %q", e.name, mailTo, e.expectationMailTo)
+		}
+	}
+}
+
+func TestRepository_ShowResetPassword(t *testing.T) {
+	token, _ := tokens.New(app.Secret, passwordResetPurpose)
+	otherToken, _ := tokens.New([]byte("other-secret"), passwordResetPurpose)
+
+	var tests = []struct {
+		name                string
+		token               string
+		expectationCode     int
+		expectationLocation string
+	}{
+		{"valid-token", token, http.StatusOK, ""},
+		{"forged-token", otherToken, http.StatusSeeOther, "/user/forgot-password"},
+		{"no-token", "", http.StatusSeeOther, "/user/forgot-password"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/user/reset-password?token="+url.QueryEscape(e.token), nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.ShowResetPassword)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+	}
+}
+
+func TestRepository_PostResetPassword(t *testing.T) {
+	token, _ := tokens.New(app.Secret, passwordResetPurpose)
+	otherToken, _ := tokens.New(app.Secret, "other-purpose")
+
+	var tests = []struct {
+		name                string
+		formData            url.Values
+		expectationCode     int
+		expectationLocation string
+	}{
+		{
+			"valid",
+			url.Values{"token": {token}, "password": {"new-password"}, "password_confirm": {"new-password"}},
+			http.StatusSeeOther,
+			"/user/login",
+		},
+		{
+			"passwords-differ",
+			url.Values{"token": {token}, "password": {"new-password"}, "password_confirm": {"other-password"}},
+			http.StatusOK,
+			"",
+		},
+		{
+			"password-too-short",
+			url.Values{"token": {token}, "password": {"short"}, "password_confirm": {"short"}},
+			http.StatusOK,
+			"",
+		},
+		{
+			"token-for-other-purpose",
+			url.Values{"token": {otherToken}, "password": {"new-password"}, "password_confirm": {"new-password"}},
+			http.StatusSeeOther,
+			"/user/forgot-password",
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/user/reset-password", strings.NewReader(e.formData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostResetPassword)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectationCode {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, e.expectationCode)
+		}
+
+		if e.expectationLocation != "" {
+			rrLoc, _ := rr.Result().Location()
+			if rrLoc.String() != e.expectationLocation {
+				t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+			}
+		}
+	}
+}
+
+// testTOTPSecret is the secret of the test user with two-factor authentication
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func TestRepository_PostTwoFactorLogin(t *testing.T) {
+	code, _ := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+
+	var tests = []struct {
+		name                string
+		code                string
+		startedAt           time.Time
+		expectationLocation string
+		expectationUserID   int
+		expectationError    string
+	}{
+		{"valid-code", code, time.Now(), "/", 4, ""},
+		{"valid-recovery-code", "ABCDE-FGHIJ", time.Now(), "/", 4, ""},
+		{"invalid-recovery-code", "zzzzz-zzzzz", time.Now(), "/user/login/two-factor", 0, "Invalid code"},
+		{"empty-code", "", time.Now(), "/user/login/two-factor", 0, "Invalid code"},
+		{"expired", code, time.Now().Add(-time.Hour), "/user/login", 0, "Please log in again"},
+	}
+
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+
+		req, _ := http.NewRequest("POST", "/user/login/two-factor", strings.NewReader("code="+url.QueryEscape(e.code)))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "two_factor_user_id", 4)
+		session.Put(ctx, "two_factor_started_at", e.startedAt.Unix())
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(repo.PostTwoFactorLogin).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if userID := session.GetInt(ctx, "user_id"); userID != e.expectationUserID {
+			t.Errorf("failed %s : wrong user in session, got %d want %d", e.name, userID, e.expectationUserID)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+func TestRepository_PostTwoFactorLoginChangedSecret(t *testing.T) {
+	code, _ := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+
+	req, _ := http.NewRequest("POST", "/user/login/two-factor", strings.NewReader("code="+code))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	session.Put(ctx, "two_factor_user_id", 6)
+	session.Put(ctx, "two_factor_started_at", time.Now().Unix())
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(NewTestRepo(&app).PostTwoFactorLogin).ServeHTTP(rr, req)
+
+	rrLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || rrLoc.String() != "/user/login/two-factor" {
+		t.Errorf("expected a redirect to the two-factor form, got %d %s", rr.Code, rrLoc)
+	}
+
+	if errMsg := session.GetString(ctx, "error"); !strings.Contains(errMsg, "please use a recovery code") {
+		t.Errorf("wrong error, got %q", errMsg)
+	}
+}
+
+func TestRepository_AdminTwoFactor(t *testing.T) {
+	var tests = []struct {
+		name         string
+		userID       int
+		expectedHTML string
+	}{
+		{"not-enrolled", 1, "otpauth://totp/Bookings:"},
+		{"enrolled", 4, "unused recovery codes left"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/two-factor", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", e.userID)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminTwoFactor).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusOK)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s : expected to find %s", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func TestRepository_AdminDisableTwoFactor(t *testing.T) {
+	var tests = []struct {
+		name             string
+		code             string
+		requiredLevel    int
+		expectationFlash string
+		expectationError string
+	}{
+		{"recovery-code", "abcde-fghij", 0, "Two-factor authentication disabled", ""},
+		{"wrong-code", "zzzzz-zzzzz", 0, "", "Invalid code"},
+		{"required-by-policy", "abcde-fghij", models.AccessLevelStaff, "", "Two-factor authentication is required for your role"},
+	}
+
+	for _, e := range tests {
+		app.TwoFactorAccessLevel = e.requiredLevel
+
+		req, _ := http.NewRequest("POST", "/admin/two-factor/disable", strings.NewReader("code="+e.code))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", 4)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminDisableTwoFactor).ServeHTTP(rr, req)
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+
+	app.TwoFactorAccessLevel = 0
+}
+
+func TestRepository_AdminEnableTwoFactor(t *testing.T) {
+	// user 1 has no prepared secret, so there is nothing to confirm
+	req, _ := http.NewRequest("POST", "/admin/two-factor/enable", strings.NewReader("code=123456"))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	session.Put(ctx, "user_id", 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminEnableTwoFactor).ServeHTTP(rr, req)
+
+	rrLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || rrLoc.String() != "/admin/two-factor" {
+		t.Errorf("expected redirect to /admin/two-factor, got %d %s", rr.Code, rrLoc)
+	}
+
+	if errMsg := session.GetString(ctx, "error"); errMsg != "Please scan the QR code again" {
+		t.Errorf("wrong error, got %q", errMsg)
+	}
+}
+
+var testAPITokenActions = []struct {
+	name                string
+	method              string
+	url                 string
+	body                string
+	handler             func(*Repository, http.ResponseWriter, *http.Request)
+	expectationLocation string
+	expectationFlash    string
+	expectationError    string
+}{
+	{"create-without-name", "POST", "/admin/api-tokens", "name=+&scopes=admin", (*Repository).AdminPostAPIToken, "/admin/api-tokens", "", "Please name the token after the script or tool that uses it"},
+	{"create-without-scopes", "POST", "/admin/api-tokens", "name=Front+desk", (*Repository).AdminPostAPIToken, "/admin/api-tokens", "", "Please choose at least one scope"},
+	{"create-unknown-scope", "POST", "/admin/api-tokens", "name=Front+desk&scopes=admin&scopes=invoices:write", (*Repository).AdminPostAPIToken, "/admin/api-tokens", "", "Unknown scope"},
+	{"create-db-error", "POST", "/admin/api-tokens", "name=fail&scopes=admin", (*Repository).AdminPostAPIToken, "/admin/api-tokens", "", "can't save api token"},
+	{"revoke", "POST", "/admin/revoke-api-token/1/do", "", (*Repository).AdminRevokeAPIToken, "/admin/api-tokens", "API token revoked", ""},
+	{"revoke-revoked", "POST", "/admin/revoke-api-token/4/do", "", (*Repository).AdminRevokeAPIToken, "/admin/api-tokens", "", "The api token doesn't exist or was already revoked"},
+	{"revoke-invalid-id", "POST", "/admin/revoke-api-token/abc/do", "", (*Repository).AdminRevokeAPIToken, "/admin/api-tokens", "", "can't parse to int"},
+}
+
+func TestRepository_APITokenActions(t *testing.T) {
+	for _, e := range testAPITokenActions {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.RequestURI = e.url
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s : wrong response code, got %d want %d", e.name, rr.Code, http.StatusSeeOther)
+		}
+
+		rrLoc, _ := rr.Result().Location()
+		if rrLoc.String() != e.expectationLocation {
+			t.Errorf("failed %s : wrong location, got %s want %s", e.name, rrLoc.String(), e.expectationLocation)
+		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectationFlash {
+			t.Errorf("failed %s : wrong flash, got %q want %q", e.name, flash, e.expectationFlash)
+		}
+
+		if errMsg := session.GetString(ctx, "error"); errMsg != e.expectationError {
+			t.Errorf("failed %s : wrong error, got %q want %q", e.name, errMsg, e.expectationError)
+		}
+	}
+}
+
+func TestRepository_AdminPostAPIToken(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/admin/api-tokens", strings.NewReader("name=Front+desk&scopes=availability:read&scopes=reservations:write"))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	session.Put(ctx, "user_id", models.AccessLevelOwner)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminPostAPIToken).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong response code, got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	// the token is shown once in a read only input
+	body := rr.Body.String()
+	_, after, ok := strings.Cut(body, `font-monospace" value="`)
+	token, _, _ := strings.Cut(after, `"`)
+	if !ok || tokens.Verify(app.Secret, apiTokenPurpose, token) != nil {
+		t.Errorf("expected a valid api token in the page, got %q", token)
+	}
+
+	if !strings.Contains(body, "reservations:write") {
+		t.Error("expected the scopes in the page")
+	}
+}
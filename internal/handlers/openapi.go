@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/openapi"
+	"net/http"
+	"strconv"
+)
+
+// apiSpec documents the json endpoints. The schemas are generated from the types the handlers encode,
+// so they can't drift from the responses.
+var apiSpec = newAPISpec()
+
+// APIOpenAPI serves the OpenAPI document of the json endpoints
+func (m *Repository) APIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiSpec)
+}
+
+// security requirements of the api operations, an empty requirement makes authentication optional
+var (
+	apiPublicSecurity = []map[string][]string{{}, {"bearerAuth": {}}}
+	apiAdminSecurity  = []map[string][]string{{"bearerAuth": {}}, {"sessionCookie": {}}}
+)
+
+func newAPISpec() *openapi.Document {
+	room := openapi.SchemaOf(apiRoom{})
+
+	availability := openapi.SchemaOf(apiAvailability{})
+	formatDates(availability, "start_date", "end_date")
+	availability.Properties["rooms"].Items.Properties["room"] = openapi.Ref("Room")
+	availability.Properties["reasons"].Description = "Why no room is available, when stay rules are in the way"
+
+	reservation := openapi.SchemaOf(apiReservation{})
+	formatDates(reservation, "start_date", "end_date")
+	reservation.Properties["status"].Enum = models.ReservationStatuses
+	reservation.Properties["email"].Format = "email"
+	reservation.Properties["can_cancel"].Description = "Whether the cancellation policy still allows the guest to cancel"
+
+	apiErr := openapi.SchemaOf(apiErrorEnvelope{})
+	apiErr.Properties["error"].Properties["fields"].Description = "The validation errors by field"
+
+	newReservation := openapi.Object(map[string]*openapi.Schema{
+		"room_id":    {Type: "integer"},
+		"start_date": {Type: "string", Format: "date"},
+		"end_date":   {Type: "string", Format: "date"},
+		"first_name": {Type: "string"},
+		"last_name":  {Type: "string"},
+		"email":      {Type: "string", Format: "email"},
+		"phone":      {Type: "string"},
+	})
+
+	availabilityCheck := openapi.SchemaOf(jsonResponse{})
+	availabilityCheck.Properties["start_date"].Format = "date"
+	availabilityCheck.Properties["end_date"].Format = "date"
+
+	return &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:   "Bookings API",
+			Version: "1",
+			Description: "Rooms, availability and reservations. Dates are formatted as 2006-01-02 and amounts " +
+				"are in cents. Api tokens are sent as a Bearer authorization header.",
+		},
+		Servers: []openapi.Server{{URL: "/"}},
+		Paths: map[string]openapi.PathItem{
+			"/api/openapi.json": {"get": {
+				OperationID: "getOpenAPI",
+				Summary:     "This document",
+				Tags:        []string{"meta"},
+				Responses: map[string]openapi.Response{
+					"200": {Description: "The OpenAPI document", Content: openapi.JSON(&openapi.Schema{Type: "object"})},
+				},
+			}},
+			"/api/v1/rooms": {"get": {
+				OperationID: "listRooms",
+				Summary:     "List the rooms by name",
+				Description: "Api tokens need the availability:read scope.",
+				Tags:        []string{"rooms"},
+				Security:    apiPublicSecurity,
+				Parameters:  pageParameters(),
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "A page of rooms", Content: openapi.JSON(apiList("Room"))},
+				}, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity, http.StatusInternalServerError),
+			}},
+			"/api/v1/rooms/{id}": {"get": {
+				OperationID: "getRoom",
+				Summary:     "Show a room",
+				Description: "Api tokens need the availability:read scope.",
+				Tags:        []string{"rooms"},
+				Security:    apiPublicSecurity,
+				Parameters:  []openapi.Parameter{{Name: "id", In: "path", Required: true, Schema: &openapi.Schema{Type: "integer"}}},
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "The room", Content: openapi.JSON(apiData(openapi.Ref("Room")))},
+				}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError),
+			}},
+			"/api/v1/availability": {"get": {
+				OperationID: "searchAvailability",
+				Summary:     "List the rooms free for a stay with their price",
+				Description: "Api tokens need the availability:read scope.",
+				Tags:        []string{"availability"},
+				Security:    apiPublicSecurity,
+				Parameters: []openapi.Parameter{
+					{Name: "start_date", In: "query", Required: true, Description: "The arrival date",
+						Schema: &openapi.Schema{Type: "string", Format: "date"}},
+					{Name: "end_date", In: "query", Required: true, Description: "The departure date",
+						Schema: &openapi.Schema{Type: "string", Format: "date"}},
+					{Name: "room_id", In: "query", Description: "Only search this room",
+						Schema: &openapi.Schema{Type: "integer"}},
+				},
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "The available rooms", Content: openapi.JSON(apiData(openapi.Ref("Availability")))},
+				}, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity, http.StatusInternalServerError),
+			}},
+			"/api/v1/reservations": {"post": {
+				OperationID: "createReservation",
+				Summary:     "Book a room for a guest",
+				Description: "The guest gets the same confirmation mail as for a booking on the website. Api tokens " +
+					"need the reservations:write scope, requests without a token need a csrf token.",
+				Tags:        []string{"reservations"},
+				Security:    apiPublicSecurity,
+				RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(openapi.Ref("NewReservation"))},
+				Responses: apiResponses(map[string]openapi.Response{
+					"201": {
+						Description: "The reservation was booked",
+						Headers: map[string]openapi.Header{"Location": {Description: "The url of the reservation",
+							Schema: &openapi.Schema{Type: "string"}}},
+						Content: openapi.JSON(apiData(openapi.Ref("Reservation"))),
+					},
+				}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict,
+					http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusInternalServerError),
+			}},
+			"/api/v1/reservations/{code}": {"get": {
+				OperationID: "getReservation",
+				Summary:     "Show a reservation to its guest",
+				Description: "Api tokens need the reservations:write scope.",
+				Tags:        []string{"reservations"},
+				Security:    apiPublicSecurity,
+				Parameters: []openapi.Parameter{
+					{Name: "code", In: "path", Required: true, Description: "The confirmation code",
+						Schema: &openapi.Schema{Type: "string"}},
+					{Name: "email", In: "query", Required: true, Description: "The email of the guest",
+						Schema: &openapi.Schema{Type: "string", Format: "email"}},
+				},
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "The reservation", Content: openapi.JSON(apiData(openapi.Ref("Reservation")))},
+				}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusUnprocessableEntity,
+					http.StatusInternalServerError),
+			}},
+			"/api/v1/reservations/{code}/cancel": {"post": {
+				OperationID: "cancelReservation",
+				Summary:     "Cancel a reservation for its guest",
+				Description: "Only while the cancellation policy allows it. Api tokens need the reservations:write " +
+					"scope, requests without a token need a csrf token.",
+				Tags:     []string{"reservations"},
+				Security: apiPublicSecurity,
+				Parameters: []openapi.Parameter{
+					{Name: "code", In: "path", Required: true, Description: "The confirmation code",
+						Schema: &openapi.Schema{Type: "string"}},
+				},
+				RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(openapi.Object(map[string]*openapi.Schema{
+					"email": {Type: "string", Format: "email", Description: "The email of the guest"},
+				}))},
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "The cancelled reservation", Content: openapi.JSON(apiData(openapi.Ref("Reservation")))},
+				}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+					http.StatusConflict, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity,
+					http.StatusInternalServerError),
+			}},
+			"/api/v1/admin/reservations": {"get": {
+				OperationID: "listReservations",
+				Summary:     "List the reservations by arrival",
+				Description: "For logged in staff, or api tokens with the admin scope.",
+				Tags:        []string{"admin"},
+				Security:    apiAdminSecurity,
+				Parameters: append(pageParameters(), openapi.Parameter{Name: "status", In: "query",
+					Description: "Only list reservations with this status",
+					Schema:      &openapi.Schema{Type: "string", Enum: models.ReservationStatuses}}),
+				Responses: apiResponses(map[string]openapi.Response{
+					"200": {Description: "A page of reservations", Content: openapi.JSON(apiList("Reservation"))},
+				}, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity, http.StatusInternalServerError),
+			}},
+			"/search-availability-json": {"post": {
+				OperationID: "checkRoomAvailability",
+				Summary:     "Check if a room is free, for the booking form of the website",
+				Description: "Always answers 200, ok is false with a message when the room can't be booked.",
+				Tags:        []string{"website"},
+				RequestBody: &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+					"application/x-www-form-urlencoded": {Schema: openapi.Object(map[string]*openapi.Schema{
+						"start":      {Type: "string", Format: "date"},
+						"end":        {Type: "string", Format: "date"},
+						"room_id":    {Type: "integer"},
+						"csrf_token": {Type: "string"},
+					})},
+				}},
+				Responses: map[string]openapi.Response{
+					"200": {Description: "Whether the room is available", Content: openapi.JSON(openapi.Ref("AvailabilityCheck"))},
+				},
+			}},
+		},
+		Components: openapi.Components{
+			Schemas: map[string]*openapi.Schema{
+				"Room":              room,
+				"Availability":      availability,
+				"Reservation":       reservation,
+				"NewReservation":    newReservation,
+				"PageMeta":          openapi.SchemaOf(apiMeta{}),
+				"Error":             apiErr,
+				"AvailabilityCheck": availabilityCheck,
+			},
+			SecuritySchemes: map[string]openapi.SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer",
+					Description: "An api token created on the admin pages"},
+				"sessionCookie": {Type: "apiKey", In: "cookie", Name: "session",
+					Description: "The session of a user logged in on the website"},
+			},
+		},
+	}
+}
+
+// formatDates marks string properties of s as dates
+func formatDates(s *openapi.Schema, names ...string) {
+	for _, name := range names {
+		s.Properties[name].Format = "date"
+	}
+}
+
+// apiData is the schema of an apiEnvelope holding data
+func apiData(data *openapi.Schema) *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{"data": data})
+}
+
+// apiList is the schema of an apiEnvelope holding a page of the component schema name
+func apiList(name string) *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{
+		"data": openapi.ArrayOf(openapi.Ref(name)),
+		"meta": openapi.Ref("PageMeta"),
+	})
+}
+
+// apiResponses adds the error responses with statuses to responses
+func apiResponses(responses map[string]openapi.Response, statuses ...int) map[string]openapi.Response {
+	for _, status := range statuses {
+		responses[strconv.Itoa(status)] = openapi.Response{
+			Description: http.StatusText(status),
+			Content:     openapi.JSON(openapi.Ref("Error")),
+		}
+	}
+	return responses
+}
+
+// pageParameters are the parameters of paginated lists
+func pageParameters() []openapi.Parameter {
+	return []openapi.Parameter{
+		{Name: "page", In: "query", Description: "The page, starting at 1", Schema: &openapi.Schema{Type: "integer"}},
+		{Name: "per_page", In: "query", Description: "The number of items on a page, at most " + strconv.Itoa(apiMaxPerPage),
+			Schema: &openapi.Schema{Type: "integer"}},
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/ismail118/bookings-app/internal/openapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testAPISpecViolations are the testAPI cases that send requests the spec doesn't allow, to test how
+// the handlers reject them
+var testAPISpecViolations = map[string]bool{
+	"rooms-invalid-page":                true,
+	"room-invalid-id":                   true,
+	"availability-missing-dates":        true,
+	"availability-invalid-date":         true,
+	"create-invalid-fields":             true,
+	"create-invalid-json":               true,
+	"create-form-body":                  true,
+	"reservation-missing-email":         true,
+	"admin-reservations-unknown-status": true,
+	"unknown-endpoint":                  true,
+	"wrong-method":                      true,
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected the spec as json, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	var doc openapi.Document
+	err := json.Unmarshal(rr.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != openapi.Version || doc.Paths["/api/v1/rooms"]["get"] == nil {
+		t.Errorf("unexpected spec %s", rr.Body.String())
+	}
+
+	// every reference has to point to a schema in the components
+	for _, ref := range strings.Split(rr.Body.String(), `"$ref":"#/components/schemas/`)[1:] {
+		name, _, _ := strings.Cut(ref, `"`)
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("unknown schema %s", name)
+		}
+	}
+}
+
+func TestAPI_MatchesSpec(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range testAPI {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+
+		err := apiSpec.ValidateRequest(req)
+		if testAPISpecViolations[e.name] {
+			if err == nil {
+				t.Errorf("failed %s : the spec should not allow the request", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed %s : the request doesn't match the spec: %v", e.name, err)
+			continue
+		}
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		err = apiSpec.ValidateResponse(req, rr.Code, rr.Header(), rr.Body.Bytes())
+		if err != nil {
+			t.Errorf("failed %s : the response doesn't match the spec: %v", e.name, err)
+		}
+	}
+}
+
+func TestPostAvailabilityJSON_MatchesSpec(t *testing.T) {
+	for _, body := range []string{
+		"start=2050-01-01&end=2050-01-02&room_id=1&csrf_token=abc",
+		"start=2050-01-01&end=2050-01-02&room_id=2&csrf_token=abc",
+	} {
+		req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		err := apiSpec.ValidateRequest(req)
+		if err != nil {
+			t.Errorf("the request %s doesn't match the spec: %v", body, err)
+			continue
+		}
+
+		rr := httptest.NewRecorder()
+		getRoutes().ServeHTTP(rr, req)
+
+		err = apiSpec.ValidateResponse(req, rr.Code, rr.Header(), rr.Body.Bytes())
+		if err != nil {
+			t.Errorf("the response to %s doesn't match the spec: %v", body, err)
+		}
+	}
+}
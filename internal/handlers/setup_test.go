@@ -8,7 +8,9 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/ismail118/bookings-app/helpers"
 	"github.com/ismail118/bookings-app/internal/config"
+	"github.com/ismail118/bookings-app/internal/feedsync"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"github.com/ismail118/bookings-app/internal/render"
 	"github.com/justinas/nosurf"
 	"html/template"
@@ -23,12 +25,16 @@ import (
 var app config.AppConfig
 var session *scs.SessionManager
 var functions = template.FuncMap{
-	"humanDate":  render.HumanDate,
-	"formatDate": render.FormatDate,
-	"iterate":    render.Iterate,
-	"add":        render.Add,
+	"humanDate":   render.HumanDate,
+	"formatDate":  render.FormatDate,
+	"iterate":     render.Iterate,
+	"add":         render.Add,
+	"formatPrice": render.FormatPrice,
+	"formatMoney": pricing.Format,
+	"statusName":  models.StatusName,
 }
 var pathToTemplates string = "./../../templates"
+var pathToMailTemplates string = "./../../email-templates"
 
 func TestMain(m *testing.M) {
 	// what am i going to put in the session
@@ -37,7 +43,6 @@ func TestMain(m *testing.M) {
 	gob.Register(models.Room{})
 	gob.Register(models.Restriction{})
 	gob.Register(models.RoomRestriction{})
-	gob.Register(map[string]int{})
 
 	// change this to true when in production
 	app.InProduction = false
@@ -51,12 +56,6 @@ func TestMain(m *testing.M) {
 
 	app.Session = session
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-	defer close(mailChan)
-
-	listenForMail()
-
 	tc, err := CreateTemplateCache()
 	if err != nil {
 		log.Fatal("cannot create template cache")
@@ -65,7 +64,19 @@ func TestMain(m *testing.M) {
 	app.TemplateCache = tc
 	app.UseCache = true
 
+	mtc, err := CreateMailTemplateCache()
+	if err != nil {
+		log.Fatal("cannot create mail template cache")
+	}
+
+	app.MailTemplateCache = mtc
+	app.BaseURL = "http://localhost:8080"
+	app.Secret = []byte("test-secret")
+	app.CancelBeforeDays = 2
+
 	repo := NewTestRepo(&app)
+	// the external calendars of the testing repo are served without a network
+	repo.Feeds = feedsync.New(repo.DB, &http.Client{Transport: testFeedTransport{}})
 	NewHandlers(repo)
 	helpers.NewHelpers(&app)
 
@@ -80,14 +91,6 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func listenForMail() {
-	go func() {
-		for {
-			_ = <-app.MailChan
-		}
-	}()
-}
-
 func getRoutes() http.Handler {
 
 	mux := chi.NewRouter()
@@ -98,8 +101,10 @@ func getRoutes() http.Handler {
 
 	mux.Get("/", Repo.Home)
 	mux.Get("/about", Repo.About)
-	mux.Get("/room-one", Repo.RoomOne)
-	mux.Get("/room-two", Repo.RoomTwo)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Get("/room-one", http.RedirectHandler("/rooms/room-one", http.StatusMovedPermanently).ServeHTTP)
+	mux.Get("/room-two", http.RedirectHandler("/rooms/room-two", http.StatusMovedPermanently).ServeHTTP)
 
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
@@ -110,21 +115,105 @@ func getRoutes() http.Handler {
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/manage-booking", Repo.ManageBooking)
+	mux.Post("/manage-booking", Repo.PostManageBooking)
+	mux.Get("/manage-booking/link", Repo.ManageBookingLink)
+	mux.Get("/manage-booking/reservation", Repo.ManageBookingReservation)
+	mux.Post("/manage-booking/reservation/dates", Repo.PostManageBookingDates)
+	mux.Post("/manage-booking/reservation/cancel", Repo.PostManageBookingCancel)
+
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
+	mux.Get("/user/login/two-factor", Repo.ShowTwoFactorLogin)
+	mux.Post("/user/login/two-factor", Repo.PostTwoFactorLogin)
 	mux.Get("/user/logout", Repo.Logout)
+	mux.Get("/user/forgot-password", Repo.ShowForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", Repo.ShowResetPassword)
+	mux.Post("/user/reset-password", Repo.PostResetPassword)
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
 	mux.Get("/admin/reservations-new", Repo.NewAdminReservations)
 	mux.Get("/admin/reservations-all", Repo.NewAdminAllReservations)
 	mux.Get("/admin/reservations-calendar", Repo.NewAdminReservationsCalendars)
 	mux.Post("/admin/reservations-calendar", Repo.NewAdminPostReservationsCalendars)
-	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
-	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Post("/admin/blocks", Repo.AdminPostBlock)
+	mux.Get("/admin/blocks/{id}/show", Repo.AdminShowBlock)
+	mux.Post("/admin/blocks/{id}", Repo.AdminPostShowBlock)
+	mux.Post("/admin/blocks/{id}/split", Repo.AdminSplitBlock)
+	mux.Post("/admin/blocks/{id}/unblock", Repo.AdminUnblockDays)
+	mux.Post("/admin/delete-block/{id}/do", Repo.AdminDeleteBlock)
+	mux.Post("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
+	mux.Post("/admin/check-in-reservation/{src}/{id}/do", Repo.AdminCheckInReservation)
+	mux.Post("/admin/check-out-reservation/{src}/{id}/do", Repo.AdminCheckOutReservation)
+	mux.Post("/admin/no-show-reservation/{src}/{id}/do", Repo.AdminNoShowReservation)
+	mux.Post("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
 
+	mux.Get("/admin/mail-queue", Repo.AdminMailQueue)
+	mux.Post("/admin/mail-queue/{id}/retry", Repo.AdminRetryMail)
+	mux.Get("/admin/external-feeds", Repo.AdminExternalFeeds)
+	mux.Post("/admin/external-feeds", Repo.AdminPostExternalFeed)
+	mux.Post("/admin/sync-external-feed/{id}/do", Repo.AdminSyncExternalFeed)
+	mux.Post("/admin/delete-external-feed/{id}/do", Repo.AdminDeleteExternalFeed)
+
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/{id}/show", Repo.AdminShowRoom)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostShowRoom)
+	mux.Post("/admin/delete-room/{id}/do", Repo.AdminDeleteRoom)
+	mux.Post("/admin/rooms/{id}/photos", Repo.AdminUploadRoomPhotos)
+	mux.Post("/admin/rooms/{id}/seasonal-rates", Repo.AdminPostSeasonalRate)
+	mux.Post("/admin/delete-seasonal-rate/{room_id}/{id}/do", Repo.AdminDeleteSeasonalRate)
+	mux.Post("/admin/rooms/{id}/stay-rules", Repo.AdminPostStayRule)
+	mux.Post("/admin/delete-stay-rule/{room_id}/{id}/do", Repo.AdminDeleteStayRule)
+	mux.Post("/admin/delete-room-photo/{id}/do", Repo.AdminDeleteRoomPhoto)
+	mux.Post("/admin/cover-room-photo/{id}/do", Repo.AdminCoverRoomPhoto)
+	mux.Post("/admin/move-up-room-photo/{id}/do", Repo.AdminMoveUpRoomPhoto)
+	mux.Post("/admin/move-down-room-photo/{id}/do", Repo.AdminMoveDownRoomPhoto)
+
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Get("/admin/users/{id}/show", Repo.AdminShowUser)
+	mux.Post("/admin/users/{id}", Repo.AdminPostShowUser)
+	mux.Post("/admin/activate-user/{id}/do", Repo.AdminActivateUser)
+	mux.Post("/admin/deactivate-user/{id}/do", Repo.AdminDeactivateUser)
+	mux.Post("/admin/delete-user/{id}/do", Repo.AdminDeleteUser)
+	mux.Post("/admin/reset-two-factor/{id}/do", Repo.AdminResetTwoFactor)
+
+	mux.Get("/admin/two-factor", Repo.AdminTwoFactor)
+	mux.Post("/admin/two-factor/enable", Repo.AdminEnableTwoFactor)
+	mux.Post("/admin/two-factor/disable", Repo.AdminDisableTwoFactor)
+
+	mux.Get("/admin/login-lockouts", Repo.AdminLoginLockouts)
+	mux.Post("/admin/login-lockouts/unlock", Repo.AdminUnlockLogin)
+
+	mux.Get("/admin/audit-log", Repo.AdminAuditLog)
+
+	mux.Get("/admin/api-tokens", Repo.AdminAPITokens)
+	mux.Post("/admin/api-tokens", Repo.AdminPostAPIToken)
+	mux.Post("/admin/revoke-api-token/{id}/do", Repo.AdminRevokeAPIToken)
+
+	mux.Get("/admin/calendar-feeds", Repo.AdminCalendarFeeds)
+	mux.Post("/admin/calendar-feeds/{id}/token", Repo.AdminPostCalendarFeedToken)
+	mux.Post("/admin/calendar-feeds/{id}/revoke", Repo.AdminRevokeCalendarFeedToken)
+	mux.Get("/calendar/rooms.ics", Repo.CalendarFeed)
+	mux.Get("/calendar/rooms/{id}.ics", Repo.RoomCalendarFeed)
+
+	mux.Get("/api/openapi.json", Repo.APIOpenAPI)
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(Repo.APINotFound)
+		mux.MethodNotAllowed(Repo.APIMethodNotAllowed)
+
+		mux.Get("/rooms", Repo.APIRooms)
+		mux.Get("/rooms/{id}", Repo.APIRoom)
+		mux.Get("/availability", Repo.APIAvailability)
+		mux.Post("/reservations", Repo.APIPostReservation)
+		mux.Get("/reservations/{code}", Repo.APIReservation)
+		mux.Post("/reservations/{code}/cancel", Repo.APICancelReservation)
+		mux.Get("/admin/reservations", Repo.APIAdminReservations)
+	})
+
 	fileServer := http.FileServer(http.Dir("static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -183,3 +272,31 @@ func CreateTemplateCache() (map[string]*template.Template, error) {
 
 	return myCache, nil
 }
+
+// CreateMailTemplateCache creates the email template cache as a map
+func CreateMailTemplateCache() (map[string]*template.Template, error) {
+
+	myCache := map[string]*template.Template{}
+
+	mails, err := filepath.Glob(fmt.Sprintf("%s/*.mail.gohtml", pathToMailTemplates))
+	if err != nil {
+		return myCache, err
+	}
+
+	for _, mail := range mails {
+		name := filepath.Base(mail)
+		ts, err := template.New(name).Funcs(functions).ParseFiles(mail)
+		if err != nil {
+			return myCache, err
+		}
+
+		ts, err = ts.ParseGlob(fmt.Sprintf("%s/*.layout.gohtml", pathToMailTemplates))
+		if err != nil {
+			return myCache, err
+		}
+
+		myCache[name] = ts
+	}
+
+	return myCache, nil
+}
@@ -0,0 +1,144 @@
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ContentType is the media type of iCalendar files
+const ContentType = "text/calendar; charset=utf-8"
+
+// event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusTentative = "TENTATIVE"
+	StatusCancelled = "CANCELLED"
+)
+
+// maxLineOctets is the length after which content lines are folded, see RFC 5545 section 3.1
+const maxLineOctets = 75
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405Z"
+)
+
+// Calendar is a VCALENDAR of all day events
+type Calendar struct {
+	// ProdID identifies the product that made the calendar
+	ProdID string
+	// Name is the name calendar apps show for a subscribed feed
+	Name string
+	// Method is the iTIP method, e.g. PUBLISH, it is left out when empty
+	Method string
+	Events []Event
+}
+
+// Event is an all day VEVENT. Start and End are dates, End is not part of the event, so a one night
+// stay from the 1st to the 2nd covers only the 1st.
+type Event struct {
+	// UID must stay the same for every version of the event, so calendar apps update it instead of
+	// adding a copy
+	UID          string
+	Start        time.Time
+	End          time.Time
+	Summary      string
+	Description  string
+	Location     string
+	Status       string
+	Stamp        time.Time
+	LastModified time.Time
+}
+
+// Encode writes c as an iCalendar stream
+func (c *Calendar) Encode(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	e.line("BEGIN", "VCALENDAR")
+	e.line("VERSION", "2.0")
+	e.line("PRODID", c.ProdID)
+	e.line("CALSCALE", "GREGORIAN")
+	if c.Method != "" {
+		e.line("METHOD", c.Method)
+	}
+	if c.Name != "" {
+		e.line("X-WR-CALNAME", Escape(c.Name))
+	}
+
+	for _, ev := range c.Events {
+		e.line("BEGIN", "VEVENT")
+		e.line("UID", ev.UID)
+		e.line("DTSTAMP", ev.Stamp.UTC().Format(dateTimeLayout))
+		e.line("DTSTART;VALUE=DATE", ev.Start.Format(dateLayout))
+		e.line("DTEND;VALUE=DATE", ev.End.Format(dateLayout))
+		e.line("SUMMARY", Escape(ev.Summary))
+		if ev.Description != "" {
+			e.line("DESCRIPTION", Escape(ev.Description))
+		}
+		if ev.Location != "" {
+			e.line("LOCATION", Escape(ev.Location))
+		}
+		if ev.Status != "" {
+			e.line("STATUS", ev.Status)
+		}
+		if !ev.LastModified.IsZero() {
+			e.line("LAST-MODIFIED", ev.LastModified.UTC().Format(dateTimeLayout))
+		}
+		e.line("TRANSP", "OPAQUE")
+		e.line("END", "VEVENT")
+	}
+
+	e.line("END", "VCALENDAR")
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// Escape escapes the characters with a meaning in TEXT values
+func Escape(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// encoder writes content lines and keeps the first error
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes a content line, folded into lines of at most maxLineOctets octets without splitting
+// utf-8 characters. Continuation lines start with a space.
+func (e *encoder) line(name, value string) {
+	if e.err != nil {
+		return
+	}
+
+	s := name + ":" + value
+	limit := maxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		_, e.err = e.w.WriteString(s[:cut] + "\r\n ")
+		if e.err != nil {
+			return
+		}
+		s = s[cut:]
+		// the leading space of a continuation line counts towards its length
+		limit = maxLineOctets - 1
+	}
+
+	_, e.err = e.w.WriteString(s + "\r\n")
+}
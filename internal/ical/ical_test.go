@@ -0,0 +1,221 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDate(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestCalendar_Encode(t *testing.T) {
+	c := &Calendar{
+		ProdID: "-//Bookings//EN",
+		Name:   "General's Quarters",
+		Method: "PUBLISH",
+		Events: []Event{
+			{
+				UID:          "reservation-1@bookings.test",
+				Start:        testDate("2050-01-01"),
+				End:          testDate("2050-01-03"),
+				Summary:      "Smith, John",
+				Description:  "Code ABCD2345\nPending",
+				Status:       StatusTentative,
+				Stamp:        time.Date(2050, 1, 1, 10, 0, 0, 0, time.UTC),
+				LastModified: time.Date(2049, 12, 1, 9, 30, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := c.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"VERSION:2.0\r\n",
+		"PRODID:-//Bookings//EN\r\n",
+		"METHOD:PUBLISH\r\n",
+		"X-WR-CALNAME:General's Quarters\r\n",
+		"UID:reservation-1@bookings.test\r\n",
+		"DTSTAMP:20500101T100000Z\r\n",
+		"DTSTART;VALUE=DATE:20500101\r\n",
+		"DTEND;VALUE=DATE:20500103\r\n",
+		"SUMMARY:Smith\\, John\r\n",
+		"DESCRIPTION:Code ABCD2345\\nPending\r\n",
+		"STATUS:TENTATIVE\r\n",
+		"LAST-MODIFIED:20491201T093000Z\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing line %q in\n%s", line, out)
+		}
+	}
+
+	if strings.Contains(out, "LOCATION") {
+		t.Error("empty properties should be left out")
+	}
+	if strings.Count(out, "\n") != strings.Count(out, "\r\n") {
+		t.Error("lines should end with crlf")
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"a,b;c", `a\,b\;c`},
+		{`back\slash`, `back\\slash`},
+		{"two\r\nlines", `two\nlines`},
+	}
+
+	for _, e := range tests {
+		if got := Escape(e.in); got != e.expected {
+			t.Errorf("Escape(%q) = %q, expected %q", e.in, got, e.expected)
+		}
+	}
+}
+
+func TestEncoder_Folding(t *testing.T) {
+	long := strings.Repeat("é", 100)
+	c := &Calendar{ProdID: "-//Bookings//EN", Name: long}
+
+	var buf bytes.Buffer
+	err := c.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("line longer than %d octets: %q", maxLineOctets, line)
+		}
+		if !strings.HasPrefix(line, " ") && strings.Contains(line, "é") && !strings.HasPrefix(line, "X-WR-CALNAME:") {
+			t.Errorf("continuation line should start with a space: %q", line)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(buf.String(), "\r\n ", "")
+	if !strings.Contains(unfolded, "X-WR-CALNAME:"+long+"\r\n") {
+		t.Error("unfolding should give back the value without splitting characters")
+	}
+}
+
+// testFeed is shaped like the feeds of booking sites: LF line endings, date-times, folded lines and a
+// nested alarm
+const testFeed = "BEGIN:VCALENDAR\n" +
+	"PRODID:-//Example Rentals//Calendar//EN\n" +
+	"VERSION:2.0\n" +
+	"X-WR-CALNAME:Room One\\, listing 42\n" +
+	"BEGIN:VEVENT\n" +
+	"DTSTAMP:20491201T093000Z\n" +
+	"DTSTART;VALUE=DATE:20500101\n" +
+	"DTEND;VALUE=DATE:20500104\n" +
+	"UID:1418fb94e984-a1b2@example.com\n" +
+	"SUMMARY:Reserved\n" +
+	"DESCRIPTION:Reservation URL: https://example.com/reservations/\n" +
+	" ABC123\\nPhone: 1234\n" +
+	"BEGIN:VALARM\n" +
+	"DESCRIPTION:Reminder\n" +
+	"END:VALARM\n" +
+	"END:VEVENT\n" +
+	"BEGIN:VEVENT\n" +
+	"DTSTART;TZID=\"Europe/Paris\":20500110T150000\n" +
+	"UID:second@example.com\n" +
+	"SUMMARY:Not available\n" +
+	"STATUS:cancelled\n" +
+	"END:VEVENT\n" +
+	"END:VCALENDAR\n"
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(testFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ProdID != "-//Example Rentals//Calendar//EN" || c.Name != "Room One, listing 42" {
+		t.Errorf("wrong calendar properties %+v", c)
+	}
+
+	if len(c.Events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(c.Events))
+	}
+
+	first := c.Events[0]
+	if first.UID != "1418fb94e984-a1b2@example.com" || first.Summary != "Reserved" ||
+		!first.Start.Equal(testDate("2050-01-01")) || !first.End.Equal(testDate("2050-01-04")) ||
+		!first.Stamp.Equal(time.Date(2049, 12, 1, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("wrong first event %+v", first)
+	}
+	if first.Description != "Reservation URL: https://example.com/reservations/ABC123\nPhone: 1234" {
+		t.Errorf("the description should be unfolded and unescaped, got %q", first.Description)
+	}
+
+	// a date-time without an end is read as the day it starts
+	second := c.Events[1]
+	if !second.Start.Equal(testDate("2050-01-10")) || !second.End.Equal(testDate("2050-01-11")) ||
+		second.Status != StatusCancelled {
+		t.Errorf("wrong second event %+v", second)
+	}
+}
+
+func TestParse_RoundTrip(t *testing.T) {
+	c := &Calendar{
+		ProdID: "-//Bookings//EN",
+		Name:   "Room One",
+		Events: []Event{{
+			UID:         "block-1@bookings.test",
+			Start:       testDate("2050-01-01"),
+			End:         testDate("2050-01-02"),
+			Summary:     "Blocked; maintenance, " + strings.Repeat("long ", 30),
+			Description: "line\\one\nline two",
+			Stamp:       time.Date(2050, 1, 1, 10, 0, 0, 0, time.UTC),
+		}},
+	}
+
+	var buf bytes.Buffer
+	err := c.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Events) != 1 || parsed.Events[0] != c.Events[0] {
+		t.Errorf("expected %+v, got %+v", c.Events, parsed.Events)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		feed        string
+		expectedErr string
+	}{
+		{"html", "<html><body>Not found</body></html>", "not an icalendar stream"},
+		{"empty", "", "not an icalendar stream"},
+		{"missing-end", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\n", "missing END:VEVENT"},
+		{"wrong-end", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n", "line 3: unexpected END:VCALENDAR"},
+		{"invalid-date", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:soon\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", `line 3: invalid DTSTART "soon"`},
+		{"missing-colon", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", "line 3: missing colon"},
+	}
+
+	for _, e := range tests {
+		_, err := Parse(strings.NewReader(e.feed))
+		if err == nil || err.Error() != e.expectedErr {
+			t.Errorf("failed %s : expected error %q, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
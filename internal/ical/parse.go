@@ -0,0 +1,198 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Parse reads an iCalendar stream. Only the properties of Calendar and Event are read, recurring events
+// are read as their first occurrence. Start and End are dates: the time of day of a date-time is dropped,
+// and an event without an end lasts one day.
+func Parse(r io.Reader) (*Calendar, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// some servers start the stream with a byte order mark
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(lines[0].text, "\ufeff")), "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an icalendar stream")
+	}
+
+	c := &Calendar{}
+	var components []string
+	var ev *Event
+
+	for _, l := range lines {
+		if strings.TrimSpace(l.text) == "" {
+			continue
+		}
+
+		name, value, err := splitLine(l.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.number, err)
+		}
+
+		switch name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(value))
+			if strings.EqualFold(value, "VEVENT") && len(components) == 2 {
+				ev = &Event{}
+			}
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != strings.ToUpper(value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", l.number, value)
+			}
+			components = components[:len(components)-1]
+			if ev != nil && len(components) == 1 {
+				if ev.End.IsZero() {
+					ev.End = ev.Start.AddDate(0, 0, 1)
+				}
+				c.Events = append(c.Events, *ev)
+				ev = nil
+			}
+			continue
+		}
+
+		switch {
+		case len(components) == 1:
+			switch name {
+			case "PRODID":
+				c.ProdID = value
+			case "METHOD":
+				c.Method = value
+			case "X-WR-CALNAME":
+				c.Name = Unescape(value)
+			}
+		case ev != nil && len(components) == 2:
+			err = ev.set(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", l.number, err)
+			}
+		}
+	}
+
+	if len(components) > 0 {
+		return nil, fmt.Errorf("missing END:%s", components[len(components)-1])
+	}
+
+	return c, nil
+}
+
+// set reads the property name of an event
+func (ev *Event) set(name, value string) error {
+	var err error
+	switch name {
+	case "UID":
+		ev.UID = value
+	case "SUMMARY":
+		ev.Summary = Unescape(value)
+	case "DESCRIPTION":
+		ev.Description = Unescape(value)
+	case "LOCATION":
+		ev.Location = Unescape(value)
+	case "STATUS":
+		ev.Status = strings.ToUpper(value)
+	case "DTSTART":
+		ev.Start, err = parseDate(value)
+	case "DTEND":
+		ev.End, err = parseDate(value)
+	case "DTSTAMP":
+		ev.Stamp, err = parseDateTime(value)
+	case "LAST-MODIFIED":
+		ev.LastModified, err = parseDateTime(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	return nil
+}
+
+// Unescape reverts Escape
+func Unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parseDate reads a DATE, or the date of a DATE-TIME
+func parseDate(value string) (time.Time, error) {
+	if len(value) > len(dateLayout) && value[len(dateLayout)] == 'T' {
+		value = value[:len(dateLayout)]
+	}
+	return time.Parse(dateLayout, value)
+}
+
+// parseDateTime reads a DATE-TIME, times without a zone are read as utc
+func parseDateTime(value string) (time.Time, error) {
+	return time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+}
+
+// contentLine is an unfolded content line and the number of its first line in the stream
+type contentLine struct {
+	number int
+	text   string
+}
+
+// unfold joins folded lines, a line starting with a space or a tab continues the one before it
+func unfold(r io.Reader) ([]contentLine, error) {
+	var lines []contentLine
+
+	br := bufio.NewReader(r)
+	for number := 1; ; number++ {
+		s, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		s = strings.TrimRight(s, "\r\n")
+		if len(lines) > 0 && (strings.HasPrefix(s, " ") || strings.HasPrefix(s, "\t")) {
+			lines[len(lines)-1].text += s[1:]
+		} else if s != "" || err == nil {
+			lines = append(lines, contentLine{number: number, text: s})
+		}
+
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+	}
+}
+
+// splitLine splits a content line into its upper case name and its value, the parameters are dropped.
+// The value starts at the first colon outside of a quoted parameter value.
+func splitLine(s string) (string, string, error) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if quoted {
+				continue
+			}
+			name, _, _ := strings.Cut(s[:i], ";")
+			return strings.ToUpper(name), s[i+1:], nil
+		}
+	}
+
+	return "", "", errors.New("missing colon")
+}
@@ -0,0 +1,134 @@
+// Package images validates uploaded photos and resizes them into the variants shown on the site
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+)
+
+// MaxUploadSize is the largest photo accepted, in bytes
+const MaxUploadSize = 10 << 20
+
+// maxPixels guards against small files that decode into huge images
+const maxPixels = 50_000_000
+
+// jpegQuality is used when encoding the resized variants
+const jpegQuality = 85
+
+var (
+	// ErrTooLarge is returned for photos bigger than MaxUploadSize
+	ErrTooLarge = fmt.Errorf("photo is larger than %d MB", MaxUploadSize>>20)
+	// ErrUnsupportedType is returned for files that are not jpeg, png, gif or webp images
+	ErrUnsupportedType = errors.New("photo must be a jpeg, png, gif or webp image")
+	// ErrTooManyPixels is returned for images with too many pixels to resize
+	ErrTooManyPixels = errors.New("photo has too many pixels")
+)
+
+// allowedTypes are the content types accepted for uploads
+var allowedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Size is a variant generated for every photo, scaled down to Width
+type Size struct {
+	Name  string
+	Width int
+}
+
+// Sizes are the variants generated for every photo
+var Sizes = []Size{
+	{Name: "thumb", Width: 320},
+	{Name: "medium", Width: 800},
+	{Name: "large", Width: 1600},
+}
+
+// Variant is one encoded size of a photo
+type Variant struct {
+	Name        string
+	Ext         string
+	ContentType string
+	Data        []byte
+}
+
+// Process reads a photo, checks its size and type, and returns it resized to every size in Sizes.
+// Images are never scaled up. Png files stay png to keep transparency, everything else becomes jpeg.
+func Process(r io.Reader) ([]Variant, error) {
+	b, err := io.ReadAll(io.LimitReader(r, MaxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(b)
+	if !allowedTypes[contentType] {
+		return nil, ErrUnsupportedType
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	variants := make([]Variant, 0, len(Sizes))
+	for _, size := range Sizes {
+		dst := Resize(src, size.Width)
+
+		var buf bytes.Buffer
+		v := Variant{Name: size.Name}
+		if contentType == "image/png" {
+			v.Ext, v.ContentType = ".png", "image/png"
+			err = png.Encode(&buf, dst)
+		} else {
+			v.Ext, v.ContentType = ".jpg", "image/jpeg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v.Data = buf.Bytes()
+		variants = append(variants, v)
+	}
+
+	return variants, nil
+}
+
+// Resize scales src down to width keeping the aspect ratio, smaller images keep their size
+func Resize(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width {
+		width = bounds.Dx()
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	return dst
+}
@@ -0,0 +1,107 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestProcess_JPEG(t *testing.T) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(2000, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := Process(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(variants) != len(Sizes) {
+		t.Fatalf("expected %d variants, got %d", len(Sizes), len(variants))
+	}
+
+	for i, v := range variants {
+		if v.Name != Sizes[i].Name || v.Ext != ".jpg" || v.ContentType != "image/jpeg" {
+			t.Errorf("wrong variant %s %s %s", v.Name, v.Ext, v.ContentType)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(v.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != Sizes[i].Width || img.Bounds().Dy() != Sizes[i].Width/2 {
+			t.Errorf("%s: wrong size %v", v.Name, img.Bounds())
+		}
+	}
+}
+
+func TestProcess_PNGIsNotScaledUp(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage(400, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := Process(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"thumb": 320, "medium": 400, "large": 400}
+	for _, v := range variants {
+		if v.Ext != ".png" {
+			t.Errorf("%s: png should stay png, got %s", v.Name, v.Ext)
+		}
+
+		img, err := png.Decode(bytes.NewReader(v.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != want[v.Name] {
+			t.Errorf("%s: expected width %d, got %d", v.Name, want[v.Name], img.Bounds().Dx())
+		}
+	}
+}
+
+func TestProcess_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"text", []byte("this is not an image"), ErrUnsupportedType},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), ErrUnsupportedType},
+		{"broken-png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...), ErrUnsupportedType},
+		{"too-large", append([]byte("\xff\xd8\xff"), make([]byte, MaxUploadSize)...), ErrTooLarge},
+	}
+
+	for _, e := range tests {
+		_, err := Process(bytes.NewReader(e.data))
+		if err != e.err {
+			t.Errorf("%s: expected %v, got %v", e.name, e.err, err)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	img := Resize(testImage(1000, 10), 50)
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 1 {
+		t.Errorf("wrong size %v", img.Bounds())
+	}
+}
@@ -0,0 +1,160 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/config"
+	"github.com/ismail118/bookings-app/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+	"strings"
+	"time"
+)
+
+// Mailer sends mail messages
+type Mailer interface {
+	Send(m models.MailData) error
+}
+
+// SMTPMailer sends mail through an SMTP server. When keep alive is on, connections are kept
+// in a pool and reused between messages.
+type SMTPMailer struct {
+	server  *mail.SMTPServer
+	from    string
+	clients chan *mail.SMTPClient
+}
+
+// NewSMTPMailer creates a mailer for the given SMTP settings, it does not connect until the first send
+func NewSMTPMailer(c config.SMTPConfig) (*SMTPMailer, error) {
+	encryption, err := ParseEncryption(c.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = c.Host
+	server.Port = c.Port
+	server.Username = c.Username
+	server.Password = c.Password
+	server.Encryption = encryption
+	server.KeepAlive = c.KeepAlive
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	poolSize := c.PoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	// the pool starts with empty slots, a slot gets a connection the first time it is used
+	clients := make(chan *mail.SMTPClient, poolSize)
+	for i := 0; i < poolSize; i++ {
+		clients <- nil
+	}
+
+	return &SMTPMailer{
+		server:  server,
+		from:    c.From,
+		clients: clients,
+	}, nil
+}
+
+// ParseEncryption converts the encryption mode from the config (none, starttls, ssl) to the mail library type
+func ParseEncryption(mode string) (mail.Encryption, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return mail.EncryptionNone, nil
+	case "starttls":
+		return mail.EncryptionSTARTTLS, nil
+	case "ssl", "tls":
+		return mail.EncryptionSSLTLS, nil
+	}
+
+	return mail.EncryptionNone, fmt.Errorf("unknown smtp encryption %q, use none, starttls or ssl", mode)
+}
+
+// Send sends one message, the configured sender is used when the message has no From address
+func (s *SMTPMailer) Send(m models.MailData) error {
+	email, err := s.message(m)
+	if err != nil {
+		return err
+	}
+
+	client := <-s.clients
+	defer func() {
+		s.clients <- client
+	}()
+
+	if client == nil {
+		client, err = s.server.Connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = email.Send(client)
+	if err != nil && s.server.KeepAlive {
+		// the server may have closed the pooled connection, try once more on a fresh one
+		_ = client.Close()
+		client, err = s.server.Connect()
+		if err != nil {
+			return err
+		}
+		err = email.Send(client)
+	}
+
+	if err != nil || !s.server.KeepAlive {
+		// without keep alive the library already closed the connection
+		if err != nil && client != nil {
+			_ = client.Close()
+		}
+		client = nil
+	}
+
+	return err
+}
+
+// Close closes every pooled connection
+func (s *SMTPMailer) Close() error {
+	var errs []string
+	for i := 0; i < cap(s.clients); i++ {
+		client := <-s.clients
+		if client != nil {
+			err := client.Quit()
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			_ = client.Close()
+		}
+		s.clients <- nil
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// message builds the email, a plain text body is sent together with the html as multipart alternative.
+// Attachments are added after the body.
+func (s *SMTPMailer) message(m models.MailData) (*mail.Email, error) {
+	from := m.From
+	if from == "" {
+		from = s.from
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(from).AddTo(m.To).SetSubject(m.Subject)
+	if m.PlainContent == "" {
+		email.SetBody(mail.TextHTML, m.Content)
+	} else {
+		email.SetBody(mail.TextPlain, m.PlainContent)
+		email.AddAlternative(mail.TextHTML, m.Content)
+	}
+
+	for _, a := range m.Attachments {
+		email.Attach(&mail.File{Name: a.Name, MimeType: a.ContentType, Data: a.Data})
+	}
+
+	return email, email.Error
+}
@@ -0,0 +1,254 @@
+package mailer
+
+import (
+	"bufio"
+	"github.com/ismail118/bookings-app/internal/config"
+	"github.com/ismail118/bookings-app/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a tiny SMTP server accepting every message, it counts connections and messages
+type fakeSMTP struct {
+	listener    net.Listener
+	mu          sync.Mutex
+	connections int
+	messages    []string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeSMTP{listener: l}
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.connections++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	write := func(s string) {
+		_, _ = conn.Write([]byte(s + "\r\n"))
+	}
+
+	write("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			write("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			write("354 go ahead")
+			var body strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(l)
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, body.String())
+			f.mu.Unlock()
+			write("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			write("221 bye")
+			return
+		default:
+			write("250 ok")
+		}
+	}
+}
+
+func (f *fakeSMTP) stats() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections, f.messages
+}
+
+var sendTests = []struct {
+	name                string
+	keepAlive           bool
+	expectedConnections int
+}{
+	{"keep-alive-reuses-connection", true, 1},
+	{"no-keep-alive-connects-per-message", false, 3},
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	for _, e := range sendTests {
+		server := newFakeSMTP(t)
+
+		m, err := NewSMTPMailer(config.SMTPConfig{
+			Host:      "127.0.0.1",
+			Port:      server.port(),
+			From:      "bookings@here.com",
+			KeepAlive: e.keepAlive,
+			PoolSize:  1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err = m.Send(models.MailData{To: "guest@here.com", Subject: "Reservation Confirmation", Content: "<p>hello</p>"})
+			if err != nil {
+				t.Fatalf("failed %s: %v", e.name, err)
+			}
+		}
+
+		_ = m.Close()
+		server.listener.Close()
+
+		connections, messages := server.stats()
+		if connections != e.expectedConnections {
+			t.Errorf("failed %s: got %d connections, wanted %d", e.name, connections, e.expectedConnections)
+		}
+		if len(messages) != 3 {
+			t.Errorf("failed %s: got %d messages, wanted 3", e.name, len(messages))
+		}
+		if len(messages) > 0 && !strings.Contains(messages[0], "bookings@here.com") {
+			t.Errorf("failed %s: message should use the configured sender", e.name)
+		}
+	}
+}
+
+func TestSMTPMailer_SendMultipart(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.listener.Close()
+
+	m, err := NewSMTPMailer(config.SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "bookings@here.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send(models.MailData{
+		To:           "guest@here.com",
+		Subject:      "Reservation Confirmation",
+		Content:      "<p>hello</p>",
+		PlainContent: "hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages := server.stats()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, wanted 1", len(messages))
+	}
+
+	for _, part := range []string{"multipart/alternative", "text/plain", "text/html"} {
+		if !strings.Contains(messages[0], part) {
+			t.Errorf("message should contain a %s part", part)
+		}
+	}
+}
+
+func TestSMTPMailer_SendAttachment(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.listener.Close()
+
+	m, err := NewSMTPMailer(config.SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "bookings@here.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send(models.MailData{
+		To:           "guest@here.com",
+		Subject:      "Reservation Confirmation",
+		Content:      "<p>hello</p>",
+		PlainContent: "hello",
+		Attachments: []models.MailAttachment{
+			{Name: "reservation.ics", ContentType: "text/calendar", Data: []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages := server.stats()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, wanted 1", len(messages))
+	}
+
+	for _, part := range []string{"multipart/mixed", "multipart/alternative", "text/calendar", "reservation.ics"} {
+		if !strings.Contains(messages[0], part) {
+			t.Errorf("message should contain %s", part)
+		}
+	}
+}
+
+func TestSMTPMailer_SendConnectionRefused(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	m, err := NewSMTPMailer(config.SMTPConfig{Host: "127.0.0.1", Port: port, KeepAlive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send(models.MailData{To: "guest@here.com", From: "me@here.com", Subject: "test"})
+	if err == nil {
+		t.Error("expected error when the smtp server is down")
+	}
+}
+
+var encryptionTests = []struct {
+	mode     string
+	expected mail.Encryption
+	isError  bool
+}{
+	{"", mail.EncryptionNone, false},
+	{"none", mail.EncryptionNone, false},
+	{"STARTTLS", mail.EncryptionSTARTTLS, false},
+	{"ssl", mail.EncryptionSSLTLS, false},
+	{"plaintext", mail.EncryptionNone, true},
+}
+
+func TestParseEncryption(t *testing.T) {
+	for _, e := range encryptionTests {
+		got, err := ParseEncryption(e.mode)
+		if (err != nil) != e.isError {
+			t.Errorf("for %q, got error %v", e.mode, err)
+		}
+		if got != e.expected {
+			t.Errorf("for %q, got %s, wanted %s", e.mode, got, e.expected)
+		}
+	}
+
+	_, err := NewSMTPMailer(config.SMTPConfig{Encryption: "plaintext"})
+	if err == nil {
+		t.Error("NewSMTPMailer should reject an unknown encryption mode")
+	}
+}
@@ -1,23 +1,69 @@
 package models
 
 import (
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"time"
 )
 
+// user access levels, each level includes the permissions of the ones below it
+const (
+	AccessLevelStaff   = 1
+	AccessLevelManager = 2
+	AccessLevelOwner   = 3
+)
+
 type User struct {
-	ID          int
-	FirstName   string
-	LastName    string
-	Email       string
-	Password    string
-	AccessLevel int
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID           int
+	FirstName    string
+	LastName     string
+	Email        string
+	Password     string
+	AccessLevel  int
+	Active       bool
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 type Room struct {
+	ID           int
+	RoomName     string
+	Slug         string
+	Description  string
+	Capacity     int
+	Amenities    []string
+	BasePrice    int // nightly price in cents
+	WeekendPrice int // friday and saturday nights in cents, 0 uses BasePrice
+	Photos       []RoomPhoto
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Cover returns the cover photo of the room, the first photo when none is marked, or nil without photos
+func (r Room) Cover() *RoomPhoto {
+	for i := range r.Photos {
+		if r.Photos[i].IsCover {
+			return &r.Photos[i]
+		}
+	}
+	if len(r.Photos) > 0 {
+		return &r.Photos[0]
+	}
+
+	return nil
+}
+
+type RoomPhoto struct {
 	ID        int
-	RoomName  string
+	RoomID    int
+	URL       string // large variant
+	MediumURL string
+	ThumbURL  string
+	Files     []string // names in the file store, empty for the bundled static images
+	Position  int
+	IsCover   bool
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -29,39 +75,404 @@ type Restriction struct {
 	UpdatedAt       time.Time
 }
 
+// reservation statuses, a new reservation is pending until the staff confirms it
+const (
+	ReservationPending    = "pending"
+	ReservationConfirmed  = "confirmed"
+	ReservationCheckedIn  = "checked_in"
+	ReservationCheckedOut = "checked_out"
+	ReservationCancelled  = "cancelled"
+	ReservationNoShow     = "no_show"
+)
+
+// ReservationStatuses lists the statuses in the order a reservation goes through them
+var ReservationStatuses = []string{
+	ReservationPending,
+	ReservationConfirmed,
+	ReservationCheckedIn,
+	ReservationCheckedOut,
+	ReservationCancelled,
+	ReservationNoShow,
+}
+
+// IsReservationStatus reports whether status is one of the ReservationStatuses
+func IsReservationStatus(status string) bool {
+	for _, s := range ReservationStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// reservationTransitions are the statuses a reservation can move to from each status
+var reservationTransitions = map[string][]string{
+	ReservationPending:   {ReservationConfirmed, ReservationCancelled},
+	ReservationConfirmed: {ReservationCheckedIn, ReservationCancelled, ReservationNoShow},
+	ReservationCheckedIn: {ReservationCheckedOut},
+}
+
+// CanChangeStatus reports whether a reservation with status from can move to status to
+func CanChangeStatus(from, to string) bool {
+	for _, next := range reservationTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusName returns the name of a reservation status shown to people
+func StatusName(status string) string {
+	switch status {
+	case ReservationPending:
+		return "Pending"
+	case ReservationConfirmed:
+		return "Confirmed"
+	case ReservationCheckedIn:
+		return "Checked in"
+	case ReservationCheckedOut:
+		return "Checked out"
+	case ReservationCancelled:
+		return "Cancelled"
+	case ReservationNoShow:
+		return "No-show"
+	}
+	return status
+}
+
 type Reservation struct {
-	ID          int
-	FirstName   string
-	LastName    string
-	Email       string
-	PhoneNumber string
-	StartDate   time.Time
-	EndDate     time.Time
-	RoomID      int
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	Processed   int
-	Room        Room
+	ID               int
+	ConfirmationCode string
+	FirstName        string
+	LastName         string
+	Email            string
+	PhoneNumber      string
+	StartDate        time.Time
+	EndDate          time.Time
+	RoomID           int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Status           string
+	ConfirmedAt      time.Time // the status timestamps are zero until the reservation gets that status
+	CheckedInAt      time.Time
+	CheckedOutAt     time.Time
+	CancelledAt      time.Time
+	NoShowAt         time.Time
+	Total            int // in cents, including discounts, fees and taxes
+	Currency         string
+	PriceLines       []pricing.Line
+	Room             Room
+}
+
+// Cancelled reports whether the reservation has been cancelled
+func (r Reservation) Cancelled() bool {
+	return r.Status == ReservationCancelled
+}
+
+// Open reports whether the guest hasn't arrived yet and the reservation still takes the room,
+// only open reservations can change dates
+func (r Reservation) Open() bool {
+	return r.Status == ReservationPending || r.Status == ReservationConfirmed
+}
+
+// NextStatuses returns the statuses the reservation can move to
+func (r Reservation) NextStatuses() []string {
+	return reservationTransitions[r.Status]
 }
 
+// StatusName returns the name of the status of the reservation
+func (r Reservation) StatusName() string {
+	return StatusName(r.Status)
+}
+
+// SeasonalRate overrides the nightly price of a room from StartDate through EndDate
+type SeasonalRate struct {
+	ID           int
+	RoomID       int
+	Name         string
+	StartDate    time.Time
+	EndDate      time.Time
+	NightlyPrice int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// StayRule restricts the stays in a room arriving, or for ClosedToDeparture departing, on the days
+// from StartDate through EndDate. Weekdays narrows those days, an empty Weekdays means every day.
+// Zero nights and lead days mean no limit.
+type StayRule struct {
+	ID                int
+	RoomID            int
+	StartDate         time.Time
+	EndDate           time.Time
+	Weekdays          []time.Weekday
+	MinNights         int
+	MaxNights         int
+	ClosedToArrival   bool
+	ClosedToDeparture bool
+	MinLeadDays       int
+	MaxLeadDays       int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// restriction types of room restrictions
+const (
+	RestrictionReservation     = 1
+	RestrictionOwnerBlock      = 2
+	RestrictionExternalBooking = 3
+)
+
+// BlockReasons are the reasons an owner block can be given
+var BlockReasons = []string{"Maintenance", "Owner stay", "Cleaning", "Other"}
+
+// RoomRestriction is a reservation, an owner block or an external booking of a room. All of them cover the
+// nights from StartDate up to, not including, EndDate, so a reservation leaves the room free from its
+// departure day. External bookings come from an ExternalFeed and are identified by the uid of their event
+// in the feed.
 type RoomRestriction struct {
+	ID             int
+	StartDate      time.Time
+	EndDate        time.Time
+	RoomID         int
+	ReservationID  int
+	RestrictionID  int
+	Reason         string
+	Note           string
+	Version        int
+	ExternalFeedID int
+	ExternalUID    string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Room           Room
+	Reservation    Reservation
+	Restriction    Restriction
+}
+
+// BlockChange blocks or, when Remove is set, unblocks one day of a room in the admin calendar. A removal
+// carries the id and version of the block the day belonged to when the calendar was shown.
+type BlockChange struct {
+	RoomID  int
+	Day     time.Time
+	Remove  bool
+	BlockID int
+	Version int
+}
+
+// BlockConflict is a change that could not be applied because the calendar changed in the meantime
+type BlockConflict struct {
+	Change BlockChange
+	Reason string
+}
+
+// Overlaps reports whether the restriction covers any night of a stay from start up to end, the queries
+// of the repository use the same rule
+func (r RoomRestriction) Overlaps(start, end time.Time) bool {
+	return r.StartDate.Before(end) && r.EndDate.After(start)
+}
+
+// LastDay is the last day covered by an owner block
+func (r RoomRestriction) LastDay() time.Time {
+	if !r.EndDate.After(r.StartDate) {
+		return r.StartDate
+	}
+	return r.EndDate.AddDate(0, 0, -1)
+}
+
+type MailData struct {
+	To           string
+	From         string
+	Subject      string
+	Content      string
+	PlainContent string
+	Template     string
+	Attachments  []MailAttachment
+}
+
+// MailAttachment is a file sent along with a mail message
+type MailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// LoginLockout counts the failed logins for an email or ip address
+type LoginLockout struct {
+	Kind          string
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// FailedLogin is the audit record of a failed login
+type FailedLogin struct {
+	ID        int
+	Email     string
+	IPAddress string
+	CreatedAt time.Time
+}
+
+// mail queue statuses
+const (
+	MailStatusPending = "pending"
+	MailStatusSending = "sending"
+	MailStatusSent    = "sent"
+	MailStatusDead    = "dead"
+)
+
+// QueuedMail is a message stored in the mail queue
+type QueuedMail struct {
 	ID            int
-	StartDate     time.Time
-	EndDate       time.Time
-	RoomID        int
-	ReservationID int
-	RestrictionID int
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
-	Room          Room
-	Reservation   Reservation
-	Restriction   Restriction
 }
 
-type MailData struct {
-	To       string
-	From     string
-	Subject  string
-	Content  string
-	Template string
+// audit log actions
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditActions lists the audit log actions
+var AuditActions = []string{AuditCreate, AuditUpdate, AuditDelete}
+
+// audited entity types
+const (
+	AuditReservation  = "reservation"
+	AuditBlock        = "block"
+	AuditRoom         = "room"
+	AuditRoomPhoto    = "room_photo"
+	AuditSeasonalRate = "seasonal_rate"
+	AuditStayRule     = "stay_rule"
+	AuditUser         = "user"
+	AuditAPIToken     = "api_token"
+	AuditExternalFeed = "external_feed"
+	AuditMail         = "mail"
+	AuditCalendarFeed = "calendar_feed"
+)
+
+// AuditEntityTypes lists the audited entity types
+var AuditEntityTypes = []string{AuditReservation, AuditBlock, AuditRoom, AuditRoomPhoto, AuditSeasonalRate,
+	AuditStayRule, AuditUser, AuditAPIToken, AuditExternalFeed, AuditMail, AuditCalendarFeed}
+
+// AuditEntry records a change of an entity. UserID is 0 for changes made by guests.
+type AuditEntry struct {
+	ID         int
+	UserID     int
+	UserName   string
+	Action     string
+	EntityType string
+	EntityID   int
+	Changes    []AuditChange
+	IPAddress  string
+	CreatedAt  time.Time
+}
+
+// AuditChange is the value of a field before and after a change
+type AuditChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// AuditFilter selects audit entries, zero fields don't filter
+type AuditFilter struct {
+	UserID     int
+	Action     string
+	EntityType string
+	EntityID   int
+	Limit      int
+	Offset     int
+}
+
+// api token scopes
+const (
+	ScopeAvailabilityRead  = "availability:read"
+	ScopeReservationsWrite = "reservations:write"
+	ScopeAdmin             = "admin"
+)
+
+// APITokenScopes lists the scopes an api token can be granted
+var APITokenScopes = []string{ScopeAvailabilityRead, ScopeReservationsWrite, ScopeAdmin}
+
+// APIToken lets a script or another application use the api on behalf of the user who created it.
+// Only the hash of the token is stored.
+type APIToken struct {
+	ID         int
+	UserID     int
+	UserName   string
+	Name       string
+	Scopes     []string
+	LastUsedAt time.Time
+	LastUsedIP string
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// HasScope reports whether the token was granted scope, the admin scope includes all others
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked reports whether the token was revoked and can no longer be used
+func (t APIToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// CalendarFeedToken opens the exported iCalendar feed of a room, or of all rooms when RoomID is 0.
+// Only the hash of the token is stored, so its url is shown once when it is created.
+type CalendarFeedToken struct {
+	ID        int
+	RoomID    int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ExternalFeed is the iCalendar feed of a room on another booking site. Its events are imported as
+// external bookings, so the room can't be booked twice.
+type ExternalFeed struct {
+	ID     int
+	RoomID int
+	Name   string
+	URL    string
+	// LastSyncedAt is the time of the last successful sync, LastAttemptAt the time of the last try
+	LastSyncedAt  time.Time
+	LastAttemptAt time.Time
+	// LastError is the reason the last sync failed, it is empty when it succeeded
+	LastError string
+	// EventCount is the number of external bookings of the last sync, Conflicts the number of them
+	// that overlap other reservations or blocks of the room
+	EventCount int
+	Conflicts  int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Room       Room
+}
+
+// Failing reports whether the last sync of the feed failed
+func (f ExternalFeed) Failing() bool {
+	return f.LastError != ""
+}
+
+// ExternalBooking is an event of an ExternalFeed, it covers the days from StartDate up to, not
+// including, EndDate
+type ExternalBooking struct {
+	UID       string
+	StartDate time.Time
+	EndDate   time.Time
+	Summary   string
 }
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomRestriction_Overlaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2050, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	// a stay from the 15th with the departure on the 18th
+	r := RoomRestriction{StartDate: day(15), EndDate: day(18)}
+
+	var tests = []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		expected bool
+	}{
+		{"before", day(10), day(14), false},
+		{"leaves-on-arrival-day", day(12), day(15), false},
+		{"arrives-on-departure-day", day(18), day(20), false},
+		{"last-night", day(17), day(18), true},
+		{"first-night", day(14), day(16), true},
+		{"inside", day(16), day(17), true},
+		{"around", day(10), day(20), true},
+	}
+
+	for _, e := range tests {
+		if got := r.Overlaps(e.start, e.end); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
-import "github.com/ismail118/bookings-app/internal/forms"
+import (
+	"github.com/ismail118/bookings-app/internal/forms"
+	"time"
+)
 
 // TemplateData holds data sent from handlers to templates
 type TemplateData struct {
@@ -14,4 +17,16 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated int
+	AccessLevel     int
+}
+
+// MailTemplateData holds data sent from handlers to email templates
+type MailTemplateData struct {
+	Reservation Reservation
+	Room        Room
+	User        User
+	StartDate   time.Time
+	EndDate     time.Time
+	Previous    Reservation // the reservation before it was changed
+	Links       map[string]string
 }
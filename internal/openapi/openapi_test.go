@@ -0,0 +1,220 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOwner struct {
+	Name string `json:"name"`
+}
+
+type testItem struct {
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Owner   *testOwner        `json:"owner,omitempty"`
+	Created time.Time         `json:"created"`
+	Secret  string            `json:"-"`
+	hidden  string
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(testItem{})
+
+	if s.Type != "object" {
+		t.Fatalf("expected an object, got %q", s.Type)
+	}
+
+	if !reflect.DeepEqual(s.Required, []string{"id", "name", "tags", "created"}) {
+		t.Errorf("wrong required fields %v", s.Required)
+	}
+
+	if len(s.Properties) != 6 {
+		t.Errorf("expected 6 properties, got %d", len(s.Properties))
+	}
+
+	tests := []struct {
+		property string
+		typ      string
+		format   string
+	}{
+		{"id", "integer", ""},
+		{"name", "string", ""},
+		{"tags", "array", ""},
+		{"labels", "object", ""},
+		{"owner", "object", ""},
+		{"created", "string", "date-time"},
+	}
+
+	for _, e := range tests {
+		p := s.Properties[e.property]
+		if p == nil || p.Type != e.typ || p.Format != e.format {
+			t.Errorf("wrong schema for %s: %+v", e.property, p)
+		}
+	}
+
+	if s.Properties["tags"].Items.Type != "string" || s.Properties["labels"].AdditionalProperties.Type != "string" {
+		t.Error("wrong items or additional properties")
+	}
+	if !s.Properties["owner"].Nullable {
+		t.Error("pointers should be nullable")
+	}
+}
+
+var testDoc = &Document{
+	OpenAPI: Version,
+	Paths: map[string]PathItem{
+		"/items": {"post": {
+			RequestBody: &RequestBody{Required: true, Content: JSON(Ref("NewItem"))},
+			Responses: map[string]Response{
+				"201": {Description: "Created", Headers: map[string]Header{"Location": {Schema: &Schema{Type: "string"}}},
+					Content: JSON(Ref("Item"))},
+			},
+		}},
+		"/items/new": {"get": {
+			Responses: map[string]Response{"200": {Description: "The form"}},
+		}},
+		"/items/{id}": {"get": {
+			Parameters: []Parameter{
+				{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}},
+				{Name: "since", In: "query", Schema: &Schema{Type: "string", Format: "date"}},
+			},
+			Responses: map[string]Response{
+				"200":     {Description: "The item", Content: JSON(Ref("Item"))},
+				"default": {Description: "An error", Content: JSON(&Schema{Type: "object"})},
+			},
+		}},
+	},
+	Components: Components{Schemas: map[string]*Schema{
+		"Item": SchemaOf(testItem{}),
+		"NewItem": Object(map[string]*Schema{
+			"name":  {Type: "string"},
+			"kind":  {Type: "string", Enum: []string{"small", "large"}},
+			"since": {Type: "string", Format: "date"},
+		}),
+	}},
+}
+
+func TestDocument_FindOperation(t *testing.T) {
+	op, params, err := testDoc.FindOperation("GET", "/items/new")
+	if err != nil || op != testDoc.Paths["/items/new"]["get"] || len(params) != 0 {
+		t.Errorf("literal paths should win over parameters, got %v %v", params, err)
+	}
+
+	_, params, err = testDoc.FindOperation("GET", "/items/12")
+	if err != nil || params["id"] != "12" {
+		t.Errorf("expected id 12, got %v %v", params, err)
+	}
+
+	for _, e := range []struct{ method, path string }{
+		{"DELETE", "/items/12"},
+		{"GET", "/items/12/photos"},
+		{"GET", "/items/"},
+	} {
+		_, _, err = testDoc.FindOperation(e.method, e.path)
+		if err == nil {
+			t.Errorf("expected no operation for %s %s", e.method, e.path)
+		}
+	}
+}
+
+func TestDocument_ValidateRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		expectedErr string
+	}{
+		{"valid", "POST", "/items", "application/json", `{"name": "a", "kind": "small", "since": "2050-01-01"}`, ""},
+		{"missing-field", "POST", "/items", "application/json", `{"name": "a", "kind": "small"}`, "body.since is required"},
+		{"wrong-enum", "POST", "/items", "application/json", `{"name": "a", "kind": "huge", "since": "2050-01-01"}`, "body.kind must be one of small, large"},
+		{"wrong-format", "POST", "/items", "application/json", `{"name": "a", "kind": "small", "since": "01/01/2050"}`, "body.since must be a date"},
+		{"wrong-type", "POST", "/items", "application/json", `{"name": 1, "kind": "small", "since": "2050-01-01"}`, "body.name must be a string"},
+		{"no-body", "POST", "/items", "application/json", "", "request body is required"},
+		{"invalid-json", "POST", "/items", "application/json", `{"name"`, "body is not valid json"},
+		{"wrong-content-type", "POST", "/items", "text/plain", "name=a", `request content type "text/plain" is not allowed`},
+		{"path-parameter", "GET", "/items/12?since=2050-01-01", "", "", ""},
+		{"invalid-path-parameter", "GET", "/items/abc", "", "", "id must be an integer"},
+		{"invalid-query-parameter", "GET", "/items/12?since=soon", "", "", "since must be a date"},
+		{"unknown-path", "GET", "/users", "", "", "no operation for the request"},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+
+		err := testDoc.ValidateRequest(req)
+		if e.expectedErr == "" && err != nil {
+			t.Errorf("failed %s : unexpected error %v", e.name, err)
+		}
+		if e.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), e.expectedErr)) {
+			t.Errorf("failed %s : expected error %q, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func TestDocument_ValidateRequest_KeepsBody(t *testing.T) {
+	body := `{"name": "a", "kind": "small", "since": "2050-01-01"}`
+	req := httptest.NewRequest("POST", "/items", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	err := testDoc.ValidateRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v map[string]string
+	err = json.NewDecoder(req.Body).Decode(&v)
+	if err != nil || v["name"] != "a" {
+		t.Errorf("the body should still be readable, got %v %v", v, err)
+	}
+}
+
+func TestDocument_ValidateResponse(t *testing.T) {
+	item := `{"id": 1, "name": "a", "tags": [], "created": "2050-01-01T10:00:00Z"}`
+	created := http.Header{"Content-Type": {"application/json"}, "Location": {"/items/1"}}
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		status      int
+		header      http.Header
+		body        string
+		expectedErr string
+	}{
+		{"valid", "POST", "/items", http.StatusCreated, created, item, ""},
+		{"nested", "GET", "/items/1", http.StatusOK, created, `{"id": 2, "name": "b", "tags": ["x"], "created": "2050-01-01T10:00:00Z", "owner": {"name": "c"}}`, ""},
+		{"null-pointer", "GET", "/items/1", http.StatusOK, created, `{"id": 2, "name": "b", "tags": ["x"], "created": "2050-01-01T10:00:00Z", "owner": null}`, ""},
+		{"null-array", "GET", "/items/1", http.StatusOK, created, `{"id": 1, "name": "a", "tags": null, "created": "2050-01-01T10:00:00Z"}`, "response.tags must not be null"},
+		{"fraction", "GET", "/items/1", http.StatusOK, created, `{"id": 1.5, "name": "a", "tags": [], "created": "2050-01-01T10:00:00Z"}`, "response.id must be an integer"},
+		{"wrong-item", "GET", "/items/1", http.StatusOK, created, `{"id": 1, "name": "a", "tags": [1], "created": "2050-01-01T10:00:00Z"}`, "response.tags[0] must be a string"},
+		{"default", "GET", "/items/1", http.StatusNotFound, created, `{}`, ""},
+		{"undocumented-status", "POST", "/items", http.StatusOK, created, item, "response status 200 is not documented"},
+		{"missing-header", "POST", "/items", http.StatusCreated, http.Header{"Content-Type": {"application/json"}}, item, "response header Location is missing"},
+		{"wrong-content-type", "POST", "/items", http.StatusCreated, http.Header{"Content-Type": {"text/html"}, "Location": {"/items/1"}}, item, "is not documented"},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.url, nil)
+
+		err := testDoc.ValidateResponse(req, e.status, e.header, []byte(e.body))
+		if e.expectedErr == "" && err != nil {
+			t.Errorf("failed %s : unexpected error %v", e.name, err)
+		}
+		if e.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), e.expectedErr)) {
+			t.Errorf("failed %s : expected error %q, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
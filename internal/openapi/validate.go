@@ -0,0 +1,379 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoOperation is returned when the document has no operation for a request
+var ErrNoOperation = errors.New("no operation for the request")
+
+// FindOperation returns the operation for method and path and the values of its path parameters.
+// Paths with fewer parameters win, so /rooms/new is preferred over /rooms/{id}.
+func (d *Document) FindOperation(method, path string) (*Operation, map[string]string, error) {
+	templates := make([]string, 0, len(d.Paths))
+	for template := range d.Paths {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return strings.Count(templates[i], "{") < strings.Count(templates[j], "{")
+	})
+
+	segments := strings.Split(path, "/")
+	for _, template := range templates {
+		params, ok := matchPath(strings.Split(template, "/"), segments)
+		if !ok {
+			continue
+		}
+
+		op := d.Paths[template][strings.ToLower(method)]
+		if op == nil {
+			return nil, nil, fmt.Errorf("%w: %s %s", ErrNoOperation, method, path)
+		}
+		return op, params, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s %s", ErrNoOperation, method, path)
+}
+
+func matchPath(template, segments []string) (map[string]string, bool) {
+	if len(template) != len(segments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[strings.Trim(t, "{}")] = segments[i]
+		} else if t != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// ValidateRequest checks the parameters and the body of r against its operation. The body is read
+// and replaced, so r can still be served afterwards.
+func (d *Document) ValidateRequest(r *http.Request) error {
+	op, pathParams, err := d.FindOperation(r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range op.Parameters {
+		var value string
+		var present bool
+		switch p.In {
+		case "path":
+			value, present = pathParams[p.Name]
+		case "query":
+			present = r.URL.Query().Has(p.Name)
+			value = r.URL.Query().Get(p.Name)
+		case "header":
+			value = r.Header.Get(p.Name)
+			present = value != ""
+		}
+
+		if !present {
+			if p.Required {
+				return fmt.Errorf("%s parameter %s is required", p.In, p.Name)
+			}
+			continue
+		}
+
+		err = d.validateString(p.Schema, value, p.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.RequestBody == nil {
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if len(body) == 0 {
+		if op.RequestBody.Required {
+			return errors.New("request body is required")
+		}
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("request content type %q is not allowed", mediaType)
+	}
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		return d.validateForm(content.Schema, values)
+	}
+
+	return d.validateJSON(content.Schema, body, "body")
+}
+
+// ValidateResponse checks a response to r against the documented response for status
+func (d *Document) ValidateResponse(r *http.Request, status int, header http.Header, body []byte) error {
+	op, _, err := d.FindOperation(r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	resp, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		resp, ok = op.Responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("response status %d is not documented", status)
+	}
+
+	for name := range resp.Headers {
+		if header.Get(name) == "" {
+			return fmt.Errorf("response header %s is missing", name)
+		}
+	}
+
+	if len(resp.Content) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("response content type %q is not documented", mediaType)
+	}
+
+	return d.validateJSON(content.Schema, body, "response")
+}
+
+func (d *Document) validateJSON(s *Schema, body []byte, path string) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		return fmt.Errorf("%s is not valid json: %w", path, err)
+	}
+
+	return d.Validate(s, v, path)
+}
+
+// validateForm checks url encoded values against an object schema
+func (d *Document) validateForm(s *Schema, values url.Values) error {
+	s, err := d.resolve(s)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range s.Required {
+		if !values.Has(name) {
+			return fmt.Errorf("form field %s is required", name)
+		}
+	}
+
+	for name, prop := range s.Properties {
+		if values.Has(name) {
+			err = d.validateString(prop, values.Get(name), name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateString checks a parameter or form value, which are always strings on the wire
+func (d *Document) validateString(s *Schema, value, path string) error {
+	s, err := d.resolve(s)
+	if err != nil {
+		return err
+	}
+
+	switch s.Type {
+	case "integer":
+		_, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+		return nil
+	case "boolean":
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+		return nil
+	}
+
+	return d.Validate(s, value, path)
+}
+
+// Validate checks a decoded json value against s, path names the value in errors. Numbers must be
+// decoded as json.Number or float64.
+func (d *Document) Validate(s *Schema, v interface{}, path string) error {
+	s, err := d.resolve(s)
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("%s must not be null", path)
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+
+			err = d.Validate(prop, obj[name], path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+
+		for i, item := range items {
+			err = d.Validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		return validateFormat(s, str, path)
+	case "integer":
+		if !isInteger(v) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	case "number":
+		switch v.(type) {
+		case json.Number, float64:
+		default:
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+
+	return nil
+}
+
+func isInteger(v interface{}) bool {
+	switch n := v.(type) {
+	case json.Number:
+		_, err := n.Int64()
+		return err == nil
+	case float64:
+		return n == float64(int64(n))
+	}
+	return false
+}
+
+func validateFormat(s *Schema, str, path string) error {
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == str {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %s", path, strings.Join(s.Enum, ", "))
+		}
+	}
+
+	var err error
+	switch s.Format {
+	case "date":
+		_, err = time.Parse("2006-01-02", str)
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, str)
+	case "email":
+		if !strings.Contains(str, "@") {
+			err = errors.New("no @")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s must be a %s", path, s.Format)
+	}
+
+	return nil
+}
+
+// resolve follows a reference to a component schema
+func (d *Document) resolve(s *Schema) (*Schema, error) {
+	if s == nil {
+		return &Schema{}, nil
+	}
+	if s.Ref == "" {
+		return s, nil
+	}
+
+	name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	resolved, ok := d.Components.Schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %s", s.Ref)
+	}
+	return d.resolve(resolved)
+}
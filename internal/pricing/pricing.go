@@ -0,0 +1,219 @@
+// Package pricing calculates the price of a stay from nightly rates, seasons, discounts, fees and taxes.
+// All amounts are integer cents.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidDates is returned when a stay does not last at least one night
+var ErrInvalidDates = errors.New("departure must be after arrival")
+
+// DefaultCurrency is used when no currency is configured
+const DefaultCurrency = "USD"
+
+// Line kinds of a quote
+const (
+	KindNight    = "night"
+	KindDiscount = "discount"
+	KindFee      = "fee"
+	KindTax      = "tax"
+)
+
+// Season overrides the nightly price for the nights from Start through End
+type Season struct {
+	Name         string
+	Start        time.Time
+	End          time.Time
+	NightlyPrice int
+}
+
+// StayDiscount takes Percent off the nightly prices of stays of at least MinNights
+type StayDiscount struct {
+	MinNights int
+	Percent   int
+}
+
+// Fee is added once per stay, or for every night when PerNight is set
+type Fee struct {
+	Name     string
+	Amount   int
+	PerNight bool
+}
+
+// Rules are everything needed to price a stay in one room
+type Rules struct {
+	Currency      string
+	NightlyPrice  int
+	WeekendPrice  int // friday and saturday nights, 0 uses NightlyPrice
+	Seasons       []Season
+	StayDiscounts []StayDiscount
+	Fees          []Fee
+	TaxRate       int // basis points, 1000 is 10%
+}
+
+// Line is one row of the price breakdown, discounts have a negative amount
+type Line struct {
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitAmount  int    `json:"unit_amount"`
+	Amount      int    `json:"amount"`
+}
+
+// Quote is the calculated price of a stay
+type Quote struct {
+	Currency string
+	Nights   int
+	Lines    []Line
+	Total    int
+}
+
+// Calculate prices the nights from start up to end. A season wins over the weekend price and
+// when seasons overlap the one listed last wins.
+func Calculate(rules Rules, start, end time.Time) (Quote, error) {
+	start = truncateDay(start)
+	end = truncateDay(end)
+	if !end.After(start) {
+		return Quote{}, ErrInvalidDates
+	}
+
+	q := Quote{Currency: rules.Currency}
+	if q.Currency == "" {
+		q.Currency = DefaultCurrency
+	}
+
+	subtotal := 0
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		description, price := nightPrice(rules, d)
+		q.Nights++
+		subtotal += price
+
+		// consecutive nights with the same rate share one line
+		if n := len(q.Lines); n > 0 && q.Lines[n-1].Description == description && q.Lines[n-1].UnitAmount == price {
+			q.Lines[n-1].Quantity++
+			q.Lines[n-1].Amount += price
+			continue
+		}
+		q.Lines = append(q.Lines, Line{Kind: KindNight, Description: description, Quantity: 1, UnitAmount: price, Amount: price})
+	}
+
+	taxable := subtotal
+
+	percent := 0
+	for _, sd := range rules.StayDiscounts {
+		if q.Nights >= sd.MinNights && sd.Percent > percent {
+			percent = sd.Percent
+		}
+	}
+	if percent > 0 {
+		discount := percentOf(subtotal, percent*100)
+		q.Lines = append(q.Lines, Line{
+			Kind:        KindDiscount,
+			Description: fmt.Sprintf("%d%% off stays of %d nights or more", percent, minNightsFor(rules.StayDiscounts, percent)),
+			Quantity:    1,
+			UnitAmount:  -discount,
+			Amount:      -discount,
+		})
+		taxable -= discount
+	}
+
+	for _, f := range rules.Fees {
+		qty := 1
+		if f.PerNight {
+			qty = q.Nights
+		}
+		q.Lines = append(q.Lines, Line{Kind: KindFee, Description: f.Name, Quantity: qty, UnitAmount: f.Amount, Amount: f.Amount * qty})
+		taxable += f.Amount * qty
+	}
+
+	q.Total = taxable
+	if rules.TaxRate > 0 {
+		tax := percentOf(taxable, rules.TaxRate)
+		q.Lines = append(q.Lines, Line{
+			Kind:        KindTax,
+			Description: fmt.Sprintf("Taxes (%s%%)", formatRate(rules.TaxRate)),
+			Quantity:    1,
+			UnitAmount:  tax,
+			Amount:      tax,
+		})
+		q.Total += tax
+	}
+
+	return q, nil
+}
+
+// nightPrice returns the rate that applies to the night starting on d
+func nightPrice(rules Rules, d time.Time) (string, int) {
+	for i := len(rules.Seasons) - 1; i >= 0; i-- {
+		s := rules.Seasons[i]
+		if !d.Before(truncateDay(s.Start)) && !d.After(truncateDay(s.End)) {
+			return s.Name, s.NightlyPrice
+		}
+	}
+
+	if rules.WeekendPrice > 0 && (d.Weekday() == time.Friday || d.Weekday() == time.Saturday) {
+		return "Weekend night", rules.WeekendPrice
+	}
+
+	return "Night", rules.NightlyPrice
+}
+
+// minNightsFor returns the smallest MinNights of the discounts with percent
+func minNightsFor(discounts []StayDiscount, percent int) int {
+	nights := 0
+	for _, sd := range discounts {
+		if sd.Percent == percent && (nights == 0 || sd.MinNights < nights) {
+			nights = sd.MinNights
+		}
+	}
+
+	return nights
+}
+
+// percentOf returns amount times basisPoints / 10000 rounded half up
+func percentOf(amount, basisPoints int) int {
+	return (amount*basisPoints + 5000) / 10000
+}
+
+func formatRate(basisPoints int) string {
+	if basisPoints%100 == 0 {
+		return fmt.Sprintf("%d", basisPoints/100)
+	}
+
+	return fmt.Sprintf("%d.%02d", basisPoints/100, basisPoints%100)
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// currencySymbols are the currencies shown with a symbol instead of their code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// Format shows amount cents in currency, like $120.00 or -$12.50
+func Format(amount int, currency string) string {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = currency + " "
+	}
+
+	return fmt.Sprintf("%s%s%d.%02d", sign, symbol, amount/100, amount%100)
+}
@@ -0,0 +1,152 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestCalculate_NightlyAndWeekend(t *testing.T) {
+	rules := Rules{NightlyPrice: 10000, WeekendPrice: 15000}
+
+	// 2050-01-05 is a wednesday: wed, thu, fri, sat, sun nights
+	q, err := Calculate(rules, date("2050-01-05"), date("2050-01-10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Nights != 5 {
+		t.Errorf("expected 5 nights, got %d", q.Nights)
+	}
+	if q.Total != 3*10000+2*15000 {
+		t.Errorf("wrong total %d", q.Total)
+	}
+	if q.Currency != DefaultCurrency {
+		t.Errorf("expected default currency, got %s", q.Currency)
+	}
+
+	want := []Line{
+		{KindNight, "Night", 2, 10000, 20000},
+		{KindNight, "Weekend night", 2, 15000, 30000},
+		{KindNight, "Night", 1, 10000, 10000},
+	}
+	if len(q.Lines) != len(want) {
+		t.Fatalf("expected %d lines, got %+v", len(want), q.Lines)
+	}
+	for i := range want {
+		if q.Lines[i] != want[i] {
+			t.Errorf("line %d: got %+v want %+v", i, q.Lines[i], want[i])
+		}
+	}
+}
+
+func TestCalculate_Seasons(t *testing.T) {
+	rules := Rules{
+		NightlyPrice: 10000,
+		WeekendPrice: 15000,
+		Seasons: []Season{
+			{Name: "Summer", Start: date("2050-06-01"), End: date("2050-08-31"), NightlyPrice: 20000},
+			{Name: "Festival", Start: date("2050-07-01"), End: date("2050-07-01"), NightlyPrice: 30000},
+		},
+	}
+
+	// may 31 is a normal night, june 30 to july 2 are summer nights with a festival night in between
+	tests := []struct {
+		start, end string
+		total      int
+	}{
+		{"2050-05-31", "2050-06-02", 10000 + 20000},
+		{"2050-06-30", "2050-07-03", 20000 + 30000 + 20000},
+		{"2050-08-31", "2050-09-01", 20000},
+	}
+
+	for _, e := range tests {
+		q, err := Calculate(rules, date(e.start), date(e.end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Total != e.total {
+			t.Errorf("%s - %s: expected %d, got %d (%+v)", e.start, e.end, e.total, q.Total, q.Lines)
+		}
+	}
+}
+
+func TestCalculate_DiscountFeesAndTaxes(t *testing.T) {
+	rules := Rules{
+		Currency:     "EUR",
+		NightlyPrice: 10000,
+		StayDiscounts: []StayDiscount{
+			{MinNights: 7, Percent: 10},
+			{MinNights: 28, Percent: 20},
+		},
+		Fees: []Fee{
+			{Name: "Cleaning", Amount: 5000},
+			{Name: "Resort fee", Amount: 1000, PerNight: true},
+		},
+		TaxRate: 825,
+	}
+
+	q, err := Calculate(rules, date("2050-01-01"), date("2050-01-08"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 7 nights 70000, 10% off 7000, fees 5000 + 7000, taxes 8.25% of 75000
+	taxable := 70000 - 7000 + 5000 + 7000
+	tax := 6188
+	if q.Total != taxable+tax {
+		t.Errorf("expected total %d, got %d: %+v", taxable+tax, q.Total, q.Lines)
+	}
+
+	kinds := []string{KindNight, KindDiscount, KindFee, KindFee, KindTax}
+	if len(q.Lines) != len(kinds) {
+		t.Fatalf("wrong lines %+v", q.Lines)
+	}
+	for i, k := range kinds {
+		if q.Lines[i].Kind != k {
+			t.Errorf("line %d: expected %s, got %s", i, k, q.Lines[i].Kind)
+		}
+	}
+
+	if q.Lines[1].Amount != -7000 || q.Lines[1].Description != "10% off stays of 7 nights or more" {
+		t.Errorf("wrong discount %+v", q.Lines[1])
+	}
+	if q.Lines[3].Quantity != 7 || q.Lines[3].Amount != 7000 {
+		t.Errorf("wrong per night fee %+v", q.Lines[3])
+	}
+	if q.Lines[4].Description != "Taxes (8.25%)" || q.Lines[4].Amount != tax {
+		t.Errorf("wrong tax %+v", q.Lines[4])
+	}
+}
+
+func TestCalculate_InvalidDates(t *testing.T) {
+	for _, e := range [][2]string{{"2050-01-02", "2050-01-02"}, {"2050-01-02", "2050-01-01"}} {
+		_, err := Calculate(Rules{NightlyPrice: 100}, date(e[0]), date(e[1]))
+		if err != ErrInvalidDates {
+			t.Errorf("%v: expected ErrInvalidDates, got %v", e, err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		want     string
+	}{
+		{12000, "USD", "$120.00"},
+		{5, "", "$0.05"},
+		{-1250, "EUR", "-€12.50"},
+		{99999, "IDR", "IDR 999.99"},
+	}
+
+	for _, e := range tests {
+		if got := Format(e.amount, e.currency); got != e.want {
+			t.Errorf("Format(%d, %q): got %s want %s", e.amount, e.currency, got, e.want)
+		}
+	}
+}
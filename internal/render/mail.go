@@ -0,0 +1,104 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/models"
+	"html"
+	"html/template"
+	"path/filepath"
+	"strings"
+)
+
+var pathToMailTemplates = "./email-templates"
+
+// MailMessage renders the email template tmpl for the recipient to. Every mail template defines
+// a "subject", a plain "text" body and an "html" body, so the message is sent as multipart.
+func MailMessage(tmpl, to string, td *models.MailTemplateData) (models.MailData, error) {
+	var tc map[string]*template.Template
+
+	if app.UseCache {
+		tc = app.MailTemplateCache
+	} else {
+		var err error
+		tc, err = CreateMailTemplateCache()
+		if err != nil {
+			return models.MailData{}, err
+		}
+	}
+
+	t, ok := tc[tmpl]
+	if !ok {
+		return models.MailData{}, fmt.Errorf("could not get mail template %s from template cache", tmpl)
+	}
+
+	subject, err := executeMailPart(t, "subject", td)
+	if err != nil {
+		return models.MailData{}, err
+	}
+
+	text, err := executeMailPart(t, "text", td)
+	if err != nil {
+		return models.MailData{}, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = t.ExecuteTemplate(buf, "html", td)
+	if err != nil {
+		return models.MailData{}, err
+	}
+
+	return models.MailData{
+		To:           to,
+		Subject:      strings.Join(strings.Fields(subject), " "),
+		Content:      buf.String(),
+		PlainContent: strings.TrimSpace(text),
+		Template:     tmpl,
+	}, nil
+}
+
+// executeMailPart renders a plain text part of a mail template. html/template escapes the values
+// as html text, which is undone here since the subject and the text body are not html.
+func executeMailPart(t *template.Template, name string, td *models.MailTemplateData) (string, error) {
+	buf := new(bytes.Buffer)
+	err := t.ExecuteTemplate(buf, name, td)
+	if err != nil {
+		return "", err
+	}
+
+	return html.UnescapeString(buf.String()), nil
+}
+
+// CreateMailTemplateCache creates the email template cache as a map
+func CreateMailTemplateCache() (map[string]*template.Template, error) {
+	myCache := map[string]*template.Template{}
+
+	mails, err := filepath.Glob(fmt.Sprintf("%s/*.mail.gohtml", pathToMailTemplates))
+	if err != nil {
+		return myCache, err
+	}
+
+	for _, mail := range mails {
+		name := filepath.Base(mail)
+		ts, err := template.New(name).Funcs(functions).ParseFiles(mail)
+		if err != nil {
+			return myCache, err
+		}
+
+		matches, err := filepath.Glob(fmt.Sprintf("%s/*.layout.gohtml", pathToMailTemplates))
+		if err != nil {
+			return myCache, err
+		}
+
+		if len(matches) > 0 {
+			ts, err = ts.ParseGlob(fmt.Sprintf("%s/*.layout.gohtml", pathToMailTemplates))
+			if err != nil {
+				return myCache, err
+			}
+		}
+
+		myCache[name] = ts
+	}
+
+	return myCache, nil
+}
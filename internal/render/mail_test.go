@@ -0,0 +1,80 @@
+package render
+
+import (
+	"github.com/ismail118/bookings-app/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateMailTemplateCache(t *testing.T) {
+	pathToMailTemplates = "./../../email-templates"
+	tc, err := CreateMailTemplateCache()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{
+		"reservation-confirmation.mail.gohtml",
+		"owner-reservation-alert.mail.gohtml",
+		"reservation-cancellation.mail.gohtml",
+		"reservation-changed.mail.gohtml",
+		"owner-reservation-changed.mail.gohtml",
+		"owner-reservation-cancelled.mail.gohtml",
+		"password-reset.mail.gohtml",
+	} {
+		if _, ok := tc[name]; !ok {
+			t.Errorf("mail template %s should be in the cache", name)
+		}
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	pathToMailTemplates = "./../../email-templates"
+	tc, err := CreateMailTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.MailTemplateCache = tc
+	app.UseCache = true
+
+	td := &models.MailTemplateData{
+		Reservation: models.Reservation{FirstName: "<b>O'Brien</b>"},
+		Room:        models.Room{RoomName: "General's Quarters"},
+		StartDate:   time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		Links:       map[string]string{"home": "http://localhost:8080/"},
+	}
+
+	msg, err := MailMessage("reservation-confirmation.mail.gohtml", "guest@here.com", td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.To != "guest@here.com" {
+		t.Errorf("wrong recipient, got %s", msg.To)
+	}
+
+	if msg.Subject != "Reservation Confirmation" {
+		t.Errorf("wrong subject, got %q", msg.Subject)
+	}
+
+	// the guest name must be escaped in the html body but kept as is in the text body
+	if strings.Contains(msg.Content, "<b>O'Brien</b>") || !strings.Contains(msg.Content, "&lt;b&gt;O&#39;Brien&lt;/b&gt;") {
+		t.Error("guest name should be escaped in the html body")
+	}
+
+	if !strings.Contains(msg.PlainContent, "Dear <b>O'Brien</b>,") {
+		t.Errorf("guest name should not be escaped in the text body, got %q", msg.PlainContent)
+	}
+
+	if !strings.Contains(msg.PlainContent, "General's Quarters from 2050-01-01 to 2050-01-03") {
+		t.Errorf("text body should contain room and dates, got %q", msg.PlainContent)
+	}
+
+	_, err = MailMessage("non-exists.mail.gohtml", "guest@here.com", td)
+	if err == nil {
+		t.Error("mail template non-exists.mail.gohtml should not exists")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/ismail118/bookings-app/internal/config"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"github.com/justinas/nosurf"
 	"html/template"
 	"net/http"
@@ -13,10 +14,13 @@ import (
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
-	"add":        Add,
+	"humanDate":   HumanDate,
+	"formatDate":  FormatDate,
+	"iterate":     Iterate,
+	"add":         Add,
+	"formatPrice": FormatPrice,
+	"formatMoney": pricing.Format,
+	"statusName":  models.StatusName,
 }
 
 var app *config.AppConfig
@@ -49,6 +53,11 @@ func Add(a, b int) int {
 	return a + b
 }
 
+// FormatPrice formats a price in cents in the currency of the app
+func FormatPrice(cents int) string {
+	return pricing.Format(cents, app.Pricing.Currency)
+}
+
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Error = app.Session.PopString(r.Context(), "error")
@@ -56,6 +65,7 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.CSRFToken = nosurf.Token(r)
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
 	}
 	return td
 }
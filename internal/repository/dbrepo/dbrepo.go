@@ -1,11 +1,31 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/ismail118/bookings-app/internal/audit"
 	"github.com/ismail118/bookings-app/internal/config"
+	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/pricing"
 	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/jackc/pgconn"
+	"strings"
+	"time"
 )
 
+// defaultQueryTimeout is used when the app config does not set a query timeout
+const defaultQueryTimeout = 3 * time.Second
+
+// uniqueViolation is the postgres error code for a unique index violation
+const uniqueViolation = "23505"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
 type postgresDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
@@ -18,6 +38,251 @@ func NewPostgresRepo(db *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
 	}
 }
 
+// queryContext derives the context for a single database call from the caller's context,
+// so the query is cancelled when the request goes away or the configured timeout is reached
+func (m *postgresDBRepo) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.App.DBQueryTimeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// encodePriceLines stores the price breakdown of a reservation as json
+func encodePriceLines(lines []pricing.Line) (string, error) {
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(lines)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// decodePriceLines reads a price breakdown stored by encodePriceLines
+func decodePriceLines(s string) ([]pricing.Line, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var lines []pricing.Line
+	err := json.Unmarshal([]byte(s), &lines)
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// encodeAttachments stores the attachments of a queued mail as json, the data is base64 encoded
+func encodeAttachments(attachments []models.MailAttachment) (string, error) {
+	if len(attachments) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(attachments)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// decodeAttachments reads attachments stored by encodeAttachments
+func decodeAttachments(s string) ([]models.MailAttachment, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var attachments []models.MailAttachment
+	err := json.Unmarshal([]byte(s), &attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// encodeWeekdays stores weekdays as a bit mask, bit 0 is sunday
+func encodeWeekdays(days []time.Weekday) int {
+	mask := 0
+	for _, d := range days {
+		mask |= 1 << uint(d)
+	}
+	return mask
+}
+
+// decodeWeekdays reads weekdays stored by encodeWeekdays
+func decodeWeekdays(mask int) []time.Weekday {
+	var days []time.Weekday
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if mask&(1<<uint(d)) != 0 {
+			days = append(days, d)
+		}
+	}
+	return days
+}
+
+// isUniqueViolation reports whether err was caused by a unique index
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+// auditDateLayout formats the dates stored in audit log changes
+const auditDateLayout = "2006-01-02"
+
+// insertAudit records the change of an entity from before to after in tx, with the actor in ctx.
+// before is nil for a new entity and after is nil for a deleted one.
+func insertAudit(ctx context.Context, tx *sql.Tx, action, entityType string, entityID int, before, after audit.Fields) error {
+	changes, err := audit.Diff(before, after)
+	if err != nil {
+		return err
+	}
+
+	actor := audit.ActorFrom(ctx)
+
+	stmt := `insert into audit_log (user_id, action, entity_type, entity_id, changes, ip_address, created_at, updated_at)
+	values (nullif($1, 0), $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err = tx.ExecContext(ctx, stmt, actor.UserID, action, entityType, entityID, changes, actor.IPAddress,
+		time.Now(), time.Now())
+	return err
+}
+
+// reservationAudit returns the audited fields of a reservation
+func reservationAudit(r models.Reservation) audit.Fields {
+	return audit.Fields{
+		"first_name": r.FirstName,
+		"last_name":  r.LastName,
+		"email":      r.Email,
+		"phone":      r.PhoneNumber,
+		"room_id":    r.RoomID,
+		"start_date": r.StartDate.Format(auditDateLayout),
+		"end_date":   r.EndDate.Format(auditDateLayout),
+		"status":     r.Status,
+		"total":      r.Total,
+	}
+}
+
+// blockAudit returns the audited fields of an owner block
+func blockAudit(b models.RoomRestriction) audit.Fields {
+	return audit.Fields{
+		"room_id":    b.RoomID,
+		"start_date": b.StartDate.Format(auditDateLayout),
+		"end_date":   b.EndDate.Format(auditDateLayout),
+		"reason":     b.Reason,
+		"note":       b.Note,
+	}
+}
+
+// roomAudit returns the audited catalog fields of a room
+func roomAudit(r models.Room) audit.Fields {
+	return audit.Fields{
+		"room_name":     r.RoomName,
+		"slug":          r.Slug,
+		"description":   r.Description,
+		"capacity":      r.Capacity,
+		"amenities":     strings.Join(r.Amenities, ", "),
+		"base_price":    r.BasePrice,
+		"weekend_price": r.WeekendPrice,
+	}
+}
+
+// roomPhotoAudit returns the audited fields of a room photo
+func roomPhotoAudit(p models.RoomPhoto) audit.Fields {
+	return audit.Fields{
+		"room_id":  p.RoomID,
+		"url":      p.URL,
+		"position": p.Position,
+		"is_cover": p.IsCover,
+	}
+}
+
+// seasonalRateAudit returns the audited fields of a seasonal rate
+func seasonalRateAudit(sr models.SeasonalRate) audit.Fields {
+	return audit.Fields{
+		"room_id":       sr.RoomID,
+		"name":          sr.Name,
+		"start_date":    sr.StartDate.Format(auditDateLayout),
+		"end_date":      sr.EndDate.Format(auditDateLayout),
+		"nightly_price": sr.NightlyPrice,
+	}
+}
+
+// stayRuleAudit returns the audited fields of a stay rule
+func stayRuleAudit(rule models.StayRule) audit.Fields {
+	weekdays := make([]string, 0, len(rule.Weekdays))
+	for _, d := range rule.Weekdays {
+		weekdays = append(weekdays, d.String())
+	}
+
+	return audit.Fields{
+		"room_id":             rule.RoomID,
+		"start_date":          rule.StartDate.Format(auditDateLayout),
+		"end_date":            rule.EndDate.Format(auditDateLayout),
+		"weekdays":            strings.Join(weekdays, ", "),
+		"min_nights":          rule.MinNights,
+		"max_nights":          rule.MaxNights,
+		"closed_to_arrival":   rule.ClosedToArrival,
+		"closed_to_departure": rule.ClosedToDeparture,
+		"min_lead_days":       rule.MinLeadDays,
+		"max_lead_days":       rule.MaxLeadDays,
+	}
+}
+
+// userAudit returns the audited fields of a user, never the password or two-factor secrets
+func userAudit(u models.User) audit.Fields {
+	return audit.Fields{
+		"first_name":   u.FirstName,
+		"last_name":    u.LastName,
+		"email":        u.Email,
+		"access_level": u.AccessLevel,
+		"active":       u.Active,
+	}
+}
+
+// queuedMailAudit returns the audited fields of a queued message, never its content
+func queuedMailAudit(m models.QueuedMail) audit.Fields {
+	return audit.Fields{
+		"to":       m.Mail.To,
+		"subject":  m.Mail.Subject,
+		"status":   m.Status,
+		"attempts": m.Attempts,
+	}
+}
+
+// apiTokenAudit returns the audited fields of an api token, never its hash
+func apiTokenAudit(t models.APIToken) audit.Fields {
+	return audit.Fields{
+		"user_id": t.UserID,
+		"name":    t.Name,
+		"scopes":  strings.Join(t.Scopes, ", "),
+		"revoked": t.Revoked(),
+	}
+}
+
+// externalFeedAudit returns the fields of an external calendar feed recorded by the audit log
+func externalFeedAudit(f models.ExternalFeed) audit.Fields {
+	return audit.Fields{
+		"room_id": f.RoomID,
+		"name":    f.Name,
+		"url":     f.URL,
+	}
+}
+
+// splitScopes parses the comma separated scopes of an api token
+func splitScopes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 type testDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
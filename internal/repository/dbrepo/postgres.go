@@ -2,18 +2,21 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/audit"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/stayrules"
 	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
 	"time"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
-}
-
-func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
@@ -36,15 +39,21 @@ func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
 	return nil
 }
 
-func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	var newID int
 
+	breakdown, err := encodePriceLines(res.PriceLines)
+	if err != nil {
+		return 0, err
+	}
+
 	stmt := `INSERT INTO reservations (first_name, last_name, email, phone,
-                          start_date, end_date, room_id, created_at, updated_at)
-                          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+                          start_date, end_date, room_id, created_at, updated_at,
+                          total_price, currency, price_breakdown, confirmation_code)
+                          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, nullif($13, '')) returning id`
 
 	row := m.DB.QueryRowContext(ctx, stmt,
 		res.FirstName,
@@ -56,9 +65,109 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.RoomID,
 		time.Now(),
 		time.Now(),
+		res.Total,
+		res.Currency,
+		breakdown,
+		res.ConfirmationCode,
+	)
+
+	err = row.Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// BookReservation checks availability and stores the reservation together with its room restriction
+// in one transaction. The room row is locked for the duration of the transaction, so two guests
+// booking the same room are serialized and the second one gets repository.ErrRoomNotAvailable.
+func (m *postgresDBRepo) BookReservation(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, res.RoomID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	var numRow int
+	query := `select count(id) from room_restrictions where room_id = $1 and start_date < $3 and end_date > $2`
+
+	err = tx.QueryRowContext(ctx, query, res.RoomID, res.StartDate, res.EndDate).Scan(&numRow)
+	if err != nil {
+		return 0, err
+	}
+
+	if numRow > 0 {
+		return 0, repository.ErrRoomNotAvailable
+	}
+
+	var newID int
+
+	breakdown, err := encodePriceLines(res.PriceLines)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `INSERT INTO reservations (first_name, last_name, email, phone,
+                          start_date, end_date, room_id, created_at, updated_at,
+                          total_price, currency, price_breakdown, confirmation_code)
+                          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, nullif($13, '')) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.PhoneNumber,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		time.Now(),
+		time.Now(),
+		res.Total,
+		res.Currency,
+		breakdown,
+		res.ConfirmationCode,
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateConfirmationCode
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+                               created_at, updated_at, restriction_id)
+                               values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		newID,
+		time.Now(),
+		time.Now(),
+		1,
 	)
+	if err != nil {
+		return 0, err
+	}
+
+	res.Status = models.ReservationPending
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditReservation, newID, nil, reservationAudit(res))
+	if err != nil {
+		return 0, err
+	}
 
-	err := row.Scan(&newID)
+	err = tx.Commit()
 	if err != nil {
 		return 0, err
 	}
@@ -66,13 +175,13 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 	return newID, nil
 }
 
-func (m *postgresDBRepo) SearchAvailabilityByRoomID(roomID int, start, end time.Time) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityByRoomID(ctx context.Context, roomID int, start, end time.Time) (bool, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	var numRow int
 
-	query := `select count(id) from room_restrictions where room_id = $1 and $2 <= end_date and $3 >= start_date;`
+	query := `select count(id) from room_restrictions where room_id = $1 and start_date < $3 and end_date > $2;`
 
 	row := m.DB.QueryRowContext(ctx, query, roomID, start, end)
 	err := row.Scan(&numRow)
@@ -80,40 +189,45 @@ func (m *postgresDBRepo) SearchAvailabilityByRoomID(roomID int, start, end time.
 		return false, err
 	}
 
-	if numRow == 0 {
-		return true, nil
+	if numRow > 0 {
+		return false, nil
+	}
+
+	rules, err := m.StayRulesForStay(ctx, start, end)
+	if err != nil {
+		return false, err
+	}
+
+	if stayrules.Check(stayrules.ByRoom(rules)[roomID], start, end, stayrules.Today()) != nil {
+		return false, nil
 	}
 
-	return false, nil
+	return true, nil
 }
 
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	query := `
 select
-    r.id,
-    r.room_name
+    ` + roomColumns + `
 from
     rooms r
 where
     r.id not in
-    (select rr.room_id from room_restrictions rr where $1 <= rr.end_date and $2 >= rr.start_date)`
+    (select rr.room_id from room_restrictions rr where rr.start_date < $2 and rr.end_date > $1)
+order by r.room_name`
 
-	rooms := make([]models.Room, 0)
 	rows, err := m.DB.QueryContext(ctx, query, start, end)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	rooms := make([]models.Room, 0)
 	for rows.Next() {
-		var room models.Room
-		err = rows.Scan(
-			&room.ID,
-			&room.RoomName,
-		)
+		room, err := scanRoom(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -125,378 +239,2915 @@ where
 		return rooms, err
 	}
 
+	// rooms whose stay rules don't allow the stay are not available either
+	rules, err := m.StayRulesForStay(ctx, start, end)
+	if err != nil {
+		return rooms, err
+	}
+
+	byRoom := stayrules.ByRoom(rules)
+	today := stayrules.Today()
+	allowed := rooms[:0]
+	for _, room := range rooms {
+		if stayrules.Check(byRoom[room.ID], start, end, today) == nil {
+			allowed = append(allowed, room)
+		}
+	}
+	rooms = allowed
+
+	err = m.attachRoomPhotos(ctx, rooms)
+	if err != nil {
+		return rooms, err
+	}
+
 	return rooms, nil
 }
 
-func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `
-select id, room_name, created_at, updated_at from rooms where id = $1
-`
+// roomColumns are the columns read by scanRoom, in order
+const roomColumns = `r.id, r.room_name, r.slug, r.description, r.capacity, r.amenities, r.base_price, r.weekend_price,
+	r.created_at, r.updated_at`
 
+// scanRoom reads the roomColumns of a single row into a room
+func scanRoom(row rowScanner) (models.Room, error) {
 	var room models.Room
+	var amenities string
 
-	row := m.DB.QueryRowContext(ctx, query, id)
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.Capacity,
+		&amenities,
+		&room.BasePrice,
+		&room.WeekendPrice,
 		&room.CreatedAt,
 		&room.UpdatedAt,
 	)
-
 	if err != nil {
 		return room, err
 	}
 
+	room.Amenities = splitLines(amenities)
+
 	return room, nil
 }
 
-func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// splitLines turns a newline separated list column into a slice, skipping blank lines
+func splitLines(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
 
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at 
-	from users where id = $1`
+	return lines
+}
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+// attachRoomPhotos loads the photos of the given rooms in display order
+func (m *postgresDBRepo) attachRoomPhotos(ctx context.Context, rooms []models.Room) error {
+	if len(rooms) == 0 {
+		return nil
+	}
 
-	var u models.User
-	err := row.Scan(
-		&u.ID,
-		&u.FirstName,
-		&u.LastName,
-		&u.Email,
-		&u.Password,
-		&u.AccessLevel,
-		&u.CreatedAt,
-		&u.UpdatedAt,
-	)
+	index := make(map[int]int, len(rooms))
+	ids := make([]int, 0, len(rooms))
+	for i, r := range rooms {
+		index[r.ID] = i
+		ids = append(ids, r.ID)
+	}
+
+	query := `select ` + photoColumns + ` from room_photos p where p.room_id = any($1) order by p.room_id, p.position, p.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, ids)
 	if err != nil {
-		return u, err
+		return err
 	}
+	defer rows.Close()
 
-	return u, nil
+	for rows.Next() {
+		p, err := scanRoomPhoto(rows)
+		if err != nil {
+			return err
+		}
+
+		i := index[p.RoomID]
+		rooms[i].Photos = append(rooms[i].Photos, p)
+	}
+
+	return rows.Err()
 }
 
-func (m *postgresDBRepo) UpdateUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// photoColumns are the columns read by scanRoomPhoto, in order
+const photoColumns = `p.id, p.room_id, p.url, p.medium_url, p.thumb_url, p.files, p.position, p.is_cover, p.created_at, p.updated_at`
 
-	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
-	where id = $6`
+// scanRoomPhoto reads the photoColumns of a single row into a photo
+func scanRoomPhoto(row rowScanner) (models.RoomPhoto, error) {
+	var p models.RoomPhoto
+	var files string
 
-	_, err := m.DB.ExecContext(ctx, query,
-		u.FirstName,
-		u.LastName,
-		u.Email,
-		u.AccessLevel,
-		time.Now(),
-		u.ID,
+	err := row.Scan(
+		&p.ID,
+		&p.RoomID,
+		&p.URL,
+		&p.MediumURL,
+		&p.ThumbURL,
+		&files,
+		&p.Position,
+		&p.IsCover,
+		&p.CreatedAt,
+		&p.UpdatedAt,
 	)
 	if err != nil {
-		return err
+		return p, err
 	}
 
-	return nil
+	p.Files = splitLines(files)
+
+	return p, nil
 }
 
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var id int
-	var hashedPassword string
+	query := `select ` + roomColumns + ` from rooms r where r.id = $1`
 
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
-	err := row.Scan(&id, &hashedPassword)
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, query, id))
 	if err != nil {
-		return 0, "", err
+		return room, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
-	} else if err != nil {
-		return 0, "", err
+	rooms := []models.Room{room}
+	err = m.attachRoomPhotos(ctx, rooms)
+	if err != nil {
+		return room, err
 	}
 
-	return id, hashedPassword, nil
+	return rooms[0], nil
 }
 
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetRoomBySlug returns the room shown at /rooms/{slug}
+func (m *postgresDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var reservations []models.Reservation
+	query := `select ` + roomColumns + ` from rooms r where r.slug = $1`
 
-	query := `
-	select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at,
-	r.processed, rm.id, rm.room_name
-	from reservations r
-	left join rooms rm on r.room_id = rm.id
-	order by r.start_date asc
-`
-	rows, err := m.DB.QueryContext(ctx, query)
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, query, slug))
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var reservation models.Reservation
-		err = rows.Scan(
-			&reservation.ID,
-			&reservation.FirstName,
-			&reservation.LastName,
-			&reservation.Email,
-			&reservation.PhoneNumber,
-			&reservation.StartDate,
-			&reservation.EndDate,
-			&reservation.RoomID,
-			&reservation.CreatedAt,
-			&reservation.UpdatedAt,
-			&reservation.Processed,
-			&reservation.Room.ID,
-			&reservation.Room.RoomName,
-		)
-		if err != nil {
-			return nil, err
-		}
-		reservations = append(reservations, reservation)
+		return room, err
 	}
 
-	if rows.Err() != nil {
-		return reservations, err
+	rooms := []models.Room{room}
+	err = m.attachRoomPhotos(ctx, rooms)
+	if err != nil {
+		return room, err
 	}
 
-	return reservations, nil
+	return rooms[0], nil
 }
 
-func (m *postgresDBRepo) NewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertRoom adds a room to the catalog and returns its id
+func (m *postgresDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var reservations []models.Reservation
-
-	query := `
-	select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at,
-	r.processed, rm.id, rm.room_name
-	from reservations r
-	left join rooms rm on r.room_id = rm.id
-	where r.processed = 0
-	order by r.start_date asc
-`
-	rows, err := m.DB.QueryContext(ctx, query)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	for rows.Next() {
-		var reservation models.Reservation
-		err = rows.Scan(
-			&reservation.ID,
-			&reservation.FirstName,
-			&reservation.LastName,
-			&reservation.Email,
-			&reservation.PhoneNumber,
-			&reservation.StartDate,
-			&reservation.EndDate,
-			&reservation.RoomID,
-			&reservation.CreatedAt,
-			&reservation.UpdatedAt,
-			&reservation.Processed,
-			&reservation.Room.ID,
-			&reservation.Room.RoomName,
-		)
-		if err != nil {
-			return nil, err
-		}
-		reservations = append(reservations, reservation)
+	query := `insert into rooms (room_name, slug, description, capacity, amenities, base_price, weekend_price,
+	created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		r.RoomName,
+		r.Slug,
+		r.Description,
+		r.Capacity,
+		strings.Join(r.Amenities, "\n"),
+		r.BasePrice,
+		r.WeekendPrice,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateSlug
+	} else if err != nil {
+		return 0, err
 	}
 
-	if rows.Err() != nil {
-		return reservations, err
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditRoom, newID, nil, roomAudit(r))
+	if err != nil {
+		return 0, err
 	}
 
-	return reservations, nil
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
 }
 
-func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// UpdateRoom saves the catalog details of a room, photos are managed separately
+func (m *postgresDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var res models.Reservation
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	query := `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, 
-    r.created_at, r.updated_at, r.processed, rm.id, rm.room_name 
-	from reservations r
-	left join rooms rm on r.room_id = rm.id
-	where r.id = $1`
+	query := `select ` + roomColumns + ` from rooms r where r.id = $1 for update`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	before, err := scanRoom(tx.QueryRowContext(ctx, query, r.ID))
+	if err != nil {
+		return err
+	}
 
-	err := row.Scan(
-		&res.ID,
-		&res.FirstName,
-		&res.LastName,
-		&res.Email,
-		&res.PhoneNumber,
-		&res.StartDate,
-		&res.EndDate,
-		&res.RoomID,
-		&res.CreatedAt,
-		&res.UpdatedAt,
-		&res.Processed,
-		&res.Room.ID,
-		&res.Room.RoomName,
+	query = `update rooms set room_name = $1, slug = $2, description = $3, capacity = $4, amenities = $5,
+	base_price = $6, weekend_price = $7, updated_at = $8 where id = $9`
+
+	_, err = tx.ExecContext(ctx, query,
+		r.RoomName,
+		r.Slug,
+		r.Description,
+		r.Capacity,
+		strings.Join(r.Amenities, "\n"),
+		r.BasePrice,
+		r.WeekendPrice,
+		time.Now(),
+		r.ID,
 	)
-	if err != nil {
-		return res, err
+	if isUniqueViolation(err) {
+		return repository.ErrDuplicateSlug
+	} else if err != nil {
+		return err
 	}
 
-	err = row.Err()
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditRoom, r.ID, roomAudit(before), roomAudit(r))
 	if err != nil {
-		return res, err
+		return err
 	}
 
-	return res, nil
+	return tx.Commit()
 }
 
-func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// DeleteRoom removes a room with its photos and blocks, rooms that still have reservations are kept
+func (m *postgresDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	query := `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
-	where id = $6`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(ctx, query,
-		u.FirstName,
-		u.LastName,
-		u.Email,
-		u.PhoneNumber,
-		time.Now(),
-		u.ID,
-	)
+	// lock the room so no reservation can be booked for it while it is checked and deleted
+	query := `select ` + roomColumns + ` from rooms r where r.id = $1 for update`
+
+	before, err := scanRoom(tx.QueryRowContext(ctx, query, id))
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	var reservations int
+	err = tx.QueryRowContext(ctx, `select count(id) from reservations where room_id = $1`, id).Scan(&reservations)
+	if err != nil {
+		return err
+	}
 
-func (m *postgresDBRepo) DeleteReservation(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	if reservations > 0 {
+		return repository.ErrRoomHasReservations
+	}
 
-	query := `delete from reservations where id = $1`
+	_, err = tx.ExecContext(ctx, `delete from rooms where id = $1`, id)
+	if err != nil {
+		return err
+	}
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditRoom, id, roomAudit(before), nil)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// SeasonalRatesForRoom returns the seasonal rates of a room ordered by start date
+func (m *postgresDBRepo) SeasonalRatesForRoom(ctx context.Context, roomID int) ([]models.SeasonalRate, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	query := `update reservations set processed = $1 where id = $2`
+	query := `select id, room_id, name, start_date, end_date, nightly_price, created_at, updated_at
+	from room_seasonal_rates where room_id = $1 order by start_date, id`
 
-	_, err := m.DB.ExecContext(ctx, query, processed, id)
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []models.SeasonalRate
+	for rows.Next() {
+		var sr models.SeasonalRate
+		err = rows.Scan(
+			&sr.ID,
+			&sr.RoomID,
+			&sr.Name,
+			&sr.StartDate,
+			&sr.EndDate,
+			&sr.NightlyPrice,
+			&sr.CreatedAt,
+			&sr.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, sr)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+func (m *postgresDBRepo) InsertSeasonalRate(ctx context.Context, sr models.SeasonalRate) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `insert into room_seasonal_rates (room_id, name, start_date, end_date, nightly_price, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		sr.RoomID,
+		sr.Name,
+		sr.StartDate,
+		sr.EndDate,
+		sr.NightlyPrice,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditSeasonalRate, newID, nil, seasonalRateAudit(sr))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteSeasonalRate removes a seasonal rate of the given room
+func (m *postgresDBRepo) DeleteSeasonalRate(ctx context.Context, roomID, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `delete from room_seasonal_rates where id = $1 and room_id = $2
+	returning room_id, name, start_date, end_date, nightly_price`
+
+	var sr models.SeasonalRate
+	err = tx.QueryRowContext(ctx, query, id, roomID).Scan(
+		&sr.RoomID,
+		&sr.Name,
+		&sr.StartDate,
+		&sr.EndDate,
+		&sr.NightlyPrice,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditSeasonalRate, id, seasonalRateAudit(sr), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// stayRuleColumns are the columns read by scanStayRule, in order
+const stayRuleColumns = `id, room_id, start_date, end_date, weekdays, min_nights, max_nights, closed_to_arrival,
+	closed_to_departure, min_lead_days, max_lead_days, created_at, updated_at`
+
+// scanStayRule reads the stayRuleColumns of a single row into a stay rule
+func scanStayRule(row rowScanner) (models.StayRule, error) {
+	var rule models.StayRule
+	var weekdays int
+
+	err := row.Scan(
+		&rule.ID,
+		&rule.RoomID,
+		&rule.StartDate,
+		&rule.EndDate,
+		&weekdays,
+		&rule.MinNights,
+		&rule.MaxNights,
+		&rule.ClosedToArrival,
+		&rule.ClosedToDeparture,
+		&rule.MinLeadDays,
+		&rule.MaxLeadDays,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Weekdays = decodeWeekdays(weekdays)
+	return rule, nil
+}
+
+// queryStayRules runs a select of stayRuleColumns and scans every row
+func (m *postgresDBRepo) queryStayRules(ctx context.Context, query string, args ...interface{}) ([]models.StayRule, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []models.StayRule
+	for rows.Next() {
+		rule, err := scanStayRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// StayRulesForRoom returns the stay rules of a room ordered by start date
+func (m *postgresDBRepo) StayRulesForRoom(ctx context.Context, roomID int) ([]models.StayRule, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select ` + stayRuleColumns + ` from room_stay_rules where room_id = $1 order by start_date, id`
+
+	return m.queryStayRules(ctx, query, roomID)
+}
+
+// StayRulesForStay returns the stay rules of all rooms covering the arrival or departure day of a stay
+func (m *postgresDBRepo) StayRulesForStay(ctx context.Context, start, end time.Time) ([]models.StayRule, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select ` + stayRuleColumns + ` from room_stay_rules
+	where ($1 between start_date and end_date) or ($2 between start_date and end_date)
+	order by room_id, start_date, id`
+
+	return m.queryStayRules(ctx, query, start, end)
+}
+
+func (m *postgresDBRepo) InsertStayRule(ctx context.Context, rule models.StayRule) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `insert into room_stay_rules (room_id, start_date, end_date, weekdays, min_nights, max_nights,
+	closed_to_arrival, closed_to_departure, min_lead_days, max_lead_days, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		rule.RoomID,
+		rule.StartDate,
+		rule.EndDate,
+		encodeWeekdays(rule.Weekdays),
+		rule.MinNights,
+		rule.MaxNights,
+		rule.ClosedToArrival,
+		rule.ClosedToDeparture,
+		rule.MinLeadDays,
+		rule.MaxLeadDays,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditStayRule, newID, nil, stayRuleAudit(rule))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteStayRule removes a stay rule of the given room
+func (m *postgresDBRepo) DeleteStayRule(ctx context.Context, roomID, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `delete from room_stay_rules where id = $1 and room_id = $2 returning ` + stayRuleColumns
+
+	rule, err := scanStayRule(tx.QueryRowContext(ctx, query, id, roomID))
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditStayRule, id, stayRuleAudit(rule), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertRoomPhoto adds a photo after the other photos of its room, the first photo of a room becomes the cover
+func (m *postgresDBRepo) InsertRoomPhoto(ctx context.Context, p models.RoomPhoto) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock the room so concurrent uploads get distinct positions
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, p.RoomID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `insert into room_photos (room_id, url, medium_url, thumb_url, files, position, is_cover, created_at, updated_at)
+	select $1, $2, $3, $4, $5,
+	       coalesce((select max(position) + 1 from room_photos where room_id = $1), 0),
+	       not exists (select 1 from room_photos where room_id = $1 and is_cover),
+	       $6, $7
+	returning id, position, is_cover`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		roomID,
+		p.URL,
+		p.MediumURL,
+		p.ThumbURL,
+		strings.Join(p.Files, "\n"),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID, &p.Position, &p.IsCover)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditRoomPhoto, newID, nil, roomPhotoAudit(p))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *postgresDBRepo) GetRoomPhotoByID(ctx context.Context, id int) (models.RoomPhoto, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select ` + photoColumns + ` from room_photos p where p.id = $1`
+
+	return scanRoomPhoto(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// DeleteRoomPhoto removes a photo, when it was the cover the next photo of the room becomes the cover
+func (m *postgresDBRepo) DeleteRoomPhoto(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var p models.RoomPhoto
+	err = tx.QueryRowContext(ctx, `delete from room_photos where id = $1 returning room_id, url, position, is_cover`, id).
+		Scan(&p.RoomID, &p.URL, &p.Position, &p.IsCover)
+	if err != nil {
+		return err
+	}
+
+	if p.IsCover {
+		query := `update room_photos set is_cover = true, updated_at = $1
+		where id = (select id from room_photos where room_id = $2 order by position, id limit 1)`
+
+		_, err = tx.ExecContext(ctx, query, time.Now(), p.RoomID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditRoomPhoto, id, roomPhotoAudit(p), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRoomCoverPhoto makes a photo the cover of its room
+func (m *postgresDBRepo) SetRoomCoverPhoto(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before models.RoomPhoto
+	err = tx.QueryRowContext(ctx, `select room_id, url, position, is_cover from room_photos where id = $1 for update`, id).
+		Scan(&before.RoomID, &before.URL, &before.Position, &before.IsCover)
+	if err != nil {
+		return err
+	}
+
+	query := `update room_photos set is_cover = (id = $1), updated_at = $2 where room_id = $3`
+
+	_, err = tx.ExecContext(ctx, query, id, time.Now(), before.RoomID)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.IsCover = true
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditRoomPhoto, id, roomPhotoAudit(before), roomPhotoAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MoveRoomPhoto swaps a photo with the one before it, or after it when up is false
+func (m *postgresDBRepo) MoveRoomPhoto(ctx context.Context, id int, up bool) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `select id, room_id, url, position, is_cover from room_photos
+	where room_id = (select room_id from room_photos where id = $1)
+	order by position, id
+	for update`
+
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	var photos []models.RoomPhoto
+	for rows.Next() {
+		var p models.RoomPhoto
+		err = rows.Scan(&p.ID, &p.RoomID, &p.URL, &p.Position, &p.IsCover)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		photos = append(photos, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	from := -1
+	for i, p := range photos {
+		if p.ID == id {
+			from = i
+		}
+	}
+	if from < 0 {
+		return sql.ErrNoRows
+	}
+
+	to := from + 1
+	if up {
+		to = from - 1
+	}
+	if to < 0 || to >= len(photos) {
+		return nil
+	}
+	photos[from], photos[to] = photos[to], photos[from]
+
+	// renumber the whole room, this also repairs gaps left by deleted photos
+	for position, p := range photos {
+		if p.Position == position {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `update room_photos set position = $1, updated_at = $2 where id = $3`,
+			position, time.Now(), p.ID)
+		if err != nil {
+			return err
+		}
+
+		after := p
+		after.Position = position
+		err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditRoomPhoto, p.ID, roomPhotoAudit(p), roomPhotoAudit(after))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select id, first_name, last_name, email, password, access_level, active,
+	totp_secret, totp_enabled, totp_last_step, created_at, updated_at
+	from users where id = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	var u models.User
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.Active,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockUserForAudit(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	// emails are matched case-insensitively, the unique index is on lower(email)
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+
+	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+	where id = $6`
+
+	_, err = tx.ExecContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.AccessLevel,
+		time.Now(),
+		u.ID,
+	)
+	if isUniqueViolation(err) {
+		return repository.ErrDuplicateEmail
+	} else if err != nil {
+		return err
+	}
+
+	after := before
+	after.FirstName, after.LastName, after.Email, after.AccessLevel = u.FirstName, u.LastName, u.Email, u.AccessLevel
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditUser, u.ID, userAudit(before), userAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockUserForAudit locks a user in tx and returns the fields recorded by the audit log
+func lockUserForAudit(ctx context.Context, tx *sql.Tx, id int) (models.User, error) {
+	var u models.User
+	query := `select id, first_name, last_name, email, access_level, active from users where id = $1 for update`
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.AccessLevel,
+		&u.Active,
+	)
+	return u, err
+}
+
+// AllUsers returns all users ordered by last name
+func (m *postgresDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select id, first_name, last_name, email, access_level, active, totp_enabled, created_at, updated_at
+	from users order by last_name, first_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.Active,
+			&u.TOTPEnabled,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// InsertUser stores a new active user with a bcrypt hash of password and returns its id
+func (m *postgresDBRepo) InsertUser(ctx context.Context, u models.User, password string) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+
+	query := `insert into users (first_name, last_name, email, password, access_level, active, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, true, $6, $7) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		string(hashedPassword),
+		u.AccessLevel,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateEmail
+	} else if err != nil {
+		return 0, err
+	}
+
+	u.Active = true
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditUser, newID, nil, userAudit(u))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateUserPassword replaces the password of a user with a bcrypt hash of password
+func (m *postgresDBRepo) UpdateUserPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = lockUserForAudit(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	query := `update users set password = $1, updated_at = $2 where id = $3`
+
+	_, err = tx.ExecContext(ctx, query, string(hashedPassword), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	// only that the password changed is recorded, never the password or its hash
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditUser, id,
+		audit.Fields{"password_changed": false}, audit.Fields{"password_changed": true})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserActive activates or deactivates a user, deactivated users can't log in
+func (m *postgresDBRepo) SetUserActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockUserForAudit(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	query := `update users set active = $1, updated_at = $2 where id = $3`
+
+	_, err = tx.ExecContext(ctx, query, active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.Active = active
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditUser, id, userAudit(before), userAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockUserForAudit(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditUser, id, userAudit(before), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserTOTPSecret stores the sealed secret of a two-factor enrollment that is not confirmed yet
+func (m *postgresDBRepo) SetUserTOTPSecret(ctx context.Context, id int, sealedSecret string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update users set totp_secret = $1, updated_at = $2 where id = $3 and totp_enabled = false`
+
+	_, err := m.DB.ExecContext(ctx, query, sealedSecret, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableUserTOTP turns on two-factor authentication with the stored secret and replaces
+// the recovery codes of the user
+func (m *postgresDBRepo) EnableUserTOTP(ctx context.Context, id int, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	wasEnabled, err := lockUserTwoFactor(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set totp_enabled = true, totp_last_step = $1, updated_at = $2 where id = $3`,
+		step, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into user_recovery_codes (user_id, code_hash, created_at, updated_at) values ($1, $2, $3, $4)`
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, stmt, id, codeHash, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	// new recovery codes are recorded as a change even when two-factor authentication was already on
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditUser, id,
+		audit.Fields{"two_factor": wasEnabled, "recovery_codes_replaced": false},
+		audit.Fields{"two_factor": true, "recovery_codes_replaced": true})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockUserTwoFactor locks a user for an update of its two-factor authentication and reports whether
+// it is enabled
+func lockUserTwoFactor(ctx context.Context, tx *sql.Tx, id int) (bool, error) {
+	var enabled bool
+	err := tx.QueryRowContext(ctx, `select totp_enabled from users where id = $1 for update`, id).Scan(&enabled)
+	return enabled, err
+}
+
+// DisableUserTOTP turns off two-factor authentication and removes the secret and recovery codes
+func (m *postgresDBRepo) DisableUserTOTP(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	wasEnabled, err := lockUserTwoFactor(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = '', totp_enabled = false, totp_last_step = 0, updated_at = $1
+	where id = $2`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditUser, id,
+		audit.Fields{"two_factor": wasEnabled}, audit.Fields{"two_factor": false})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code and returns false when that step
+// or a later one was already used, so a code can't be used twice
+func (m *postgresDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+
+	result, err := m.DB.ExecContext(ctx, query, step, id)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used and reports whether there was one
+func (m *postgresDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update user_recovery_codes set used_at = $1, updated_at = $1
+	where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of the user
+func (m *postgresDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, `select count(id) from user_recovery_codes where user_id = $1 and used_at is null`,
+		userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (m *postgresDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select id, first_name, last_name, email, password, access_level, active,
+	totp_secret, totp_enabled, totp_last_step, created_at, updated_at
+	from users where lower(email) = lower($1)`
+
+	row := m.DB.QueryRowContext(ctx, query, email)
+
+	var u models.User
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.Active,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// InsertPasswordReset stores the hash of a password reset token for a user
+func (m *postgresDBRepo) InsertPasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at, updated_at)
+	values ($1, $2, $3, $4, $5)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CheckPasswordReset returns ErrInvalidResetToken unless the token can still be used
+func (m *postgresDBRepo) CheckPasswordReset(ctx context.Context, tokenHash string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select count(pr.id) from password_resets pr
+	left join users u on (u.id = pr.user_id)
+	where pr.token_hash = $1 and pr.used_at is null and pr.expires_at > $2 and u.active = true`
+
+	var numRows int
+	err := m.DB.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+
+	if numRows == 0 {
+		return repository.ErrInvalidResetToken
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password for the owner of the token and marks all of
+// the user's outstanding tokens as used, so a link can only be used once
+func (m *postgresDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `select pr.user_id from password_resets pr
+	left join users u on (u.id = pr.user_id)
+	where pr.token_hash = $1 and pr.used_at is null and pr.expires_at > $2 and u.active = true
+	for update of pr`
+
+	var userID int
+	err = tx.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrInvalidResetToken
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set password = $1, updated_at = $2 where id = $3`,
+		string(hashedPassword), time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update password_resets set used_at = $1, updated_at = $1
+	where user_id = $2 and used_at is null`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+	var active bool
+
+	row := m.DB.QueryRowContext(ctx, "select id, password, active from users where lower(email) = lower($1)", email)
+	err := row.Scan(&id, &hashedPassword, &active)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !active {
+		return 0, "", errors.New("user is deactivated")
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	return id, hashedPassword, nil
+}
+
+// AllReservations returns the reservations with the given status, or all reservations when status is empty
+func (m *postgresDBRepo) AllReservations(ctx context.Context, status string) ([]models.Reservation, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := reservationQuery + ` where $1 = '' or r.status = $1 order by r.start_date asc`
+
+	rows, err := m.DB.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []models.Reservation
+	for rows.Next() {
+		reservation, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// reservationQuery selects the columns read by scanReservation, the caller adds the where clause
+const reservationQuery = `select r.id, coalesce(r.confirmation_code, ''), r.first_name, r.last_name, r.email, r.phone,
+	r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.status, r.confirmed_at, r.checked_in_at,
+	r.checked_out_at, r.cancelled_at, r.no_show_at, r.total_price, r.currency, r.price_breakdown, rm.id, rm.room_name
+	from reservations r
+	left join rooms rm on r.room_id = rm.id`
+
+// scanReservation reads a row of reservationQuery into a reservation
+func scanReservation(row rowScanner) (models.Reservation, error) {
+	var res models.Reservation
+	var breakdown string
+	var confirmedAt, checkedInAt, checkedOutAt, cancelledAt, noShowAt sql.NullTime
+
+	err := row.Scan(
+		&res.ID,
+		&res.ConfirmationCode,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.PhoneNumber,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomID,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.Status,
+		&confirmedAt,
+		&checkedInAt,
+		&checkedOutAt,
+		&cancelledAt,
+		&noShowAt,
+		&res.Total,
+		&res.Currency,
+		&breakdown,
+		&res.Room.ID,
+		&res.Room.RoomName,
+	)
+	if err != nil {
+		return res, err
+	}
+
+	res.ConfirmedAt = confirmedAt.Time
+	res.CheckedInAt = checkedInAt.Time
+	res.CheckedOutAt = checkedOutAt.Time
+	res.CancelledAt = cancelledAt.Time
+	res.NoShowAt = noShowAt.Time
+
+	res.PriceLines, err = decodePriceLines(breakdown)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+func (m *postgresDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	return scanReservation(m.DB.QueryRowContext(ctx, reservationQuery+` where r.id = $1`, id))
+}
+
+// lockReservation locks a reservation in tx and returns it, the audit log compares it with the change
+func lockReservation(ctx context.Context, tx *sql.Tx, id int) (models.Reservation, error) {
+	return scanReservation(tx.QueryRowContext(ctx, reservationQuery+` where r.id = $1 for update of r`, id))
+}
+
+// GetReservationByCode returns the reservation with the given confirmation code
+func (m *postgresDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	return scanReservation(m.DB.QueryRowContext(ctx, reservationQuery+` where r.confirmation_code = $1`, code))
+}
+
+// ChangeReservationDates moves a reservation and its room restriction to new dates and stores the new price.
+// Like BookReservation the room is locked while the new dates are checked, the reservation itself doesn't
+// count as taking the room.
+func (m *postgresDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockReservation(ctx, tx, res.ID)
+	if err != nil {
+		return err
+	}
+	if !current.Open() {
+		return repository.ErrInvalidStatusChange
+	}
+
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, current.RoomID).Scan(&roomID)
+	if err != nil {
+		return err
+	}
+
+	var numRow int
+	query := `select count(id) from room_restrictions
+	where room_id = $1 and start_date < $3 and end_date > $2 and coalesce(reservation_id, 0) <> $4`
+
+	err = tx.QueryRowContext(ctx, query, roomID, res.StartDate, res.EndDate, res.ID).Scan(&numRow)
+	if err != nil {
+		return err
+	}
+	if numRow > 0 {
+		return repository.ErrRoomNotAvailable
+	}
+
+	breakdown, err := encodePriceLines(res.PriceLines)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update reservations set start_date = $1, end_date = $2, total_price = $3, currency = $4,
+	price_breakdown = $5, updated_at = $6
+	where id = $7`
+
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.Total, res.Currency, breakdown, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`
+
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	after := current
+	after.StartDate, after.EndDate, after.Total = res.StartDate, res.EndDate, res.Total
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditReservation, res.ID,
+		reservationAudit(current), reservationAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockReservation(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
+	where id = $6`
+
+	_, err = tx.ExecContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.PhoneNumber,
+		time.Now(),
+		u.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.FirstName, after.LastName, after.Email, after.PhoneNumber = u.FirstName, u.LastName, u.Email, u.PhoneNumber
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditReservation, u.ID,
+		reservationAudit(before), reservationAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// statusTimestamps are the columns that record when a reservation got each status
+var statusTimestamps = map[string]string{
+	models.ReservationConfirmed:  "confirmed_at",
+	models.ReservationCheckedIn:  "checked_in_at",
+	models.ReservationCheckedOut: "checked_out_at",
+	models.ReservationCancelled:  "cancelled_at",
+	models.ReservationNoShow:     "no_show_at",
+}
+
+// UpdateReservationStatus moves a reservation to status when its current status allows it and records
+// when it happened. Cancelled and no-show reservations free their room.
+func (m *postgresDBRepo) UpdateReservationStatus(ctx context.Context, id int, status string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	column, ok := statusTimestamps[status]
+	if !ok {
+		return repository.ErrInvalidStatusChange
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockReservation(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if !models.CanChangeStatus(before.Status, status) {
+		return repository.ErrInvalidStatusChange
+	}
+
+	now := time.Now()
+	stmt := fmt.Sprintf(`update reservations set status = $1, %s = $2, updated_at = $2 where id = $3`, column)
+
+	_, err = tx.ExecContext(ctx, stmt, status, now, id)
+	if err != nil {
+		return err
+	}
+
+	if status == models.ReservationCancelled || status == models.ReservationNoShow {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	after := before
+	after.Status = status
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditReservation, id,
+		reservationAudit(before), reservationAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var rooms []models.Room
+
+	query := `select ` + roomColumns + ` from rooms r order by r.room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+
+		rooms = append(rooms, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return rooms, err
+	}
+
+	err = m.attachRoomPhotos(ctx, rooms)
+	if err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// GetRestrictionsForRoomByDate returns the restrictions of a room covering a night from start up to end
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var roomRestrictions []models.RoomRestriction
+
+	query := `select id, start_date, end_date, room_id, coalesce(reservation_id, 0), restriction_id, reason, note,
+	version, created_at, updated_at
+	from room_restrictions where start_date < $2 and end_date > $1 and room_id = $3`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	if err != nil {
+		return roomRestrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(
+			&r.ID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.RoomID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.Reason,
+			&r.Note,
+			&r.Version,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return roomRestrictions, err
+		}
+
+		err = rows.Err()
+		if err != nil {
+			return roomRestrictions, err
+		}
+
+		roomRestrictions = append(roomRestrictions, r)
+	}
+
+	return roomRestrictions, nil
+}
+
+// GetBlockByID returns an owner block with the name of its room
+func (m *postgresDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var b models.RoomRestriction
+
+	query := `select rr.id, rr.start_date, rr.end_date, rr.room_id, rr.restriction_id, rr.reason, rr.note,
+	rr.version, rr.created_at, rr.updated_at, r.room_name
+	from room_restrictions rr left join rooms r on (r.id = rr.room_id)
+	where rr.id = $1 and rr.restriction_id = $2`
+
+	err := m.DB.QueryRowContext(ctx, query, id, models.RestrictionOwnerBlock).Scan(
+		&b.ID,
+		&b.StartDate,
+		&b.EndDate,
+		&b.RoomID,
+		&b.RestrictionID,
+		&b.Reason,
+		&b.Note,
+		&b.Version,
+		&b.CreatedAt,
+		&b.UpdatedAt,
+		&b.Room.RoomName,
+	)
+	if err != nil {
+		return b, err
+	}
+	b.Room.ID = b.RoomID
+
+	return b, nil
+}
+
+// lockRoomForBlocks locks a room in tx and returns repository.ErrRoomNotAvailable when the days from start up to
+// end overlap a reservation or another owner block than exceptID
+func lockRoomForBlocks(ctx context.Context, tx *sql.Tx, roomID int, start, end time.Time, exceptID int) error {
+	var id int
+	err := tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, roomID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	var numRow int
+	query := `select count(id) from room_restrictions
+	where room_id = $1 and start_date < $3 and end_date > $2 and id <> $4`
+
+	err = tx.QueryRowContext(ctx, query, roomID, start, end, exceptID).Scan(&numRow)
+	if err != nil {
+		return err
+	}
+	if numRow > 0 {
+		return repository.ErrRoomNotAvailable
+	}
+
+	return nil
+}
+
+// InsertBlock blocks a room for the days from b.StartDate up to b.EndDate, the days must be free
+func (m *postgresDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	if !b.EndDate.After(b.StartDate) {
+		return 0, repository.ErrInvalidBlockRange
+	}
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = lockRoomForBlocks(ctx, tx, b.RoomID, b.StartDate, b.EndDate, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	newID, err := insertBlock(ctx, tx, b)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func insertBlock(ctx context.Context, tx *sql.Tx, b models.RoomRestriction) (int, error) {
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, reason, note,
+	created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	var newID int
+	err := tx.QueryRowContext(ctx, query,
+		b.StartDate,
+		b.EndDate,
+		b.RoomID,
+		models.RestrictionOwnerBlock,
+		b.Reason,
+		b.Note,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditBlock, newID, nil, blockAudit(b))
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// lockBlock locks an owner block in tx and returns the fields recorded by the audit log
+func lockBlock(ctx context.Context, tx *sql.Tx, id int) (models.RoomRestriction, error) {
+	var b models.RoomRestriction
+	query := `select id, start_date, end_date, room_id, reason, note from room_restrictions
+	where id = $1 and restriction_id = $2 for update`
+
+	err := tx.QueryRowContext(ctx, query, id, models.RestrictionOwnerBlock).Scan(
+		&b.ID,
+		&b.StartDate,
+		&b.EndDate,
+		&b.RoomID,
+		&b.Reason,
+		&b.Note,
+	)
+	return b, err
+}
+
+// UpdateBlock changes the days, the reason and the note of an owner block, the new days must be free
+func (m *postgresDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
+	if !b.EndDate.After(b.StartDate) {
+		return repository.ErrInvalidBlockRange
+	}
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockBlock(ctx, tx, b.ID)
+	if err != nil {
+		return err
+	}
+
+	err = lockRoomForBlocks(ctx, tx, before.RoomID, b.StartDate, b.EndDate, b.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `update room_restrictions set start_date = $1, end_date = $2, reason = $3, note = $4, updated_at = $5,
+	version = version + 1
+	where id = $6`
+
+	_, err = tx.ExecContext(ctx, query, b.StartDate, b.EndDate, b.Reason, b.Note, time.Now(), b.ID)
+	if err != nil {
+		return err
+	}
+
+	b.RoomID = before.RoomID
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditBlock, b.ID, blockAudit(before), blockAudit(b))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SplitBlock splits an owner block in two, the new block starts at and gets the reason and note of the old one.
+// It returns the id of the new block.
+func (m *postgresDBRepo) SplitBlock(ctx context.Context, id int, at time.Time) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	b, err := lockBlock(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if !at.After(b.StartDate) || !at.Before(b.EndDate) {
+		return 0, repository.ErrInvalidBlockRange
+	}
+
+	_, err = tx.ExecContext(ctx, `update room_restrictions set end_date = $1, updated_at = $2, version = version + 1 where id = $3`,
+		at, time.Now(), b.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	first := b
+	first.EndDate = at
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditBlock, b.ID, blockAudit(b), blockAudit(first))
+	if err != nil {
+		return 0, err
+	}
+
+	b.StartDate = at
+	newID, err := insertBlock(ctx, tx, b)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteBlockRange unblocks the days of a room from start up to end. Blocks inside the range are deleted, blocks
+// sticking out of it are shortened and a block covering the whole range is split around it.
+func (m *postgresDBRepo) DeleteBlockRange(ctx context.Context, roomID int, start, end time.Time) error {
+	if !end.After(start) {
+		return repository.ErrInvalidBlockRange
+	}
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = unblockDays(ctx, tx, roomID, start, end)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// unblockDays removes the days from start up to end from the owner blocks of a room, see DeleteBlockRange
+func unblockDays(ctx context.Context, tx *sql.Tx, roomID int, start, end time.Time) error {
+	query := `select id, start_date, end_date, room_id, reason, note from room_restrictions
+	where room_id = $1 and restriction_id = $2 and start_date < $4 and end_date > $3
+	order by start_date for update`
+
+	rows, err := tx.QueryContext(ctx, query, roomID, models.RestrictionOwnerBlock, start, end)
+	if err != nil {
+		return err
+	}
+
+	var blocks []models.RoomRestriction
+	for rows.Next() {
+		var b models.RoomRestriction
+		err = rows.Scan(&b.ID, &b.StartDate, &b.EndDate, &b.RoomID, &b.Reason, &b.Note)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		blocks = append(blocks, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	endBlock := `update room_restrictions set end_date = $1, updated_at = $2, version = version + 1 where id = $3`
+	startBlock := `update room_restrictions set start_date = $1, updated_at = $2, version = version + 1 where id = $3`
+
+	for _, b := range blocks {
+		before := b.StartDate.Before(start)
+		after := b.EndDate.After(end)
+		changed := b
+
+		switch {
+		case before && after:
+			_, err = tx.ExecContext(ctx, endBlock, start, time.Now(), b.ID)
+			if err == nil {
+				rest := b
+				rest.StartDate = end
+				_, err = insertBlock(ctx, tx, rest)
+			}
+			changed.EndDate = start
+		case before:
+			_, err = tx.ExecContext(ctx, endBlock, start, time.Now(), b.ID)
+			changed.EndDate = start
+		case after:
+			_, err = tx.ExecContext(ctx, startBlock, end, time.Now(), b.ID)
+			changed.StartDate = end
+		default:
+			_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, b.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if before || after {
+			err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditBlock, b.ID, blockAudit(b), blockAudit(changed))
+		} else {
+			err = insertAudit(ctx, tx, models.AuditDelete, models.AuditBlock, b.ID, blockAudit(b), nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyBlockChanges applies the changes of the admin calendar in a single transaction. A removal whose block was
+// changed or deleted since the calendar was shown, and a day to block that has a reservation by now, are returned
+// as conflicts and then nothing is applied. Blocking a blocked day and unblocking a free day change nothing, so
+// posting the same changes twice is harmless.
+func (m *postgresDBRepo) ApplyBlockChanges(ctx context.Context, changes []models.BlockChange) ([]models.BlockConflict, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// lock the rooms in order so concurrent calendar saves don't deadlock
+	var roomIDs []int
+	locked := make(map[int]bool)
+	for _, c := range changes {
+		if !locked[c.RoomID] {
+			locked[c.RoomID] = true
+			roomIDs = append(roomIDs, c.RoomID)
+		}
+	}
+	sort.Ints(roomIDs)
+	for _, id := range roomIDs {
+		var roomID int
+		err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, id).Scan(&roomID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var conflicts []models.BlockConflict
+
+	// the versions are checked before anything changes, unblocking several days of a block bumps its version
+	checked := make(map[int]bool)
+	for _, c := range changes {
+		if !c.Remove || checked[c.BlockID] {
+			continue
+		}
+		checked[c.BlockID] = true
+
+		var version int
+		err = tx.QueryRowContext(ctx, `select version from room_restrictions where id = $1 and restriction_id = $2`,
+			c.BlockID, models.RestrictionOwnerBlock).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) {
+			// someone else removed the whole block already
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if version != c.Version {
+			conflicts = append(conflicts, models.BlockConflict{Change: c, Reason: "the block was changed by someone else"})
+		}
+	}
+
+	for _, c := range changes {
+		if !c.Remove {
+			continue
+		}
+		err = unblockDays(ctx, tx, c.RoomID, c.Day, c.Day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range changes {
+		if c.Remove {
+			continue
+		}
+
+		var reservations, blocks int
+		query := `select count(id) filter (where restriction_id <> $4), count(id) filter (where restriction_id = $4)
+		from room_restrictions where room_id = $1 and start_date < $3 and end_date > $2`
+
+		err = tx.QueryRowContext(ctx, query, c.RoomID, c.Day, c.Day.AddDate(0, 0, 1), models.RestrictionOwnerBlock).
+			Scan(&reservations, &blocks)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case reservations > 0:
+			conflicts = append(conflicts, models.BlockConflict{Change: c, Reason: "the room has been booked"})
+		case blocks == 0:
+			_, err = insertBlock(ctx, tx, models.RoomRestriction{
+				RoomID:    c.RoomID,
+				StartDate: c.Day,
+				EndDate:   c.Day.AddDate(0, 0, 1),
+				Reason:    "Other",
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts, nil
+	}
+
+	return nil, tx.Commit()
+}
+
+// DeleteBlockByID removes an owner block
+func (m *postgresDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	b, err := lockBlock(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditBlock, id, blockAudit(b), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetCalendarRestrictions returns the reservations and owner blocks of a room, or of all rooms when roomID
+// is 0, that end after since. They come with the room name and, for reservations, the guest.
+func (m *postgresDBRepo) GetCalendarRestrictions(ctx context.Context, roomID int, since time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `select rr.id, rr.start_date, rr.end_date, rr.room_id, coalesce(rr.reservation_id, 0), rr.restriction_id,
+	rr.reason, rr.note, rr.version, rr.created_at, rr.updated_at, r.room_name,
+	coalesce(res.confirmation_code, ''), coalesce(res.first_name, ''), coalesce(res.last_name, ''),
+	coalesce(res.status, ''), coalesce(res.updated_at, rr.updated_at)
+	from room_restrictions rr
+	left join rooms r on (r.id = rr.room_id)
+	left join reservations res on (res.id = rr.reservation_id)
+	where rr.end_date > $1 and ($2 = 0 or rr.room_id = $2)
+	order by rr.start_date, r.room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query, since, roomID)
+	if err != nil {
+		return restrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(
+			&r.ID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.RoomID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.Reason,
+			&r.Note,
+			&r.Version,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+			&r.Room.RoomName,
+			&r.Reservation.ConfirmationCode,
+			&r.Reservation.FirstName,
+			&r.Reservation.LastName,
+			&r.Reservation.Status,
+			&r.Reservation.UpdatedAt,
+		)
+		if err != nil {
+			return restrictions, err
+		}
+		r.Room.ID = r.RoomID
+		r.Reservation.ID = r.ReservationID
+
+		restrictions = append(restrictions, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return restrictions, err
+	}
+
+	return restrictions, nil
+}
+
+// AllCalendarFeedTokens returns the tokens of the exported calendar feeds, the one of all rooms first
+func (m *postgresDBRepo) AllCalendarFeedTokens(ctx context.Context) ([]models.CalendarFeedToken, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `select id, coalesce(room_id, 0), created_at, updated_at from calendar_feed_tokens
+	order by room_id nulls first`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedTokens []models.CalendarFeedToken
+	for rows.Next() {
+		var t models.CalendarFeedToken
+		err = rows.Scan(&t.ID, &t.RoomID, &t.CreatedAt, &t.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		feedTokens = append(feedTokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return feedTokens, nil
+}
+
+// GetCalendarFeedTokenByHash returns the calendar feed token with tokenHash
+func (m *postgresDBRepo) GetCalendarFeedTokenByHash(ctx context.Context, tokenHash string) (models.CalendarFeedToken, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var t models.CalendarFeedToken
+	query := `select id, coalesce(room_id, 0), created_at, updated_at from calendar_feed_tokens where token_hash = $1`
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(&t.ID, &t.RoomID, &t.CreatedAt, &t.UpdatedAt)
+	return t, err
+}
+
+// ReplaceCalendarFeedToken stores a new token for the feed of a room, or of all rooms when roomID is 0,
+// and returns its id. The previous token of the feed stops working.
+func (m *postgresDBRepo) ReplaceCalendarFeedToken(ctx context.Context, roomID int, tokenHash string) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = deleteCalendarFeedToken(ctx, tx, roomID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	stmt := `insert into calendar_feed_tokens (room_id, token_hash, created_at, updated_at)
+	values (nullif($1, 0), $2, $3, $4) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, stmt, roomID, tokenHash, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditCalendarFeed, newID, nil, audit.Fields{"room_id": roomID})
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteCalendarFeedToken revokes the token of the feed of a room, or of all rooms when roomID is 0. It
+// returns sql.ErrNoRows when the feed has no token.
+func (m *postgresDBRepo) DeleteCalendarFeedToken(ctx context.Context, roomID int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteCalendarFeedToken(ctx, tx, roomID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteCalendarFeedToken removes the token of a feed in tx and records it in the audit log
+func deleteCalendarFeedToken(ctx context.Context, tx *sql.Tx, roomID int) error {
+	var id int
+	err := tx.QueryRowContext(ctx, `delete from calendar_feed_tokens where coalesce(room_id, 0) = $1 returning id`, roomID).
+		Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	return insertAudit(ctx, tx, models.AuditDelete, models.AuditCalendarFeed, id, audit.Fields{"room_id": roomID}, nil)
+}
+
+// EnqueueMail stores a message in the mail queue, ready to be sent by the mail workers
+func (m *postgresDBRepo) EnqueueMail(ctx context.Context, mail models.MailData) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	attachments, err := encodeAttachments(mail.Attachments)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into mail_queue (to_address, from_address, subject, content, plain_content, template, attachments,
+                        status, attempts, next_attempt_at, last_error, created_at, updated_at)
+                        values ($1, $2, $3, $4, $5, $6, $7, $8, 0, $9, '', $10, $11)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		mail.To,
+		mail.From,
+		mail.Subject,
+		mail.Content,
+		mail.PlainContent,
+		mail.Template,
+		attachments,
+		models.MailStatusPending,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimMail marks up to limit due messages as sending and returns them. Rows claimed by another
+// worker are skipped, and messages stuck in sending for longer than staleAfter (e.g. because the
+// process died mid-send) are claimed again.
+func (m *postgresDBRepo) ClaimMail(ctx context.Context, limit int, staleAfter time.Duration) ([]models.QueuedMail, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var mails []models.QueuedMail
+
+	query := `
+	update mail_queue set status = $1, attempts = attempts + 1, updated_at = $2
+	where id in (
+		select id from mail_queue
+		where (status = $3 and next_attempt_at <= $2) or (status = $1 and updated_at < $4)
+		order by next_attempt_at asc
+		limit $5
+		for update skip locked
+	)
+	returning id, to_address, from_address, subject, content, plain_content, template, attachments, status, attempts,
+	next_attempt_at, last_error, created_at, updated_at`
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, query,
+		models.MailStatusSending,
+		now,
+		models.MailStatusPending,
+		now.Add(-staleAfter),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		mail, err := scanQueuedMail(rows)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, mail)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return mails, err
+	}
+
+	return mails, nil
+}
+
+// MarkMailSent marks a queued message as delivered
+func (m *postgresDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update mail_queue set status = $1, last_error = '', updated_at = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, query, models.MailStatusSent, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkMailFailed puts a queued message back in the queue to be retried at nextAttempt
+func (m *postgresDBRepo) MarkMailFailed(ctx context.Context, id int, lastError string, nextAttempt time.Time) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update mail_queue set status = $1, last_error = $2, next_attempt_at = $3, updated_at = $4 where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, query, models.MailStatusPending, lastError, nextAttempt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkMailDead moves a queued message to the dead-letter state, it won't be retried automatically
+func (m *postgresDBRepo) MarkMailDead(ctx context.Context, id int, lastError string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	query := `update mail_queue set status = $1, last_error = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, query, models.MailStatusDead, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MailByStatus returns the queued messages with the given status, newest first
+func (m *postgresDBRepo) MailByStatus(ctx context.Context, status string) ([]models.QueuedMail, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var mails []models.QueuedMail
+
+	query := `select id, to_address, from_address, subject, content, plain_content, template, attachments, status, attempts,
+	next_attempt_at, last_error, created_at, updated_at
+	from mail_queue where status = $1
+	order by updated_at desc
+	limit 200`
+
+	rows, err := m.DB.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		mail, err := scanQueuedMail(rows)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, mail)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return mails, err
+	}
+
+	return mails, nil
+}
+
+// RetryMail puts a dead-letter message back in the queue with a fresh attempt count
+func (m *postgresDBRepo) RetryMail(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before models.QueuedMail
+	query := `select to_address, subject, status, attempts from mail_queue where id = $1 and status = $2 for update`
+
+	err = tx.QueryRowContext(ctx, query, id, models.MailStatusDead).
+		Scan(&before.Mail.To, &before.Mail.Subject, &before.Status, &before.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		// it was sent or retried in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stmt := `update mail_queue set status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2 where id = $3`
+
+	_, err = tx.ExecContext(ctx, stmt, models.MailStatusPending, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.Status = models.MailStatusPending
+	after.Attempts = 0
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditMail, id, queuedMailAudit(before), queuedMailAudit(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanQueuedMail(rows *sql.Rows) (models.QueuedMail, error) {
+	var mail models.QueuedMail
+	var attachments string
+	err := rows.Scan(
+		&mail.ID,
+		&mail.Mail.To,
+		&mail.Mail.From,
+		&mail.Mail.Subject,
+		&mail.Mail.Content,
+		&mail.Mail.PlainContent,
+		&mail.Mail.Template,
+		&attachments,
+		&mail.Status,
+		&mail.Attempts,
+		&mail.NextAttemptAt,
+		&mail.LastError,
+		&mail.CreatedAt,
+		&mail.UpdatedAt,
+	)
+	if err != nil {
+		return mail, err
+	}
+
+	mail.Mail.Attachments, err = decodeAttachments(attachments)
+	return mail, err
+}
+
+// InsertFailedLogin stores an audit record of a failed login
+func (m *postgresDBRepo) InsertFailedLogin(ctx context.Context, email, ipAddress string) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	stmt := `insert into failed_logins (email, ip_address, created_at, updated_at) values ($1, $2, $3, $4)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, email, ipAddress, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecentFailedLogins returns the latest failed logins, newest first
+func (m *postgresDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.FailedLogin, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	var logins []models.FailedLogin
+
+	query := `select id, email, ip_address, created_at from failed_logins order by created_at desc limit $1`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return logins, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.FailedLogin
+		err := rows.Scan(&l.ID, &l.Email, &l.IPAddress, &l.CreatedAt)
+		if err != nil {
+			return logins, err
+		}
+		logins = append(logins, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return logins, err
+	}
+
+	return logins, nil
+}
+
+// SaveLoginLockout inserts or updates the failure count of a login key
+func (m *postgresDBRepo) SaveLoginLockout(ctx context.Context, l models.LoginLockout) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	stmt := `insert into login_lockouts (kind, key, failures, last_failure_at, locked_until, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $6)
+	on conflict (kind, key) do update set failures = excluded.failures, last_failure_at = excluded.last_failure_at,
+		locked_until = excluded.locked_until, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, l.Kind, l.Key, l.Failures, l.LastFailureAt, l.LockedUntil, time.Now())
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) DeleteLoginLockout(ctx context.Context, kind, key string) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var rooms []models.Room
+	_, err := m.DB.ExecContext(ctx, `delete from login_lockouts where kind = $1 and key = $2`, kind, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
-	query := `select id, room_name, created_at, updated_at from rooms`
+func (m *postgresDBRepo) LoginLockouts(ctx context.Context, kind string) ([]models.LoginLockout, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	var lockouts []models.LoginLockout
+
+	query := `select kind, key, failures, last_failure_at, locked_until from login_lockouts where kind = $1`
+
+	rows, err := m.DB.QueryContext(ctx, query, kind)
 	if err != nil {
-		return rooms, nil
+		return lockouts, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var r models.Room
-		err = rows.Scan(
-			&r.ID,
-			&r.RoomName,
-			&r.CreatedAt,
-			&r.UpdatedAt,
-		)
+		var l models.LoginLockout
+		err := rows.Scan(&l.Kind, &l.Key, &l.Failures, &l.LastFailureAt, &l.LockedUntil)
 		if err != nil {
-			return rooms, err
+			return lockouts, err
 		}
+		lockouts = append(lockouts, l)
+	}
 
-		rooms = append(rooms, r)
+	if err = rows.Err(); err != nil {
+		return lockouts, err
 	}
 
-	return rooms, nil
+	return lockouts, nil
 }
 
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AuditLog returns the audit log entries matching f, newest first
+func (m *postgresDBRepo) AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, error) {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	var roomRestrictions []models.RoomRestriction
-
-	query := `select id, start_date, end_date, room_id, coalesce(reservation_id, 0), restriction_id, created_at, updated_at 
-	from room_restrictions where $1 <= end_date and $2 >= start_date and room_id = $3`
+	query := `select a.id, coalesce(a.user_id, 0), coalesce(u.first_name || ' ' || u.last_name, ''), a.action,
+	a.entity_type, a.entity_id, a.changes, a.ip_address, a.created_at
+	from audit_log a
+	left join users u on u.id = a.user_id
+	where ($1 = 0 or a.user_id = $1) and ($2 = '' or a.action = $2) and ($3 = '' or a.entity_type = $3)
+	and ($4 = 0 or a.entity_id = $4)
+	order by a.created_at desc, a.id desc
+	limit nullif($5, 0) offset $6`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	rows, err := m.DB.QueryContext(ctx, query, f.UserID, f.Action, f.EntityType, f.EntityID, f.Limit, f.Offset)
 	if err != nil {
-		return roomRestrictions, err
+		return nil, err
 	}
 	defer rows.Close()
 
+	var entries []models.AuditEntry
 	for rows.Next() {
-		var r models.RoomRestriction
+		var e models.AuditEntry
+		var changes string
 		err = rows.Scan(
-			&r.ID,
-			&r.StartDate,
-			&r.EndDate,
-			&r.RoomID,
-			&r.ReservationID,
-			&r.RestrictionID,
-			&r.CreatedAt,
-			&r.UpdatedAt,
+			&e.ID,
+			&e.UserID,
+			&e.UserName,
+			&e.Action,
+			&e.EntityType,
+			&e.EntityID,
+			&changes,
+			&e.IPAddress,
+			&e.CreatedAt,
 		)
 		if err != nil {
-			return roomRestrictions, err
+			return nil, err
 		}
 
-		err = rows.Err()
+		e.Changes, err = audit.Parse(changes)
 		if err != nil {
-			return roomRestrictions, err
+			return nil, err
 		}
+		entries = append(entries, e)
+	}
 
-		roomRestrictions = append(roomRestrictions, r)
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return roomRestrictions, nil
+	return entries, nil
+}
+
+// apiTokenQuery selects the columns read by scanAPIToken
+const apiTokenQuery = `select t.id, t.user_id, u.first_name || ' ' || u.last_name, t.name, t.scopes, t.last_used_at,
+	t.last_used_ip, t.revoked_at, t.created_at, t.updated_at
+	from api_tokens t
+	join users u on u.id = t.user_id`
+
+// scanAPIToken reads a row of apiTokenQuery into an api token
+func scanAPIToken(row rowScanner) (models.APIToken, error) {
+	var t models.APIToken
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.UserName,
+		&t.Name,
+		&scopes,
+		&lastUsedAt,
+		&t.LastUsedIP,
+		&revokedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if err != nil {
+		return t, err
+	}
+
+	t.Scopes = splitScopes(scopes)
+	t.LastUsedAt = lastUsedAt.Time
+	t.RevokedAt = revokedAt.Time
+
+	return t, nil
+}
+
+// InsertAPIToken stores the hash of a new api token and returns its id
+func (m *postgresDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken, tokenHash string) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into api_tokens (user_id, name, token_hash, scopes, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, stmt, t.UserID, t.Name, tokenHash, strings.Join(t.Scopes, ","),
+		time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditAPIToken, newID, nil, apiTokenAudit(t))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllAPITokens returns all api tokens, including revoked ones, newest first
+func (m *postgresDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, apiTokenQuery+` order by t.created_at desc, t.id desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiTokens []models.APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		apiTokens = append(apiTokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return apiTokens, nil
+}
+
+// GetAPITokenByHash returns the api token with the given hash, or sql.ErrNoRows when there is none,
+// it was revoked or the user who created it was deactivated
+func (m *postgresDBRepo) GetAPITokenByHash(ctx context.Context, tokenHash string) (models.APIToken, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, apiTokenQuery+` where t.token_hash = $1 and t.revoked_at is null and u.active`,
+		tokenHash)
+
+	return scanAPIToken(row)
+}
+
+// RevokeAPIToken stops an api token from being accepted. It returns sql.ErrNoRows when the token
+// doesn't exist or was already revoked.
+func (m *postgresDBRepo) RevokeAPIToken(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update api_tokens set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null
+	returning user_id, name, scopes, revoked_at`
+
+	var t models.APIToken
+	var scopes string
+	err = tx.QueryRowContext(ctx, query, time.Now(), id).Scan(&t.UserID, &t.Name, &scopes, &t.RevokedAt)
+	if err != nil {
+		return err
+	}
+	t.Scopes = splitScopes(scopes)
+
+	before := t
+	before.RevokedAt = time.Time{}
+
+	err = insertAudit(ctx, tx, models.AuditUpdate, models.AuditAPIToken, id, apiTokenAudit(before), apiTokenAudit(t))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// TouchAPIToken records that an api token was used from ipAddress. The time is only written when the
+// last use is a minute old, so busy clients don't cause a write on every request.
+func (m *postgresDBRepo) TouchAPIToken(ctx context.Context, id int, ipAddress string) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at) 
-values ($1, $2, $3, $4, $5, $6)`
+	stmt := `update api_tokens set last_used_at = $1, last_used_ip = $2
+	where id = $3 and (last_used_at is null or last_used_at < $1 - interval '1 minute' or last_used_ip <> $2)`
 
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), ipAddress, id)
 	if err != nil {
 		return err
 	}
@@ -504,13 +3155,259 @@ values ($1, $2, $3, $4, $5, $6)`
 	return nil
 }
 
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// externalFeedQuery selects the columns read by scanExternalFeed
+const externalFeedQuery = `select f.id, f.room_id, r.room_name, f.name, f.url, f.last_synced_at, f.last_attempt_at,
+	f.last_error, f.event_count, f.conflicts, f.created_at, f.updated_at
+	from external_feeds f
+	join rooms r on r.id = f.room_id`
+
+// scanExternalFeed reads a row of externalFeedQuery into an external feed
+func scanExternalFeed(row rowScanner) (models.ExternalFeed, error) {
+	var f models.ExternalFeed
+	var lastSyncedAt, lastAttemptAt sql.NullTime
+
+	err := row.Scan(
+		&f.ID,
+		&f.RoomID,
+		&f.Room.RoomName,
+		&f.Name,
+		&f.URL,
+		&lastSyncedAt,
+		&lastAttemptAt,
+		&f.LastError,
+		&f.EventCount,
+		&f.Conflicts,
+		&f.CreatedAt,
+		&f.UpdatedAt,
+	)
+	if err != nil {
+		return f, err
+	}
+
+	f.Room.ID = f.RoomID
+	f.LastSyncedAt = lastSyncedAt.Time
+	f.LastAttemptAt = lastAttemptAt.Time
+
+	return f, nil
+}
+
+// AllExternalFeeds returns the external calendar feeds by room
+func (m *postgresDBRepo) AllExternalFeeds(ctx context.Context) ([]models.ExternalFeed, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, externalFeedQuery+` order by r.room_name, f.name, f.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []models.ExternalFeed
+	for rows.Next() {
+		f, err := scanExternalFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return feeds, nil
+}
+
+// GetExternalFeedByID returns an external calendar feed
+func (m *postgresDBRepo) GetExternalFeedByID(ctx context.Context, id int) (models.ExternalFeed, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	return scanExternalFeed(m.DB.QueryRowContext(ctx, externalFeedQuery+` where f.id = $1`, id))
+}
+
+// InsertExternalFeed stores a new external calendar feed and returns its id
+func (m *postgresDBRepo) InsertExternalFeed(ctx context.Context, f models.ExternalFeed) (int, error) {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into external_feeds (room_id, name, url, created_at, updated_at)
+	values ($1, $2, $3, $4, $5) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, stmt, f.RoomID, f.Name, f.URL, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditCreate, models.AuditExternalFeed, newID, nil, externalFeedAudit(f))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteExternalFeed removes an external calendar feed together with its external bookings, it returns
+// sql.ErrNoRows when there is no such feed
+func (m *postgresDBRepo) DeleteExternalFeed(ctx context.Context, id int) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var f models.ExternalFeed
+	err = tx.QueryRowContext(ctx, `delete from external_feeds where id = $1 returning room_id, name, url`, id).
+		Scan(&f.RoomID, &f.Name, &f.URL)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, models.AuditDelete, models.AuditExternalFeed, id, externalFeedAudit(f), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SyncExternalFeed replaces the external bookings of a feed with bookings. Bookings are inserted or
+// updated by their uid, and the ones that are no longer in the feed, e.g. because they were cancelled,
+// are removed. The feed is marked as synced, with the number of bookings that overlap reservations
+// or blocks of the room.
+func (m *postgresDBRepo) SyncExternalFeed(ctx context.Context, id int, bookings []models.ExternalBooking) error {
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roomID int
+	var name string
+	err = tx.QueryRowContext(ctx, `select room_id, name from external_feeds where id = $1 for update`, id).
+		Scan(&roomID, &name)
+	if err != nil {
+		return err
+	}
+
+	// lock the room like every other writer of its restrictions, so a reservation can't pass its
+	// availability check while an overlapping external booking is being stored
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, roomID).Scan(&roomID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `select id, external_uid from room_restrictions where external_feed_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]int)
+	for rows.Next() {
+		var restrictionID int
+		var uid string
+		err = rows.Scan(&restrictionID, &uid)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[uid] = restrictionID
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, b := range bookings {
+		seen[b.UID] = true
+
+		if restrictionID, ok := existing[b.UID]; ok {
+			stmt := `update room_restrictions set start_date = $1, end_date = $2, reason = $3, note = $4,
+			version = version + 1, updated_at = $5
+			where id = $6 and (start_date <> $1 or end_date <> $2 or reason <> $3 or note <> $4)`
+
+			_, err = tx.ExecContext(ctx, stmt, b.StartDate, b.EndDate, name, b.Summary, now, restrictionID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, reason, note,
+		external_feed_id, external_uid, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+		var newID int
+		err = tx.QueryRowContext(ctx, stmt, b.StartDate, b.EndDate, roomID, models.RestrictionExternalBooking,
+			name, b.Summary, id, b.UID, now, now).Scan(&newID)
+		if err != nil {
+			return err
+		}
+		existing[b.UID] = newID
+	}
+
+	for uid, restrictionID := range existing {
+		if seen[uid] {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, restrictionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var conflicts int
+	query := `select count(distinct e.id) from room_restrictions e
+	join room_restrictions o on (o.room_id = e.room_id and o.id <> e.id
+		and coalesce(o.external_feed_id, 0) <> e.external_feed_id
+		and o.start_date < e.end_date and o.end_date > e.start_date)
+	where e.external_feed_id = $1`
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update external_feeds set last_synced_at = $1, last_attempt_at = $1, last_error = '', event_count = $2,
+	conflicts = $3, updated_at = $1 where id = $4`
+
+	_, err = tx.ExecContext(ctx, stmt, now, len(seen), conflicts, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkExternalFeedFailed records why a sync of an external calendar feed failed, its external bookings
+// are kept until a sync succeeds again
+func (m *postgresDBRepo) MarkExternalFeedFailed(ctx context.Context, id int, lastError string) error {
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
-	query := `delete from room_restrictions where id = $1`
+	stmt := `update external_feeds set last_attempt_at = $1, last_error = $2, updated_at = $1 where id = $3`
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), lastError, id)
 	if err != nil {
 		return err
 	}
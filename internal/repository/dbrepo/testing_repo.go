@@ -1,20 +1,34 @@
 package dbrepo
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/ismail118/bookings-app/internal/models"
+	"github.com/ismail118/bookings-app/internal/repository"
+	"github.com/ismail118/bookings-app/internal/tokens"
+	"github.com/ismail118/bookings-app/internal/totp"
+	"strings"
 	"time"
 )
 
-func (m *testDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
+func (m *testDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if r.RoomID == 0 {
 		return errors.New("some error")
 	}
 	return nil
 }
 
-func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
+func (m *testDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	// if the room id is 2, the fail; otherwise, pass
 	if res.RoomID == 2 {
 		return 0, errors.New("some error")
@@ -22,14 +36,45 @@ func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 	return 1, nil
 }
 
-func (m *testDBRepo) SearchAvailabilityByRoomID(roomID int, start, end time.Time) (bool, error) {
+// testReservedStay is another guest staying from 2050-01-15 up to the departure on 2050-01-18, stays and
+// blocks overlapping it are not available
+var testReservedStay = models.RoomRestriction{
+	StartDate: time.Date(2050, 1, 15, 0, 0, 0, 0, time.UTC),
+	EndDate:   time.Date(2050, 1, 18, 0, 0, 0, 0, time.UTC),
+}
+
+func (m *testDBRepo) BookReservation(ctx context.Context, res models.Reservation) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// simulates another guest taking the room first
+	if testReservedStay.Overlaps(res.StartDate, res.EndDate) {
+		return 0, repository.ErrRoomNotAvailable
+	}
+	// room id 2 fails inserting the reservation, room id 0 fails inserting the restriction
+	if res.RoomID == 2 || res.RoomID == 0 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) SearchAvailabilityByRoomID(ctx context.Context, roomID int, start, end time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	if roomID > 2 {
 		return false, errors.New("some error")
 	}
 	return false, nil
 }
 
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	rooms := make([]models.Room, 0)
 
 	if start.Format("2006-01-02") == "2050-01-01" {
@@ -43,58 +88,581 @@ func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 	return rooms, nil
 }
 
-func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
+func (m *testDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Room{}, err
+	}
+
 	var room models.Room
 	if id > 2 {
-		return room, fmt.Errorf("can't find room_id:%d", id)
+		return room, fmt.Errorf("can't find room_id:%d: %w", id, sql.ErrNoRows)
+	}
+	if id == 2 {
+		room.ID = id
+		room.Photos = []models.RoomPhoto{
+			{ID: 3, RoomID: id, Files: []string{"rooms/2/photo3-thumb.jpg", "rooms/2/photo3-large.jpg"}},
+		}
 	}
 	return room, nil
 }
 
-func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
-	var u models.User
+func (m *testDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Room{}, err
+	}
+
+	switch slug {
+	case "room-one":
+		return models.Room{ID: 1, RoomName: "Room One", Slug: slug, Capacity: 2, BasePrice: 12000}, nil
+	case "room-two":
+		return models.Room{ID: 2, RoomName: "Room Two", Slug: slug, Capacity: 4, BasePrice: 18000}, nil
+	}
+
+	return models.Room{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if r.Slug == "taken" {
+		return 0, repository.ErrDuplicateSlug
+	}
+
+	return 3, nil
+}
+
+func (m *testDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if r.Slug == "taken" {
+		return repository.ErrDuplicateSlug
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id == 1 {
+		return repository.ErrRoomHasReservations
+	}
+	if id > 2 {
+		return fmt.Errorf("can't find room_id:%d", id)
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) SeasonalRatesForRoom(ctx context.Context, roomID int) ([]models.SeasonalRate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if roomID == 1 {
+		start, _ := time.Parse("2006-01-02", "2050-12-24")
+		end, _ := time.Parse("2006-01-02", "2050-12-31")
+		return []models.SeasonalRate{
+			{ID: 1, RoomID: 1, Name: "Holidays", StartDate: start, EndDate: end, NightlyPrice: 25000},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (m *testDBRepo) InsertSeasonalRate(ctx context.Context, sr models.SeasonalRate) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if sr.RoomID > 2 {
+		return 0, fmt.Errorf("can't find room_id:%d", sr.RoomID)
+	}
+
+	return 2, nil
+}
+
+func (m *testDBRepo) DeleteSeasonalRate(ctx context.Context, roomID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if roomID != 1 || id != 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) StayRulesForRoom(ctx context.Context, roomID int) ([]models.StayRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if roomID != 1 {
+		return nil, nil
+	}
+
+	start, _ := time.Parse("2006-01-02", "2050-03-01")
+	end, _ := time.Parse("2006-01-02", "2050-03-31")
+	return []models.StayRule{
+		{ID: 1, RoomID: 1, StartDate: start, EndDate: end, MinNights: 3},
+	}, nil
+}
+
+func (m *testDBRepo) StayRulesForStay(ctx context.Context, start, end time.Time) ([]models.StayRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// march 2050 has a minimum stay in room 1 and no arrivals in room 2
+	ruleStart, _ := time.Parse("2006-01-02", "2050-03-01")
+	ruleEnd, _ := time.Parse("2006-01-02", "2050-03-31")
+	if start.After(ruleEnd) || start.Before(ruleStart) {
+		return nil, nil
+	}
+
+	return []models.StayRule{
+		{ID: 1, RoomID: 1, StartDate: ruleStart, EndDate: ruleEnd, MinNights: 3},
+		{ID: 2, RoomID: 2, StartDate: ruleStart, EndDate: ruleEnd, ClosedToArrival: true},
+	}, nil
+}
+
+func (m *testDBRepo) InsertStayRule(ctx context.Context, rule models.StayRule) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if rule.RoomID > 2 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) DeleteStayRule(ctx context.Context, roomID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if roomID != 1 || id != 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) InsertRoomPhoto(ctx context.Context, p models.RoomPhoto) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if p.RoomID > 2 {
+		return 0, fmt.Errorf("can't find room_id:%d", p.RoomID)
+	}
+
+	return 1, nil
+}
+
+func (m *testDBRepo) GetRoomPhotoByID(ctx context.Context, id int) (models.RoomPhoto, error) {
+	if err := ctx.Err(); err != nil {
+		return models.RoomPhoto{}, err
+	}
+
+	if id > 2 {
+		return models.RoomPhoto{}, sql.ErrNoRows
+	}
+
+	return models.RoomPhoto{
+		ID:     id,
+		RoomID: 1,
+		URL:    fmt.Sprintf("/uploads/rooms/1/photo%d-large.jpg", id),
+		Files: []string{
+			fmt.Sprintf("rooms/1/photo%d-thumb.jpg", id),
+			fmt.Sprintf("rooms/1/photo%d-medium.jpg", id),
+			fmt.Sprintf("rooms/1/photo%d-large.jpg", id),
+		},
+	}, nil
+}
+
+func (m *testDBRepo) DeleteRoomPhoto(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 2 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) SetRoomCoverPhoto(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 2 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) MoveRoomPhoto(ctx context.Context, id int, up bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 2 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	if id == testTOTPUserID || id == testStaleTOTPUserID {
+		appSecret := m.App.Secret
+		if id == testStaleTOTPUserID {
+			appSecret = []byte("old-secret")
+		}
+
+		secret, err := totp.Seal(appSecret, testTOTPSecret)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		u := models.User{ID: id, Email: "totp@here.com", AccessLevel: models.AccessLevelStaff, Active: true,
+			TOTPSecret: secret, TOTPEnabled: true}
+		return u, nil
+	}
+
+	// the id doubles as the access level of the other test users
+	if id < models.AccessLevelStaff || id > models.AccessLevelOwner {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	u := models.User{ID: id, AccessLevel: id, Active: true}
 	return u, nil
 }
 
-func (m *testDBRepo) UpdateUser(u models.User) error {
+func (m *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if u.Email == "taken@here.com" {
+		return repository.ErrDuplicateEmail
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	users := []models.User{
+		{ID: 1, FirstName: "Staff", Email: "staff@here.com", AccessLevel: models.AccessLevelStaff, Active: true},
+		{ID: 2, FirstName: "Manager", Email: "manager@here.com", AccessLevel: models.AccessLevelManager},
+		{ID: 3, FirstName: "Owner", Email: "owner@here.com", AccessLevel: models.AccessLevelOwner, Active: true},
+	}
+	return users, nil
+}
+
+func (m *testDBRepo) InsertUser(ctx context.Context, u models.User, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if u.Email == "taken@here.com" {
+		return 0, repository.ErrDuplicateEmail
+	}
+
+	return 4, nil
+}
+
+func (m *testDBRepo) UpdateUserPassword(ctx context.Context, id int, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) SetUserActive(ctx context.Context, id int, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > models.AccessLevelOwner {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > models.AccessLevelOwner {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	// emails match case-insensitively like lower(email), the mixed case user was stored before emails
+	// were lowercased
+	switch strings.ToLower(email) {
+	case "staff@here.com":
+		return models.User{ID: 1, FirstName: "Staff", Email: "staff@here.com", AccessLevel: models.AccessLevelStaff, Active: true}, nil
+	case "mixed.case@here.com":
+		return models.User{ID: 5, FirstName: "Mixed", Email: "Mixed.Case@Here.com", AccessLevel: models.AccessLevelStaff, Active: true}, nil
+	}
+
+	return models.User{}, sql.ErrNoRows
+}
+
+// the test user with two-factor authentication, its only valid recovery code is "abcde-fghij". The secret
+// of testStaleTOTPUserID was sealed with another app secret.
+const (
+	testTOTPUserID      = 4
+	testStaleTOTPUserID = 6
+	testTOTPSecret      = "JBSWY3DPEHPK3PXP"
+)
+
+func (m *testDBRepo) SetUserTOTPSecret(ctx context.Context, id int, sealedSecret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) EnableUserTOTP(ctx context.Context, id int, step int64, recoveryCodeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) DisableUserTOTP(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (m *testDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return userID == testTOTPUserID && codeHash == tokens.Hash(totp.NormalizeRecoveryCode("abcde-fghij")), nil
+}
+
+func (m *testDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return 10, nil
+}
+
+func (m *testDBRepo) InsertPasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+func (m *testDBRepo) CheckPasswordReset(ctx context.Context, tokenHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if tokenHash == "" {
+		return repository.ErrInvalidResetToken
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if tokenHash == "" {
+		return repository.ErrInvalidResetToken
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+
 	if email == "ismail@here.com" {
 		return 0, "", errors.New("some error")
 	}
+
+	if email == "totp@here.com" {
+		return testTOTPUserID, "", nil
+	}
 	return 1, "", nil
 }
 
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
-	var r []models.Reservation
-	return r, nil
-}
+func (m *testDBRepo) AllReservations(ctx context.Context, status string) ([]models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if status == "invalid" {
+		return nil, errors.New("some error")
+	}
 
-func (m *testDBRepo) NewReservations() ([]models.Reservation, error) {
 	var r []models.Reservation
 	return r, nil
 }
 
-func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	var res models.Reservation
+func (m *testDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Reservation{}, err
+	}
+
+	res := models.Reservation{ID: id, Status: testReservationStatus(id)}
 
 	return res, nil
 }
-func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
+
+// testReservationStatus is the status of the test reservations: 3 is cancelled, 4 checked in and
+// the others are pending
+func testReservationStatus(id int) string {
+	switch id {
+	case 3:
+		return models.ReservationCancelled
+	case 4:
+		return models.ReservationCheckedIn
+	}
+	return models.ReservationPending
+}
+
+func (m *testDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Reservation{}, err
+	}
+
+	start, _ := time.Parse("2006-01-02", "2050-06-10")
+	res := models.Reservation{
+		ID:               1,
+		ConfirmationCode: code,
+		FirstName:        "Guest",
+		LastName:         "Here",
+		Email:            "guest@here.com",
+		StartDate:        start,
+		EndDate:          start.AddDate(0, 0, 2),
+		RoomID:           1,
+		Status:           models.ReservationConfirmed,
+		Total:            24000,
+		Currency:         "USD",
+		Room:             models.Room{ID: 1, RoomName: "Room One"},
+	}
+
+	switch code {
+	case "ABCD2345":
+		return res, nil
+	case "SOON2345":
+		// arrives tomorrow, too late to change or cancel
+		y, mo, d := time.Now().Date()
+		res.ID = 2
+		res.StartDate = time.Date(y, mo, d+1, 0, 0, 0, 0, time.UTC)
+		res.EndDate = res.StartDate.AddDate(0, 0, 2)
+		return res, nil
+	case "GONE2345":
+		res.ID = 3
+		res.Status = models.ReservationCancelled
+		res.CancelledAt = time.Now()
+		return res, nil
+	}
+
+	return models.Reservation{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if res.StartDate.Format("2006-01-02") == "2050-01-15" {
+		return repository.ErrRoomNotAvailable
+	}
+	current := models.Reservation{Status: testReservationStatus(res.ID)}
+	if !current.Open() {
+		return repository.ErrInvalidStatusChange
+	}
 	return nil
 }
 
-func (m *testDBRepo) DeleteReservation(id int) error {
+func (m *testDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (m *testDBRepo) UpdateReservationStatus(ctx context.Context, id int, status string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 100 {
+		return errors.New("some error")
+	}
+	if !models.CanChangeStatus(testReservationStatus(id), status) {
+		return repository.ErrInvalidStatusChange
+	}
 	return nil
 }
 
-func (m *testDBRepo) AllRooms() ([]models.Room, error) {
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var rooms []models.Room
 	rooms = append(rooms, models.Room{
 		ID:        1,
@@ -105,27 +673,572 @@ func (m *testDBRepo) AllRooms() ([]models.Room, error) {
 	return rooms, nil
 }
 
-func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+func (m *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if start.Format("2006-01-02") == "2050-05-01" {
 		return []models.RoomRestriction{
 			{
 				ID:            1,
 				StartDate:     start,
-				EndDate:       start.AddDate(0, 0, 1),
+				EndDate:       start.AddDate(0, 0, 3),
 				RoomID:        roomID,
-				RestrictionID: 2,
+				RestrictionID: models.RestrictionOwnerBlock,
+				Reason:        "Maintenance",
+				Note:          "new boiler",
+				Version:       1,
 				CreatedAt:     time.Now(),
 				UpdatedAt:     time.Now(),
 			},
+			{
+				ID:             3,
+				StartDate:      start.AddDate(0, 0, 9),
+				EndDate:        start.AddDate(0, 0, 12),
+				RoomID:         roomID,
+				RestrictionID:  models.RestrictionExternalBooking,
+				Reason:         "Holiday Lets",
+				Note:           "Reserved",
+				Version:        1,
+				ExternalFeedID: 1,
+				ExternalUID:    "stay-1@holidaylets.test",
+				CreatedAt:      time.Now(),
+				UpdatedAt:      time.Now(),
+			},
 		}, nil
 	}
 	return []models.RoomRestriction{}, nil
 }
 
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+func (m *testDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	if err := ctx.Err(); err != nil {
+		return models.RoomRestriction{}, err
+	}
+
+	if id != 1 {
+		return models.RoomRestriction{}, sql.ErrNoRows
+	}
+
+	start, _ := time.Parse("2006-01-02", "2050-05-01")
+	return models.RoomRestriction{
+		ID:            1,
+		StartDate:     start,
+		EndDate:       start.AddDate(0, 0, 3),
+		RoomID:        1,
+		RestrictionID: models.RestrictionOwnerBlock,
+		Reason:        "Maintenance",
+		Note:          "new boiler",
+		Version:       1,
+		Room:          models.Room{ID: 1, RoomName: "Room One"},
+	}, nil
+}
+
+func (m *testDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if !b.EndDate.After(b.StartDate) {
+		return 0, repository.ErrInvalidBlockRange
+	}
+	if testReservedStay.Overlaps(b.StartDate, b.EndDate) {
+		return 0, repository.ErrRoomNotAvailable
+	}
+	if b.RoomID > 2 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if b.ID != 1 {
+		return sql.ErrNoRows
+	}
+	if !b.EndDate.After(b.StartDate) {
+		return repository.ErrInvalidBlockRange
+	}
+	if testReservedStay.Overlaps(b.StartDate, b.EndDate) {
+		return repository.ErrRoomNotAvailable
+	}
+	return nil
+}
+
+func (m *testDBRepo) SplitBlock(ctx context.Context, id int, at time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if id != 1 {
+		return 0, sql.ErrNoRows
+	}
+	// block 1 covers 2050-05-01 up to 2050-05-04
+	start, _ := time.Parse("2006-01-02", "2050-05-01")
+	if !at.After(start) || !at.Before(start.AddDate(0, 0, 3)) {
+		return 0, repository.ErrInvalidBlockRange
+	}
+	return 2, nil
+}
+
+func (m *testDBRepo) DeleteBlockRange(ctx context.Context, roomID int, start, end time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !end.After(start) {
+		return repository.ErrInvalidBlockRange
+	}
+	if roomID > 2 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) ApplyBlockChanges(ctx context.Context, changes []models.BlockChange) ([]models.BlockConflict, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// block 1 is at version 1 and 2050-01-15 is booked
+	var conflicts []models.BlockConflict
+	for _, c := range changes {
+		if c.RoomID > 2 {
+			return nil, errors.New("some error")
+		}
+		if c.Remove && c.BlockID == 1 && c.Version != 1 {
+			conflicts = append(conflicts, models.BlockConflict{Change: c, Reason: "the block was changed by someone else"})
+		}
+		if !c.Remove && c.Day.Format("2006-01-02") == "2050-01-15" {
+			conflicts = append(conflicts, models.BlockConflict{Change: c, Reason: "the room has been booked"})
+		}
+	}
+
+	return conflicts, nil
+}
+
+func (m *testDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) GetCalendarRestrictions(ctx context.Context, roomID int, since time.Time) ([]models.RoomRestriction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	updated := time.Date(2049, 12, 1, 9, 30, 0, 0, time.UTC)
+	all := []models.RoomRestriction{
+		{
+			ID:            1,
+			StartDate:     start,
+			EndDate:       start.AddDate(0, 0, 2),
+			RoomID:        1,
+			ReservationID: 1,
+			RestrictionID: models.RestrictionReservation,
+			UpdatedAt:     updated,
+			Room:          models.Room{ID: 1, RoomName: "Room One"},
+			Reservation: models.Reservation{
+				ID:               1,
+				ConfirmationCode: "ABCD2345",
+				FirstName:        "John",
+				LastName:         "Smith",
+				Status:           models.ReservationPending,
+				UpdatedAt:        updated,
+			},
+		},
+		{
+			ID:            2,
+			StartDate:     start.AddDate(0, 1, 0),
+			EndDate:       start.AddDate(0, 1, 3),
+			RoomID:        2,
+			RestrictionID: models.RestrictionOwnerBlock,
+			Reason:        "Maintenance",
+			Note:          "new boiler",
+			UpdatedAt:     updated,
+			Room:          models.Room{ID: 2, RoomName: "Room Two"},
+		},
+		{
+			ID:             3,
+			StartDate:      start.AddDate(0, 0, 9),
+			EndDate:        start.AddDate(0, 0, 12),
+			RoomID:         1,
+			RestrictionID:  models.RestrictionExternalBooking,
+			Reason:         "Holiday Lets",
+			Note:           "Reserved",
+			ExternalFeedID: 1,
+			ExternalUID:    "stay-1@holidaylets.test",
+			UpdatedAt:      updated,
+			Room:           models.Room{ID: 1, RoomName: "Room One"},
+		},
+	}
+
+	var restrictions []models.RoomRestriction
+	for _, r := range all {
+		if roomID == 0 || r.RoomID == roomID {
+			restrictions = append(restrictions, r)
+		}
+	}
+
+	return restrictions, nil
+}
+
+// testCalendarFeedTokens are the calendar feed tokens of the testing repo by payload, their tokens are
+// signed with tokens.Sign for the "calendar-feed" purpose. Room 2 has no feed token.
+var testCalendarFeedTokens = map[string]models.CalendarFeedToken{
+	"all-rooms-feed": {ID: 1, RoomID: 0},
+	"room-one-feed":  {ID: 2, RoomID: 1},
+}
+
+func (m *testDBRepo) AllCalendarFeedTokens(ctx context.Context) ([]models.CalendarFeedToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return []models.CalendarFeedToken{testCalendarFeedTokens["all-rooms-feed"], testCalendarFeedTokens["room-one-feed"]}, nil
+}
+
+// GetCalendarFeedTokenByHash finds the testCalendarFeedTokens by the hash of their signed token
+func (m *testDBRepo) GetCalendarFeedTokenByHash(ctx context.Context, tokenHash string) (models.CalendarFeedToken, error) {
+	if err := ctx.Err(); err != nil {
+		return models.CalendarFeedToken{}, err
+	}
+
+	for payload, t := range testCalendarFeedTokens {
+		if tokens.Hash(tokens.Sign(m.App.Secret, "calendar-feed", payload)) == tokenHash {
+			return t, nil
+		}
+	}
+
+	return models.CalendarFeedToken{}, sql.ErrNoRows
+}
+
+// ReplaceCalendarFeedToken fails for rooms above 2
+func (m *testDBRepo) ReplaceCalendarFeedToken(ctx context.Context, roomID int, tokenHash string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if roomID > 2 {
+		return 0, errors.New("can't insert calendar feed token")
+	}
+
+	return 3, nil
+}
+
+// DeleteCalendarFeedToken returns sql.ErrNoRows for the feeds without a token
+func (m *testDBRepo) DeleteCalendarFeedToken(ctx context.Context, roomID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if roomID > 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) EnqueueMail(ctx context.Context, mail models.MailData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) ClaimMail(ctx context.Context, limit int, staleAfter time.Duration) ([]models.QueuedMail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (m *testDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) MarkMailFailed(ctx context.Context, id int, lastError string, nextAttempt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) MarkMailDead(ctx context.Context, id int, lastError string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) MailByStatus(ctx context.Context, status string) ([]models.QueuedMail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if status == models.MailStatusDead {
+		return []models.QueuedMail{
+			{
+				ID:        1,
+				Mail:      models.MailData{To: "guest@here.com", From: "me@here.com", Subject: "Reservation Confirmation"},
+				Status:    models.MailStatusDead,
+				Attempts:  5,
+				LastError: "connection refused",
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (m *testDBRepo) RetryMail(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 1 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) InsertFailedLogin(ctx context.Context, email, ipAddress string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.FailedLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logins := []models.FailedLogin{
+		{ID: 1, Email: "ismail@here.com", IPAddress: "127.0.0.1", CreatedAt: time.Now()},
+	}
+	return logins, nil
+}
+
+func (m *testDBRepo) SaveLoginLockout(ctx context.Context, l models.LoginLockout) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) DeleteLoginLockout(ctx context.Context, kind, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) LoginLockouts(ctx context.Context, kind string) ([]models.LoginLockout, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// AuditLog returns an update of reservation 1 by the owner and the creation of a block, an error
+// for user ids above 100
+func (m *testDBRepo) AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.UserID > 100 {
+		return nil, errors.New("can't read audit log")
+	}
+
+	entries := []models.AuditEntry{
+		{ID: 2, UserID: models.AccessLevelOwner, UserName: "Owner User", Action: models.AuditUpdate,
+			EntityType: models.AuditReservation, EntityID: 1, IPAddress: "127.0.0.1", CreatedAt: time.Now(),
+			Changes: []models.AuditChange{{Field: "status", Before: models.ReservationPending, After: models.ReservationConfirmed}}},
+		{ID: 1, UserID: models.AccessLevelManager, UserName: "Manager User", Action: models.AuditCreate,
+			EntityType: models.AuditBlock, EntityID: 1, IPAddress: "127.0.0.1", CreatedAt: time.Now(),
+			Changes: []models.AuditChange{{Field: "reason", After: "Maintenance"}}},
+	}
+
+	var matching []models.AuditEntry
+	for _, e := range entries {
+		if f.EntityType != "" && e.EntityType != f.EntityType {
+			continue
+		}
+		if f.EntityID != 0 && e.EntityID != f.EntityID {
+			continue
+		}
+		matching = append(matching, e)
+	}
+
+	return matching, nil
+}
+
+// testAPITokens are the api tokens of the testing repo by payload, their tokens are signed with
+// tokens.Sign for the "api-token" purpose
+var testAPITokens = map[string]models.APIToken{
+	"frontdesk": {ID: 1, UserID: models.AccessLevelManager, UserName: "Manager User", Name: "Front desk",
+		Scopes: []string{models.ScopeAvailabilityRead, models.ScopeReservationsWrite}},
+	"reader": {ID: 2, UserID: models.AccessLevelStaff, UserName: "Staff User", Name: "Availability widget",
+		Scopes: []string{models.ScopeAvailabilityRead}},
+	"admintool": {ID: 3, UserID: models.AccessLevelOwner, UserName: "Owner User", Name: "Reporting",
+		Scopes: []string{models.ScopeAdmin}},
+}
+
+// InsertAPIToken fails for a token named "fail"
+func (m *testDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken, tokenHash string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if t.Name == "fail" {
+		return 0, errors.New("can't insert api token")
+	}
+
+	return 4, nil
+}
+
+// AllAPITokens returns the testAPITokens and a revoked token
+func (m *testDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	apiTokens := []models.APIToken{{ID: 4, UserID: models.AccessLevelOwner, UserName: "Owner User", Name: "Old script",
+		Scopes: []string{models.ScopeAdmin}, RevokedAt: time.Now()}}
+	for _, t := range testAPITokens {
+		apiTokens = append(apiTokens, t)
+	}
+
+	return apiTokens, nil
+}
+
+// GetAPITokenByHash finds the testAPITokens by the hash of their signed token
+func (m *testDBRepo) GetAPITokenByHash(ctx context.Context, tokenHash string) (models.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return models.APIToken{}, err
+	}
+
+	for payload, t := range testAPITokens {
+		if tokens.Hash(tokens.Sign(m.App.Secret, "api-token", payload)) == tokenHash {
+			return t, nil
+		}
+	}
+
+	return models.APIToken{}, sql.ErrNoRows
+}
+
+// RevokeAPIToken returns sql.ErrNoRows for ids above 3
+func (m *testDBRepo) RevokeAPIToken(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 3 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
 
-func (m *testDBRepo) DeleteBlockByID(id int) error {
+func (m *testDBRepo) TouchAPIToken(ctx context.Context, id int, ipAddress string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// testExternalFeeds are the external calendar feeds of the testing repo, the second one failed to sync
+var testExternalFeeds = []models.ExternalFeed{
+	{ID: 1, RoomID: 1, Name: "Holiday Lets", URL: "https://holidaylets.test/listing/1.ics",
+		LastSyncedAt: time.Date(2050, 1, 1, 10, 0, 0, 0, time.UTC), LastAttemptAt: time.Date(2050, 1, 1, 10, 0, 0, 0, time.UTC),
+		EventCount: 2, Room: models.Room{ID: 1, RoomName: "Room One"}},
+	{ID: 2, RoomID: 2, Name: "Stay Finder", URL: "https://stayfinder.test/calendar/2.ics",
+		LastSyncedAt: time.Date(2050, 1, 1, 10, 0, 0, 0, time.UTC), LastAttemptAt: time.Date(2050, 1, 1, 11, 0, 0, 0, time.UTC),
+		LastError: "unexpected status 404 Not Found", EventCount: 1, Conflicts: 1,
+		Room: models.Room{ID: 2, RoomName: "Room Two"}},
+}
+
+// AllExternalFeeds returns the testExternalFeeds
+func (m *testDBRepo) AllExternalFeeds(ctx context.Context) ([]models.ExternalFeed, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return testExternalFeeds, nil
+}
+
+// GetExternalFeedByID returns sql.ErrNoRows for ids above 2
+func (m *testDBRepo) GetExternalFeedByID(ctx context.Context, id int) (models.ExternalFeed, error) {
+	if err := ctx.Err(); err != nil {
+		return models.ExternalFeed{}, err
+	}
+
+	if id < 1 || id > len(testExternalFeeds) {
+		return models.ExternalFeed{}, sql.ErrNoRows
+	}
+
+	return testExternalFeeds[id-1], nil
+}
+
+// InsertExternalFeed fails for a feed named "fail"
+func (m *testDBRepo) InsertExternalFeed(ctx context.Context, f models.ExternalFeed) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if f.Name == "fail" {
+		return 0, errors.New("can't insert external feed")
+	}
+
+	return 3, nil
+}
+
+// DeleteExternalFeed returns sql.ErrNoRows for ids above 2
+func (m *testDBRepo) DeleteExternalFeed(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id > 2 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) SyncExternalFeed(ctx context.Context, id int, bookings []models.ExternalBooking) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) MarkExternalFeedFailed(ctx context.Context, id int, lastError string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -1,27 +1,121 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"github.com/ismail118/bookings-app/internal/models"
 	"time"
 )
 
+// ErrRoomNotAvailable is returned when a room was booked by someone else before the reservation was stored
+var ErrRoomNotAvailable = errors.New("room is no longer available for the selected dates")
+
+// ErrDuplicateEmail is returned when a user is saved with an email that another user already has
+var ErrDuplicateEmail = errors.New("email is already in use")
+
+// ErrInvalidResetToken is returned when a password reset token is unknown, expired or already used
+var ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+
+// ErrInvalidBlockRange is returned when the dates of an owner block don't cover at least one day, or when a
+// block is split outside of its days
+var ErrInvalidBlockRange = errors.New("invalid block dates")
+
+// ErrDuplicateConfirmationCode is returned when a reservation is booked with a confirmation code that is taken
+var ErrDuplicateConfirmationCode = errors.New("confirmation code is already in use")
+
+// ErrInvalidStatusChange is returned when the status of a reservation doesn't allow a change, like
+// checking in a cancelled reservation or moving a reservation after the guest has arrived
+var ErrInvalidStatusChange = errors.New("reservation status doesn't allow this change")
+
+// ErrDuplicateSlug is returned when a room is saved with a slug that another room already has
+var ErrDuplicateSlug = errors.New("slug is already in use")
+
+// ErrRoomHasReservations is returned when a room that still has reservations is deleted
+var ErrRoomHasReservations = errors.New("room still has reservations")
+
 type DatabaseRepo interface {
-	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(r models.RoomRestriction) error
-	SearchAvailabilityByRoomID(roomID int, start, end time.Time) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
-	GetRoomByID(id int) (models.Room, error)
-	GetUserByID(id int) (models.User, error)
-	UpdateUser(u models.User) error
-	Authenticate(email, testPassword string) (int, string, error)
-	AllReservations() ([]models.Reservation, error)
-	NewReservations() ([]models.Reservation, error)
-	GetReservationByID(id int) (models.Reservation, error)
-	UpdateReservation(u models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
-	AllRooms() ([]models.Room, error)
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockByID(id int) error
+	InsertReservation(ctx context.Context, res models.Reservation) (int, error)
+	InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error
+	BookReservation(ctx context.Context, res models.Reservation) (int, error)
+	SearchAvailabilityByRoomID(ctx context.Context, roomID int, start, end time.Time) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error)
+	GetRoomByID(ctx context.Context, id int) (models.Room, error)
+	GetRoomBySlug(ctx context.Context, slug string) (models.Room, error)
+	InsertRoom(ctx context.Context, r models.Room) (int, error)
+	UpdateRoom(ctx context.Context, r models.Room) error
+	DeleteRoom(ctx context.Context, id int) error
+	SeasonalRatesForRoom(ctx context.Context, roomID int) ([]models.SeasonalRate, error)
+	InsertSeasonalRate(ctx context.Context, sr models.SeasonalRate) (int, error)
+	DeleteSeasonalRate(ctx context.Context, roomID, id int) error
+	StayRulesForRoom(ctx context.Context, roomID int) ([]models.StayRule, error)
+	StayRulesForStay(ctx context.Context, start, end time.Time) ([]models.StayRule, error)
+	InsertStayRule(ctx context.Context, rule models.StayRule) (int, error)
+	DeleteStayRule(ctx context.Context, roomID, id int) error
+	InsertRoomPhoto(ctx context.Context, p models.RoomPhoto) (int, error)
+	GetRoomPhotoByID(ctx context.Context, id int) (models.RoomPhoto, error)
+	DeleteRoomPhoto(ctx context.Context, id int) error
+	SetRoomCoverPhoto(ctx context.Context, id int) error
+	MoveRoomPhoto(ctx context.Context, id int, up bool) error
+	GetUserByID(ctx context.Context, id int) (models.User, error)
+	UpdateUser(ctx context.Context, u models.User) error
+	AllUsers(ctx context.Context) ([]models.User, error)
+	InsertUser(ctx context.Context, u models.User, password string) (int, error)
+	UpdateUserPassword(ctx context.Context, id int, password string) error
+	SetUserActive(ctx context.Context, id int, active bool) error
+	DeleteUser(ctx context.Context, id int) error
+	GetUserByEmail(ctx context.Context, email string) (models.User, error)
+	SetUserTOTPSecret(ctx context.Context, id int, sealedSecret string) error
+	EnableUserTOTP(ctx context.Context, id int, step int64, recoveryCodeHashes []string) error
+	DisableUserTOTP(ctx context.Context, id int) error
+	UseTOTPStep(ctx context.Context, id int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID int) (int, error)
+	InsertPasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	CheckPasswordReset(ctx context.Context, tokenHash string) error
+	ResetPassword(ctx context.Context, tokenHash, password string) error
+	InsertFailedLogin(ctx context.Context, email, ipAddress string) error
+	RecentFailedLogins(ctx context.Context, limit int) ([]models.FailedLogin, error)
+	SaveLoginLockout(ctx context.Context, l models.LoginLockout) error
+	DeleteLoginLockout(ctx context.Context, kind, key string) error
+	LoginLockouts(ctx context.Context, kind string) ([]models.LoginLockout, error)
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+	AllReservations(ctx context.Context, status string) ([]models.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (models.Reservation, error)
+	GetReservationByCode(ctx context.Context, code string) (models.Reservation, error)
+	ChangeReservationDates(ctx context.Context, res models.Reservation) error
+	UpdateReservation(ctx context.Context, u models.Reservation) error
+	UpdateReservationStatus(ctx context.Context, id int, status string) error
+	AllRooms(ctx context.Context) ([]models.Room, error)
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error)
+	InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error)
+	UpdateBlock(ctx context.Context, b models.RoomRestriction) error
+	SplitBlock(ctx context.Context, id int, at time.Time) (int, error)
+	DeleteBlockRange(ctx context.Context, roomID int, start, end time.Time) error
+	ApplyBlockChanges(ctx context.Context, changes []models.BlockChange) ([]models.BlockConflict, error)
+	DeleteBlockByID(ctx context.Context, id int) error
+	GetCalendarRestrictions(ctx context.Context, roomID int, since time.Time) ([]models.RoomRestriction, error)
+	AllCalendarFeedTokens(ctx context.Context) ([]models.CalendarFeedToken, error)
+	GetCalendarFeedTokenByHash(ctx context.Context, tokenHash string) (models.CalendarFeedToken, error)
+	ReplaceCalendarFeedToken(ctx context.Context, roomID int, tokenHash string) (int, error)
+	DeleteCalendarFeedToken(ctx context.Context, roomID int) error
+	EnqueueMail(ctx context.Context, m models.MailData) error
+	ClaimMail(ctx context.Context, limit int, staleAfter time.Duration) ([]models.QueuedMail, error)
+	MarkMailSent(ctx context.Context, id int) error
+	MarkMailFailed(ctx context.Context, id int, lastError string, nextAttempt time.Time) error
+	MarkMailDead(ctx context.Context, id int, lastError string) error
+	MailByStatus(ctx context.Context, status string) ([]models.QueuedMail, error)
+	RetryMail(ctx context.Context, id int) error
+	AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, error)
+	InsertAPIToken(ctx context.Context, t models.APIToken, tokenHash string) (int, error)
+	AllAPITokens(ctx context.Context) ([]models.APIToken, error)
+	GetAPITokenByHash(ctx context.Context, tokenHash string) (models.APIToken, error)
+	RevokeAPIToken(ctx context.Context, id int) error
+	TouchAPIToken(ctx context.Context, id int, ipAddress string) error
+	AllExternalFeeds(ctx context.Context) ([]models.ExternalFeed, error)
+	GetExternalFeedByID(ctx context.Context, id int) (models.ExternalFeed, error)
+	InsertExternalFeed(ctx context.Context, f models.ExternalFeed) (int, error)
+	DeleteExternalFeed(ctx context.Context, id int) error
+	SyncExternalFeed(ctx context.Context, id int, bookings []models.ExternalBooking) error
+	MarkExternalFeedFailed(ctx context.Context, id int, lastError string) error
 }
@@ -0,0 +1,119 @@
+// Package stayrules checks a stay against the minimum and maximum stay, closed to arrival,
+// closed to departure and booking lead time rules of a room.
+package stayrules
+
+import (
+	"fmt"
+	"github.com/ismail118/bookings-app/internal/models"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Violation is returned for a stay a rule does not allow, Reason is meant for the guest
+type Violation struct {
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return v.Reason
+}
+
+// Today is the current date at midnight UTC, like the dates parsed from the search forms
+func Today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// ValidateDates rejects stays without any night and stays arriving before today
+func ValidateDates(start, end, today time.Time) error {
+	start, end, today = truncateDay(start), truncateDay(end), truncateDay(today)
+
+	if !end.After(start) {
+		return &Violation{Reason: "The departure date must be after the arrival date"}
+	}
+	if start.Before(today) {
+		return &Violation{Reason: "The arrival date can't be in the past"}
+	}
+
+	return nil
+}
+
+// Check validates the dates of a stay from start to end and returns the first of the rules of a
+// single room the stay breaks. today is the date the stay is booked on.
+func Check(rules []models.StayRule, start, end, today time.Time) error {
+	err := ValidateDates(start, end, today)
+	if err != nil {
+		return err
+	}
+
+	start, end, today = truncateDay(start), truncateDay(end), truncateDay(today)
+	nights := days(start, end)
+	lead := days(today, start)
+	arrival := start.Format(dateLayout)
+
+	for _, rule := range rules {
+		if Applies(rule, start) {
+			switch {
+			case rule.ClosedToArrival:
+				return &Violation{Reason: fmt.Sprintf("Arrivals are not possible on %s", arrival)}
+			case rule.MinNights > 0 && nights < rule.MinNights:
+				return &Violation{Reason: fmt.Sprintf("A minimum stay of %s applies to arrivals on %s", plural(rule.MinNights, "night"), arrival)}
+			case rule.MaxNights > 0 && nights > rule.MaxNights:
+				return &Violation{Reason: fmt.Sprintf("A maximum stay of %s applies to arrivals on %s", plural(rule.MaxNights, "night"), arrival)}
+			case rule.MinLeadDays > 0 && lead < rule.MinLeadDays:
+				return &Violation{Reason: fmt.Sprintf("Arrivals on %s must be booked at least %s ahead", arrival, plural(rule.MinLeadDays, "day"))}
+			case rule.MaxLeadDays > 0 && lead > rule.MaxLeadDays:
+				return &Violation{Reason: fmt.Sprintf("Arrivals on %s can be booked at most %s ahead", arrival, plural(rule.MaxLeadDays, "day"))}
+			}
+		}
+
+		if rule.ClosedToDeparture && Applies(rule, end) {
+			return &Violation{Reason: fmt.Sprintf("Departures are not possible on %s", end.Format(dateLayout))}
+		}
+	}
+
+	return nil
+}
+
+// Applies reports whether day is covered by the date range and the weekdays of rule
+func Applies(rule models.StayRule, day time.Time) bool {
+	day = truncateDay(day)
+	if day.Before(truncateDay(rule.StartDate)) || day.After(truncateDay(rule.EndDate)) {
+		return false
+	}
+	if len(rule.Weekdays) == 0 {
+		return true
+	}
+	for _, wd := range rule.Weekdays {
+		if wd == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// ByRoom groups rules by their room
+func ByRoom(rules []models.StayRule) map[int][]models.StayRule {
+	grouped := make(map[int][]models.StayRule)
+	for _, rule := range rules {
+		grouped[rule.RoomID] = append(grouped[rule.RoomID], rule)
+	}
+	return grouped
+}
+
+func days(from, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,93 @@
+package stayrules
+
+import (
+	"errors"
+	"github.com/ismail118/bookings-app/internal/models"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestValidateDates(t *testing.T) {
+	today := date("2050-01-10")
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		valid bool
+	}{
+		{"one-night", "2050-01-10", "2050-01-11", true},
+		{"same-day", "2050-01-12", "2050-01-12", false},
+		{"end-before-start", "2050-01-12", "2050-01-11", false},
+		{"past-arrival", "2050-01-09", "2050-01-11", false},
+	}
+
+	for _, e := range tests {
+		err := ValidateDates(date(e.start), date(e.end), today)
+		if (err == nil) != e.valid {
+			t.Errorf("%s: expected valid %v, got %v", e.name, e.valid, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	today := date("2050-01-01")
+
+	// 2050-07-01 is a friday
+	rules := []models.StayRule{
+		{StartDate: date("2050-07-01"), EndDate: date("2050-07-31"), MinNights: 3, MaxNights: 14},
+		{StartDate: date("2050-07-01"), EndDate: date("2050-07-31"), Weekdays: []time.Weekday{time.Sunday}, ClosedToArrival: true},
+		{StartDate: date("2050-07-01"), EndDate: date("2050-07-31"), Weekdays: []time.Weekday{time.Monday}, ClosedToDeparture: true},
+		{StartDate: date("2050-12-20"), EndDate: date("2050-12-31"), MinLeadDays: 400},
+		{StartDate: date("2050-06-01"), EndDate: date("2050-06-30"), MaxLeadDays: 90},
+	}
+
+	tests := []struct {
+		name   string
+		start  string
+		end    string
+		reason string
+	}{
+		{"allowed", "2050-07-01", "2050-07-05", ""},
+		{"outside-rules", "2050-08-01", "2050-08-02", ""},
+		{"min-nights", "2050-07-01", "2050-07-03", "A minimum stay of 3 nights applies to arrivals on 2050-07-01"},
+		{"max-nights", "2050-07-01", "2050-07-20", "A maximum stay of 14 nights applies to arrivals on 2050-07-01"},
+		{"closed-to-arrival", "2050-07-03", "2050-07-07", "Arrivals are not possible on 2050-07-03"},
+		{"closed-to-departure", "2050-07-01", "2050-07-04", "Departures are not possible on 2050-07-04"},
+		{"min-lead", "2050-12-24", "2050-12-26", "Arrivals on 2050-12-24 must be booked at least 400 days ahead"},
+		{"max-lead", "2050-06-10", "2050-06-12", "Arrivals on 2050-06-10 can be booked at most 90 days ahead"},
+		{"invalid-dates", "2050-07-05", "2050-07-01", "The departure date must be after the arrival date"},
+	}
+
+	for _, e := range tests {
+		err := Check(rules, date(e.start), date(e.end), today)
+		if e.reason == "" {
+			if err != nil {
+				t.Errorf("%s: expected no violation, got %v", e.name, err)
+			}
+			continue
+		}
+
+		var v *Violation
+		if !errors.As(err, &v) {
+			t.Errorf("%s: expected a violation, got %v", e.name, err)
+			continue
+		}
+		if v.Reason != e.reason {
+			t.Errorf("%s: wrong reason, got %q want %q", e.name, v.Reason, e.reason)
+		}
+	}
+}
+
+func TestByRoom(t *testing.T) {
+	grouped := ByRoom([]models.StayRule{{ID: 1, RoomID: 1}, {ID: 2, RoomID: 2}, {ID: 3, RoomID: 1}})
+
+	if len(grouped[1]) != 2 || len(grouped[2]) != 1 {
+		t.Errorf("wrong grouping %+v", grouped)
+	}
+}
@@ -0,0 +1,195 @@
+package throttle
+
+import (
+	"context"
+	"github.com/ismail118/bookings-app/internal/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config sets how a Limiter reacts to failures
+type Config struct {
+	// MaxFailures is the number of failures after which the key is locked
+	MaxFailures int
+	// Lockout is how long a key stays locked, and how long failures are remembered
+	Lockout time.Duration
+	// BaseDelay is the wait after the first failure, it doubles with every failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Store persists lockouts so they survive a restart
+type Store interface {
+	SaveLoginLockout(ctx context.Context, l models.LoginLockout) error
+	DeleteLoginLockout(ctx context.Context, kind, key string) error
+	LoginLockouts(ctx context.Context, kind string) ([]models.LoginLockout, error)
+}
+
+// Limiter counts failures per key in memory and slows down and then locks keys that keep failing
+type Limiter struct {
+	kind    string
+	config  Config
+	store   Store
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*models.LoginLockout
+}
+
+// New returns a limiter for one kind of key, e.g. "email" or "ip". The store may be nil
+// to keep the failures in memory only.
+func New(kind string, config Config, store Store) *Limiter {
+	return &Limiter{
+		kind:    kind,
+		config:  config,
+		store:   store,
+		now:     time.Now,
+		entries: make(map[string]*models.LoginLockout),
+	}
+}
+
+// Load reads the stored lockouts into memory and deletes the ones that have expired
+func (l *Limiter) Load(ctx context.Context) error {
+	if l.store == nil {
+		return nil
+	}
+
+	lockouts, err := l.store.LoginLockouts(ctx, l.kind)
+	if err != nil {
+		return err
+	}
+
+	now := l.now()
+	for i := range lockouts {
+		if l.expired(&lockouts[i], now) {
+			err = l.store.DeleteLoginLockout(ctx, l.kind, lockouts[i].Key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		l.mu.Lock()
+		l.entries[lockouts[i].Key] = &lockouts[i]
+		l.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Wait returns how long key has to wait before its next attempt, zero when it may try now
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+
+	now := l.now()
+	wait := e.LockedUntil.Sub(now)
+	if delay := e.LastFailureAt.Add(l.delay(e.Failures)).Sub(now); delay > wait {
+		wait = delay
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Fail records a failure for key and locks it once it reaches the maximum failures
+func (l *Limiter) Fail(ctx context.Context, key string) error {
+	l.mu.Lock()
+
+	now := l.now()
+	l.prune(now)
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &models.LoginLockout{Kind: l.kind, Key: key}
+		l.entries[key] = e
+	}
+
+	e.Failures++
+	e.LastFailureAt = now
+	if e.Failures >= l.config.MaxFailures {
+		e.LockedUntil = now.Add(l.config.Lockout)
+	}
+
+	saved := *e
+	l.mu.Unlock()
+
+	if l.store == nil {
+		return nil
+	}
+	return l.store.SaveLoginLockout(ctx, saved)
+}
+
+// Reset forgets the failures of key, used after a successful login and to unlock a key
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	l.mu.Unlock()
+
+	if !ok || l.store == nil {
+		return nil
+	}
+	return l.store.DeleteLoginLockout(ctx, l.kind, key)
+}
+
+// Lockouts returns the keys with remembered failures, locked keys first
+func (l *Limiter) Lockouts() []models.LoginLockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(l.now())
+
+	lockouts := make([]models.LoginLockout, 0, len(l.entries))
+	for _, e := range l.entries {
+		lockouts = append(lockouts, *e)
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+		}
+		return lockouts[i].Key < lockouts[j].Key
+	})
+
+	return lockouts
+}
+
+// delay returns the wait after the given number of failures
+func (l *Limiter) delay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+
+	d := l.config.BaseDelay
+	for i := 1; i < failures && d < l.config.MaxDelay; i++ {
+		d *= 2
+	}
+
+	if d > l.config.MaxDelay {
+		d = l.config.MaxDelay
+	}
+	return d
+}
+
+// prune forgets keys that have expired. The stored rows are left alone,
+// they are cleaned up when the key is reset or on the next Load.
+func (l *Limiter) prune(now time.Time) {
+	for key, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// expired reports whether e is not locked and has not failed within the lockout window
+func (l *Limiter) expired(e *models.LoginLockout, now time.Time) bool {
+	return now.After(e.LockedUntil) && now.Sub(e.LastFailureAt) > l.config.Lockout
+}
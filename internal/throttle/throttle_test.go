@@ -0,0 +1,161 @@
+package throttle
+
+import (
+	"context"
+	"github.com/ismail118/bookings-app/internal/models"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	MaxFailures: 3,
+	Lockout:     15 * time.Minute,
+	BaseDelay:   time.Second,
+	MaxDelay:    4 * time.Second,
+}
+
+// memoryStore keeps saved lockouts in a map
+type memoryStore map[string]models.LoginLockout
+
+func (s memoryStore) SaveLoginLockout(ctx context.Context, l models.LoginLockout) error {
+	s[l.Kind+":"+l.Key] = l
+	return nil
+}
+
+func (s memoryStore) DeleteLoginLockout(ctx context.Context, kind, key string) error {
+	delete(s, kind+":"+key)
+	return nil
+}
+
+func (s memoryStore) LoginLockouts(ctx context.Context, kind string) ([]models.LoginLockout, error) {
+	var lockouts []models.LoginLockout
+	for _, l := range s {
+		if l.Kind == kind {
+			lockouts = append(lockouts, l)
+		}
+	}
+	return lockouts, nil
+}
+
+// newTestLimiter returns a limiter with a clock that only moves when the returned func is called
+func newTestLimiter(store Store) (*Limiter, func(time.Duration)) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := New("email", testConfig, store)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiter_ProgressiveDelay(t *testing.T) {
+	l, advance := newTestLimiter(nil)
+	ctx := context.Background()
+
+	if wait := l.Wait("me@here.com"); wait != 0 {
+		t.Errorf("unknown key should not wait, got %s", wait)
+	}
+
+	_ = l.Fail(ctx, "me@here.com")
+	if wait := l.Wait("me@here.com"); wait != time.Second {
+		t.Errorf("expected 1s after first failure, got %s", wait)
+	}
+
+	advance(time.Second)
+	if wait := l.Wait("me@here.com"); wait != 0 {
+		t.Errorf("delay should be over, got %s", wait)
+	}
+
+	_ = l.Fail(ctx, "me@here.com")
+	if wait := l.Wait("me@here.com"); wait != 2*time.Second {
+		t.Errorf("expected 2s after second failure, got %s", wait)
+	}
+
+	if wait := l.Wait("other@here.com"); wait != 0 {
+		t.Errorf("other keys should not wait, got %s", wait)
+	}
+}
+
+func TestLimiter_Lockout(t *testing.T) {
+	l, advance := newTestLimiter(nil)
+	ctx := context.Background()
+
+	for i := 0; i < testConfig.MaxFailures; i++ {
+		_ = l.Fail(ctx, "me@here.com")
+	}
+
+	if wait := l.Wait("me@here.com"); wait != testConfig.Lockout {
+		t.Errorf("expected lockout of %s, got %s", testConfig.Lockout, wait)
+	}
+
+	lockouts := l.Lockouts()
+	if len(lockouts) != 1 || lockouts[0].Key != "me@here.com" || lockouts[0].Failures != testConfig.MaxFailures {
+		t.Errorf("unexpected lockouts %+v", lockouts)
+	}
+
+	advance(testConfig.Lockout + time.Second)
+	if wait := l.Wait("me@here.com"); wait != 0 {
+		t.Errorf("lockout should be over, got %s", wait)
+	}
+
+	if lockouts := l.Lockouts(); len(lockouts) != 0 {
+		t.Errorf("expired lockouts should be forgotten, got %+v", lockouts)
+	}
+}
+
+func TestLimiter_Reset(t *testing.T) {
+	store := memoryStore{}
+	l, _ := newTestLimiter(store)
+	ctx := context.Background()
+
+	for i := 0; i < testConfig.MaxFailures; i++ {
+		_ = l.Fail(ctx, "me@here.com")
+	}
+
+	if len(store) != 1 {
+		t.Errorf("lockout should be stored, got %d rows", len(store))
+	}
+
+	_ = l.Reset(ctx, "me@here.com")
+	if wait := l.Wait("me@here.com"); wait != 0 {
+		t.Errorf("reset key should not wait, got %s", wait)
+	}
+
+	if len(store) != 0 {
+		t.Errorf("reset should delete the stored lockout, got %d rows", len(store))
+	}
+}
+
+func TestLimiter_Load(t *testing.T) {
+	store := memoryStore{}
+	l, advance := newTestLimiter(store)
+	ctx := context.Background()
+
+	for i := 0; i < testConfig.MaxFailures; i++ {
+		_ = l.Fail(ctx, "locked@here.com")
+	}
+	advance(testConfig.Lockout / 2)
+
+	store["email:stale@here.com"] = models.LoginLockout{Kind: "email", Key: "stale@here.com", Failures: 1,
+		LastFailureAt: l.now().Add(-testConfig.Lockout - time.Minute)}
+	store["ip:127.0.0.1"] = models.LoginLockout{Kind: "ip", Key: "127.0.0.1", Failures: 1, LastFailureAt: l.now()}
+
+	// a restarted app picks up the lockout, but not the stale failure or other kinds
+	restarted := New("email", testConfig, store)
+	restarted.now = l.now
+
+	err := restarted.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := restarted.Wait("locked@here.com"); wait != testConfig.Lockout/2 {
+		t.Errorf("expected the remaining lockout of %s, got %s", testConfig.Lockout/2, wait)
+	}
+
+	lockouts := restarted.Lockouts()
+	if len(lockouts) != 1 {
+		t.Errorf("expected only the email lockout to be loaded, got %+v", lockouts)
+	}
+
+	if _, ok := store["email:stale@here.com"]; ok {
+		t.Error("stale lockout should be deleted from the store")
+	}
+}
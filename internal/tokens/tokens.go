@@ -0,0 +1,73 @@
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// tokenBytes is the amount of randomness in a token
+const tokenBytes = 32
+
+// ErrInvalid is returned when a token was not signed by us for the given purpose
+var ErrInvalid = errors.New("invalid token")
+
+// New returns a random token signed with secret for purpose, e.g. "password-reset".
+// Only the Hash of the token should be stored.
+func New(secret []byte, purpose string) (string, error) {
+	b := make([]byte, tokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + sign(secret, purpose, payload), nil
+}
+
+// Verify checks that token was created by New with the same secret and purpose
+func Verify(secret []byte, purpose, token string) error {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || payload == "" {
+		return ErrInvalid
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, purpose, payload))) {
+		return ErrInvalid
+	}
+
+	return nil
+}
+
+// Sign returns payload signed with secret for purpose, for links that carry their own data instead of a
+// random token. The payload must not contain a dot.
+func Sign(secret []byte, purpose, payload string) string {
+	return payload + "." + sign(secret, purpose, payload)
+}
+
+// Open checks a token created by Sign and returns its payload
+func Open(secret []byte, purpose, token string) (string, error) {
+	err := Verify(secret, purpose, token)
+	if err != nil {
+		return "", err
+	}
+
+	payload, _, _ := strings.Cut(token, ".")
+	return payload, nil
+}
+
+// Hash returns the hex encoded sha256 of token, so a leaked table can't be used to redeem tokens
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sign(secret []byte, purpose, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,85 @@
+package tokens
+
+import (
+	"testing"
+)
+
+var secret = []byte("test-secret")
+
+func TestNew(t *testing.T) {
+	a, err := New(secret, "password-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(secret, "password-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Error("tokens should be random")
+	}
+
+	if err := Verify(secret, "password-reset", a); err != nil {
+		t.Errorf("token should be valid, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	token, _ := New(secret, "password-reset")
+
+	var tests = []struct {
+		name    string
+		secret  []byte
+		purpose string
+		token   string
+	}{
+		{"wrong-secret", []byte("other-secret"), "password-reset", token},
+		{"wrong-purpose", secret, "api", token},
+		{"tampered", secret, "password-reset", "x" + token},
+		{"no-signature", secret, "password-reset", token[:43]},
+		{"empty", secret, "password-reset", ""},
+	}
+
+	for _, e := range tests {
+		if err := Verify(e.secret, e.purpose, e.token); err != ErrInvalid {
+			t.Errorf("%s: expected ErrInvalid, got %v", e.name, err)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("a") != Hash("a") {
+		t.Error("hash should be stable")
+	}
+
+	if Hash("a") == Hash("b") {
+		t.Error("different tokens should have different hashes")
+	}
+
+	if len(Hash("a")) != 64 {
+		t.Errorf("hash should be 64 hex characters, got %d", len(Hash("a")))
+	}
+}
+
+func TestSignOpen(t *testing.T) {
+	secret := []byte("secret")
+	token := Sign(secret, "manage-booking", "ABCD2345")
+
+	payload, err := Open(secret, "manage-booking", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload != "ABCD2345" {
+		t.Errorf("wrong payload %q", payload)
+	}
+
+	if _, err := Open(secret, "password-reset", token); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for another purpose, got %v", err)
+	}
+
+	if _, err := Open(secret, "manage-booking", "WXYZ2345"+token[8:]); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for a changed payload, got %v", err)
+	}
+}
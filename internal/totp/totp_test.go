@@ -0,0 +1,144 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 secret "12345678901234567890" from the RFC 6238 test vectors
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last 6 digits of the RFC 6238 SHA1 test vectors
+	var tests = []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		code, err := Code(rfc6238Secret, Step(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != e.code {
+			t.Errorf("at %d expected %s but got %s", e.unix, e.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, _ := Code(rfc6238Secret, Step(now))
+
+	step, ok := Validate(rfc6238Secret, code, now)
+	if !ok || step != Step(now) {
+		t.Errorf("current code should be valid, got %d %v", step, ok)
+	}
+
+	if _, ok := Validate(rfc6238Secret, code, now.Add(period*time.Second)); !ok {
+		t.Error("code of the previous period should be valid")
+	}
+
+	if _, ok := Validate(rfc6238Secret, code, now.Add(3*period*time.Second)); ok {
+		t.Error("old code should not be valid")
+	}
+
+	if _, ok := Validate(rfc6238Secret, "000000", now); ok {
+		t.Error("wrong code should not be valid")
+	}
+
+	if _, ok := Validate(rfc6238Secret, "", now); ok {
+		t.Error("empty code should not be valid")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := NewSecret()
+	if a == b {
+		t.Error("secrets should be random")
+	}
+
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("new secret should be usable, got %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Bookings", "me@here.com", rfc6238Secret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Bookings:me@here.com?") {
+		t.Errorf("unexpected uri %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret="+rfc6238Secret) || !strings.Contains(uri, "issuer=Bookings") {
+		t.Errorf("uri should contain secret and issuer, got %s", uri)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	sealed, err := Seal([]byte("app-secret"), rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, rfc6238Secret) {
+		t.Error("sealed secret should not contain the secret")
+	}
+
+	secret, err := Open([]byte("app-secret"), sealed)
+	if err != nil || secret != rfc6238Secret {
+		t.Errorf("expected the secret back, got %q %v", secret, err)
+	}
+
+	if _, err := Open([]byte("other-secret"), sealed); err != ErrDecrypt {
+		t.Errorf("wrong key should fail, got %v", err)
+	}
+
+	if _, err := Open([]byte("app-secret"), "not sealed"); err != ErrDecrypt {
+		t.Errorf("garbage should fail, got %v", err)
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("unexpected code format %q", c)
+		}
+
+		if seen[c] {
+			t.Errorf("duplicate code %q", c)
+		}
+		seen[c] = true
+	}
+
+	if len(codes) != 10 {
+		t.Errorf("expected 10 codes, got %d", len(codes))
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	for _, c := range []string{"abcde-fghij", " ABCDE-FGHIJ ", "abcde fghij", "abcdefghij"} {
+		if got := NormalizeRecoveryCode(c); got != "abcdefghij" {
+			t.Errorf("%q normalized to %q", c, got)
+		}
+	}
+}
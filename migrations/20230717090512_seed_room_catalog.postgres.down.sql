@@ -0,0 +1,4 @@
+delete from room_photos where url in ('/static/images/room-one.png', '/static/images/room-two.png');
+
+update rooms set room_name = replace(slug, '-', '_'), capacity = 2, base_price = 0, amenities = '', description = ''
+where slug in ('room-one', 'room-two');
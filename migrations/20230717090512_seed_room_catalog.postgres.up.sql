@@ -0,0 +1,12 @@
+update rooms set room_name = 'Room One', capacity = 2, base_price = 12000,
+    amenities = E'Ocean view\nKing size bed\nPrivate bathroom\nFree wifi',
+    description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean.'
+where slug = 'room-one';
+
+update rooms set room_name = 'Room Two', capacity = 4, base_price = 18000,
+    amenities = E'Garden view\nTwo queen size beds\nKitchenette\nFree wifi',
+    description = 'A spacious room for the whole family, a short walk from the beach.'
+where slug = 'room-two';
+
+insert into room_photos (room_id, url, position, created_at, updated_at)
+select id, '/static/images/' || slug || '.png', 0, now(), now() from rooms where slug in ('room-one', 'room-two');
@@ -0,0 +1 @@
+update reservations set confirmation_code = null;
\ No newline at end of file
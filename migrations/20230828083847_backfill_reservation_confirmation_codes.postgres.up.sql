@@ -0,0 +1,4 @@
+-- give the existing reservations a confirmation code
+update reservations
+set confirmation_code = upper(substr(md5(random()::text || id::text), 1, 8))
+where confirmation_code is null;
\ No newline at end of file
@@ -0,0 +1 @@
+update reservations set processed = 1 where status <> 'pending';
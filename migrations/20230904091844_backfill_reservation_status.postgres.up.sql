@@ -0,0 +1,3 @@
+-- processed reservations were confirmed, guest cancellations keep their cancelled_at
+update reservations set status = 'confirmed', confirmed_at = updated_at where processed = 1;
+update reservations set status = 'cancelled' where cancelled_at is not null;
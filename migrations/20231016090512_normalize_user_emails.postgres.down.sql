@@ -0,0 +1,2 @@
+drop index if exists users_email_idx;
+create unique index users_email_idx on users (email);
\ No newline at end of file
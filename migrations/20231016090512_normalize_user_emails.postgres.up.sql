@@ -0,0 +1,5 @@
+-- emails are matched case-insensitively, store them lowercased and keep them unique regardless of case.
+-- Accounts that only differ in case make the new index fail and have to be merged by hand first.
+drop index if exists users_email_idx;
+update users set email = lower(trim(email)) where email <> lower(trim(email));
+create unique index users_email_idx on users (lower(email));
\ No newline at end of file